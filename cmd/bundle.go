@@ -0,0 +1,216 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/dlipovetsky/machine-monitor/internal/bundle"
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// bundleOptions are the options of the bundle subcommand.
+type bundleOptions struct {
+	localJournalDirectory string
+	managementCluster     string
+	cluster               string
+	since                 string
+	until                 string
+	output                string
+	objects               bool
+	kubeconfig            string
+	kubeContext           string
+}
+
+// runBundle writes the support bundle of a Cluster. It returns the exit code.
+func runBundle(args []string) int {
+	options := bundleOptions{}
+	flags := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: mm bundle [flags] -cluster <namespace>/<cluster>\n\n"+
+				"Writes the journals, capture status, timelines and Kubernetes objects of the "+
+				"Machines\nof the Cluster, and a manifest with checksums, to a gzipped tar "+
+				"archive.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(
+		&options.localJournalDirectory,
+		"local-journal-directory",
+		"",
+		"The directory of the local journal files. Default is the current working directory.",
+	)
+	flags.StringVar(
+		&options.managementCluster,
+		"management-cluster",
+		"",
+		"The management cluster of the Cluster, if machine-monitor monitors more than one.",
+	)
+	flags.StringVar(
+		&options.cluster,
+		"cluster",
+		"",
+		"The Cluster, as <namespace>/<name>.",
+	)
+	flags.StringVar(
+		&options.since,
+		"since",
+		"",
+		"Add entries logged at or after the time, e.g. \"2025-01-02 15:04:05\", \"today\", "+
+			"or \"-1h\".",
+	)
+	flags.StringVar(
+		&options.until,
+		"until",
+		"",
+		"Add entries logged at or before the time, in the same format as -since.",
+	)
+	flags.StringVar(
+		&options.output,
+		"o",
+		"",
+		"The path of the bundle, or \"-\" for standard output. "+
+			"Default is <namespace>-<cluster>.tar.gz.",
+	)
+	flags.BoolVar(
+		&options.objects,
+		"objects",
+		true,
+		"Add the Machine, infrastructure Machine and bootstrap config of each Machine, read "+
+			"from the management cluster.",
+	)
+	flags.StringVar(
+		&options.kubeconfig,
+		"kubeconfig",
+		"",
+		"The path to the kubeconfig file of the management cluster. Default is the KUBECONFIG "+
+			"environment variable, or ~/.kube/config.",
+	)
+	flags.StringVar(
+		&options.kubeContext,
+		"context",
+		"",
+		"The kubeconfig context. Default is the current context.",
+	)
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "error: unexpected arguments: %s\n", strings.Join(flags.Args(), " "))
+		return 2
+	}
+
+	if options.managementCluster != "" {
+		options.localJournalDirectory = filepath.Join(
+			options.localJournalDirectory,
+			options.managementCluster,
+		)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := writeBundle(ctx, options, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func writeBundle(ctx context.Context, options bundleOptions, now time.Time) (err error) {
+	namespace, cluster, ok := strings.Cut(options.cluster, "/")
+	if !ok || namespace == "" || cluster == "" {
+		return fmt.Errorf("invalid cluster %q, expected <namespace>/<name>", options.cluster)
+	}
+	store := &journald.FileStore{Directory: options.localJournalDirectory}
+	o := bundle.Options{
+		Store:     store,
+		Directory: options.localJournalDirectory,
+		Namespace: namespace,
+		Cluster:   cluster,
+	}
+	if options.since != "" {
+		if o.Since, err = parseTime(options.since, now); err != nil {
+			return err
+		}
+	}
+	if options.until != "" {
+		if o.Until, err = parseTime(options.until, now); err != nil {
+			return err
+		}
+	}
+	o.Machines, err = bundle.Machines(store, namespace, cluster)
+	if err != nil {
+		return err
+	}
+
+	if options.objects {
+		restConfig, err := loadRESTConfig(options.kubeconfig, options.kubeContext)
+		if err != nil {
+			return fmt.Errorf("%w; use -objects=false to write the bundle without objects", err)
+		}
+		ctrl.SetLogger(logr.Discard())
+		c, err := client.New(restConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
+		machineAPIVersion, err := capi.ServedVersion(restConfig)
+		if err != nil {
+			return err
+		}
+		o.Objects = bundle.KubernetesObjects(c, c.RESTMapper(), machineAPIVersion)
+	}
+
+	var w io.Writer = os.Stdout
+	if options.output != "-" {
+		filePath := options.output
+		if filePath == "" {
+			filePath = bundle.FileName(namespace, cluster)
+		}
+		file, createErr := os.Create(filePath)
+		if createErr != nil {
+			return fmt.Errorf("failed to create bundle file: %w", createErr)
+		}
+		defer func() {
+			if closeErr := file.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("failed to close bundle file: %w", closeErr)
+			}
+			if err != nil {
+				_ = os.Remove(filePath)
+			}
+		}()
+		w = file
+	}
+	return bundle.Write(ctx, w, o)
+}
@@ -0,0 +1,644 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	"github.com/dlipovetsky/machine-monitor/internal/archive"
+	"github.com/dlipovetsky/machine-monitor/internal/controller"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/logging"
+	"github.com/dlipovetsky/machine-monitor/internal/snapshot"
+	"github.com/dlipovetsky/machine-monitor/internal/ssh"
+)
+
+// The apiVersion and kind of the configuration file.
+const (
+	configAPIVersion = "machine-monitor.dlipovetsky.github.io/v1alpha1"
+	configKind       = "Configuration"
+)
+
+// Config is the configuration of the controller. It is read from the flags, and then from the
+// configuration file, if any.
+type Config struct {
+	MachineConfig
+
+	// Overrides replace parts of MachineConfig for the Machines that match their selectors.
+	Overrides []OverrideConfig
+
+	LogLevel              int
+	LogFormat             string
+	LogSamplingInitial    int
+	LogSamplingThereafter int
+	MachineDiagnosticsLog bool
+
+	LocalJournalDirectory           string
+	LocalJournalSyncInterval        time.Duration
+	LocalJournalMaxFileSize         int64
+	SearchIndex                     bool
+	DeleteJournalsOfDeletedMachines bool
+
+	MaxConcurrentReconciles int
+	RequeueBaseDelay        time.Duration
+	RequeueMaxDelay         time.Duration
+	LabelSelector           string
+
+	SSHDialRate            float64
+	SSHDialBurst           int
+	BastionDialConcurrency int
+	SSHDialRetries         int
+
+	LokiURL       string
+	LokiTenantID  string
+	LokiBatchSize int
+	LokiBatchWait time.Duration
+
+	ArchiveS3Endpoint  string
+	ArchiveS3Region    string
+	ArchiveS3Bucket    string
+	ArchiveKeyTemplate string
+	ArchivePartSize    int
+
+	OTLPEndpoint  string
+	OTLPProtocol  string
+	OTLPHeaders   map[string]string
+	OTLPBatchSize int
+	OTLPBatchWait time.Duration
+	// OTLPTracesEndpoint is where spans are exported, with the OTLP protocol and headers. If
+	// empty, spans are not recorded.
+	OTLPTracesEndpoint string
+
+	ManagementClusters []ManagementCluster
+
+	MetricsBindAddress     string
+	HealthProbeBindAddress string
+	APIBindAddress         string
+	// APIBundleObjects adds the Kubernetes objects of the Machines to the support bundles that the
+	// API serves. The API has no authentication, so they are not added by default.
+	APIBundleObjects bool
+}
+
+// MachineConfig is the part of the configuration that applies to each Machine. It can be
+// overridden for some Machines, and changed without a restart.
+type MachineConfig struct {
+	SSHPort           int
+	SSHUser           string
+	SSHPrivateKeyFile string
+
+	BastionSSHHost           string
+	BastionSSHPort           int
+	BastionSSHUser           string
+	BastionSSHPrivateKeyFile string
+
+	PrivilegeStrategy string
+	// SudoPasswordSecret is the "namespace/name" of the Secret with the sudo password.
+	SudoPasswordSecret string
+
+	// RemoteJournaldCursorFilePath is deprecated, and ignored.
+	RemoteJournaldCursorFilePath string
+	Backfill                     journald.Backfill
+
+	CollectionPolicy     string
+	NodeReadyGracePeriod time.Duration
+
+	Snapshots                bool
+	SnapshotCommandsFile     string
+	SnapshotCommands         []snapshot.Command
+	SnapshotBootstrapTimeout time.Duration
+}
+
+// OverrideConfig replaces parts of MachineConfig for the Machines that match its selector.
+type OverrideConfig struct {
+	Selector string
+	MachineFileConfig
+}
+
+// FileConfig is the configuration file. Fields that are not set keep the value of their flag.
+type FileConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	MachineFileConfig `json:",inline"`
+	// Overrides are applied to the Machines that match their selectors. The first override that
+	// matches a Machine applies to it.
+	Overrides []OverrideFileConfig `json:"overrides,omitempty"`
+
+	LogLevel              *int                   `json:"logLevel,omitempty"`
+	LogFormat             *string                `json:"logFormat,omitempty"`
+	LogSampling           *LogSamplingFileConfig `json:"logSampling,omitempty"`
+	MachineDiagnosticsLog *bool                  `json:"machineDiagnosticsLog,omitempty"`
+
+	LocalJournalDirectory    *string          `json:"localJournalDirectory,omitempty"`
+	LocalJournalSyncInterval *metav1.Duration `json:"localJournalSyncInterval,omitempty"`
+	LocalJournalMaxFileSize  *int64           `json:"localJournalMaxFileSize,omitempty"`
+	SearchIndex              *bool            `json:"searchIndex,omitempty"`
+
+	DeleteJournalsOfDeletedMachines *bool `json:"deleteJournalsOfDeletedMachines,omitempty"`
+
+	MaxConcurrentReconciles *int             `json:"maxConcurrentReconciles,omitempty"`
+	RequeueBaseDelay        *metav1.Duration `json:"requeueBaseDelay,omitempty"`
+	RequeueMaxDelay         *metav1.Duration `json:"requeueMaxDelay,omitempty"`
+	LabelSelector           *string          `json:"labelSelector,omitempty"`
+
+	SSHDial *SSHDialFileConfig `json:"sshDial,omitempty"`
+
+	Loki    *LokiFileConfig    `json:"loki,omitempty"`
+	Archive *ArchiveFileConfig `json:"archive,omitempty"`
+	OTLP    *OTLPFileConfig    `json:"otlp,omitempty"`
+
+	ManagementClusters []ManagementCluster `json:"managementClusters,omitempty"`
+
+	MetricsBindAddress     *string `json:"metricsBindAddress,omitempty"`
+	HealthProbeBindAddress *string `json:"healthProbeBindAddress,omitempty"`
+	APIBindAddress         *string `json:"apiBindAddress,omitempty"`
+	APIBundleObjects       *bool   `json:"apiBundleObjects,omitempty"`
+}
+
+// MachineFileConfig is the part of the configuration file that applies to each Machine.
+type MachineFileConfig struct {
+	SSH                          *SSHFileConfig       `json:"ssh,omitempty"`
+	Bastion                      *BastionFileConfig   `json:"bastion,omitempty"`
+	Privilege                    *PrivilegeFileConfig `json:"privilege,omitempty"`
+	RemoteJournaldCursorFilePath *string              `json:"remoteJournaldCursorFilePath,omitempty"`
+	Backfill                     *BackfillFileConfig  `json:"backfill,omitempty"`
+	CollectionPolicy             *string              `json:"collectionPolicy,omitempty"`
+	NodeReadyGracePeriod         *metav1.Duration     `json:"nodeReadyGracePeriod,omitempty"`
+	Snapshots                    *SnapshotsFileConfig `json:"snapshots,omitempty"`
+}
+
+// OverrideFileConfig is an override in the configuration file.
+type OverrideFileConfig struct {
+	// Selector is a label selector, e.g. "cluster.x-k8s.io/cluster-name=prod".
+	Selector          string `json:"selector"`
+	MachineFileConfig `json:",inline"`
+}
+
+type SSHFileConfig struct {
+	Port           *int    `json:"port,omitempty"`
+	User           *string `json:"user,omitempty"`
+	PrivateKeyFile *string `json:"privateKeyFile,omitempty"`
+}
+
+type BastionFileConfig struct {
+	Host          *string `json:"host,omitempty"`
+	SSHFileConfig `json:",inline"`
+}
+
+type PrivilegeFileConfig struct {
+	Strategy           *string `json:"strategy,omitempty"`
+	SudoPasswordSecret *string `json:"sudoPasswordSecret,omitempty"`
+}
+
+type BackfillFileConfig struct {
+	Boots      *int             `json:"boots,omitempty"`
+	Since      *metav1.Duration `json:"since,omitempty"`
+	MaxEntries *int             `json:"maxEntries,omitempty"`
+	MaxBytes   *int64           `json:"maxBytes,omitempty"`
+}
+
+type SnapshotsFileConfig struct {
+	Enabled *bool `json:"enabled,omitempty"`
+	// Commands, if not empty, are the commands to run, instead of the commands in CommandsFile.
+	Commands         []snapshot.Command `json:"commands,omitempty"`
+	CommandsFile     *string            `json:"commandsFile,omitempty"`
+	BootstrapTimeout *metav1.Duration   `json:"bootstrapTimeout,omitempty"`
+}
+
+type LogSamplingFileConfig struct {
+	Initial    *int `json:"initial,omitempty"`
+	Thereafter *int `json:"thereafter,omitempty"`
+}
+
+type SSHDialFileConfig struct {
+	Rate               *float64 `json:"rate,omitempty"`
+	Burst              *int     `json:"burst,omitempty"`
+	BastionConcurrency *int     `json:"bastionConcurrency,omitempty"`
+	Retries            *int     `json:"retries,omitempty"`
+}
+
+type LokiFileConfig struct {
+	URL       *string          `json:"url,omitempty"`
+	TenantID  *string          `json:"tenantID,omitempty"`
+	BatchSize *int             `json:"batchSize,omitempty"`
+	BatchWait *metav1.Duration `json:"batchWait,omitempty"`
+}
+
+type ArchiveFileConfig struct {
+	S3Endpoint  *string `json:"s3Endpoint,omitempty"`
+	S3Region    *string `json:"s3Region,omitempty"`
+	S3Bucket    *string `json:"s3Bucket,omitempty"`
+	KeyTemplate *string `json:"keyTemplate,omitempty"`
+	PartSize    *int    `json:"partSize,omitempty"`
+}
+
+type OTLPFileConfig struct {
+	Endpoint  *string           `json:"endpoint,omitempty"`
+	Protocol  *string           `json:"protocol,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	BatchSize *int              `json:"batchSize,omitempty"`
+	BatchWait *metav1.Duration  `json:"batchWait,omitempty"`
+
+	TracesEndpoint *string `json:"tracesEndpoint,omitempty"`
+}
+
+// loadConfig applies the configuration file, if any, to the configuration from the flags, and
+// resolves the result.
+func loadConfig(flagConfig Config, configFilePath string) (*resolvedConfig, error) {
+	config := flagConfig
+	if configFilePath != "" {
+		fileConfig, err := loadConfigFile(configFilePath)
+		if err != nil {
+			return nil, err
+		}
+		config = flagConfig.withFile(fileConfig)
+	}
+	return config.resolve()
+}
+
+// loadConfigFile reads the configuration file. Unknown fields are rejected.
+func loadConfigFile(filePath string) (*FileConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	fileConfig := &FileConfig{}
+	if err := yaml.UnmarshalStrict(data, fileConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration file: %w", err)
+	}
+	if fileConfig.APIVersion != configAPIVersion || fileConfig.Kind != configKind {
+		return nil, fmt.Errorf(
+			"unsupported configuration file: expected apiVersion %s and kind %s, got %s and %s",
+			configAPIVersion,
+			configKind,
+			fileConfig.APIVersion,
+			fileConfig.Kind,
+		)
+	}
+	return fileConfig, nil
+}
+
+// set sets dst to the value of src, if src is not nil.
+func set[T any](dst *T, src *T) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+// setDuration sets dst to the value of src, if src is not nil.
+func setDuration(dst *time.Duration, src *metav1.Duration) {
+	if src != nil {
+		*dst = src.Duration
+	}
+}
+
+// withFile returns the configuration with the values set in the configuration file.
+func (c Config) withFile(f *FileConfig) Config {
+	c.MachineConfig = c.MachineConfig.withFile(f.MachineFileConfig)
+	c.Overrides = nil
+	for _, override := range f.Overrides {
+		c.Overrides = append(c.Overrides, OverrideConfig(override))
+	}
+
+	set(&c.LogLevel, f.LogLevel)
+	set(&c.LogFormat, f.LogFormat)
+	if f.LogSampling != nil {
+		set(&c.LogSamplingInitial, f.LogSampling.Initial)
+		set(&c.LogSamplingThereafter, f.LogSampling.Thereafter)
+	}
+	set(&c.MachineDiagnosticsLog, f.MachineDiagnosticsLog)
+	set(&c.LocalJournalDirectory, f.LocalJournalDirectory)
+	setDuration(&c.LocalJournalSyncInterval, f.LocalJournalSyncInterval)
+	set(&c.LocalJournalMaxFileSize, f.LocalJournalMaxFileSize)
+	set(&c.DeleteJournalsOfDeletedMachines, f.DeleteJournalsOfDeletedMachines)
+	set(&c.SearchIndex, f.SearchIndex)
+	set(&c.MaxConcurrentReconciles, f.MaxConcurrentReconciles)
+	setDuration(&c.RequeueBaseDelay, f.RequeueBaseDelay)
+	setDuration(&c.RequeueMaxDelay, f.RequeueMaxDelay)
+	set(&c.LabelSelector, f.LabelSelector)
+	if f.SSHDial != nil {
+		set(&c.SSHDialRate, f.SSHDial.Rate)
+		set(&c.SSHDialBurst, f.SSHDial.Burst)
+		set(&c.BastionDialConcurrency, f.SSHDial.BastionConcurrency)
+		set(&c.SSHDialRetries, f.SSHDial.Retries)
+	}
+	if f.Loki != nil {
+		set(&c.LokiURL, f.Loki.URL)
+		set(&c.LokiTenantID, f.Loki.TenantID)
+		set(&c.LokiBatchSize, f.Loki.BatchSize)
+		setDuration(&c.LokiBatchWait, f.Loki.BatchWait)
+	}
+	if f.Archive != nil {
+		set(&c.ArchiveS3Endpoint, f.Archive.S3Endpoint)
+		set(&c.ArchiveS3Region, f.Archive.S3Region)
+		set(&c.ArchiveS3Bucket, f.Archive.S3Bucket)
+		set(&c.ArchiveKeyTemplate, f.Archive.KeyTemplate)
+		set(&c.ArchivePartSize, f.Archive.PartSize)
+	}
+	if f.OTLP != nil {
+		set(&c.OTLPEndpoint, f.OTLP.Endpoint)
+		set(&c.OTLPProtocol, f.OTLP.Protocol)
+		if f.OTLP.Headers != nil {
+			c.OTLPHeaders = f.OTLP.Headers
+		}
+		set(&c.OTLPBatchSize, f.OTLP.BatchSize)
+		setDuration(&c.OTLPBatchWait, f.OTLP.BatchWait)
+		set(&c.OTLPTracesEndpoint, f.OTLP.TracesEndpoint)
+	}
+	if f.ManagementClusters != nil {
+		c.ManagementClusters = f.ManagementClusters
+	}
+	set(&c.MetricsBindAddress, f.MetricsBindAddress)
+	set(&c.HealthProbeBindAddress, f.HealthProbeBindAddress)
+	set(&c.APIBindAddress, f.APIBindAddress)
+	set(&c.APIBundleObjects, f.APIBundleObjects)
+	return c
+}
+
+// withFile returns the configuration with the values set in the configuration file.
+func (m MachineConfig) withFile(f MachineFileConfig) MachineConfig {
+	if f.SSH != nil {
+		set(&m.SSHPort, f.SSH.Port)
+		set(&m.SSHUser, f.SSH.User)
+		set(&m.SSHPrivateKeyFile, f.SSH.PrivateKeyFile)
+	}
+	if f.Bastion != nil {
+		set(&m.BastionSSHHost, f.Bastion.Host)
+		set(&m.BastionSSHPort, f.Bastion.Port)
+		set(&m.BastionSSHUser, f.Bastion.User)
+		set(&m.BastionSSHPrivateKeyFile, f.Bastion.PrivateKeyFile)
+	}
+	if f.Privilege != nil {
+		set(&m.PrivilegeStrategy, f.Privilege.Strategy)
+		set(&m.SudoPasswordSecret, f.Privilege.SudoPasswordSecret)
+	}
+	set(&m.RemoteJournaldCursorFilePath, f.RemoteJournaldCursorFilePath)
+	if f.Backfill != nil {
+		set(&m.Backfill.Boots, f.Backfill.Boots)
+		setDuration(&m.Backfill.Since, f.Backfill.Since)
+		set(&m.Backfill.MaxEntries, f.Backfill.MaxEntries)
+		set(&m.Backfill.MaxBytes, f.Backfill.MaxBytes)
+	}
+	set(&m.CollectionPolicy, f.CollectionPolicy)
+	setDuration(&m.NodeReadyGracePeriod, f.NodeReadyGracePeriod)
+	if f.Snapshots != nil {
+		set(&m.Snapshots, f.Snapshots.Enabled)
+		if len(f.Snapshots.Commands) > 0 {
+			m.SnapshotCommands = f.Snapshots.Commands
+		}
+		set(&m.SnapshotCommandsFile, f.Snapshots.CommandsFile)
+		setDuration(&m.SnapshotBootstrapTimeout, f.Snapshots.BootstrapTimeout)
+	}
+	return m
+}
+
+// resolvedConfig is a valid configuration, with the files it references read, and its values
+// parsed.
+type resolvedConfig struct {
+	Config
+
+	Settings       controller.MachineSettings
+	Overrides      []controller.SettingsOverride
+	LabelSelectors *metav1.LabelSelector
+}
+
+// resolve validates the configuration, and reads the files it references.
+func (c Config) resolve() (*resolvedConfig, error) {
+	resolved := &resolvedConfig{Config: c}
+
+	settings, err := c.MachineConfig.settings()
+	if err != nil {
+		return nil, err
+	}
+	resolved.Settings = settings
+
+	for _, override := range c.Overrides {
+		selector, err := labels.Parse(override.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid override selector %q: %w", override.Selector, err)
+		}
+		settings, err := c.MachineConfig.withFile(override.MachineFileConfig).settings()
+		if err != nil {
+			return nil, fmt.Errorf("invalid override %q: %w", override.Selector, err)
+		}
+		resolved.Overrides = append(resolved.Overrides, controller.SettingsOverride{
+			Selector: selector,
+			Settings: settings,
+		})
+	}
+
+	if c.LabelSelector != "" {
+		labelSelectors, err := metav1.ParseToLabelSelector(c.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse label selector: %w", err)
+		}
+		resolved.LabelSelectors = labelSelectors
+	}
+
+	names := map[string]bool{}
+	resolved.ManagementClusters = nil
+	for _, managementCluster := range c.ManagementClusters {
+		managementCluster, err := managementCluster.withDefaults()
+		if err != nil {
+			return nil, fmt.Errorf("invalid management cluster: %w", err)
+		}
+		if names[managementCluster.Name] {
+			return nil, fmt.Errorf("duplicate management cluster name %q", managementCluster.Name)
+		}
+		names[managementCluster.Name] = true
+		resolved.ManagementClusters = append(resolved.ManagementClusters, managementCluster)
+	}
+
+	if !slices.Contains(logging.Formats, c.LogFormat) {
+		return nil, fmt.Errorf(
+			"unsupported log format %q, must be one of %v",
+			c.LogFormat,
+			logging.Formats,
+		)
+	}
+	if c.LogSamplingInitial < 0 || c.LogSamplingThereafter < 0 {
+		return nil, fmt.Errorf("the log sampling initial and thereafter must not be negative")
+	}
+
+	if c.SSHDialRate <= 0 || c.SSHDialBurst < 1 {
+		return nil, fmt.Errorf("the SSH dial rate and burst must be positive")
+	}
+	if c.BastionDialConcurrency < 0 || c.SSHDialRetries < 0 {
+		return nil, fmt.Errorf(
+			"the bastion dial concurrency and SSH dial retries must not be negative",
+		)
+	}
+	if c.SSHDialRetries > ssh.MaxDialRetries {
+		return nil, fmt.Errorf("the SSH dial retries must be at most %d", ssh.MaxDialRetries)
+	}
+
+	if c.LocalJournalSyncInterval < 0 {
+		return nil, fmt.Errorf("the local journal sync interval must not be negative")
+	}
+	if c.LocalJournalMaxFileSize < 0 {
+		return nil, fmt.Errorf("the local journal max file size must not be negative")
+	}
+	fileInfo, err := os.Stat(c.LocalJournalDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat local journal directory: %w", err)
+	}
+	if !fileInfo.IsDir() {
+		return nil, fmt.Errorf(
+			"local journal directory %q is not a directory",
+			c.LocalJournalDirectory,
+		)
+	}
+
+	if c.ArchiveS3Endpoint != "" {
+		if c.ArchiveS3Bucket == "" {
+			return nil, fmt.Errorf("the archive S3 bucket is required")
+		}
+		if c.ArchivePartSize < archive.MinPartSize {
+			return nil, fmt.Errorf("the archive part size must be at least 5 MiB")
+		}
+		// Machines of different management clusters can have the same namespace and name.
+		multipleManagementClusters := len(resolved.ManagementClusters) > 1
+		if multipleManagementClusters && c.ArchiveKeyTemplate == archive.DefaultKeyTemplate {
+			resolved.ArchiveKeyTemplate = archive.DefaultMultiClusterKeyTemplate
+		}
+		err := archive.ValidateKeyTemplate(resolved.ArchiveKeyTemplate, multipleManagementClusters)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
+
+// settings validates the configuration, and returns the settings of the Machines it applies to.
+func (m MachineConfig) settings() (controller.MachineSettings, error) {
+	settings := controller.MachineSettings{
+		SSHPort:                  m.SSHPort,
+		SSHUser:                  m.SSHUser,
+		PrivilegeStrategy:        m.PrivilegeStrategy,
+		Backfill:                 m.Backfill,
+		CollectionPolicy:         m.CollectionPolicy,
+		NodeReadyGracePeriod:     m.NodeReadyGracePeriod,
+		SnapshotBootstrapTimeout: m.SnapshotBootstrapTimeout,
+	}
+
+	if m.Backfill.Boots < 0 || m.Backfill.Since < 0 || m.Backfill.MaxEntries < 0 ||
+		m.Backfill.MaxBytes < 0 {
+		return settings, fmt.Errorf("backfill limits must not be negative")
+	}
+
+	if m.CollectionPolicy != controller.CollectionPolicyAlways &&
+		m.CollectionPolicy != controller.CollectionPolicyBootstrap {
+		return settings, fmt.Errorf("unsupported collection policy %q", m.CollectionPolicy)
+	}
+
+	if !slices.Contains(journald.PrivilegeStrategies, m.PrivilegeStrategy) {
+		return settings, fmt.Errorf("unsupported privilege strategy %q", m.PrivilegeStrategy)
+	}
+	if m.PrivilegeStrategy == journald.PrivilegeSudoPassword {
+		namespace, name, ok := strings.Cut(m.SudoPasswordSecret, "/")
+		if !ok || namespace == "" || name == "" {
+			return settings, fmt.Errorf(
+				"the sudo password Secret is required, as namespace/name, with privilege "+
+					"strategy %q",
+				journald.PrivilegeSudoPassword,
+			)
+		}
+		settings.SudoPasswordSecret = types.NamespacedName{Namespace: namespace, Name: name}
+	}
+
+	if m.SSHPrivateKeyFile == "" {
+		return settings, fmt.Errorf("the SSH private key is required")
+	}
+	sshPrivateKey, err := os.ReadFile(m.SSHPrivateKeyFile)
+	if err != nil {
+		return settings, fmt.Errorf("unable to read SSH private key file: %w", err)
+	}
+	settings.SSHPrivateKey = sshPrivateKey
+
+	if m.BastionSSHHost != "" {
+		if m.BastionSSHPrivateKeyFile == "" {
+			return settings, fmt.Errorf("the bastion SSH private key is required")
+		}
+		bastionSSHPrivateKey, err := os.ReadFile(m.BastionSSHPrivateKeyFile)
+		if err != nil {
+			return settings, fmt.Errorf("unable to read bastion SSH private key file: %w", err)
+		}
+		settings.BastionSSHHost = m.BastionSSHHost
+		settings.BastionSSHPort = m.BastionSSHPort
+		settings.BastionSSHUser = m.BastionSSHUser
+		settings.BastionSSHPrivateKey = bastionSSHPrivateKey
+	}
+
+	if m.Snapshots {
+		switch {
+		case len(m.SnapshotCommands) > 0:
+			if err := snapshot.ValidateCommands(m.SnapshotCommands); err != nil {
+				return settings, err
+			}
+			settings.SnapshotCommands = m.SnapshotCommands
+		case m.SnapshotCommandsFile != "":
+			settings.SnapshotCommands, err = snapshot.LoadCommands(m.SnapshotCommandsFile)
+			if err != nil {
+				return settings, err
+			}
+		default:
+			settings.SnapshotCommands = snapshot.DefaultCommands
+		}
+	}
+	return settings, nil
+}
+
+// reload returns the configuration that applies once the reloaded configuration is applied.
+// Only the fields that are applied without a restart, see restartRequired, are taken from the
+// reloaded configuration. The others keep their running values until the restart.
+func (c *resolvedConfig) reload(reloaded *resolvedConfig) *resolvedConfig {
+	applied := *c
+	applied.MachineConfig = reloaded.MachineConfig
+	applied.Config.Overrides = reloaded.Config.Overrides
+	applied.LogLevel = reloaded.LogLevel
+	applied.Settings = reloaded.Settings
+	applied.Overrides = reloaded.Overrides
+	return &applied
+}
+
+// restartRequired returns the names of the fields that differ between the configurations, and
+// that can only be changed with a restart.
+func restartRequired(old, new Config) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		switch name := oldValue.Type().Field(i).Name; name {
+		case "MachineConfig", "Overrides", "LogLevel":
+			// These are applied without a restart.
+		default:
+			if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+				changed = append(changed, name)
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/dlipovetsky/machine-monitor/internal/controller"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/logging"
+)
+
+var _ = Describe("configuration", func() {
+	var (
+		directory      string
+		flagConfig     Config
+		configFilePath string
+	)
+
+	BeforeEach(func() {
+		directory = GinkgoT().TempDir()
+		sshPrivateKeyFile := filepath.Join(directory, "id_ed25519")
+		Expect(os.WriteFile(sshPrivateKeyFile, []byte("key"), 0o600)).To(Succeed())
+		configFilePath = filepath.Join(directory, "config.yaml")
+
+		// flagConfig has the default values of the flags that are validated.
+		flagConfig = Config{
+			MachineConfig: MachineConfig{
+				SSHPort:           22,
+				SSHUser:           "capi",
+				SSHPrivateKeyFile: sshPrivateKeyFile,
+				PrivilegeStrategy: journald.PrivilegeSudo,
+				CollectionPolicy:  controller.CollectionPolicyAlways,
+			},
+			LogFormat:             logging.FormatJSON,
+			LocalJournalDirectory: directory,
+			SSHDialRate:           10,
+			SSHDialBurst:          10,
+		}
+	})
+
+	writeConfigFile := func(content string) {
+		Expect(os.WriteFile(
+			configFilePath,
+			[]byte("apiVersion: "+configAPIVersion+"\nkind: "+configKind+"\n"+content),
+			0o644,
+		)).To(Succeed())
+	}
+
+	Describe("loadConfig", func() {
+		It("resolves the flags without a configuration file", func() {
+			resolved, err := loadConfig(flagConfig, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Settings.SSHUser).To(Equal("capi"))
+			Expect(resolved.Settings.SSHPrivateKey).To(Equal([]byte("key")))
+			Expect(resolved.Overrides).To(BeEmpty())
+		})
+
+		It("applies the configuration file to the flags", func() {
+			writeConfigFile(`
+logLevel: 2
+ssh:
+  user: admin
+localJournalMaxFileSize: 1048576
+overrides:
+- selector: pool=a
+  ssh:
+    port: 2222
+`)
+			resolved, err := loadConfig(flagConfig, configFilePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.LogLevel).To(Equal(2))
+			Expect(resolved.LocalJournalMaxFileSize).To(BeEquivalentTo(1048576))
+			Expect(resolved.Settings.SSHUser).To(Equal("admin"))
+			Expect(resolved.Settings.SSHPort).To(Equal(22))
+			Expect(resolved.Overrides).To(HaveLen(1))
+			Expect(resolved.Overrides[0].Selector.String()).To(Equal("pool=a"))
+			// An override applies to the configuration, including the configuration file.
+			Expect(resolved.Overrides[0].Settings.SSHUser).To(Equal("admin"))
+			Expect(resolved.Overrides[0].Settings.SSHPort).To(Equal(2222))
+		})
+
+		DescribeTable("rejects an invalid configuration file",
+			func(content, reason string) {
+				writeConfigFile(content)
+				_, err := loadConfig(flagConfig, configFilePath)
+				Expect(err).To(MatchError(ContainSubstring(reason)))
+			},
+			Entry("with an unknown field", "unknown: true\n", "unknown field"),
+			Entry("with an invalid value",
+				"localJournalMaxFileSize: -1\n",
+				"the local journal max file size must not be negative",
+			),
+			Entry("with an invalid override",
+				"overrides:\n- selector: pool=a\n  collectionPolicy: sometimes\n",
+				`invalid override "pool=a": unsupported collection policy "sometimes"`,
+			),
+			Entry("with an invalid override selector",
+				"overrides:\n- selector: '!!'\n",
+				"invalid override selector",
+			),
+		)
+
+		It("rejects a configuration file of another kind", func() {
+			Expect(os.WriteFile(
+				configFilePath,
+				[]byte("apiVersion: v1\nkind: ConfigMap\n"),
+				0o644,
+			)).To(Succeed())
+			_, err := loadConfig(flagConfig, configFilePath)
+			Expect(err).To(MatchError(ContainSubstring("unsupported configuration file")))
+		})
+	})
+
+	DescribeTable("restartRequired",
+		func(change func(c *Config), fields []string) {
+			changed := flagConfig
+			change(&changed)
+			Expect(restartRequired(flagConfig, changed)).To(Equal(fields))
+		},
+		Entry("nothing changed", func(*Config) {}, nil),
+		Entry("the settings of the Machines changed",
+			func(c *Config) {
+				c.SSHUser = "admin"
+				c.NodeReadyGracePeriod = time.Minute
+				c.Overrides = []OverrideConfig{{Selector: "pool=a"}}
+				c.LogLevel = 2
+			},
+			nil,
+		),
+		Entry("fields that require a restart changed",
+			func(c *Config) {
+				c.LocalJournalDirectory = "/elsewhere"
+				c.SSHDialRate = 1
+				c.OTLPHeaders = map[string]string{"a": "b"}
+			},
+			[]string{"LocalJournalDirectory", "SSHDialRate", "OTLPHeaders"},
+		),
+	)
+
+	Describe("reload", func() {
+		It("applies the settings, and keeps the fields that require a restart", func() {
+			writeConfigFile("logLevel: 1\n")
+			running, err := loadConfig(flagConfig, configFilePath)
+			Expect(err).NotTo(HaveOccurred())
+
+			writeConfigFile(`
+logLevel: 3
+ssh:
+  user: admin
+overrides:
+- selector: pool=a
+  ssh:
+    port: 2222
+localJournalSyncInterval: 5s
+searchIndex: true
+`)
+			reloaded, err := loadConfig(flagConfig, configFilePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restartRequired(running.Config, reloaded.Config)).To(
+				Equal([]string{"LocalJournalSyncInterval", "SearchIndex"}),
+			)
+
+			applied := running.reload(reloaded)
+			Expect(applied.LogLevel).To(Equal(3))
+			Expect(applied.Settings.SSHUser).To(Equal("admin"))
+			Expect(applied.Overrides).To(HaveLen(1))
+			Expect(applied.Config.Overrides).To(HaveLen(1))
+			Expect(applied.LocalJournalSyncInterval).To(BeZero())
+			Expect(applied.SearchIndex).To(BeFalse())
+			// The fields that require a restart are still reported until the restart.
+			Expect(restartRequired(applied.Config, reloaded.Config)).To(
+				Equal([]string{"LocalJournalSyncInterval", "SearchIndex"}),
+			)
+			// The running configuration is not changed.
+			Expect(running.LogLevel).To(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,472 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// Output formats of the logs subcommand, named as in journalctl --output.
+const (
+	outputShort    = "short"
+	outputShortISO = "short-iso"
+	outputJSON     = "json"
+	outputCat      = "cat"
+)
+
+// stringsFlag is a flag that can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// logsOptions are the options of the logs subcommand.
+type logsOptions struct {
+	localJournalDirectory string
+	managementCluster     string
+	since                 string
+	until                 string
+	units                 stringsFlag
+	priority              string
+	boot                  string
+	grep                  string
+	output                string
+	cluster               string
+	correctClockSkew      bool
+	machines              []string
+}
+
+// runLogs reads the local journal files of one or more Machines, like journalctl. It returns the
+// exit code.
+func runLogs(args []string) int {
+	options := logsOptions{}
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: mm logs [flags] <namespace>/<machine>...\n"+
+				"       mm logs [flags] --cluster <namespace>/<cluster>\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(
+		&options.localJournalDirectory,
+		"local-journal-directory",
+		"",
+		"The directory of the local journal files. Default is the current working directory.",
+	)
+	flags.StringVar(
+		&options.managementCluster,
+		"management-cluster",
+		"",
+		"The management cluster of the Machines, if machine-monitor monitors more than one.",
+	)
+	flags.StringVar(
+		&options.since,
+		"since",
+		"",
+		"Show entries logged at or after the time, e.g. \"2025-01-02 15:04:05\", \"today\", "+
+			"or \"-1h\".",
+	)
+	flags.StringVar(
+		&options.until,
+		"until",
+		"",
+		"Show entries logged at or before the time, in the same format as -since.",
+	)
+	flags.Var(
+		&options.units,
+		"u",
+		"Show entries of the unit. Can be repeated. A unit without a suffix is a service.",
+	)
+	flags.StringVar(
+		&options.priority,
+		"p",
+		"",
+		"Show entries with the priority, or a higher priority, e.g. \"err\", or in the range, "+
+			"e.g. \"err..info\".",
+	)
+	flags.StringVar(
+		&options.boot,
+		"b",
+		"",
+		"Show entries of the boot, given as a boot ID, or as an offset, e.g. \"0\" for the latest "+
+			"boot, and \"-1\" for the boot before it. Offsets are relative to each Machine.",
+	)
+	flags.StringVar(
+		&options.grep,
+		"grep",
+		"",
+		"Show entries whose message matches the regular expression. The match is case-insensitive "+
+			"unless the expression contains an uppercase character.",
+	)
+	flags.StringVar(
+		&options.output,
+		"o",
+		outputShort,
+		fmt.Sprintf(
+			"The output format, one of %q, %q, %q, or %q.",
+			outputShort,
+			outputShortISO,
+			outputJSON,
+			outputCat,
+		),
+	)
+	flags.StringVar(
+		&options.cluster,
+		"cluster",
+		"",
+		"Show entries of every Machine of the cluster, given as <namespace>/<cluster>, "+
+			"interleaved by time.",
+	)
+	flags.BoolVar(
+		&options.correctClockSkew,
+		"correct-clock-skew",
+		true,
+		"When entries of more than one Machine are shown, correct their timestamps by the clock "+
+			"offset of their Machine, measured when machine-monitor last connected to it.",
+	)
+
+	// Flags may follow the Machines, as they may with journalctl.
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+			return 2
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		options.machines = append(options.machines, args[0])
+		args = args[1:]
+	}
+
+	if options.managementCluster != "" {
+		options.localJournalDirectory = filepath.Join(
+			options.localJournalDirectory,
+			options.managementCluster,
+		)
+	}
+
+	if err := logs(os.Stdout, options, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func logs(w io.Writer, options logsOptions, now time.Time) error {
+	machines, err := selectMachines(options)
+	if err != nil {
+		return err
+	}
+
+	filter, err := newLogsFilter(options, now)
+	if err != nil {
+		return err
+	}
+
+	store := &journald.FileStore{Directory: options.localJournalDirectory}
+	for _, machine := range machines {
+		if options.boot != "" {
+			bootIDs, err := journald.ReadBootIDs(
+				context.Background(),
+				store,
+				machine.Namespace,
+				machine.Name,
+			)
+			if err != nil {
+				return err
+			}
+			selected, err := journald.ParseBoot(options.boot, bootIDs)
+			if err != nil {
+				return fmt.Errorf("machine %s/%s: %w", machine.Namespace, machine.Name, err)
+			}
+			// Boot IDs are unique, so the boots selected for every Machine can be matched at once.
+			filter.BootIDs = append(filter.BootIDs, selected...)
+		}
+	}
+
+	var infos []journald.MachineInfo
+	if options.correctClockSkew && len(machines) > 1 {
+		infos, err = machineInfos(store, machines)
+		if err != nil {
+			return err
+		}
+	}
+
+	readers := make([]journald.Reader, 0, len(machines))
+	for _, machine := range machines {
+		readers = append(readers, store.Reader(machine.Namespace, machine.Name, ""))
+	}
+	out := bufio.NewWriter(w)
+	err = journald.Merge(
+		context.Background(),
+		readers,
+		infos,
+		filter,
+		func(i int, entry journald.Entry) error {
+			machine := ""
+			if len(machines) > 1 {
+				machine = machines[i].Namespace + "/" + machines[i].Name
+			}
+			var line []byte
+			if options.output == outputJSON {
+				var err error
+				if line, err = json.Marshal(entry); err != nil {
+					return fmt.Errorf("failed to serialize entry: %w", err)
+				}
+				line = append(line, '\n')
+			}
+			if infos != nil {
+				if t := infos[i].CorrectTime(entry); !t.Equal(entry.RealtimeTimestamp()) {
+					// Text output shows the corrected time, and JSON output adds it to the entry.
+					corrected := strconv.FormatInt(t.UnixMicro(), 10)
+					entry[journald.FieldRealtimeTimestamp] = corrected
+					line = addField(line, journald.FieldCorrectedRealtimeTimestamp, corrected)
+				}
+			}
+			return writeEntry(out, options.output, machine, 0, line, entry)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// machineInfos returns the MachineInfos of the Machines, with their clock offsets, as recorded in
+// the store. The clock offsets of a Machine without a MachineInfo are unknown.
+func machineInfos(
+	store journald.Store,
+	machines []journald.MachineInfo,
+) ([]journald.MachineInfo, error) {
+	infos := make([]journald.MachineInfo, len(machines))
+	for i, machine := range machines {
+		info, err := store.MachineInfo(machine.Namespace, machine.Name)
+		if errors.Is(err, os.ErrNotExist) {
+			infos[i] = machine
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+// selectMachines returns the Machines selected by name, or by cluster.
+func selectMachines(options logsOptions) ([]journald.MachineInfo, error) {
+	if options.cluster == "" {
+		if len(options.machines) == 0 {
+			return nil, fmt.Errorf("no machine given, expected <namespace>/<machine>, or -cluster")
+		}
+		machines := make([]journald.MachineInfo, 0, len(options.machines))
+		for _, arg := range options.machines {
+			namespace, name, ok := strings.Cut(arg, "/")
+			if !ok || namespace == "" || name == "" {
+				return nil, fmt.Errorf("invalid machine %q, expected <namespace>/<machine>", arg)
+			}
+			machines = append(machines, journald.MachineInfo{Namespace: namespace, Name: name})
+		}
+		return machines, nil
+	}
+
+	if len(options.machines) > 0 {
+		return nil, fmt.Errorf("machines and -cluster are mutually exclusive")
+	}
+	namespace, cluster, ok := strings.Cut(options.cluster, "/")
+	if !ok || namespace == "" || cluster == "" {
+		return nil, fmt.Errorf(
+			"invalid cluster %q, expected <namespace>/<cluster>",
+			options.cluster,
+		)
+	}
+	infos, err := (&journald.FileStore{Directory: options.localJournalDirectory}).List()
+	if err != nil {
+		return nil, err
+	}
+	var machines []journald.MachineInfo
+	for _, info := range infos {
+		if info.Namespace == namespace && info.Cluster == cluster {
+			machines = append(machines, info)
+		}
+	}
+	if len(machines) == 0 {
+		return nil, fmt.Errorf("no machines of cluster %s found", options.cluster)
+	}
+	return machines, nil
+}
+
+func newLogsFilter(options logsOptions, now time.Time) (journald.Filter, error) {
+	var err error
+	filter := journald.NewFilter()
+	if options.since != "" {
+		if filter.Since, err = parseTime(options.since, now); err != nil {
+			return filter, err
+		}
+	}
+	if options.until != "" {
+		if filter.Until, err = parseTime(options.until, now); err != nil {
+			return filter, err
+		}
+	}
+	for _, unit := range options.units {
+		filter.Units = append(filter.Units, journald.ParseUnit(unit))
+	}
+	if options.priority != "" {
+		filter.MinPriority, filter.MaxPriority, err = journald.ParsePriority(options.priority)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if options.grep != "" {
+		if filter.Grep, err = journald.CompileGrep(options.grep); err != nil {
+			return filter, err
+		}
+	}
+	return filter, validateOutput(options.output)
+}
+
+func validateOutput(output string) error {
+	switch output {
+	case outputShort, outputShortISO, outputJSON, outputCat:
+		return nil
+	}
+	return fmt.Errorf("unsupported output format %q", output)
+}
+
+// timeLayouts are the absolute time formats accepted by -since and -until.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime parses a time as journalctl --since does: an absolute time in local time, "now",
+// "today", "yesterday", "tomorrow", or a duration relative to now, e.g. "-1h30m".
+func parseTime(s string, now time.Time) (time.Time, error) {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch s {
+	case "now":
+		return now, nil
+	case "today":
+		return midnight, nil
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), nil
+	case "tomorrow":
+		return midnight.AddDate(0, 0, 1), nil
+	}
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q: %w", s, err)
+		}
+		return now.Add(d), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// prefix returns the prefix of a line of text output of the Machine. If color is not zero, the
+// prefix is colored with the ANSI color code.
+func prefix(machine string, color int) string {
+	if machine == "" {
+		return ""
+	}
+	if color != 0 {
+		return fmt.Sprintf("\x1b[%dm%s\x1b[0m ", color, machine)
+	}
+	return machine + " "
+}
+
+// addField adds the field to the JSON object of the entry in the line, keeping the rest of the
+// line as it is.
+func addField(line []byte, field, value string) []byte {
+	if len(line) == 0 || line[0] != '{' {
+		return line
+	}
+	return append(fmt.Appendf(nil, "{%q:%q,", field, value), line[1:]...)
+}
+
+// writeEntry writes the entry in the output format. If machine is not empty, the entry is
+// labeled with the Machine, in the color, if not zero.
+func writeEntry(
+	w io.Writer,
+	output, machine string,
+	color int,
+	line []byte,
+	entry journald.Entry,
+) error {
+	var err error
+	switch output {
+	case outputJSON:
+		if machine != "" {
+			line = addField(line, journald.FieldMachine, machine)
+		}
+		_, err = w.Write(line)
+	case outputCat:
+		_, err = fmt.Fprintf(w, "%s%s\n", prefix(machine, color), entry.Message())
+	default:
+		timestamp := entry.RealtimeTimestamp().Local().Format(time.Stamp)
+		if output == outputShortISO {
+			timestamp = entry.RealtimeTimestamp().Local().Format(time.RFC3339)
+		}
+		identifier := entry[journald.FieldSyslogIdentifier]
+		if identifier == "" {
+			identifier = entry["_COMM"]
+		}
+		if pid := entry["_PID"]; pid != "" {
+			identifier += "[" + pid + "]"
+		}
+		_, err = fmt.Fprintf(
+			w,
+			"%s%s %s %s: %s\n",
+			prefix(machine, color),
+			timestamp,
+			entry["_HOSTNAME"],
+			identifier,
+			entry.Message(),
+		)
+	}
+	return err
+}
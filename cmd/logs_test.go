@@ -0,0 +1,74 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("parseTime", func() {
+	// now is in a zone other than UTC, so that times are known to be parsed in its location.
+	location := time.FixedZone("UTC+2", 2*60*60)
+	now := time.Date(2025, 1, 2, 15, 4, 5, 6, location)
+
+	DescribeTable("parses a time as journalctl does",
+		func(s string, expected time.Time) {
+			t, err := parseTime(s, now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t).To(BeTemporally("==", expected))
+			Expect(t.Location()).To(Equal(location))
+		},
+		Entry("now", "now", now),
+		Entry("today", "today", time.Date(2025, 1, 2, 0, 0, 0, 0, location)),
+		Entry("yesterday", "yesterday", time.Date(2025, 1, 1, 0, 0, 0, 0, location)),
+		Entry("tomorrow", "tomorrow", time.Date(2025, 1, 3, 0, 0, 0, 0, location)),
+		Entry("a duration before now", "-1h30m", now.Add(-90*time.Minute)),
+		Entry("a duration after now", "+10s", now.Add(10*time.Second)),
+		Entry("a date", "2024-12-31", time.Date(2024, 12, 31, 0, 0, 0, 0, location)),
+		Entry("a date and a time", "2024-12-31 23:59",
+			time.Date(2024, 12, 31, 23, 59, 0, 0, location)),
+		Entry("a date and a time with seconds", "2024-12-31 23:59:58",
+			time.Date(2024, 12, 31, 23, 59, 58, 0, location)),
+	)
+
+	It("parses an RFC 3339 time in its own zone", func() {
+		t, err := parseTime("2024-12-31T23:59:58.5Z", now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t).To(BeTemporally("==", time.Date(2024, 12, 31, 23, 59, 58, 5e8, time.UTC)))
+	})
+
+	It("crosses the start of a month", func() {
+		t, err := parseTime("yesterday", time.Date(2025, 3, 1, 12, 0, 0, 0, location))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t).To(Equal(time.Date(2025, 2, 28, 0, 0, 0, 0, location)))
+	})
+
+	DescribeTable("rejects an invalid time",
+		func(s string) {
+			_, err := parseTime(s, now)
+			Expect(err).To(MatchError(ContainSubstring("invalid time %q", s)))
+		},
+		Entry("an empty time", ""),
+		Entry("an unknown word", "noon"),
+		Entry("a duration without a sign", "1h"),
+		Entry("an invalid duration", "-1x"),
+		Entry("a date in another format", "01/02/2025"),
+	)
+})
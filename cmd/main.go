@@ -17,25 +17,43 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
+	"github.com/dlipovetsky/machine-monitor/internal/api"
+	"github.com/dlipovetsky/machine-monitor/internal/archive"
+	"github.com/dlipovetsky/machine-monitor/internal/bundle"
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
 	"github.com/dlipovetsky/machine-monitor/internal/controller"
-	"github.com/go-logr/stdr"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/logging"
+	"github.com/dlipovetsky/machine-monitor/internal/loki"
+	"github.com/dlipovetsky/machine-monitor/internal/otlp"
+	"github.com/dlipovetsky/machine-monitor/internal/s3"
+	"github.com/dlipovetsky/machine-monitor/internal/snapshot"
+	"github.com/dlipovetsky/machine-monitor/internal/ssh"
+	"github.com/dlipovetsky/machine-monitor/internal/tracing"
+	"go.opentelemetry.io/otel"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	cabpkv1 "sigs.k8s.io/cluster-api/bootstrap/kubeadm/api/v1beta1"
 	// +kubebuilder:scaffold:imports
@@ -50,31 +68,33 @@ func init() {
 	// +kubebuilder:scaffold:scheme
 }
 
-type Config struct {
-	SSHPort       int
-	SSHUser       string
-	SSHPrivateKey []byte
-
-	BastionSSHHost       string
-	BastionSSHPort       int
-	BastionSSHUser       string
-	BastionSSHPrivateKey []byte
-
-	LocalJournalDirectory        string
-	RemoteJournaldCursorFilePath string
-
-	MaxConcurrentReconciles int
-	RequeueBaseDelay        time.Duration
-	RequeueMaxDelay         time.Duration
-	LabelSelectors          *metav1.LabelSelector
-
-	HealthProbeBindAddress string
+// subcommands are run instead of the controller, if named by the first argument.
+var subcommands = map[string]func(args []string) int{
+	"logs":   runLogs,
+	"tail":   runTail,
+	"search": runSearch,
+	"bundle": runBundle,
 }
 
 // nolint:gocyclo
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(subcommand(os.Args[2:]))
+		}
+	}
+
 	config := Config{}
 
+	var configFilePath string
+	flag.StringVar(
+		&configFilePath,
+		"config",
+		"",
+		"The path to the YAML configuration file. Values in the file take precedence over flags. "+
+			"The file is reloaded on SIGHUP, and when it changes.",
+	)
+
 	flag.IntVar(
 		&config.SSHPort,
 		"ssh-port",
@@ -85,11 +105,10 @@ func main() {
 		&config.SSHUser,
 		"ssh-user",
 		"",
-		"The username for the SSH connection to the machines. The user must have sudo privileges.",
+		"The username for the SSH connection to the machines.",
 	)
-	var sshPrivateKeyFileName string
 	flag.StringVar(
-		&sshPrivateKeyFileName,
+		&config.SSHPrivateKeyFile,
 		"ssh-private-key",
 		"",
 		"The path to the private key file for the SSH connection to the machines.")
@@ -112,14 +131,30 @@ func main() {
 		"",
 		"The username for the SSH connection to the bastion server.",
 	)
-	var bastionSSHPrivateKeyFileName string
 	flag.StringVar(
-		&bastionSSHPrivateKeyFileName,
+		&config.BastionSSHPrivateKeyFile,
 		"bastion-ssh-private-key",
 		"",
 		"The path to the private key file for the SSH connection to the bastion server.",
 	)
 
+	flag.StringVar(
+		&config.PrivilegeStrategy,
+		"privilege",
+		journald.PrivilegeSudo,
+		fmt.Sprintf(
+			"How journalctl is run with access to the entire journal, one of %q.",
+			journald.PrivilegeStrategies,
+		),
+	)
+	flag.StringVar(
+		&config.SudoPasswordSecret,
+		"sudo-password-secret",
+		"",
+		"The namespace/name of the Secret with the sudo password of the SSH user, in its "+
+			"\"password\" key. Required with the sudo-password privilege strategy.",
+	)
+
 	flag.StringVar(
 		&config.LocalJournalDirectory,
 		"local-journal-directory",
@@ -128,16 +163,220 @@ func main() {
 	flag.StringVar(
 		&config.RemoteJournaldCursorFilePath,
 		"remote-journald-cursor-file-path",
-		"$HOME/machine-monitor-journald.cursor",
-		"The path used to store the journald cursor file on the remote machine.",
+		"",
+		"Deprecated: ignored. The stream resumes after the last entry in the local journal file.",
+	)
+	flag.DurationVar(
+		&config.LocalJournalSyncInterval,
+		"local-journal-sync-interval",
+		journald.DefaultSyncInterval,
+		"How often the local journal files are synced to disk. Entries that are not synced when "+
+			"the host crashes are streamed again. 0 syncs after every write.",
+	)
+	flag.Int64Var(
+		&config.LocalJournalMaxFileSize,
+		"local-journal-max-file-size",
+		0,
+		"The size, in bytes, above which the local journal file of a machine is rotated. Rotated "+
+			"files are kept, and read along with the local journal file. 0 means no limit.",
+	)
+	flag.BoolVar(
+		&config.DeleteJournalsOfDeletedMachines,
+		"delete-journals-of-deleted-machines",
+		false,
+		"If true, the local journal files of a machine, and the files derived from them, are "+
+			"deleted once the machine is deleted, and, if archiving is configured, its journal "+
+			"is archived.",
+	)
+	flag.BoolVar(
+		&config.SearchIndex,
+		"search-index",
+		false,
+		"If true, the journal entries of each Machine are indexed for full-text search, in the "+
+			"local journal directory.",
+	)
+	flag.IntVar(
+		&config.Backfill.Boots,
+		"backfill-boots",
+		0,
+		"When the journal of a machine is streamed for the first time, only stream entries from "+
+			"this many of the latest boots, e.g. 1 for the current boot. 0 means no limit.",
+	)
+	flag.DurationVar(
+		&config.Backfill.Since,
+		"backfill-since",
+		0,
+		"When the journal of a machine is streamed for the first time, only stream entries "+
+			"logged in this duration before the stream starts. 0 means no limit.",
+	)
+	flag.IntVar(
+		&config.Backfill.MaxEntries,
+		"backfill-max-entries",
+		0,
+		"When the journal of a machine is streamed for the first time, only stream this many of "+
+			"the latest entries. 0 means no limit.",
+	)
+	flag.Int64Var(
+		&config.Backfill.MaxBytes,
+		"backfill-max-bytes",
+		0,
+		"When the journal of a machine is streamed for the first time, only stream the latest "+
+			"entries that fit in this many bytes of journalctl JSON output. 0 means no limit.",
+	)
+
+	flag.StringVar(
+		&config.LokiURL,
+		"loki-url",
+		"",
+		"The Loki push API URL, e.g. http://loki:3100/loki/api/v1/push. "+
+			"If empty, journal entries will not be forwarded to Loki.",
+	)
+	flag.StringVar(
+		&config.LokiTenantID,
+		"loki-tenant-id",
+		"",
+		"The Loki tenant ID. If empty, no tenant ID will be sent.",
+	)
+	flag.IntVar(
+		&config.LokiBatchSize,
+		"loki-batch-size",
+		1000,
+		"The maximum number of journal entries to push to Loki in one request.",
+	)
+	flag.DurationVar(
+		&config.LokiBatchWait,
+		"loki-batch-wait",
+		time.Second,
+		"The maximum time to wait for a batch of journal entries to fill up before pushing it "+
+			"to Loki.",
 	)
 
-	var unparsedLabelSelectors string
 	flag.StringVar(
-		&unparsedLabelSelectors,
+		&config.OTLPEndpoint,
+		"otlp-endpoint",
+		"",
+		"The OTLP logs endpoint, e.g. http://collector:4317 for gRPC, or "+
+			"http://collector:4318/v1/logs for HTTP. "+
+			"If empty, journal entries will not be exported as OpenTelemetry log records.",
+	)
+	flag.StringVar(
+		&config.OTLPProtocol,
+		"otlp-protocol",
+		otlp.ProtocolGRPC,
+		"The OTLP protocol, either grpc or http/protobuf.",
+	)
+	var unparsedOTLPHeaders string
+	flag.StringVar(
+		&unparsedOTLPHeaders,
+		"otlp-headers",
+		"",
+		"The headers to send with every OTLP request, as comma-separated key=value pairs.",
+	)
+	flag.IntVar(
+		&config.OTLPBatchSize,
+		"otlp-batch-size",
+		1000,
+		"The maximum number of journal entries to export in one OTLP request.",
+	)
+	flag.DurationVar(
+		&config.OTLPBatchWait,
+		"otlp-batch-wait",
+		time.Second,
+		"The maximum time to wait for a batch of journal entries to fill up before exporting it.",
+	)
+	flag.StringVar(
+		&config.OTLPTracesEndpoint,
+		"otlp-traces-endpoint",
+		"",
+		"The OTLP traces endpoint, e.g. http://collector:4317 for gRPC, or "+
+			"http://collector:4318/v1/traces for HTTP. The OTLP protocol and headers are used. "+
+			"If empty, reconciles are not traced.",
+	)
+
+	flag.StringVar(
+		&config.ArchiveS3Endpoint,
+		"archive-s3-endpoint",
+		"",
+		"The URL of the S3-compatible object storage to archive journals to, "+
+			"e.g. https://s3.us-east-1.amazonaws.com. "+
+			"The credentials are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY "+
+			"environment variables. If empty, journals will not be archived.",
+	)
+	flag.StringVar(
+		&config.ArchiveS3Region,
+		"archive-s3-region",
+		"us-east-1",
+		"The region of the S3-compatible object storage.",
+	)
+	flag.StringVar(
+		&config.ArchiveS3Bucket,
+		"archive-s3-bucket",
+		"",
+		"The bucket to archive journals to.",
+	)
+	flag.StringVar(
+		&config.ArchiveKeyTemplate,
+		"archive-key-template",
+		archive.DefaultKeyTemplate,
+		"The Go template for the object key of the journal of one boot of a machine. "+
+			"The template can use .ManagementCluster, .Cluster, .Namespace, .Machine and "+
+			".BootID. With more than one management cluster, the default is prefixed with "+
+			"{{.ManagementCluster}}/.",
+	)
+	flag.IntVar(
+		&config.ArchivePartSize,
+		"archive-part-size",
+		8*1024*1024,
+		"The size, in bytes, of each part of a multipart upload. Must be at least 5 MiB.",
+	)
+
+	flag.StringVar(
+		&config.LabelSelector,
 		"label-selectors",
 		"",
 		"The label selectors to filter the machines to monitor. Empty string means all machines.")
+	flag.StringVar(
+		&config.CollectionPolicy,
+		"collection-policy",
+		controller.CollectionPolicyAlways,
+		fmt.Sprintf(
+			"When to collect the journal of a machine. With %q, the journal of every machine is "+
+				"collected. With %q, the journal is collected until the node of the machine has "+
+				"been ready for the node ready grace period, and again once the machine is being "+
+				"deleted, or loses its node.",
+			controller.CollectionPolicyAlways,
+			controller.CollectionPolicyBootstrap,
+		),
+	)
+	flag.DurationVar(
+		&config.NodeReadyGracePeriod,
+		"node-ready-grace-period",
+		10*time.Minute,
+		"How long to keep collecting the journal of a machine after its node becomes ready, with "+
+			"the bootstrap collection policy.",
+	)
+	flag.BoolVar(
+		&config.Snapshots,
+		"snapshots",
+		false,
+		"Take diagnostic snapshots of machines when they report a failure, when their node is "+
+			"not ready within the snapshot bootstrap timeout, or when requested with the "+
+			snapshot.AnnotationRequest+" annotation.",
+	)
+	flag.StringVar(
+		&config.SnapshotCommandsFile,
+		"snapshot-commands-file",
+		"",
+		"The YAML file with the commands to run to take a snapshot. If empty, a default set of "+
+			"commands is used.",
+	)
+	flag.DurationVar(
+		&config.SnapshotBootstrapTimeout,
+		"snapshot-bootstrap-timeout",
+		30*time.Minute,
+		"Take a snapshot of a machine if its node is not ready this long after the machine was "+
+			"created. 0 disables this trigger.",
+	)
 	flag.IntVar(
 		&config.MaxConcurrentReconciles,
 		"max-concurrent-reconciles",
@@ -157,12 +396,81 @@ func main() {
 		"The max delay for requeuing a machine after an error.",
 	)
 
-	var logLevel int
-	flag.IntVar(&logLevel,
+	flag.Float64Var(
+		&config.SSHDialRate,
+		"ssh-dial-rate",
+		ssh.DefaultDialRate,
+		"The maximum number of SSH connections to start per second, across all machines.",
+	)
+	flag.IntVar(
+		&config.SSHDialBurst,
+		"ssh-dial-burst",
+		ssh.DefaultDialBurst,
+		"The maximum number of SSH connections to start at once, above the dial rate.",
+	)
+	flag.IntVar(
+		&config.BastionDialConcurrency,
+		"bastion-dial-concurrency",
+		ssh.DefaultBastionConcurrency,
+		"The maximum number of SSH connections to start through the same bastion server at a "+
+			"time. Keep it below the MaxStartups setting of the bastion sshd. 0 means no limit.",
+	)
+	flag.IntVar(
+		&config.SSHDialRetries,
+		"ssh-dial-retries",
+		ssh.DefaultDialRetries,
+		"The number of times a failed SSH connection is retried, with a jittered delay, before "+
+			"the machine is requeued. At most 10.",
+	)
+
+	var unparsedManagementClusters stringsFlag
+	flag.Var(
+		&unparsedManagementClusters,
+		"management-cluster",
+		"A management cluster to monitor, as a comma-separated list of key=value pairs, e.g. "+
+			"name=us-east,kubeconfig=/path/to/kubeconfig,context=admin. Can be repeated. "+
+			"The local journal files of each management cluster are stored in a subdirectory "+
+			"named after it. If not provided, the default kubeconfig is used.",
+	)
+
+	flag.IntVar(&config.LogLevel,
 		"log-level",
 		0,
 		"The log verbosity.",
 	)
+	flag.StringVar(
+		&config.LogFormat,
+		"log-format",
+		logging.FormatConsole,
+		"The log format, either json or console.",
+	)
+	flag.IntVar(
+		&config.LogSamplingInitial,
+		"log-sampling-initial",
+		100,
+		"The number of log entries with the same level and message to log each second, before "+
+			"sampling them. If 0, log entries are not sampled.",
+	)
+	flag.IntVar(
+		&config.LogSamplingThereafter,
+		"log-sampling-thereafter",
+		100,
+		"Once sampled, only every Nth log entry with the same level and message is logged, "+
+			"until the next second.",
+	)
+	flag.BoolVar(
+		&config.MachineDiagnosticsLog,
+		"machine-diagnostics-log",
+		false,
+		"If true, the connection history of each Machine is logged to a diagnostics log file "+
+			"in the local journal directory.",
+	)
+	flag.StringVar(
+		&config.MetricsBindAddress,
+		"metrics-bind-address",
+		"0",
+		"The address to bind the metrics server to. If 0, the metrics server will be disabled.",
+	)
 	flag.StringVar(
 		&config.HealthProbeBindAddress,
 		"health-probe-bind-address",
@@ -170,124 +478,374 @@ func main() {
 		"The address to bind the health probe server to. If empty, the health probe server will be disabled.",
 	)
 
+	flag.StringVar(
+		&config.APIBindAddress,
+		"api-bind-address",
+		"",
+		"The address to bind the API server and web UI to. If empty, they will be disabled.",
+	)
+	flag.BoolVar(
+		&config.APIBundleObjects,
+		"api-bundle-objects",
+		false,
+		"Add the Machine, infrastructure Machine and bootstrap config of each Machine to the "+
+			"support bundles that the API serves. Secrets are redacted, but the API has no "+
+			"authentication.",
+	)
+
 	// All flags must be defined before Parse() is called.
 	flag.Parse()
 
-	stdr.SetVerbosity(logLevel)
-	logger := stdr.New(log.New(os.Stderr, "", 0))
+	// The logger is replaced once the configuration file is applied.
+	verbosity := logging.NewVerbosity(config.LogLevel)
+	logger := logging.New(os.Stderr, logging.Options{
+		Format:    config.LogFormat,
+		Verbosity: verbosity,
+	})
 
-	if unparsedLabelSelectors != "" {
-		labelSelectors, err := metav1.ParseToLabelSelector(unparsedLabelSelectors)
+	for _, unparsed := range unparsedManagementClusters {
+		managementCluster, err := parseManagementCluster(unparsed)
 		if err != nil {
-			logger.Error(err, "unable to parse label selector")
+			logger.Error(err, "unable to parse management cluster")
 			defer os.Exit(1)
 			return
 		}
-		config.LabelSelectors = labelSelectors
+		config.ManagementClusters = append(config.ManagementClusters, managementCluster)
 	}
 
-	{
-		if sshPrivateKeyFileName == "" {
-			logger.Error(nil, "--ssh-private-key flag is required")
-			defer os.Exit(1)
-			return
+	if unparsedOTLPHeaders != "" {
+		config.OTLPHeaders = map[string]string{}
+		for _, pair := range strings.Split(unparsedOTLPHeaders, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				logger.Error(nil, "unable to parse OTLP header, expected key=value", "header", pair)
+				defer os.Exit(1)
+				return
+			}
+			config.OTLPHeaders[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	// The flags are kept, so that the configuration file can be applied to them again when it is
+	// reloaded.
+	flagConfig := config
+	resolved, err := loadConfig(flagConfig, configFilePath)
+	if err != nil {
+		logger.Error(err, "invalid configuration")
+		defer os.Exit(1)
+		return
+	}
+	verbosity.Set(resolved.LogLevel)
+	logger = logging.New(os.Stderr, logging.Options{
+		Format:             resolved.LogFormat,
+		Verbosity:          verbosity,
+		SamplingInitial:    resolved.LogSamplingInitial,
+		SamplingThereafter: resolved.LogSamplingThereafter,
+	})
+
+	ctrl.SetLogger(logger)
+
+	var lokiConfig *loki.Config
+	if resolved.LokiURL != "" {
+		lokiConfig = &loki.Config{
+			URL:       resolved.LokiURL,
+			TenantID:  resolved.LokiTenantID,
+			BatchSize: resolved.LokiBatchSize,
+			BatchWait: resolved.LokiBatchWait,
 		}
-		sshPrivateKey, err := os.ReadFile(sshPrivateKeyFileName)
+	}
+
+	var archiver *archive.Archiver
+	if resolved.ArchiveS3Endpoint != "" {
+		archiver, err = archive.NewArchiver(archive.Config{
+			S3: s3.Config{
+				Endpoint:        resolved.ArchiveS3Endpoint,
+				Region:          resolved.ArchiveS3Region,
+				Bucket:          resolved.ArchiveS3Bucket,
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			},
+			KeyTemplate: resolved.ArchiveKeyTemplate,
+			PartSize:    resolved.ArchivePartSize,
+		})
 		if err != nil {
-			logger.Error(err, "unable to read SSH private key file")
+			logger.Error(err, "unable to create archiver")
 			defer os.Exit(1)
 			return
 		}
-		config.SSHPrivateKey = sshPrivateKey
 	}
 
-	if config.BastionSSHHost != "" {
-		if bastionSSHPrivateKeyFileName == "" {
-			logger.Error(nil, "--bastion-ssh-private-key flag is required")
+	var otlpConfig *otlp.Config
+	if resolved.OTLPEndpoint != "" {
+		otlpConfig = &otlp.Config{
+			Protocol:   resolved.OTLPProtocol,
+			Endpoint:   resolved.OTLPEndpoint,
+			Headers:    resolved.OTLPHeaders,
+			BatchSize:  resolved.OTLPBatchSize,
+			BatchWait:  resolved.OTLPBatchWait,
+			HTTPClient: otlp.NewHTTPClient(resolved.OTLPProtocol),
+		}
+		if err := otlpConfig.Validate(); err != nil {
+			logger.Error(err, "invalid OTLP configuration")
 			defer os.Exit(1)
 			return
 		}
-		bastionSSHPrivateKey, err := os.ReadFile(bastionSSHPrivateKeyFileName)
-		if err != nil {
-			logger.Error(err, "unable to read bastion SSH private key file")
+	}
+
+	if resolved.OTLPTracesEndpoint != "" {
+		tracesConfig := otlp.Config{
+			Protocol: resolved.OTLPProtocol,
+			Endpoint: resolved.OTLPTracesEndpoint,
+			Headers:  resolved.OTLPHeaders,
+		}
+		if err := tracesConfig.Validate(); err != nil {
+			logger.Error(err, "invalid OTLP traces configuration")
 			defer os.Exit(1)
 			return
 		}
-		config.BastionSSHPrivateKey = bastionSSHPrivateKey
+		tracerProvider := tracing.NewTracerProvider(otlp.NewSpanExporter(tracesConfig))
+		otel.SetTracerProvider(tracerProvider)
+		defer func() {
+			// Export the spans that are still buffered.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+				logger.Error(err, "failed to shut down tracer provider")
+			}
+		}()
 	}
 
-	fileInfo, err := os.Stat(config.LocalJournalDirectory)
-	if err != nil {
-		logger.Error(err, "unable to stat local journal directory")
-		defer os.Exit(1)
-		return
-	}
-	if !fileInfo.IsDir() {
-		logger.Error(
-			nil,
-			"local journal directory is not a directory",
-			"directory",
-			config.LocalJournalDirectory,
-		)
-		defer os.Exit(1)
-		return
+	managementClusters := resolved.ManagementClusters
+	if len(managementClusters) == 0 {
+		// Without management clusters, the default kubeconfig is used, and the local journal files
+		// are stored directly in the local journal directory.
+		managementClusters = []ManagementCluster{{}}
 	}
 
-	ctrl.SetLogger(logger)
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme: scheme,
-		Metrics: server.Options{
-			BindAddress: "0", // Disable the metrics server.
-		},
-		HealthProbeBindAddress: config.HealthProbeBindAddress,
-	})
-	if err != nil {
-		logger.Error(err, "unable to start manager")
-		defer os.Exit(1)
-		return
+	apiServer := &api.Server{
+		BindAddress:        resolved.APIBindAddress,
+		ManagementClusters: map[string]string{},
+		Stores:             map[string]journald.Store{},
+		Objects:            map[string]bundle.ObjectsFunc{},
 	}
 
-	// When machine-monitor is started as a background process, the readyz check can be used to
-	// check that initialization is complete,
-	if err := mgr.AddHealthzCheck("", healthz.Ping); err != nil {
-		logger.Error(err, "unable to add liveness check")
-		defer os.Exit(1)
-		return
-	}
+	// The reconcilers of every management cluster share the dial limits, because their Machines
+	// may share a bastion server.
+	dialScheduler := ssh.NewScheduler(
+		resolved.SSHDialRate,
+		resolved.SSHDialBurst,
+		resolved.BastionDialConcurrency,
+		resolved.SSHDialRetries,
+	)
 
-	reconciler := &controller.MachineReconciler{
-		Client: mgr.GetClient(),
+	managers := make([]manager.Manager, 0, len(managementClusters))
+	reconcilers := make([]*controller.MachineReconciler, 0, len(managementClusters))
+	for i, managementCluster := range managementClusters {
+		log := logger.WithValues("managementCluster", managementCluster.Name)
+
+		// The local journal files of each management cluster are stored in their own directory,
+		// so that Machines with the same namespace and name do not share files.
+		localJournalDirectory := resolved.LocalJournalDirectory
+		if managementCluster.Name != "" {
+			localJournalDirectory = filepath.Join(localJournalDirectory, managementCluster.Name)
+			if err := os.MkdirAll(localJournalDirectory, 0o755); err != nil {
+				log.Error(err, "unable to create local journal directory of management cluster")
+				defer os.Exit(1)
+				return
+			}
+			apiServer.ManagementClusters[managementCluster.Name] = localJournalDirectory
+		} else {
+			apiServer.LocalJournalDirectory = localJournalDirectory
+		}
+		// The API reads the journals from the Store that the reconciler appends to.
+		store := &journald.FileStore{Directory: localJournalDirectory}
+		apiServer.Stores[managementCluster.Name] = store
 
-		SSHPrivateKey: config.SSHPrivateKey,
-		SSHUser:       config.SSHUser,
-		SSHPort:       config.SSHPort,
+		restConfig, err := managementCluster.restConfig()
+		if err != nil {
+			log.Error(err, "unable to get kubeconfig")
+			defer os.Exit(1)
+			return
+		}
 
-		LocalJournalDirectory:        config.LocalJournalDirectory,
-		RemoteJournaldCursorFilePath: config.RemoteJournaldCursorFilePath,
+		machineAPIVersion, err := capi.ServedVersion(restConfig)
+		if err != nil {
+			log.Error(err, "unable to detect the served Machine API version")
+			defer os.Exit(1)
+			return
+		}
+		log.Info("detected the served Machine API version", "version", machineAPIVersion)
+
+		// Metrics are collected from every manager, and health probes and the API serve local
+		// data, so only the first manager serves them.
+		options := ctrl.Options{
+			Scheme: scheme,
+			// Machines are read as unstructured objects, so that every served Machine API version
+			// can be read. By default, the client reads unstructured objects from the API server,
+			// not from the cache.
+			Client: client.Options{
+				Cache: &client.CacheOptions{Unstructured: true},
+			},
+			Metrics: server.Options{
+				BindAddress: "0", // Disable the metrics server.
+			},
+		}
+		if i == 0 {
+			options.Metrics.BindAddress = resolved.MetricsBindAddress
+			options.HealthProbeBindAddress = resolved.HealthProbeBindAddress
+		}
+		mgr, err := ctrl.NewManager(restConfig, options)
+		if err != nil {
+			log.Error(err, "unable to start manager")
+			defer os.Exit(1)
+			return
+		}
 
-		MaxConcurrentReconciles: config.MaxConcurrentReconciles,
-		RequeueBaseDelay:        config.RequeueBaseDelay,
-		RequeueMaxDelay:         config.RequeueMaxDelay,
-		LabelSelector:           config.LabelSelectors,
-	}
+		if i == 0 {
+			// When machine-monitor is started as a background process, the readyz check can be
+			// used to check that initialization is complete,
+			if err := mgr.AddHealthzCheck("", healthz.Ping); err != nil {
+				log.Error(err, "unable to add liveness check")
+				defer os.Exit(1)
+				return
+			}
+			if resolved.APIBindAddress != "" {
+				if err := mgr.Add(apiServer); err != nil {
+					log.Error(err, "unable to add API server")
+					defer os.Exit(1)
+					return
+				}
+			}
+		}
+
+		// Support bundles read the objects without a cache, so that the infrastructure Machines
+		// and bootstrap configs are not watched.
+		if resolved.APIBundleObjects {
+			apiServer.Objects[managementCluster.Name] = bundle.KubernetesObjects(
+				mgr.GetAPIReader(),
+				mgr.GetRESTMapper(),
+				machineAPIVersion,
+			)
+		}
+
+		reconciler := &controller.MachineReconciler{
+			Client:    mgr.GetClient(),
+			APIReader: mgr.GetAPIReader(),
+			Recorder:  mgr.GetEventRecorderFor("machine-monitor"),
+
+			ManagementCluster: managementCluster.Name,
+			MachineAPIVersion: machineAPIVersion,
+
+			LocalJournalDirectory:           localJournalDirectory,
+			Store:                           store,
+			LocalJournalSyncInterval:        resolved.LocalJournalSyncInterval,
+			LocalJournalMaxFileSize:         resolved.LocalJournalMaxFileSize,
+			DeleteJournalsOfDeletedMachines: resolved.DeleteJournalsOfDeletedMachines,
+			MachineDiagnosticsLog:           resolved.MachineDiagnosticsLog,
+			SearchIndex:                     resolved.SearchIndex,
+
+			Loki:     lokiConfig,
+			Archiver: archiver,
+			OTLP:     otlpConfig,
+
+			Settings:  resolved.Settings,
+			Overrides: resolved.Overrides,
+
+			DialScheduler: dialScheduler,
+
+			MaxConcurrentReconciles: resolved.MaxConcurrentReconciles,
+			RequeueBaseDelay:        resolved.RequeueBaseDelay,
+			RequeueMaxDelay:         resolved.RequeueMaxDelay,
+			LabelSelector:           resolved.LabelSelectors,
+		}
+
+		if err := reconciler.SetupWithManager(mgr); err != nil {
+			log.Error(err, "unable to create controller", "controller", "Machine")
+			defer os.Exit(1)
+			return
+		}
+		// +kubebuilder:scaffold:builder
 
-	if config.BastionSSHHost != "" {
-		reconciler.BastionSSHPrivateKey = config.BastionSSHPrivateKey
-		reconciler.BastionSSHUser = config.BastionSSHUser
-		reconciler.BastionSSHPort = config.BastionSSHPort
-		reconciler.BastionSSHHost = config.BastionSSHHost
+		managers = append(managers, mgr)
+		reconcilers = append(reconcilers, reconciler)
 	}
 
-	if err := reconciler.SetupWithManager(mgr); err != nil {
-		logger.Error(err, "unable to create controller", "controller", "Machine")
-		defer os.Exit(1)
-		return
+	apiServer.Streaming = func(managementCluster, namespace, name string) bool {
+		for i, reconciler := range reconcilers {
+			if managementClusters[i].Name == managementCluster {
+				return reconciler.Streaming(namespace, name)
+			}
+		}
+		return false
 	}
-	// +kubebuilder:scaffold:builder
 
-	logger.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
-		logger.Error(err, "problem running manager")
+	// If any manager fails, every manager is stopped.
+	ctx, cancel := context.WithCancel(ctrl.SetupSignalHandler())
+	defer cancel()
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+
+	if configFilePath != "" {
+		// The settings of the Machines are applied without a restart. Streams are restarted only
+		// for the Machines whose settings changed.
+		reload := func() {
+			reloaded, err := loadConfig(flagConfig, configFilePath)
+			if err != nil {
+				logger.Error(err, "invalid configuration, keeping the current configuration")
+				return
+			}
+			if changed := restartRequired(resolved.Config, reloaded.Config); len(changed) > 0 {
+				logger.Info(
+					"configuration changed that only takes effect after a restart",
+					"fields",
+					changed,
+				)
+			}
+			resolved = resolved.reload(reloaded)
+			verbosity.Set(resolved.LogLevel)
+			for i, reconciler := range reconcilers {
+				restarted, requeued := reconciler.UpdateSettings(
+					resolved.Settings,
+					resolved.Overrides,
+				)
+				logger.Info(
+					"configuration reloaded",
+					"managementCluster",
+					managementClusters[i].Name,
+					"restartedStreams",
+					restarted,
+					"requeuedMachines",
+					requeued,
+				)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := watchConfigFile(ctx, logger, configFilePath, reload); err != nil {
+				logger.Error(err, "unable to watch configuration file, it will not be reloaded")
+			}
+		}()
+	}
+	for i, mgr := range managers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			logger.Info("starting manager", "managementCluster", managementClusters[i].Name)
+			if err := mgr.Start(ctx); err != nil {
+				logger.Error(
+					err,
+					"problem running manager",
+					"managementCluster",
+					managementClusters[i].Name,
+				)
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed.Load() {
 		defer os.Exit(1)
 		return
 	}
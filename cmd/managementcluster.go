@@ -0,0 +1,94 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// ManagementCluster is a Kubernetes cluster with Cluster API Machine resources.
+type ManagementCluster struct {
+	// Name identifies the management cluster in the local journal directory, metrics, and API.
+	Name string `json:"name"`
+	// Kubeconfig is the path to the kubeconfig file. If empty, the KUBECONFIG environment
+	// variable, or ~/.kube/config, is used.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Context is the kubeconfig context. If empty, the current context is used.
+	Context string `json:"context,omitempty"`
+}
+
+// parseManagementCluster parses a management cluster from a comma-separated list of key=value
+// pairs, e.g. "name=us-east,kubeconfig=/etc/kubeconfig/us-east,context=admin". The name is
+// required. If only a context is given, the name defaults to the context.
+func parseManagementCluster(s string) (ManagementCluster, error) {
+	managementCluster := ManagementCluster{}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return managementCluster, fmt.Errorf(
+				"invalid management cluster %q: expected key=value, got %q",
+				s,
+				pair,
+			)
+		}
+		switch strings.TrimSpace(key) {
+		case "name":
+			managementCluster.Name = strings.TrimSpace(value)
+		case "kubeconfig":
+			managementCluster.Kubeconfig = strings.TrimSpace(value)
+		case "context":
+			managementCluster.Context = strings.TrimSpace(value)
+		default:
+			return managementCluster, fmt.Errorf(
+				"invalid management cluster %q: unknown key %q",
+				s,
+				key,
+			)
+		}
+	}
+	managementCluster, err := managementCluster.withDefaults()
+	if err != nil {
+		return managementCluster, fmt.Errorf("invalid management cluster %q: %w", s, err)
+	}
+	return managementCluster, nil
+}
+
+// withDefaults returns the management cluster with the name defaulted to the context, or an
+// error if the name is invalid.
+func (m ManagementCluster) withDefaults() (ManagementCluster, error) {
+	if m.Name == "" {
+		m.Name = m.Context
+	}
+	// The name is used as a directory name, and as a label value.
+	if errs := validation.IsDNS1123Label(m.Name); len(errs) > 0 {
+		return m, fmt.Errorf("invalid name %q: %s", m.Name, strings.Join(errs, ", "))
+	}
+	return m, nil
+}
+
+// restConfig returns the configuration to access the management cluster.
+func (m ManagementCluster) restConfig() (*rest.Config, error) {
+	if m.Kubeconfig == "" && m.Context == "" {
+		return ctrl.GetConfig()
+	}
+	return loadRESTConfig(m.Kubeconfig, m.Context)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+)
+
+// configReloadDelay is how long to wait after the configuration file changes before it is
+// reloaded, so that a file that is written in several steps is reloaded once.
+const configReloadDelay = time.Second
+
+// watchConfigFile calls reload when the process receives SIGHUP, or when the configuration file
+// changes, until the context is done.
+func watchConfigFile(
+	ctx context.Context,
+	logger logr.Logger,
+	filePath string,
+	reload func(),
+) error {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	defer func() {
+		if err := watcher.Close(); err != nil {
+			logger.Error(err, "failed to close file watcher")
+		}
+	}()
+	// The directory is watched, because editors, and Kubernetes ConfigMap volumes, replace the
+	// file, rather than write to it.
+	filePath = filepath.Clean(filePath)
+	if err := watcher.Add(filepath.Dir(filePath)); err != nil {
+		return fmt.Errorf("failed to watch configuration file: %w", err)
+	}
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hangup:
+			logger.Info("received SIGHUP, reloading configuration")
+			reload()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// A ConfigMap volume replaces the ..data symlink when any of its files changes.
+			if filepath.Clean(event.Name) != filePath && filepath.Base(event.Name) != "..data" {
+				continue
+			}
+			timer.Reset(configReloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Error(err, "failed to watch configuration file")
+		case <-timer.C:
+			logger.Info("configuration file changed, reloading configuration")
+			reload()
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/index"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// searchOptions are the options of the search subcommand.
+type searchOptions struct {
+	localJournalDirectory string
+	managementCluster     string
+	since                 string
+	until                 string
+	limit                 int
+	output                string
+	query                 string
+}
+
+// runSearch searches the indexes of the journals of every Machine. It returns the exit code.
+func runSearch(args []string) int {
+	options := searchOptions{}
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: mm search [flags] <query>\n\n"+
+				"The query is made of words, \"phrases in quotes\", and the filters "+
+				"machine:<namespace>/<machine>,\ncluster:<namespace>/<cluster>, unit:<unit>, "+
+				"priority:<priority>, and boot:<boot ID>.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(
+		&options.localJournalDirectory,
+		"local-journal-directory",
+		"",
+		"The directory of the local journal files. Default is the current working directory.",
+	)
+	flags.StringVar(
+		&options.managementCluster,
+		"management-cluster",
+		"",
+		"The management cluster of the Machines, if machine-monitor monitors more than one.",
+	)
+	flags.StringVar(
+		&options.since,
+		"since",
+		"",
+		"Find entries logged at or after the time, e.g. \"2025-01-02 15:04:05\", \"today\", "+
+			"or \"-1h\".",
+	)
+	flags.StringVar(
+		&options.until,
+		"until",
+		"",
+		"Find entries logged at or before the time, in the same format as -since.",
+	)
+	flags.IntVar(
+		&options.limit,
+		"limit",
+		index.DefaultLimit,
+		"The maximum number of entries to show. Entries are shown latest first.",
+	)
+	flags.StringVar(
+		&options.output,
+		"o",
+		outputShort,
+		fmt.Sprintf(
+			"The output format, one of %q, %q, %q, or %q.",
+			outputShort,
+			outputShortISO,
+			outputJSON,
+			outputCat,
+		),
+	)
+
+	// Flags may follow the query, as they may with the logs subcommand.
+	var words []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+			return 2
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		words = append(words, args[0])
+		args = args[1:]
+	}
+	options.query = strings.Join(words, " ")
+
+	if options.managementCluster != "" {
+		options.localJournalDirectory = filepath.Join(
+			options.localJournalDirectory,
+			options.managementCluster,
+		)
+	}
+
+	if err := search(os.Stdout, options, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func search(w io.Writer, options searchOptions, now time.Time) error {
+	if strings.TrimSpace(options.query) == "" {
+		return fmt.Errorf("no query given")
+	}
+	if err := validateOutput(options.output); err != nil {
+		return err
+	}
+	query, err := index.ParseQuery(options.query)
+	if err != nil {
+		return err
+	}
+	if options.since != "" {
+		if query.Filter.Since, err = parseTime(options.since, now); err != nil {
+			return err
+		}
+	}
+	if options.until != "" {
+		if query.Filter.Until, err = parseTime(options.until, now); err != nil {
+			return err
+		}
+	}
+	query.Limit = options.limit
+
+	results, err := index.Search(
+		&journald.FileStore{Directory: options.localJournalDirectory},
+		options.localJournalDirectory,
+		query,
+	)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	for _, result := range results {
+		var line []byte
+		if options.output == outputJSON {
+			if line, err = json.Marshal(result.Entry); err != nil {
+				return fmt.Errorf("failed to serialize entry: %w", err)
+			}
+			line = append(line, '\n')
+		}
+		machine := result.Machine.Namespace + "/" + result.Machine.Name
+		if err := writeEntry(out, options.output, machine, 0, line, result.Entry); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
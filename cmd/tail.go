@@ -0,0 +1,457 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/term"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/ssh"
+)
+
+// tailResyncInterval is how often the Machines are listed, to start streams for new Machines,
+// and stop streams for deleted Machines.
+const tailResyncInterval = 10 * time.Second
+
+// tailRetryDelay is how long to wait before a stream that failed is started again.
+const tailRetryDelay = 5 * time.Second
+
+// tailColors are the ANSI color codes of the Machine prefixes, used in turn.
+var tailColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+// tailOptions are the options of the tail subcommand.
+type tailOptions struct {
+	kubeconfig  string
+	kubeContext string
+	namespace   string
+	selector    string
+	lines       int
+	output      string
+	noColor     bool
+	dialer      ssh.Dialer
+	privilege   string
+}
+
+// runTail streams the journals of every Machine that matches the selector, and prints their
+// entries as they arrive, until interrupted. It does not store the entries, and does not use the
+// remote journald cursor files. It returns the exit code.
+func runTail(args []string) int {
+	options := tailOptions{}
+	var sshPrivateKeyFileName, bastionSSHPrivateKeyFileName string
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: mm tail [flags] -selector <label selector>\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(
+		&options.kubeconfig,
+		"kubeconfig",
+		"",
+		"The path to the kubeconfig file. Default is the KUBECONFIG environment variable, or "+
+			"~/.kube/config.",
+	)
+	flags.StringVar(
+		&options.kubeContext,
+		"context",
+		"",
+		"The kubeconfig context. Default is the current context.",
+	)
+	flags.StringVar(
+		&options.namespace,
+		"namespace",
+		"",
+		"The namespace of the Machines. Default is all namespaces.",
+	)
+	flags.StringVar(
+		&options.selector,
+		"selector",
+		"",
+		"The label selector of the Machines, e.g. cluster.x-k8s.io/deployment-name=md-0.",
+	)
+	flags.IntVar(
+		&options.lines,
+		"n",
+		10,
+		"The number of recent entries of each Machine to show before new entries.",
+	)
+	flags.StringVar(
+		&options.output,
+		"o",
+		outputShort,
+		fmt.Sprintf(
+			"The output format, one of %q, %q, %q, or %q.",
+			outputShort,
+			outputShortISO,
+			outputJSON,
+			outputCat,
+		),
+	)
+	flags.BoolVar(
+		&options.noColor,
+		"no-color",
+		false,
+		"Do not color the Machine prefixes. Colors are also disabled if the output is not a "+
+			"terminal, or if the NO_COLOR environment variable is set.",
+	)
+	flags.IntVar(
+		&options.dialer.Port,
+		"ssh-port",
+		22,
+		"The port for the SSH connection to the machines.",
+	)
+	flags.StringVar(
+		&options.dialer.User,
+		"ssh-user",
+		"",
+		"The username for the SSH connection to the machines.",
+	)
+	flags.StringVar(
+		&options.privilege,
+		"privilege",
+		journald.PrivilegeSudo,
+		fmt.Sprintf(
+			"How journalctl is run with access to the entire journal, one of %q, %q, %q, or %q.",
+			journald.PrivilegeNone,
+			journald.PrivilegeSudo,
+			journald.PrivilegeDoas,
+			journald.PrivilegeAuto,
+		),
+	)
+	flags.StringVar(
+		&sshPrivateKeyFileName,
+		"ssh-private-key",
+		"",
+		"The path to the private key file for the SSH connection to the machines.",
+	)
+	flags.StringVar(
+		&options.dialer.BastionHost,
+		"bastion-ssh-host",
+		"",
+		"The host of the bastion server. If not provided, no bastion server will be used.",
+	)
+	flags.IntVar(
+		&options.dialer.BastionPort,
+		"bastion-ssh-port",
+		22,
+		"The port of the bastion server.",
+	)
+	flags.StringVar(
+		&options.dialer.BastionUser,
+		"bastion-ssh-user",
+		"",
+		"The username for the SSH connection to the bastion server.",
+	)
+	flags.StringVar(
+		&bastionSSHPrivateKeyFileName,
+		"bastion-ssh-private-key",
+		"",
+		"The path to the private key file for the SSH connection to the bastion server.",
+	)
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	if err := tail(options, sshPrivateKeyFileName, bastionSSHPrivateKeyFileName); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func tail(options tailOptions, sshPrivateKeyFileName, bastionSSHPrivateKeyFileName string) error {
+	if options.selector == "" {
+		return fmt.Errorf("-selector is required")
+	}
+	selector, err := labels.Parse(options.selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+	if err := validateOutput(options.output); err != nil {
+		return err
+	}
+	switch options.privilege {
+	case journald.PrivilegeNone, journald.PrivilegeSudo, journald.PrivilegeDoas,
+		journald.PrivilegeAuto:
+	default:
+		return fmt.Errorf("invalid -privilege %q", options.privilege)
+	}
+
+	if sshPrivateKeyFileName == "" {
+		return fmt.Errorf("-ssh-private-key is required")
+	}
+	if options.dialer.PrivateKey, err = os.ReadFile(sshPrivateKeyFileName); err != nil {
+		return fmt.Errorf("unable to read SSH private key file: %w", err)
+	}
+	if options.dialer.BastionHost != "" {
+		if bastionSSHPrivateKeyFileName == "" {
+			return fmt.Errorf("-bastion-ssh-private-key is required")
+		}
+		options.dialer.BastionPrivateKey, err = os.ReadFile(bastionSSHPrivateKeyFileName)
+		if err != nil {
+			return fmt.Errorf("unable to read bastion SSH private key file: %w", err)
+		}
+	}
+
+	restConfig, err := loadRESTConfig(options.kubeconfig, options.kubeContext)
+	if err != nil {
+		return err
+	}
+	// Errors are printed with the Machine they belong to, so the log is not needed.
+	ctrl.SetLogger(logr.Discard())
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	machineAPIVersion, err := capi.ServedVersion(restConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	useColor := !options.noColor &&
+		os.Getenv("NO_COLOR") == "" &&
+		term.IsTerminal(int(os.Stdout.Fd()))
+	t := newTailer(options, os.Stdout, useColor)
+	defer t.wait()
+
+	listOptions := []client.ListOption{client.MatchingLabelsSelector{Selector: selector}}
+	if options.namespace != "" {
+		listOptions = append(listOptions, client.InNamespace(options.namespace))
+	}
+	ticker := time.NewTicker(tailResyncInterval)
+	defer ticker.Stop()
+	for listed := false; ; listed = true {
+		machines := capi.NewUnstructuredMachineList(machineAPIVersion)
+		err := c.List(ctx, machines, listOptions...)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil && !listed:
+			return fmt.Errorf("failed to list machines: %w", err)
+		case err != nil:
+			// The streams that are running are not affected, so we keep them running.
+			fmt.Fprintf(os.Stderr, "error: failed to list machines: %s\n", err)
+		default:
+			t.sync(ctx, machines.Items)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadRESTConfig loads the kubeconfig file, and returns the configuration of the context.
+func loadRESTConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	return restConfig, nil
+}
+
+// tailer runs one stream for every Machine, and prints the entries of all streams.
+type tailer struct {
+	options  tailOptions
+	useColor bool
+	// streamOnce streams the journal of the Machine with the IP address after the entry with the
+	// cursor, until the stream fails, or the context is cancelled.
+	streamOnce func(ctx context.Context, ip, cursor string, handler journald.EntryHandler) error
+	// retryDelay is how long to wait before a stream that failed is started again.
+	retryDelay time.Duration
+
+	// mu serializes writes to out, and errOut.
+	mu     sync.Mutex
+	out    io.Writer
+	errOut io.Writer
+
+	// streams holds a function that stops the stream of each Machine, by namespace/name.
+	streams map[string]context.CancelFunc
+	// colors holds the color of each Machine, by namespace/name. Only sync uses it, so that a
+	// Machine keeps its color when its stream is started again.
+	colors map[string]int
+	wg     sync.WaitGroup
+}
+
+// newTailer returns a tailer that prints to out, and streams journals over SSH.
+func newTailer(options tailOptions, out io.Writer, useColor bool) *tailer {
+	t := &tailer{
+		options:    options,
+		out:        out,
+		errOut:     os.Stderr,
+		useColor:   useColor,
+		retryDelay: tailRetryDelay,
+		streams:    map[string]context.CancelFunc{},
+		colors:     map[string]int{},
+	}
+	t.streamOnce = t.streamOverSSH
+	return t
+}
+
+// sync starts streams for the Machines that have an IP address, and stops streams for Machines
+// that are no longer listed.
+func (t *tailer) sync(ctx context.Context, machines []unstructured.Unstructured) {
+	listed := map[string]bool{}
+	for i := range machines {
+		machine, err := capi.FromUnstructured(&machines[i])
+		if err != nil {
+			t.mu.Lock()
+			fmt.Fprintf(t.errOut, "error: %s\n", err)
+			t.mu.Unlock()
+			continue
+		}
+		ip := machine.InternalIP()
+		if ip == "" {
+			continue
+		}
+		name := machine.Namespace() + "/" + machine.Name()
+		listed[name] = true
+		if _, ok := t.streams[name]; ok {
+			continue
+		}
+		if _, ok := t.colors[name]; !ok && t.useColor {
+			t.colors[name] = tailColors[len(t.colors)%len(tailColors)]
+		}
+		color := t.colors[name]
+		streamCtx, cancel := context.WithCancel(ctx)
+		t.streams[name] = cancel
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.stream(streamCtx, name, color, ip)
+		}()
+	}
+	for name, cancel := range t.streams {
+		if !listed[name] {
+			cancel()
+			delete(t.streams, name)
+		}
+	}
+}
+
+// stream streams the journal of one Machine until the context is cancelled. If the stream fails,
+// it is started again after the last entry that was printed.
+func (t *tailer) stream(ctx context.Context, name string, color int, ip string) {
+	cursor := ""
+	printEntry := func(_ context.Context, entry journald.Entry) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		line, err := entryLine(entry)
+		if err == nil {
+			err = writeEntry(t.out, t.options.output, name, color, line, entry)
+		}
+		if err != nil {
+			t.printError(name, color, err)
+		}
+		cursor = entry.Cursor()
+	}
+	for {
+		err := t.streamOnce(ctx, ip, cursor, printEntry)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("stream ended")
+		}
+		t.mu.Lock()
+		t.printError(name, color, err)
+		t.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(t.retryDelay):
+		}
+	}
+}
+
+// streamOverSSH streams the journal of the Machine with the IP address over SSH.
+func (t *tailer) streamOverSSH(
+	ctx context.Context,
+	ip, cursor string,
+	handler journald.EntryHandler,
+) error {
+	sshClient, err := t.options.dialer.Dial(ctx, ip)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sshClient.Close()
+	}()
+	remote, err := journald.NewRemote(
+		ctx,
+		sshClient,
+		journald.Privilege{Strategy: t.options.privilege},
+	)
+	if err != nil {
+		return err
+	}
+	return journald.StreamLive(ctx, remote, t.options.lines, cursor, handler)
+}
+
+// entryLine serializes the entry as a line of journalctl JSON output. Fields that journalctl
+// serializes as byte arrays, or as arrays of values, are serialized as strings.
+func entryLine(entry journald.Entry) ([]byte, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize journal entry: %w", err)
+	}
+	return append(line, '\n'), nil
+}
+
+// printError prints the error of a stream. The caller must hold mu.
+func (t *tailer) printError(name string, color int, err error) {
+	fmt.Fprintf(t.errOut, "%serror: %s\n", prefix(name, color), err)
+}
+
+// wait waits for every stream to stop.
+func (t *tailer) wait() {
+	for _, cancel := range t.streams {
+		cancel()
+	}
+	t.wg.Wait()
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// tailMachine returns a Machine with the internal IP address, or without an address if ip is
+// empty.
+func tailMachine(name, ip string) unstructured.Unstructured {
+	object := capi.NewUnstructuredMachine(capi.VersionV1Beta1)
+	object.SetNamespace("ns")
+	object.SetName(name)
+	Expect(unstructured.SetNestedField(object.Object, "c", "spec", "clusterName")).To(Succeed())
+	if ip != "" {
+		Expect(unstructured.SetNestedSlice(object.Object, []any{map[string]any{
+			"type":    capi.MachineInternalIP,
+			"address": ip,
+		}}, "status", "addresses")).To(Succeed())
+	}
+	return *object
+}
+
+// streamCall is a call of the streamOnce function of a tailer.
+type streamCall struct {
+	ip, cursor string
+}
+
+var _ = Describe("tailer", func() {
+	var (
+		t       *tailer
+		out     *bytes.Buffer
+		errOut  *bytes.Buffer
+		ctx     context.Context
+		calls   chan streamCall
+		stopped chan string
+	)
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		out, errOut = &bytes.Buffer{}, &bytes.Buffer{}
+		t = newTailer(tailOptions{output: outputCat}, out, true)
+		t.errOut = errOut
+		t.retryDelay = 0
+		calls = make(chan streamCall, 10)
+		stopped = make(chan string, 10)
+		// By default, a stream runs until it is stopped.
+		t.streamOnce = func(
+			ctx context.Context,
+			ip, cursor string,
+			_ journald.EntryHandler,
+		) error {
+			calls <- streamCall{ip: ip, cursor: cursor}
+			<-ctx.Done()
+			stopped <- ip
+			return ctx.Err()
+		}
+	})
+
+	It("starts streams for the new Machines that have an IP address", func() {
+		t.sync(ctx, []unstructured.Unstructured{
+			tailMachine("a", "10.0.0.1"),
+			tailMachine("b", ""),
+		})
+		Eventually(calls).Should(Receive(Equal(streamCall{ip: "10.0.0.1"})))
+		Expect(t.streams).To(HaveLen(1))
+		Expect(t.streams).To(HaveKey("ns/a"))
+
+		// A Machine that is listed again is not streamed again, and a Machine that has an IP
+		// address now is streamed.
+		t.sync(ctx, []unstructured.Unstructured{
+			tailMachine("a", "10.0.0.1"),
+			tailMachine("b", "10.0.0.2"),
+		})
+		Eventually(calls).Should(Receive(Equal(streamCall{ip: "10.0.0.2"})))
+		Consistently(calls, "100ms").ShouldNot(Receive())
+		Expect(t.streams).To(HaveLen(2))
+
+		t.wait()
+		Expect(stopped).To(HaveLen(2))
+	})
+
+	It("stops the streams of Machines that are no longer listed", func() {
+		t.sync(ctx, []unstructured.Unstructured{
+			tailMachine("a", "10.0.0.1"),
+			tailMachine("b", "10.0.0.2"),
+		})
+		Eventually(calls).Should(HaveLen(2))
+
+		t.sync(ctx, []unstructured.Unstructured{tailMachine("b", "10.0.0.2")})
+		Eventually(stopped).Should(Receive(Equal("10.0.0.1")))
+		Expect(t.streams).To(HaveLen(1))
+		Expect(t.streams).To(HaveKey("ns/b"))
+		Consistently(stopped, "100ms").ShouldNot(Receive())
+
+		t.wait()
+	})
+
+	It("keeps the color of a Machine when its stream is started again", func() {
+		t.sync(ctx, []unstructured.Unstructured{
+			tailMachine("a", "10.0.0.1"),
+			tailMachine("b", "10.0.0.2"),
+		})
+		colorA, colorB := t.colors["ns/a"], t.colors["ns/b"]
+		Expect(colorA).NotTo(Equal(colorB))
+		Expect(tailColors).To(ContainElements(colorA, colorB))
+
+		t.sync(ctx, nil)
+		Eventually(stopped).Should(HaveLen(2))
+		t.sync(ctx, []unstructured.Unstructured{
+			tailMachine("c", "10.0.0.3"),
+			tailMachine("b", "10.0.0.2"),
+			tailMachine("a", "10.0.0.1"),
+		})
+		Expect(t.colors["ns/a"]).To(Equal(colorA))
+		Expect(t.colors["ns/b"]).To(Equal(colorB))
+		Expect(t.colors["ns/c"]).NotTo(BeElementOf(colorA, colorB))
+
+		t.wait()
+	})
+
+	It("does not color the Machines without colors", func() {
+		t.useColor = false
+		t.sync(ctx, []unstructured.Unstructured{tailMachine("a", "10.0.0.1")})
+		Expect(t.colors).To(BeEmpty())
+		t.wait()
+	})
+
+	It("resumes a stream that failed after the last printed entry", func() {
+		t.streamOnce = func(
+			ctx context.Context,
+			ip, cursor string,
+			handler journald.EntryHandler,
+		) error {
+			calls <- streamCall{ip: ip, cursor: cursor}
+			if cursor == "" {
+				for _, c := range []string{"c1", "c2"} {
+					handler(ctx, journald.Entry{
+						journald.FieldCursor:  c,
+						journald.FieldMessage: "message " + c,
+					})
+				}
+				return errors.New("connection lost")
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		t.useColor = false
+		t.sync(ctx, []unstructured.Unstructured{tailMachine("a", "10.0.0.1")})
+		Eventually(calls).Should(Receive(Equal(streamCall{ip: "10.0.0.1"})))
+		Eventually(calls).Should(Receive(Equal(streamCall{ip: "10.0.0.1", cursor: "c2"})))
+
+		t.wait()
+		Expect(out.String()).To(Equal("ns/a message c1\nns/a message c2\n"))
+		Expect(errOut.String()).To(Equal("ns/a error: connection lost\n"))
+	})
+})
+
+var _ = Describe("tail", func() {
+	var keyFileName string
+
+	BeforeEach(func() {
+		keyFileName = filepath.Join(GinkgoT().TempDir(), "id")
+		Expect(os.WriteFile(keyFileName, []byte("key"), 0o600)).To(Succeed())
+	})
+
+	DescribeTable("validates its flags",
+		func(modify func(*tailOptions, *string, *string), expectedErr string) {
+			options := tailOptions{
+				selector:  "a=b",
+				output:    outputShort,
+				privilege: journald.PrivilegeSudo,
+			}
+			sshKey, bastionKey := keyFileName, ""
+			modify(&options, &sshKey, &bastionKey)
+			Expect(tail(options, sshKey, bastionKey)).To(MatchError(ContainSubstring(expectedErr)))
+		},
+		Entry("without a selector",
+			func(o *tailOptions, _, _ *string) { o.selector = "" },
+			"-selector is required"),
+		Entry("with an invalid selector",
+			func(o *tailOptions, _, _ *string) { o.selector = "a in (" },
+			"invalid selector"),
+		Entry("with an invalid output format",
+			func(o *tailOptions, _, _ *string) { o.output = "yaml" },
+			`"yaml"`),
+		Entry("with an invalid privilege",
+			func(o *tailOptions, _, _ *string) { o.privilege = "su" },
+			`invalid -privilege "su"`),
+		Entry("without an SSH private key",
+			func(_ *tailOptions, sshKey, _ *string) { *sshKey = "" },
+			"-ssh-private-key is required"),
+		Entry("with an SSH private key that cannot be read",
+			func(_ *tailOptions, sshKey, _ *string) { *sshKey += ".missing" },
+			"unable to read SSH private key file"),
+		Entry("with a bastion, without its SSH private key",
+			func(o *tailOptions, _, _ *string) { o.dialer.BastionHost = "bastion" },
+			"-bastion-ssh-private-key is required"),
+	)
+})
@@ -0,0 +1,358 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// defaultEntriesLimit is the number of entries returned, if the request has no limit.
+const defaultEntriesLimit = 500
+
+// machineStatus is a Machine, and the status of the capture of its journal.
+type machineStatus struct {
+	journald.MachineInfo
+	// Streaming is true if the journal of the Machine is being streamed.
+	Streaming bool `json:"streaming"`
+	// LocalJournalFileSize is the size of the local journal file, in bytes.
+	LocalJournalFileSize int64 `json:"localJournalFileSize"`
+	// LastWritten is when the local journal file was last written to.
+	LastWritten *time.Time `json:"lastWritten,omitempty"`
+	// LatestMilestone is the latest bootstrap milestone of the latest boot.
+	LatestMilestone *timeline.Event `json:"latestMilestone,omitempty"`
+}
+
+func (s *Server) listManagementClusters(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.ManagementClusters))
+	for name := range s.ManagementClusters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	writeJSON(r.Context(), w, struct {
+		ManagementClusters []string `json:"managementClusters"`
+	}{ManagementClusters: names})
+}
+
+func (s *Server) listMachines(w http.ResponseWriter, r *http.Request) {
+	store, directory, err := s.store(r)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusNotFound, err)
+		return
+	}
+	infos, err := store.List()
+	if err != nil {
+		writeError(r.Context(), w, http.StatusInternalServerError, err)
+		return
+	}
+	machines := make([]machineStatus, 0, len(infos))
+	for _, info := range infos {
+		status := machineStatus{MachineInfo: info}
+		if s.Streaming != nil {
+			status.Streaming = s.Streaming(
+				r.PathValue("managementCluster"),
+				info.Namespace,
+				info.Name,
+			)
+		}
+		if journalStatus, err := store.Status(info.Namespace, info.Name); err == nil {
+			status.LocalJournalFileSize = journalStatus.Size
+			status.LastWritten = &journalStatus.LastWritten
+		}
+		t, err := timeline.Load(timeline.FilePath(directory, info.Namespace, info.Name))
+		if err == nil {
+			if boot := t.LatestBoot(); boot != nil && len(boot.Events) > 0 {
+				status.LatestMilestone = &boot.Events[len(boot.Events)-1]
+			}
+		}
+		machines = append(machines, status)
+	}
+	writeJSON(r.Context(), w, struct {
+		Machines []machineStatus `json:"machines"`
+	}{Machines: machines})
+}
+
+func (s *Server) listBoots(w http.ResponseWriter, r *http.Request) {
+	store, _, err := s.store(r)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusNotFound, err)
+		return
+	}
+	bootIDs, err := journald.ReadBootIDs(
+		r.Context(),
+		store,
+		r.PathValue("namespace"),
+		r.PathValue("name"),
+	)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusInternalServerError, err)
+		return
+	}
+	if bootIDs == nil {
+		bootIDs = []string{}
+	}
+	writeJSON(r.Context(), w, struct {
+		Boots []string `json:"boots"`
+	}{Boots: bootIDs})
+}
+
+// listEntries returns the latest entries of the Machine that match the unit, priority, boot and
+// grep parameters, oldest first, and the cursor of the last entry of the journal, whether it
+// matches or not. With follow=true, it instead streams the matching entries after the
+// entry with the after cursor as server-sent events, until the request is cancelled.
+func (s *Server) listEntries(w http.ResponseWriter, r *http.Request) {
+	store, _, err := s.store(r)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusNotFound, err)
+		return
+	}
+	namespace, name := r.PathValue("namespace"), r.PathValue("name")
+	params := r.URL.Query()
+	filter, err := entriesFilter(params, func() ([]string, error) {
+		return journald.ReadBootIDs(r.Context(), store, namespace, name)
+	})
+	if err != nil {
+		writeError(r.Context(), w, http.StatusBadRequest, err)
+		return
+	}
+
+	if params.Get("follow") == "true" {
+		followEntries(w, r, store.Reader(namespace, name, params.Get("after")), filter)
+		return
+	}
+
+	limit := defaultEntriesLimit
+	if value := params.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(
+				r.Context(),
+				w,
+				http.StatusBadRequest,
+				fmt.Errorf("invalid limit %q, expected a positive integer", value),
+			)
+			return
+		}
+	}
+	entries, cursor, err := journald.LatestEntries(
+		r.Context(),
+		store,
+		namespace,
+		name,
+		filter,
+		limit,
+	)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(r.Context(), w, struct {
+		Entries []journald.Entry `json:"entries"`
+		Cursor  string           `json:"cursor"`
+	}{Entries: entries, Cursor: cursor})
+}
+
+// entriesFilter returns the filter of the unit, priority, boot and grep parameters. The boot is
+// an ID, or an offset into the boot IDs that bootIDs returns, as with the logs subcommand. If
+// bootIDs is nil, the boot can only be an ID.
+func entriesFilter(
+	params url.Values,
+	bootIDs func() ([]string, error),
+) (journald.Filter, error) {
+	var err error
+	filter := journald.NewFilter()
+	for _, unit := range params["unit"] {
+		if unit != "" {
+			filter.Units = append(filter.Units, journald.ParseUnit(unit))
+		}
+	}
+	if priority := params.Get("priority"); priority != "" {
+		filter.MinPriority, filter.MaxPriority, err = journald.ParsePriority(priority)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if boot := params.Get("boot"); boot != "" && bootIDs == nil {
+		filter.BootIDs = []string{strings.ReplaceAll(boot, "-", "")}
+	} else if boot != "" {
+		ids, err := bootIDs()
+		if err != nil {
+			return filter, err
+		}
+		if filter.BootIDs, err = journald.ParseBoot(boot, ids); err != nil {
+			return filter, err
+		}
+	}
+	if grep := params.Get("grep"); grep != "" {
+		if filter.Grep, err = journald.CompileGrep(grep); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// followEntries streams the entries that the reader reads that match the filter, as server-sent
+// events, until the request is cancelled. It closes the reader.
+func followEntries(
+	w http.ResponseWriter,
+	r *http.Request,
+	reader journald.Reader,
+	filter journald.Filter,
+) {
+	defer func() {
+		_ = reader.Close()
+	}()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(
+			r.Context(),
+			w,
+			http.StatusInternalServerError,
+			fmt.Errorf("streaming is not supported"),
+		)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		entry, err := reader.Next(r.Context(), true)
+		if err != nil {
+			if r.Context().Err() == nil {
+				logf.FromContext(r.Context()).Error(err, "failed to follow journal")
+			}
+			return
+		}
+		if !filter.Match(entry) {
+			continue
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			// The client is gone.
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// listClusterEntries exports the entries of every Machine of the Cluster that match the unit,
+// priority, boot and grep parameters, as JSON lines, in the order they were logged. The timestamps
+// of every Machine are corrected by its clock offset, and every entry is annotated with its
+// Machine, and its corrected timestamp. With the limit parameter, only the latest entries are
+// exported.
+func (s *Server) listClusterEntries(w http.ResponseWriter, r *http.Request) {
+	store, _, err := s.store(r)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusNotFound, err)
+		return
+	}
+	params := r.URL.Query()
+	filter, err := entriesFilter(params, nil)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusBadRequest, err)
+		return
+	}
+	limit := 0
+	if value := params.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(
+				r.Context(),
+				w,
+				http.StatusBadRequest,
+				fmt.Errorf("invalid limit %q, expected a positive integer", value),
+			)
+			return
+		}
+	}
+
+	infos, err := store.List()
+	if err != nil {
+		writeError(r.Context(), w, http.StatusInternalServerError, err)
+		return
+	}
+	var machines []journald.MachineInfo
+	var readers []journald.Reader
+	for _, info := range infos {
+		if info.Namespace != r.PathValue("namespace") || info.Cluster != r.PathValue("cluster") {
+			continue
+		}
+		if _, err := store.Status(info.Namespace, info.Name); err != nil {
+			// The journal of the Machine has not been streamed yet.
+			continue
+		}
+		machines = append(machines, info)
+		readers = append(readers, store.Reader(info.Namespace, info.Name, ""))
+	}
+	if len(machines) == 0 {
+		writeError(
+			r.Context(),
+			w,
+			http.StatusNotFound,
+			fmt.Errorf("no machines of cluster %s/%s found: %w",
+				r.PathValue("namespace"), r.PathValue("cluster"), os.ErrNotExist),
+		)
+		return
+	}
+
+	// Without a limit, entries are written as they are read, so that large exports are not held
+	// in memory.
+	var latest [][]byte
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	err = journald.Merge(
+		r.Context(),
+		readers,
+		machines,
+		filter,
+		func(i int, entry journald.Entry) error {
+			entry[journald.FieldMachine] = machines[i].Namespace + "/" + machines[i].Name
+			entry[journald.FieldCorrectedRealtimeTimestamp] = strconv.FormatInt(
+				machines[i].CorrectTime(entry).UnixMicro(),
+				10,
+			)
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return fmt.Errorf("failed to serialize entry: %w", err)
+			}
+			line = append(line, '\n')
+			if limit == 0 {
+				_, err = w.Write(line)
+				return err
+			}
+			latest = append(latest, line)
+			if len(latest) >= 2*limit {
+				latest = append(latest[:0], latest[len(latest)-limit:]...)
+			}
+			return nil
+		},
+	)
+	if err != nil && limit != 0 {
+		writeError(r.Context(), w, http.StatusInternalServerError, err)
+		return
+	}
+	if err != nil {
+		// Entries were already written, so the status can no longer be changed.
+		logf.FromContext(r.Context()).Error(err, "failed to export cluster entries")
+		return
+	}
+	if len(latest) > limit {
+		latest = latest[len(latest)-limit:]
+	}
+	for _, line := range latest {
+		if _, err := w.Write(line); err != nil {
+			return
+		}
+	}
+}
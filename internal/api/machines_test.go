@@ -0,0 +1,327 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/dlipovetsky/machine-monitor/internal/api"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+)
+
+var base = time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+
+// entryLine returns a line of journalctl JSON output, of an entry logged seconds after base.
+func entryLine(cursor, bootID, unit, priority string, seconds int) string {
+	line, err := json.Marshal(journald.Entry{
+		journald.FieldCursor: cursor,
+		journald.FieldRealtimeTimestamp: strconv.FormatInt(
+			base.Add(time.Duration(seconds)*time.Second).UnixMicro(),
+			10,
+		),
+		journald.FieldBootID:      bootID,
+		journald.FieldSystemdUnit: unit,
+		journald.FieldPriority:    priority,
+		journald.FieldMessage:     "message " + cursor,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return string(line) + "\n"
+}
+
+// appendLines appends the lines to the journal of the Machine.
+func appendLines(store journald.Store, name string, lines ...string) {
+	appender, err := store.Open("ns", name)
+	Expect(err).NotTo(HaveOccurred())
+	_, err = appender.Write([]byte(strings.Join(lines, "")))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(appender.Close()).To(Succeed())
+}
+
+// entriesResponse is the response of the entries endpoint.
+type entriesResponse struct {
+	Entries []journald.Entry `json:"entries"`
+	Cursor  string           `json:"cursor"`
+}
+
+func cursors(entries []journald.Entry) []string {
+	c := []string{}
+	for _, entry := range entries {
+		c = append(c, entry.Cursor())
+	}
+	return c
+}
+
+var _ = Describe("Server", func() {
+	var (
+		store  *journald.FileStore
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		directory := GinkgoT().TempDir()
+		store = &journald.FileStore{Directory: directory}
+		s := &api.Server{
+			LocalJournalDirectory: directory,
+			Stores:                map[string]journald.Store{"": store},
+			Streaming: func(managementCluster, namespace, name string) bool {
+				return managementCluster == "" && namespace == "ns" && name == "a"
+			},
+		}
+		server = httptest.NewServer(s.Handler())
+		DeferCleanup(server.Close)
+
+		for _, info := range []journald.MachineInfo{
+			{Namespace: "ns", Name: "a", Cluster: "c"},
+			{Namespace: "ns", Name: "b", Cluster: "c"},
+		} {
+			Expect(store.PutMachineInfo(info)).To(Succeed())
+		}
+		appendLines(store, "a",
+			entryLine("a-1", "boot1", "kubelet.service", "6", 1),
+			entryLine("a-2", "boot1", "containerd.service", "3", 2),
+			entryLine("a-3", "boot2", "kubelet.service", "3", 3),
+			entryLine("a-4", "boot2", "containerd.service", "6", 4),
+		)
+	})
+
+	// get sends a GET request, and decodes the JSON response into v. It returns the status.
+	get := func(path string, v any) int {
+		resp, err := http.Get(server.URL + path)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			Expect(resp.Body.Close()).To(Succeed())
+		}()
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(json.NewDecoder(resp.Body).Decode(v)).To(Succeed())
+		return resp.StatusCode
+	}
+
+	// getEntries returns the entries of Machine a that the query selects.
+	getEntries := func(query url.Values) entriesResponse {
+		response := entriesResponse{}
+		Expect(get("/api/v1/namespaces/ns/machines/a/entries?"+query.Encode(), &response)).
+			To(Equal(http.StatusOK))
+		return response
+	}
+
+	// getError returns the status and the error of a request that fails.
+	getError := func(path string) (int, string) {
+		response := struct {
+			Error string `json:"error"`
+		}{}
+		status := get(path, &response)
+		return status, response.Error
+	}
+
+	It("lists the machines, and the status of their journals", func() {
+		t := &timeline.Timeline{}
+		t.Record("boot2", timeline.KubeletStarted, base.Add(3*time.Second))
+		Expect(t.Save(timeline.FilePath(store.Directory, "ns", "a"))).To(Succeed())
+
+		response := struct {
+			Machines []struct {
+				Namespace            string          `json:"namespace"`
+				Name                 string          `json:"name"`
+				Cluster              string          `json:"cluster"`
+				Streaming            bool            `json:"streaming"`
+				LocalJournalFileSize int64           `json:"localJournalFileSize"`
+				LastWritten          *time.Time      `json:"lastWritten"`
+				LatestMilestone      *timeline.Event `json:"latestMilestone"`
+			} `json:"machines"`
+		}{}
+		Expect(get("/api/v1/machines", &response)).To(Equal(http.StatusOK))
+		Expect(response.Machines).To(HaveLen(2))
+
+		a := response.Machines[0]
+		Expect(a.Name).To(Equal("a"))
+		Expect(a.Cluster).To(Equal("c"))
+		Expect(a.Streaming).To(BeTrue())
+		status, err := store.Status("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.LocalJournalFileSize).To(Equal(status.Size))
+		Expect(a.LastWritten).NotTo(BeNil())
+		Expect(a.LatestMilestone).NotTo(BeNil())
+		Expect(a.LatestMilestone.Milestone).To(Equal(timeline.KubeletStarted))
+
+		// Machine b has no journal yet.
+		b := response.Machines[1]
+		Expect(b.Name).To(Equal("b"))
+		Expect(b.Streaming).To(BeFalse())
+		Expect(b.LocalJournalFileSize).To(BeZero())
+		Expect(b.LastWritten).To(BeNil())
+		Expect(b.LatestMilestone).To(BeNil())
+	})
+
+	It("lists the boots of a machine", func() {
+		response := struct {
+			Boots []string `json:"boots"`
+		}{}
+		Expect(get("/api/v1/namespaces/ns/machines/a/boots", &response)).To(Equal(http.StatusOK))
+		Expect(response.Boots).To(Equal([]string{"boot1", "boot2"}))
+
+		Expect(get("/api/v1/namespaces/ns/machines/b/boots", &response)).To(Equal(http.StatusOK))
+		Expect(response.Boots).To(BeEmpty())
+		Expect(response.Boots).NotTo(BeNil())
+	})
+
+	DescribeTable("lists the latest matching entries of a machine, and the latest cursor",
+		func(query url.Values, expected []string) {
+			response := getEntries(query)
+			Expect(cursors(response.Entries)).To(Equal(expected))
+			Expect(response.Cursor).To(Equal("a-4"))
+		},
+		Entry("every entry", url.Values{}, []string{"a-1", "a-2", "a-3", "a-4"}),
+		Entry("with a limit", url.Values{"limit": {"2"}}, []string{"a-3", "a-4"}),
+		Entry("of a unit", url.Values{"unit": {"kubelet"}}, []string{"a-1", "a-3"}),
+		Entry("of units", url.Values{"unit": {"kubelet", "containerd"}},
+			[]string{"a-1", "a-2", "a-3", "a-4"}),
+		Entry("of a priority", url.Values{"priority": {"err"}}, []string{"a-2", "a-3"}),
+		Entry("of a boot offset", url.Values{"boot": {"-1"}}, []string{"a-1", "a-2"}),
+		Entry("of a boot ID", url.Values{"boot": {"boot2"}}, []string{"a-3", "a-4"}),
+		Entry("matching a pattern", url.Values{"grep": {"A-[24]"}}, []string{}),
+		Entry("matching a pattern, ignoring case", url.Values{"grep": {"a-[24]"}},
+			[]string{"a-2", "a-4"}),
+		Entry("of several filters, with a limit",
+			url.Values{"unit": {"containerd"}, "boot": {"0"}, "limit": {"1"}},
+			[]string{"a-4"}),
+	)
+
+	It("lists no entries of a machine without a journal", func() {
+		response := entriesResponse{}
+		Expect(get("/api/v1/namespaces/ns/machines/b/entries", &response)).
+			To(Equal(http.StatusOK))
+		Expect(response.Entries).To(BeEmpty())
+		Expect(response.Entries).NotTo(BeNil())
+		Expect(response.Cursor).To(BeEmpty())
+	})
+
+	It("lists the entries of rotated journal files", func() {
+		Expect(store.Rotate("ns", "a")).To(Succeed())
+		appendLines(store, "a", entryLine("a-5", "boot2", "kubelet.service", "6", 5))
+		response := getEntries(url.Values{"limit": {"3"}})
+		Expect(cursors(response.Entries)).To(Equal([]string{"a-3", "a-4", "a-5"}))
+		Expect(response.Cursor).To(Equal("a-5"))
+	})
+
+	DescribeTable("rejects invalid requests",
+		func(path string, expectedStatus int, expectedError string) {
+			status, err := getError(path)
+			Expect(status).To(Equal(expectedStatus))
+			Expect(err).To(ContainSubstring(expectedError))
+		},
+		Entry("a limit that is not a number",
+			"/api/v1/namespaces/ns/machines/a/entries?limit=all",
+			http.StatusBadRequest, `invalid limit "all"`),
+		Entry("a limit that is not positive",
+			"/api/v1/namespaces/ns/machines/a/entries?limit=0",
+			http.StatusBadRequest, `invalid limit "0"`),
+		Entry("an invalid priority",
+			"/api/v1/namespaces/ns/machines/a/entries?priority=loud",
+			http.StatusBadRequest, `invalid priority "loud"`),
+		Entry("a boot that is not found",
+			"/api/v1/namespaces/ns/machines/a/entries?boot=-5",
+			http.StatusBadRequest, "boot offset -5 not found"),
+		Entry("an invalid pattern",
+			"/api/v1/namespaces/ns/machines/a/entries?grep=(",
+			http.StatusBadRequest, "invalid grep pattern"),
+		Entry("a namespace that escapes the local journal directory",
+			"/api/v1/namespaces/%2E%2E/machines/a/timeline",
+			http.StatusBadRequest, `invalid namespace ".."`),
+		Entry("a name with a slash",
+			"/api/v1/namespaces/ns/machines/..%2F..%2Fetc/entries",
+			http.StatusBadRequest, `invalid name "../../etc"`),
+		Entry("a cluster that is not a valid name",
+			"/api/v1/namespaces/ns/clusters/C_1/entries",
+			http.StatusBadRequest, `invalid cluster "C_1"`),
+		Entry("an unknown management cluster",
+			"/api/v1/managementclusters/other/machines",
+			http.StatusNotFound, `management cluster "other"`),
+	)
+
+	It("reads the journals of each management cluster from its Store", func() {
+		directory := GinkgoT().TempDir()
+		mcStore := &journald.FileStore{Directory: directory}
+		appendLines(mcStore, "x", entryLine("x-1", "boot3", "kubelet.service", "6", 1))
+		s := &api.Server{
+			ManagementClusters: map[string]string{"mc": directory, "nostore": directory},
+			Stores:             map[string]journald.Store{"mc": mcStore},
+		}
+		mcServer := httptest.NewServer(s.Handler())
+		defer mcServer.Close()
+		bootsURL := func(managementCluster string) string {
+			return mcServer.URL + "/api/v1/managementclusters/" + managementCluster +
+				"/namespaces/ns/machines/x/boots"
+		}
+
+		resp, err := http.Get(bootsURL("mc"))
+		Expect(err).NotTo(HaveOccurred())
+		response := struct {
+			Boots []string `json:"boots"`
+		}{}
+		Expect(json.NewDecoder(resp.Body).Decode(&response)).To(Succeed())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Boots).To(Equal([]string{"boot3"}))
+
+		resp, err = http.Get(bootsURL("nostore"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Body.Close()).To(Succeed())
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("follows the matching entries after the cursor", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		query := url.Values{"follow": {"true"}, "after": {"a-2"}, "unit": {"kubelet"}}
+		req, err := http.NewRequestWithContext(
+			ctx,
+			http.MethodGet,
+			server.URL+"/api/v1/namespaces/ns/machines/a/entries?"+query.Encode(),
+			nil,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(resp.Body.Close)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+		events := make(chan string)
+		go func() {
+			defer GinkgoRecover()
+			defer close(events)
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+				if !ok {
+					continue
+				}
+				entry := journald.Entry{}
+				Expect(json.Unmarshal([]byte(data), &entry)).To(Succeed())
+				select {
+				case events <- entry.Cursor():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		Eventually(events).Should(Receive(Equal("a-3")))
+		appendLines(store, "a",
+			entryLine("a-5", "boot2", "containerd.service", "6", 5),
+			entryLine("a-6", "boot2", "kubelet.service", "6", 6),
+		)
+		Eventually(events, 5*time.Second).Should(Receive(Equal("a-6")))
+		Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+	})
+})
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/bundle"
+	"github.com/dlipovetsky/machine-monitor/internal/index"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+	"k8s.io/apimachinery/pkg/util/validation"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Server serves a read-only HTTP API for the data that machine-monitor collects.
+// It implements the controller-runtime manager.Runnable interface.
+type Server struct {
+	BindAddress string
+	// LocalJournalDirectory is the directory of the local journal files, if machine-monitor
+	// monitors only one management cluster.
+	LocalJournalDirectory string
+	// ManagementClusters maps the name of each management cluster to the directory of its local
+	// journal files, if machine-monitor monitors more than one management cluster.
+	ManagementClusters map[string]string
+	// Stores maps the name of each management cluster to the Store of its journals, i.e. the
+	// Store that its reconciler appends to. The name is empty if only one management cluster is
+	// monitored.
+	Stores map[string]journald.Store
+	// Streaming, if not nil, returns true if the journal of the Machine of the management cluster
+	// is being streamed. The management cluster is empty if only one is monitored.
+	Streaming func(managementCluster, namespace, name string) bool
+	// Objects maps the name of each management cluster to the function that reads the Kubernetes
+	// objects of its Machines for support bundles. The name is empty if only one management
+	// cluster is monitored. If a management cluster has no function, bundles have no objects.
+	// The API has no authentication, so objects are only served if enabled explicitly.
+	Objects map[string]bundle.ObjectsFunc
+}
+
+// NeedLeaderElection implements the controller-runtime manager.LeaderElectionRunnable interface.
+// The API serves local data, so it runs whether or not this process is the leader.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+// Start serves the API until the context is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	log := logf.FromContext(ctx).WithName("api")
+
+	listener, err := net.Listen("tcp", s.BindAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.BindAddress, err)
+	}
+
+	server := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return logf.IntoContext(context.Background(), log)
+		},
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Info("serving API", "address", listener.Addr().String())
+		errCh <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("failed to serve API: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down API server: %w", err)
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler for the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	// Every path is served both for the single management cluster, and, prefixed with the
+	// management cluster, for each of several management clusters.
+	handle := func(pattern string, handler http.HandlerFunc) {
+		method, path, _ := strings.Cut(pattern, " ")
+		handler = validateObjectNames(handler)
+		mux.HandleFunc(method+" /api/v1"+path, handler)
+		mux.HandleFunc(method+" /api/v1/managementclusters/{managementCluster}"+path, handler)
+	}
+	mux.HandleFunc("GET /api/v1/managementclusters", s.listManagementClusters)
+	handle("GET /machines", s.listMachines)
+	handle("GET /namespaces/{namespace}/machines/{name}/boots", s.listBoots)
+	handle("GET /namespaces/{namespace}/machines/{name}/entries", s.listEntries)
+	handle("GET /namespaces/{namespace}/machines/{name}/timeline", s.getTimeline)
+	handle("GET /namespaces/{namespace}/clusters/{cluster}/entries", s.listClusterEntries)
+	handle("GET /namespaces/{namespace}/clusters/{cluster}/bundle", s.getBundle)
+	handle("GET /search", s.search)
+	mux.Handle("GET /", uiHandler())
+	return mux
+}
+
+// objectNamePathValues are the path values that name Kubernetes objects.
+var objectNamePathValues = []string{"namespace", "name", "cluster"}
+
+// validateObjectNames responds with 400 Bad Request if a path value that names a Kubernetes object
+// is not a valid name. The names are used in the paths of local files, so that a name like ".."
+// could otherwise read files outside the local journal directory.
+func validateObjectNames(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range objectNamePathValues {
+			if !strings.Contains(r.Pattern, "{"+key+"}") {
+				continue
+			}
+			value := r.PathValue(key)
+			if errs := validation.IsDNS1123Subdomain(value); len(errs) > 0 {
+				writeError(
+					r.Context(),
+					w,
+					http.StatusBadRequest,
+					fmt.Errorf("invalid %s %q: %s", key, value, strings.Join(errs, ", ")),
+				)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// localJournalDirectory returns the directory of the local journal files of the management
+// cluster in the request path.
+func (s *Server) localJournalDirectory(r *http.Request) (string, error) {
+	managementCluster := r.PathValue("managementCluster")
+	if managementCluster == "" {
+		if s.LocalJournalDirectory == "" {
+			return "", fmt.Errorf(
+				"more than one management cluster is monitored, the path must include one: %w",
+				os.ErrNotExist,
+			)
+		}
+		return s.LocalJournalDirectory, nil
+	}
+	directory, ok := s.ManagementClusters[managementCluster]
+	if !ok {
+		return "", fmt.Errorf("management cluster %q: %w", managementCluster, os.ErrNotExist)
+	}
+	return directory, nil
+}
+
+// store returns the Store of the journals of the management cluster in the request path, and the
+// directory of its local journal files.
+func (s *Server) store(r *http.Request) (journald.Store, string, error) {
+	directory, err := s.localJournalDirectory(r)
+	if err != nil {
+		return nil, "", err
+	}
+	managementCluster := r.PathValue("managementCluster")
+	store, ok := s.Stores[managementCluster]
+	if !ok {
+		return nil, "", fmt.Errorf(
+			"management cluster %q has no journal store: %w",
+			managementCluster,
+			os.ErrNotExist,
+		)
+	}
+	return store, directory, nil
+}
+
+func (s *Server) getTimeline(w http.ResponseWriter, r *http.Request) {
+	directory, err := s.localJournalDirectory(r)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusNotFound, err)
+		return
+	}
+	t, err := timeline.Load(timeline.FilePath(
+		directory,
+		r.PathValue("namespace"),
+		r.PathValue("name"),
+	))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(r.Context(), w, http.StatusNotFound, err)
+			return
+		}
+		writeError(r.Context(), w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(r.Context(), w, t)
+}
+
+// search searches the indexes of the journals of every Machine. The query is in the q parameter,
+// in the syntax of index.ParseQuery. The since and until parameters are RFC 3339 times, and the
+// limit parameter is the maximum number of results, which are returned latest first.
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	store, directory, err := s.store(r)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusNotFound, err)
+		return
+	}
+	params := r.URL.Query()
+	query, err := index.ParseQuery(params.Get("q"))
+	if err != nil {
+		writeError(r.Context(), w, http.StatusBadRequest, err)
+		return
+	}
+	for name, t := range map[string]*time.Time{
+		"since": &query.Filter.Since,
+		"until": &query.Filter.Until,
+	} {
+		if value := params.Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				err = fmt.Errorf("invalid %s: %w", name, err)
+				writeError(r.Context(), w, http.StatusBadRequest, err)
+				return
+			}
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit <= 0 {
+			writeError(
+				r.Context(),
+				w,
+				http.StatusBadRequest,
+				fmt.Errorf("invalid limit %q, expected a positive integer", value),
+			)
+			return
+		}
+	}
+	results, err := index.Search(store, directory, query)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusInternalServerError, err)
+		return
+	}
+	if results == nil {
+		results = []index.Result{}
+	}
+	writeJSON(r.Context(), w, struct {
+		Results []index.Result `json:"results"`
+	}{Results: results})
+}
+
+// getBundle returns the support bundle of the Cluster, as a gzipped tar archive. The since and
+// until parameters are RFC 3339 times that select the journal entries.
+func (s *Server) getBundle(w http.ResponseWriter, r *http.Request) {
+	store, directory, err := s.store(r)
+	if err != nil {
+		writeError(r.Context(), w, http.StatusNotFound, err)
+		return
+	}
+	managementCluster := r.PathValue("managementCluster")
+	options := bundle.Options{
+		Store:     store,
+		Directory: directory,
+		Namespace: r.PathValue("namespace"),
+		Cluster:   r.PathValue("cluster"),
+		Objects:   s.Objects[managementCluster],
+	}
+	params := r.URL.Query()
+	for name, t := range map[string]*time.Time{
+		"since": &options.Since,
+		"until": &options.Until,
+	} {
+		if value := params.Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				err = fmt.Errorf("invalid %s: %w", name, err)
+				writeError(r.Context(), w, http.StatusBadRequest, err)
+				return
+			}
+		}
+	}
+	if s.Streaming != nil {
+		options.Streaming = func(namespace, name string) bool {
+			return s.Streaming(managementCluster, namespace, name)
+		}
+	}
+	options.Machines, err = bundle.Machines(store, options.Namespace, options.Cluster)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(r.Context(), w, http.StatusNotFound, err)
+			return
+		}
+		writeError(r.Context(), w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", bundle.FileName(options.Namespace, options.Cluster)),
+	)
+	if err := bundle.Write(r.Context(), w, options); err != nil {
+		// The response has started, so the error can only be logged. The archive is incomplete,
+		// and fails to extract.
+		logf.FromContext(r.Context()).Error(err, "failed to write bundle")
+	}
+}
+
+func writeJSON(ctx context.Context, w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logf.FromContext(ctx).Error(err, "failed to write response")
+	}
+}
+
+func writeError(ctx context.Context, w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encodeErr := json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+	if encodeErr != nil {
+		logf.FromContext(ctx).Error(encodeErr, "failed to write response")
+	}
+}
@@ -0,0 +1,23 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// ui holds the static assets of the web UI. The UI only uses the API, so it needs no build step,
+// and no external resources.
+//
+//go:embed ui
+var ui embed.FS
+
+// uiHandler serves the web UI.
+func uiHandler() http.Handler {
+	assets, err := fs.Sub(ui, "ui")
+	if err != nil {
+		// The embedded directory always exists.
+		panic(err)
+	}
+	return http.FileServerFS(assets)
+}
@@ -0,0 +1,384 @@
+"use strict";
+
+// The web UI of machine-monitor. It only uses the API that serves it.
+
+const machinesRefreshInterval = 10000;
+const clusterEntriesLimit = 1000;
+const priorityNames = ["emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"];
+
+const state = {
+  managementCluster: "",
+  machine: null,
+  cluster: null,
+  cursor: "",
+  events: null,
+  highlight: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+function apiBase() {
+  if (state.managementCluster === "") {
+    return "/api/v1";
+  }
+  return "/api/v1/managementclusters/" + encodeURIComponent(state.managementCluster);
+}
+
+function clusterPath(cluster) {
+  return apiBase() + "/namespaces/" + encodeURIComponent(cluster.namespace) +
+    "/clusters/" + encodeURIComponent(cluster.name);
+}
+
+function machinePath(machine) {
+  return apiBase() + "/namespaces/" + encodeURIComponent(machine.namespace) +
+    "/machines/" + encodeURIComponent(machine.name);
+}
+
+async function getJSON(url) {
+  const response = await fetch(url);
+  const body = await response.json();
+  if (!response.ok) {
+    throw new Error(body.error || response.statusText);
+  }
+  return body;
+}
+
+function showError(err) {
+  $("error").textContent = err ? String(err.message || err) : "";
+  $("error").hidden = !err;
+}
+
+function element(tag, className, text) {
+  const e = document.createElement(tag);
+  if (className) {
+    e.className = className;
+  }
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  return e;
+}
+
+// Management clusters
+
+async function loadManagementClusters() {
+  const body = await getJSON("/api/v1/managementclusters");
+  if (body.managementClusters.length === 0) {
+    return;
+  }
+  const select = $("management-cluster");
+  for (const name of body.managementClusters) {
+    select.append(new Option(name, name));
+  }
+  state.managementCluster = body.managementClusters[0];
+  $("management-cluster-label").hidden = false;
+  select.addEventListener("change", () => {
+    state.managementCluster = select.value;
+    selectMachine(null);
+    loadMachines();
+  });
+}
+
+// Machines
+
+// groupMachines groups the Machines by Cluster, and then by MachineDeployment.
+function groupMachines(machines) {
+  const clusters = new Map();
+  for (const machine of machines) {
+    const key = machine.namespace + "/" + (machine.cluster || "(no Cluster)");
+    if (!clusters.has(key)) {
+      clusters.set(key, {
+        cluster: machine.cluster ? { namespace: machine.namespace, name: machine.cluster } : null,
+        deployments: new Map(),
+      });
+    }
+    const deployments = clusters.get(key).deployments;
+    const deployment = machine.machineDeployment || "(no MachineDeployment)";
+    if (!deployments.has(deployment)) {
+      deployments.set(deployment, []);
+    }
+    deployments.get(deployment).push(machine);
+  }
+  return clusters;
+}
+
+function describeStatus(machine) {
+  const details = [machine.streaming ? "streaming" : "not streaming"];
+  if (machine.lastWritten) {
+    details.push("written " + new Date(machine.lastWritten).toLocaleString());
+  }
+  if (machine.latestMilestone) {
+    details.push(machine.latestMilestone.milestone);
+  }
+  return details.join(" · ");
+}
+
+async function loadMachines() {
+  let body;
+  try {
+    body = await getJSON(apiBase() + "/machines");
+  } catch (err) {
+    showError(err);
+    return;
+  }
+  const nav = $("machines");
+  nav.replaceChildren();
+  if (body.machines.length === 0) {
+    nav.append(element("p", "empty", "No Machines found."));
+    return;
+  }
+  for (const [key, { cluster, deployments }] of groupMachines(body.machines)) {
+    const heading = element("h3", "", key);
+    if (cluster) {
+      heading.classList.add("cluster");
+      heading.title = "Show the entries of every Machine of the Cluster";
+      if (state.cluster && state.cluster.namespace === cluster.namespace &&
+        state.cluster.name === cluster.name) {
+        heading.classList.add("selected");
+      }
+      heading.addEventListener("click", () => {
+        for (const selected of nav.querySelectorAll(".selected")) {
+          selected.classList.remove("selected");
+        }
+        heading.classList.add("selected");
+        selectCluster(cluster);
+      });
+    }
+    nav.append(heading);
+    for (const [deployment, machines] of deployments) {
+      nav.append(element("h4", "", deployment));
+      const list = element("ul");
+      for (const machine of machines) {
+        const item = element("li");
+        const status = element("span", "status" + (machine.streaming ? " streaming" : ""));
+        status.title = machine.streaming ? "streaming" : "not streaming";
+        item.append(status, machine.name, element("span", "details", describeStatus(machine)));
+        if (state.machine && state.machine.namespace === machine.namespace &&
+          state.machine.name === machine.name) {
+          item.classList.add("selected");
+        }
+        item.addEventListener("click", () => {
+          for (const selected of nav.querySelectorAll(".selected")) {
+            selected.classList.remove("selected");
+          }
+          item.classList.add("selected");
+          selectMachine(machine);
+        });
+        list.append(item);
+      }
+      nav.append(list);
+    }
+  }
+}
+
+// Journal
+
+function filterParams() {
+  const params = new URLSearchParams();
+  for (const unit of $("units").value.split(",")) {
+    if (unit.trim() !== "") {
+      params.append("unit", unit.trim());
+    }
+  }
+  for (const id of ["priority", "boot", "grep"]) {
+    if ($(id).value !== "") {
+      params.set(id, $(id).value);
+    }
+  }
+  return params;
+}
+
+function compileHighlight() {
+  const pattern = $("highlight").value;
+  if (pattern === "") {
+    return null;
+  }
+  try {
+    return new RegExp(pattern, "i");
+  } catch (err) {
+    showError(err);
+    return null;
+  }
+}
+
+function entryRow(entry) {
+  const row = element("tr");
+  const priority = Number(entry.PRIORITY);
+  if (priority <= 3) {
+    row.classList.add("error");
+  } else if (priority === 4) {
+    row.classList.add("warning");
+  }
+  if (!Number.isNaN(priority)) {
+    row.title = priorityNames[priority] || "";
+  }
+  const message = entry.MESSAGE || "";
+  if (state.highlight && state.highlight.test(message)) {
+    row.classList.add("highlight");
+  }
+  // The entries of a Cluster are shown at their timestamps corrected for clock skew.
+  const timestamp = entry.MM_CORRECTED_REALTIME_TIMESTAMP || entry.__REALTIME_TIMESTAMP;
+  const time = new Date(Number(timestamp) / 1000);
+  let identifier = entry.SYSLOG_IDENTIFIER || entry._COMM || "";
+  if (entry._PID) {
+    identifier += "[" + entry._PID + "]";
+  }
+  row.append(element("td", "time", time.toLocaleString()));
+  if (entry.MM_MACHINE) {
+    row.append(element("td", "machine", entry.MM_MACHINE));
+  }
+  row.append(
+    element("td", "identifier", identifier),
+    element("td", "message", message),
+  );
+  return row;
+}
+
+function appendEntries(entries) {
+  const container = $("entries-container");
+  const atBottom = container.scrollHeight - container.scrollTop - container.clientHeight < 20;
+  const body = $("entries").tBodies[0];
+  for (const entry of entries) {
+    body.append(entryRow(entry));
+  }
+  if (atBottom) {
+    container.scrollTop = container.scrollHeight;
+  }
+}
+
+function stopFollowing() {
+  if (state.events) {
+    state.events.close();
+    state.events = null;
+  }
+}
+
+function follow(machine, params) {
+  params.set("follow", "true");
+  params.set("after", state.cursor);
+  state.events = new EventSource(machinePath(machine) + "/entries?" + params);
+  state.events.onmessage = (event) => {
+    const entry = JSON.parse(event.data);
+    state.cursor = entry.__CURSOR;
+    appendEntries([entry]);
+  };
+  // EventSource would reconnect after the first cursor, so it reconnects after the latest one.
+  state.events.onerror = () => {
+    stopFollowing();
+    setTimeout(() => {
+      if (state.machine === machine && $("follow").checked && !state.events) {
+        follow(machine, params);
+      }
+    }, 2000);
+  };
+}
+
+// loadClusterEntries shows the latest entries of every Machine of the Cluster, interleaved in the
+// order they were logged.
+async function loadClusterEntries(cluster, params) {
+  params.set("limit", clusterEntriesLimit);
+  const response = await fetch(clusterPath(cluster) + "/entries?" + params);
+  if (!response.ok) {
+    const body = await response.json();
+    throw new Error(body.error || response.statusText);
+  }
+  const text = await response.text();
+  if (cluster !== state.cluster) {
+    return;
+  }
+  const entries = text.split("\n").filter((line) => line !== "").map((line) => JSON.parse(line));
+  appendEntries(entries);
+  $("entries-container").scrollTop = $("entries-container").scrollHeight;
+}
+
+async function loadEntries() {
+  stopFollowing();
+  showError(null);
+  const machine = state.machine;
+  $("entries").tBodies[0].replaceChildren();
+  state.highlight = compileHighlight();
+  const params = filterParams();
+  if (state.cluster) {
+    try {
+      await loadClusterEntries(state.cluster, params);
+    } catch (err) {
+      showError(err);
+    }
+    return;
+  }
+  if (!machine) {
+    return;
+  }
+  let body;
+  try {
+    body = await getJSON(machinePath(machine) + "/entries?" + params);
+  } catch (err) {
+    showError(err);
+    return;
+  }
+  if (machine !== state.machine) {
+    return;
+  }
+  state.cursor = body.cursor;
+  appendEntries(body.entries);
+  $("entries-container").scrollTop = $("entries-container").scrollHeight;
+  if ($("follow").checked) {
+    follow(machine, params);
+  }
+}
+
+async function loadBoots(machine) {
+  const select = $("boot");
+  select.replaceChildren(new Option("all", ""));
+  const body = await getJSON(machinePath(machine) + "/boots");
+  // Boots are listed latest first, with their offset, as with journalctl --list-boots.
+  const boots = body.boots.slice().reverse();
+  boots.forEach((id, i) => {
+    select.append(new Option((i === 0 ? "0" : "-" + i) + "  " + id, id));
+  });
+}
+
+async function selectCluster(cluster) {
+  state.machine = null;
+  state.cluster = cluster;
+  $("journal-title").textContent = "Cluster " + cluster.namespace + "/" + cluster.name;
+  // Boot offsets differ by Machine, and only the entries of a Machine are followed.
+  $("boot").replaceChildren(new Option("all", ""));
+  $("boot").disabled = true;
+  $("follow").disabled = true;
+  await loadEntries();
+}
+
+async function selectMachine(machine) {
+  state.machine = machine;
+  state.cluster = null;
+  $("boot").disabled = false;
+  $("follow").disabled = false;
+  $("journal-title").textContent = machine ?
+    machine.namespace + "/" + machine.name : "Select a Machine";
+  if (machine) {
+    try {
+      await loadBoots(machine);
+    } catch (err) {
+      showError(err);
+    }
+  }
+  await loadEntries();
+}
+
+async function main() {
+  $("filters").addEventListener("submit", (event) => {
+    event.preventDefault();
+    loadEntries();
+  });
+  $("follow").addEventListener("change", loadEntries);
+  try {
+    await loadManagementClusters();
+  } catch (err) {
+    showError(err);
+  }
+  await loadMachines();
+  setInterval(loadMachines, machinesRefreshInterval);
+}
+
+main();
@@ -0,0 +1,351 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/s3"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DefaultKeyTemplate is the default template for the object key of a segment.
+const DefaultKeyTemplate = "{{.Cluster}}/{{.Namespace}}/{{.Machine}}/{{.BootID}}.log"
+
+// DefaultMultiClusterKeyTemplate is the default template for the object key of a segment if
+// machine-monitor monitors more than one management cluster, whose Machines can have the same
+// namespaces and names.
+const DefaultMultiClusterKeyTemplate = "{{.ManagementCluster}}/" + DefaultKeyTemplate
+
+// ErrUnknownCluster is returned by Archive if the Cluster of the Machine is neither given, nor
+// recorded by an earlier Archive.
+var ErrUnknownCluster = errors.New("the cluster of the machine is unknown")
+
+// MinPartSize is the minimum size of every part of a multipart upload, except the last part.
+const MinPartSize = 5 * 1024 * 1024
+
+// Config configures how segments are archived.
+type Config struct {
+	S3 s3.Config
+	// KeyTemplate is a text/template for the object key of a segment. It is executed with a
+	// KeyData value.
+	KeyTemplate string
+	// PartSize is the size of each part of a multipart upload. Segments smaller than PartSize
+	// are uploaded in a single request.
+	PartSize int
+}
+
+// KeyData is the data that the key template is executed with.
+type KeyData struct {
+	// ManagementCluster is empty if machine-monitor monitors only one management cluster.
+	ManagementCluster string
+	Cluster           string
+	Namespace         string
+	Machine           string
+	BootID            string
+}
+
+// ValidateKeyTemplate returns an error if the key template can give two segments the same key,
+// i.e. if it does not tell apart the namespaces, Machines and boots, and, if
+// multipleManagementClusters is true, the management clusters.
+func ValidateKeyTemplate(keyTemplate string, multipleManagementClusters bool) error {
+	t, err := template.New("key").Option("missingkey=error").Parse(keyTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse key template: %w", err)
+	}
+	execute := func(data KeyData) (string, error) {
+		var key strings.Builder
+		if err := t.Execute(&key, data); err != nil {
+			return "", fmt.Errorf("failed to execute key template: %w", err)
+		}
+		return key.String(), nil
+	}
+
+	data := KeyData{
+		ManagementCluster: "management-cluster-a",
+		Cluster:           "cluster-a",
+		Namespace:         "namespace-a",
+		Machine:           "machine-a",
+		BootID:            "boot-a",
+	}
+	key, err := execute(data)
+	if err != nil {
+		return err
+	}
+	fields := []string{"Namespace", "Machine", "BootID"}
+	if multipleManagementClusters {
+		fields = append(fields, "ManagementCluster")
+	}
+	for _, field := range fields {
+		variant := data
+		switch field {
+		case "Namespace":
+			variant.Namespace = "namespace-b"
+		case "Machine":
+			variant.Machine = "machine-b"
+		case "BootID":
+			variant.BootID = "boot-b"
+		case "ManagementCluster":
+			variant.ManagementCluster = "management-cluster-b"
+		}
+		variantKey, err := execute(variant)
+		if err != nil {
+			return err
+		}
+		if variantKey == key {
+			return fmt.Errorf(
+				"key template %q gives segments with a different %s the same key, use .%s",
+				keyTemplate,
+				field,
+				field,
+			)
+		}
+	}
+	return nil
+}
+
+// Archiver uploads the journal of a Machine to an S3-compatible object storage, one segment per
+// boot. A segment is uploaded once the boot is complete, i.e. once a later boot is observed, or
+// once the Machine is deleted.
+type Archiver struct {
+	client      *s3.Client
+	keyTemplate *template.Template
+	partSize    int
+}
+
+// NewArchiver returns an Archiver.
+func NewArchiver(config Config) (*Archiver, error) {
+	keyTemplate, err := template.New("key").Option("missingkey=error").Parse(config.KeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key template: %w", err)
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = MinPartSize
+	}
+	return &Archiver{
+		client:      s3.NewClient(config.S3),
+		keyTemplate: keyTemplate,
+		partSize:    config.PartSize,
+	}, nil
+}
+
+// Archive uploads every segment of the journal of the Machine in the store that is complete, and
+// that was not uploaded before. If includeLatest is true, the segment of the latest boot is
+// considered complete. A segment holds the entries of its boot as journalctl JSON lines. If the
+// Cluster of the Machine is empty, the Cluster recorded by an earlier Archive is used, and if there
+// is none, Archive returns ErrUnknownCluster.
+func (a *Archiver) Archive(
+	ctx context.Context,
+	machine KeyData,
+	store journald.Store,
+	stateFilePath string,
+	includeLatest bool,
+) error {
+	log := logf.FromContext(ctx)
+
+	state, err := LoadState(stateFilePath)
+	if err != nil {
+		return err
+	}
+	if machine.Cluster == "" {
+		// The Machine may have been deleted, so we use what we knew about it.
+		machine.Cluster = state.Cluster
+	}
+	if machine.Cluster == "" {
+		return ErrUnknownCluster
+	}
+	state.Cluster = machine.Cluster
+
+	if state.Pending != nil {
+		// A multipart upload was interrupted. Its parts are not visible, but are stored, until
+		// the upload is aborted.
+		if err := a.client.AbortMultipartUpload(
+			ctx,
+			state.Pending.Key,
+			state.Pending.UploadID,
+		); err != nil {
+			log.Error(err, "failed to abort interrupted multipart upload", "key", state.Pending.Key)
+		}
+		state.Pending = nil
+		if err := state.save(stateFilePath); err != nil {
+			return err
+		}
+	}
+
+	boots, err := journald.ReadBootIDs(ctx, store, machine.Namespace, machine.Machine)
+	if err != nil {
+		return err
+	}
+	if !includeLatest && len(boots) > 0 {
+		boots = boots[:len(boots)-1]
+	}
+	pending := map[string]bool{}
+	for _, bootID := range boots {
+		if !state.uploaded(bootID) {
+			pending[bootID] = true
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// The segments are uploaded in one pass over the journal. The entries of a boot are
+	// contiguous, so the segment of a boot ends where the entries of the next boot begin.
+	reader := store.Reader(machine.Namespace, machine.Machine, "")
+	defer func() {
+		_ = reader.Close()
+	}()
+	var segment *segmentUpload
+	finish := func() error {
+		upload, err := segment.finish(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to archive boot %s: %w", segment.upload.BootID, err)
+		}
+		segment = nil
+		log.V(1).Info("archived segment",
+			"bootID", upload.BootID, "key", upload.Key, "size", upload.Size)
+		state.Uploads = append(state.Uploads, upload)
+		return state.save(stateFilePath)
+	}
+	for {
+		entry, err := reader.Next(ctx, false)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		bootID := entry.BootID()
+		if bootID == "" {
+			continue
+		}
+		if segment != nil && bootID != segment.upload.BootID {
+			if err := finish(); err != nil {
+				return err
+			}
+		}
+		if segment == nil {
+			if !pending[bootID] {
+				continue
+			}
+			delete(pending, bootID)
+			machine.BootID = bootID
+			var key strings.Builder
+			if err := a.keyTemplate.Execute(&key, machine); err != nil {
+				return fmt.Errorf("failed to execute key template: %w", err)
+			}
+			segment = a.newSegmentUpload(stateFilePath, state, bootID, key.String())
+		}
+		if err := segment.write(ctx, entry); err != nil {
+			return fmt.Errorf("failed to archive boot %s: %w", bootID, err)
+		}
+	}
+	if segment != nil {
+		return finish()
+	}
+	return nil
+}
+
+// segmentUpload uploads the segment of one boot, in a single request, or, if the segment is larger
+// than the part size, in a multipart upload. The object storage verifies the content of every
+// request against its MD5 checksum. The ETags of the object and its parts are not compared with
+// the checksums, since, e.g. with server-side encryption, they are not MD5 checksums.
+type segmentUpload struct {
+	archiver      *Archiver
+	stateFilePath string
+	state         *State
+
+	upload   Upload
+	sha      hash.Hash
+	uploadID string
+	parts    []s3.Part
+	part     []byte
+}
+
+func (a *Archiver) newSegmentUpload(
+	stateFilePath string,
+	state *State,
+	bootID, key string,
+) *segmentUpload {
+	return &segmentUpload{
+		archiver:      a,
+		stateFilePath: stateFilePath,
+		state:         state,
+		upload:        Upload{BootID: bootID, Key: key},
+		sha:           sha256.New(),
+		part:          make([]byte, 0, a.partSize),
+	}
+}
+
+// write adds the entry to the segment, and uploads a part once the part size is reached.
+func (u *segmentUpload) write(ctx context.Context, entry journald.Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize journal entry: %w", err)
+	}
+	line = append(line, '\n')
+	u.sha.Write(line)
+	u.upload.Size += int64(len(line))
+	u.part = append(u.part, line...)
+	if len(u.part) >= u.archiver.partSize {
+		return u.uploadPart(ctx)
+	}
+	return nil
+}
+
+// uploadPart uploads the part, and starts the multipart upload first, if needed. The multipart
+// upload is recorded in the state as pending, so that it can be aborted if it is interrupted.
+func (u *segmentUpload) uploadPart(ctx context.Context) error {
+	client := u.archiver.client
+	if u.uploadID == "" {
+		var err error
+		u.uploadID, err = client.CreateMultipartUpload(ctx, u.upload.Key)
+		if err != nil {
+			return err
+		}
+		u.state.Pending = &PendingUpload{Key: u.upload.Key, UploadID: u.uploadID}
+		if err := u.state.save(u.stateFilePath); err != nil {
+			return err
+		}
+	}
+	uploaded, err := client.UploadPart(ctx, u.upload.Key, u.uploadID, len(u.parts)+1, u.part)
+	if err != nil {
+		return err
+	}
+	u.parts = append(u.parts, uploaded)
+	u.part = u.part[:0]
+	return nil
+}
+
+// finish uploads the rest of the segment, and returns the Upload.
+func (u *segmentUpload) finish(ctx context.Context) (Upload, error) {
+	client := u.archiver.client
+	if u.uploadID == "" {
+		if _, err := client.PutObject(ctx, u.upload.Key, u.part); err != nil {
+			return Upload{}, err
+		}
+	} else {
+		if len(u.part) > 0 {
+			if err := u.uploadPart(ctx); err != nil {
+				return Upload{}, err
+			}
+		}
+		_, err := client.CompleteMultipartUpload(ctx, u.upload.Key, u.uploadID, u.parts)
+		if err != nil {
+			return Upload{}, err
+		}
+		u.state.Pending = nil
+	}
+	u.upload.SHA256 = hex.EncodeToString(u.sha.Sum(nil))
+	u.upload.Time = time.Now().UTC()
+	return u.upload, nil
+}
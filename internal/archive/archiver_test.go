@@ -0,0 +1,313 @@
+package archive
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/s3"
+)
+
+// s3StandIn is a local stand-in for an S3-compatible object storage. It supports path-style
+// addressing, and only the operations used by the Archiver.
+type s3StandIn struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	aborted  []string
+	requests int
+	// opaqueETags makes the ETags differ from the MD5 checksums, as with server-side encryption.
+	opaqueETags bool
+}
+
+func newS3StandIn() *s3StandIn {
+	return &s3StandIn{
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" {
+		sum := md5.Sum(body)
+		if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	key := r.URL.Path
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := fmt.Sprintf("upload-%d", len(s.uploads))
+		s.uploads[uploadID] = map[int][]byte{}
+		_, _ = fmt.Fprintf(w,
+			"<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+			uploadID)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		s.uploads[query.Get("uploadId")][partNumber] = body
+		w.Header().Set("ETag", s.etag(body))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		request := struct {
+			Parts []s3.Part `xml:"Part"`
+		}{}
+		_ = xml.Unmarshal(body, &request)
+		parts := s.uploads[query.Get("uploadId")]
+		var object, md5s []byte
+		for _, part := range request.Parts {
+			object = append(object, parts[part.PartNumber]...)
+			sum := md5.Sum(parts[part.PartNumber])
+			md5s = append(md5s, sum[:]...)
+		}
+		s.objects[key] = object
+		delete(s.uploads, query.Get("uploadId"))
+		etag := s.etag(object)
+		if !s.opaqueETags {
+			sum := md5.Sum(md5s)
+			etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(request.Parts))
+		}
+		_, _ = fmt.Fprintf(w,
+			`<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>`,
+			etag)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.aborted = append(s.aborted, query.Get("uploadId"))
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+		w.Header().Set("ETag", s.etag(body))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// etag returns the ETag of an object, or of a part, with the content.
+func (s *s3StandIn) etag(content []byte) string {
+	if s.opaqueETags {
+		sum := md5.Sum(append([]byte("encrypted "), content...))
+		return `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+	sum := md5.Sum(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// readerCountingStore counts the Readers of the journals of the store.
+type readerCountingStore struct {
+	*journald.FileStore
+	readers int
+}
+
+func (s *readerCountingStore) Reader(namespace, name, afterCursor string) journald.Reader {
+	s.readers++
+	return s.FileStore.Reader(namespace, name, afterCursor)
+}
+
+// journalLine returns a line of journalctl JSON output, with its fields in the order that a
+// segment has them.
+func journalLine(cursor int, bootID string) string {
+	return fmt.Sprintf(`{"MESSAGE":"message %d","_BOOT_ID":"%s","__CURSOR":"c%d"}`+"\n",
+		cursor, bootID, cursor)
+}
+
+var _ = Describe("Archiver", func() {
+	var (
+		standIn              *s3StandIn
+		archiver             *Archiver
+		store                *journald.FileStore
+		localJournalFilePath string
+		stateFilePath        string
+		machine              KeyData
+		boot1, boot2         string
+	)
+
+	BeforeEach(func() {
+		standIn = newS3StandIn()
+		server := httptest.NewServer(standIn)
+		DeferCleanup(server.Close)
+
+		var err error
+		archiver, err = NewArchiver(Config{
+			S3: s3.Config{
+				Endpoint:        server.URL,
+				Region:          "us-east-1",
+				Bucket:          "journals",
+				AccessKeyID:     "access",
+				SecretAccessKey: "secret",
+			},
+			KeyTemplate: DefaultKeyTemplate,
+			PartSize:    100,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		dir := GinkgoT().TempDir()
+		store = &journald.FileStore{Directory: dir}
+		localJournalFilePath = store.LocalJournalFilePath("ns", "m")
+		stateFilePath = StateFilePath(dir, "ns", "m")
+		machine = KeyData{Cluster: "c", Namespace: "ns", Machine: "m"}
+
+		boot1 = journalLine(0, "b1") + journalLine(1, "b1") + journalLine(2, "b1")
+		boot2 = journalLine(3, "b2")
+		Expect(os.WriteFile(localJournalFilePath, []byte(boot1+boot2), 0o644)).To(Succeed())
+	})
+
+	It("should archive completed boots once", func() {
+		ctx := context.Background()
+		Expect(archiver.Archive(ctx, machine, store, stateFilePath, false)).
+			To(Succeed())
+		Expect(standIn.objects).To(HaveKeyWithValue("/journals/c/ns/m/b1.log", []byte(boot1)))
+		Expect(standIn.objects).NotTo(HaveKey("/journals/c/ns/m/b2.log"))
+
+		requests := standIn.requests
+		Expect(archiver.Archive(ctx, machine, store, stateFilePath, false)).
+			To(Succeed())
+		Expect(standIn.requests).To(Equal(requests))
+
+		state, err := LoadState(stateFilePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.Uploads).To(HaveLen(1))
+		Expect(state.Uploads[0].Size).To(BeEquivalentTo(len(boot1)))
+	})
+
+	It("should archive the latest boot of a deleted machine", func() {
+		ctx := context.Background()
+		Expect(archiver.Archive(ctx, machine, store, stateFilePath, false)).
+			To(Succeed())
+
+		deleted := KeyData{Namespace: "ns", Machine: "m"}
+		Expect(archiver.Archive(ctx, deleted, store, stateFilePath, true)).
+			To(Succeed())
+		Expect(standIn.objects).To(HaveKeyWithValue("/journals/c/ns/m/b2.log", []byte(boot2)))
+	})
+
+	It("should not archive the journal of a machine of an unknown cluster", func() {
+		deleted := KeyData{Namespace: "ns", Machine: "m"}
+		err := archiver.Archive(context.Background(), deleted, store, stateFilePath, true)
+		Expect(err).To(MatchError(ErrUnknownCluster))
+		Expect(standIn.requests).To(BeZero())
+		Expect(stateFilePath).NotTo(BeAnExistingFile())
+	})
+
+	It("should archive every boot in one pass over the journal", func() {
+		boot3 := journalLine(4, "b3") + journalLine(5, "b3")
+		appender, err := store.Open("ns", "m")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = appender.Write([]byte(boot3))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(appender.Close()).To(Succeed())
+
+		counting := &readerCountingStore{FileStore: store}
+		Expect(archiver.Archive(context.Background(), machine, counting, stateFilePath, true)).
+			To(Succeed())
+		Expect(standIn.objects).To(Equal(map[string][]byte{
+			"/journals/c/ns/m/b1.log": []byte(boot1),
+			"/journals/c/ns/m/b2.log": []byte(boot2),
+			"/journals/c/ns/m/b3.log": []byte(boot3),
+		}))
+		// One Reader lists the boots, and one reads their entries.
+		Expect(counting.readers).To(Equal(2))
+	})
+
+	It("should archive to an object storage whose ETags are not MD5 checksums", func() {
+		standIn.opaqueETags = true
+		Expect(archiver.Archive(context.Background(), machine, store, stateFilePath, true)).
+			To(Succeed())
+		// The segment of boot b1 is larger than the part size, so it is uploaded in parts.
+		Expect(standIn.objects).To(HaveKeyWithValue("/journals/c/ns/m/b1.log", []byte(boot1)))
+		Expect(standIn.objects).To(HaveKeyWithValue("/journals/c/ns/m/b2.log", []byte(boot2)))
+		state, err := LoadState(stateFilePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(state.Uploads).To(HaveLen(2))
+		Expect(state.Pending).To(BeNil())
+	})
+
+	It("should archive the rotated entries of a boot", func() {
+		Expect(store.Rotate("ns", "m")).To(Succeed())
+		appender, err := store.Open("ns", "m")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = appender.Write([]byte(journalLine(4, "b2") + journalLine(5, "b3")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(appender.Close()).To(Succeed())
+
+		Expect(archiver.Archive(context.Background(), machine, store, stateFilePath, false)).
+			To(Succeed())
+		Expect(standIn.objects).To(HaveKeyWithValue("/journals/c/ns/m/b1.log", []byte(boot1)))
+		Expect(standIn.objects).To(HaveKeyWithValue(
+			"/journals/c/ns/m/b2.log",
+			[]byte(boot2+journalLine(4, "b2")),
+		))
+		Expect(standIn.objects).NotTo(HaveKey("/journals/c/ns/m/b3.log"))
+	})
+
+	It("should abort an interrupted multipart upload", func() {
+		state := &State{Pending: &PendingUpload{Key: "c/ns/m/b1.log", UploadID: "interrupted"}}
+		Expect(state.save(stateFilePath)).To(Succeed())
+
+		Expect(archiver.Archive(
+			context.Background(),
+			machine,
+			store,
+			stateFilePath,
+			false,
+		)).To(Succeed())
+		Expect(standIn.aborted).To(ConsistOf("interrupted"))
+		Expect(standIn.objects).To(HaveKeyWithValue("/journals/c/ns/m/b1.log", []byte(boot1)))
+	})
+})
+
+var _ = Describe("ValidateKeyTemplate", func() {
+	DescribeTable("accepts templates that give every segment its own key",
+		func(keyTemplate string, multipleManagementClusters bool) {
+			Expect(ValidateKeyTemplate(keyTemplate, multipleManagementClusters)).To(Succeed())
+		},
+		Entry("the default", DefaultKeyTemplate, false),
+		Entry("the multi-cluster default", DefaultMultiClusterKeyTemplate, true),
+		Entry("a flat key", "{{.Namespace}}_{{.Machine}}_{{.BootID}}", false),
+	)
+
+	DescribeTable("rejects templates that give two segments the same key",
+		func(keyTemplate string, multipleManagementClusters bool, field string) {
+			err := ValidateKeyTemplate(keyTemplate, multipleManagementClusters)
+			Expect(err).To(MatchError(ContainSubstring("use ." + field)))
+		},
+		Entry("without the management cluster",
+			DefaultKeyTemplate, true, "ManagementCluster"),
+		Entry("without the namespace",
+			"{{.Cluster}}/{{.Machine}}/{{.BootID}}.log", false, "Namespace"),
+		Entry("without the machine",
+			"{{.Namespace}}/{{.BootID}}.log", false, "Machine"),
+		Entry("without the boot",
+			"{{.Namespace}}/{{.Machine}}.log", false, "BootID"),
+	)
+
+	It("rejects templates that cannot be executed", func() {
+		Expect(ValidateKeyTemplate("{{.Node}}", false)).To(MatchError(
+			ContainSubstring("failed to execute key template")))
+		Expect(ValidateKeyTemplate("{{.Machine", false)).To(MatchError(
+			ContainSubstring("failed to parse key template")))
+	})
+})
@@ -0,0 +1,75 @@
+package archive
+
+import (
+	"context"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// retryInterval is how long to wait before archiving again after archiving failed.
+const retryInterval = time.Minute
+
+// MachineArchiver archives the completed segments of one Machine while its journal is streamed.
+type MachineArchiver struct {
+	archiver      *Archiver
+	machine       KeyData
+	store         journald.Store
+	stateFilePath string
+
+	bootID string
+	notify chan struct{}
+}
+
+// ForMachine returns a MachineArchiver for the Machine, whose journal is in the store.
+func (a *Archiver) ForMachine(
+	machine KeyData,
+	store journald.Store,
+	stateFilePath string,
+) *MachineArchiver {
+	return &MachineArchiver{
+		archiver:      a,
+		machine:       machine,
+		store:         store,
+		stateFilePath: stateFilePath,
+		notify:        make(chan struct{}, 1),
+	}
+}
+
+// HandleEntry is a journald.EntryHandler. When the entry belongs to a new boot, the previous boot
+// is complete, and the MachineArchiver is woken up to archive it.
+func (m *MachineArchiver) HandleEntry(_ context.Context, entry journald.Entry) {
+	bootID := entry.BootID()
+	if bootID == "" || bootID == m.bootID {
+		return
+	}
+	if m.bootID != "" {
+		select {
+		case m.notify <- struct{}{}:
+		default:
+		}
+	}
+	m.bootID = bootID
+}
+
+// Run archives the completed segments, and then archives again whenever a boot is completed,
+// until the context is done.
+func (m *MachineArchiver) Run(ctx context.Context) {
+	log := logf.FromContext(ctx)
+
+	for {
+		var retry <-chan time.Time
+		err := m.archiver.Archive(ctx, m.machine, m.store, m.stateFilePath, false)
+		if err != nil && ctx.Err() == nil {
+			log.Error(err, "failed to archive journal", "retryInterval", retryInterval)
+			retry = time.After(retryInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.notify:
+		case <-retry:
+		}
+	}
+}
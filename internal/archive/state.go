@@ -0,0 +1,83 @@
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// StateFilePath returns the path of the file that records the archived segments of a Machine.
+func StateFilePath(directory, namespace, name string) string {
+	return path.Join(directory, fmt.Sprintf("%s-%s.archive.json", namespace, name))
+}
+
+// State records the segments of a Machine that were archived, so that they are not archived
+// again after a restart.
+type State struct {
+	// Cluster is the name of the Cluster of the Machine, which is needed to archive the last
+	// segment after the Machine is deleted.
+	Cluster string   `json:"cluster,omitempty"`
+	Uploads []Upload `json:"uploads,omitempty"`
+	// Pending is the multipart upload in progress, if any.
+	Pending *PendingUpload `json:"pending,omitempty"`
+}
+
+// Upload records an archived segment.
+type Upload struct {
+	BootID string    `json:"bootID"`
+	Key    string    `json:"key"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+}
+
+// PendingUpload records a multipart upload in progress.
+type PendingUpload struct {
+	Key      string `json:"key"`
+	UploadID string `json:"uploadID"`
+}
+
+// LoadState reads the archive state from a file. If the file does not exist, it returns an
+// empty state.
+func LoadState(filePath string) (*State, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &State{}, nil
+		}
+		return nil, fmt.Errorf("failed to read archive state file: %w", err)
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse archive state file: %w", err)
+	}
+	return state, nil
+}
+
+// save writes the state to a file. The file is replaced atomically.
+func (s *State) save(filePath string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to serialize archive state: %w", err)
+	}
+	tmpFilePath := filePath + ".tmp"
+	if err := os.WriteFile(tmpFilePath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write archive state file: %w", err)
+	}
+	if err := os.Rename(tmpFilePath, filePath); err != nil {
+		return fmt.Errorf("failed to replace archive state file: %w", err)
+	}
+	return nil
+}
+
+func (s *State) uploaded(bootID string) bool {
+	for _, upload := range s.Uploads {
+		if upload.BootID == bootID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,384 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+)
+
+// ManifestFileName is the name of the manifest file in a bundle. It is the last file, because it
+// lists the checksums of every other file.
+const ManifestFileName = "manifest.json"
+
+// ObjectsFunc returns the Kubernetes objects of a Machine. If some objects cannot be read, it
+// returns the others, and an error.
+type ObjectsFunc func(
+	ctx context.Context,
+	namespace, name string,
+) ([]*unstructured.Unstructured, error)
+
+// Options select what a bundle contains.
+type Options struct {
+	// Store stores the journals of the Machines.
+	Store journald.Store
+	// Directory is the directory of the local journal files, and of the timeline files.
+	Directory string
+	// Namespace and Cluster are the namespace and name of the Cluster of the Machines.
+	Namespace string
+	Cluster   string
+	// Machines are the Machines of the Cluster, as returned by Machines.
+	Machines []journald.MachineInfo
+	// Since and Until, if not zero, select the journal entries logged at or after, and at or
+	// before, the time. The time of each entry is corrected for the clock skew of its Machine.
+	Since time.Time
+	Until time.Time
+	// Streaming, if not nil, returns true if the journal of the Machine is being streamed.
+	Streaming func(namespace, name string) bool
+	// Objects, if not nil, returns the Kubernetes objects of each Machine.
+	Objects ObjectsFunc
+}
+
+// Manifest describes a bundle.
+type Manifest struct {
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster"`
+	// ManagementCluster is empty if machine-monitor monitors only one management cluster.
+	ManagementCluster string     `json:"managementCluster,omitempty"`
+	Created           time.Time  `json:"created"`
+	Since             *time.Time `json:"since,omitempty"`
+	Until             *time.Time `json:"until,omitempty"`
+	Files             []File     `json:"files"`
+	// Errors describe what could not be added to the bundle, e.g. because the management cluster
+	// was not reachable.
+	Errors []string `json:"errors,omitempty"`
+	// Redacted lists the fields of the objects in the bundle whose secret values were replaced
+	// with Redacted, or that were removed, as <path>: <field>.
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+// File is a file in a bundle, other than the manifest. Its path is relative to the directory of
+// the Cluster.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Status is the status of the capture of the journal of a Machine.
+type Status struct {
+	journald.MachineInfo
+	// Streaming is true if the journal of the Machine is being streamed, and nil if it is unknown.
+	Streaming *bool `json:"streaming,omitempty"`
+	// LocalJournalFileSize is the size of the local journal file, in bytes, not counting rotated
+	// local journal files.
+	LocalJournalFileSize int64 `json:"localJournalFileSize"`
+	// LastWritten is when the local journal file was last written to.
+	LastWritten *time.Time `json:"lastWritten,omitempty"`
+	// Entries is the number of journal entries in the bundle.
+	Entries int `json:"entries"`
+}
+
+// Machines returns the Machines of the Cluster that have a journal in the store. It returns an
+// error that wraps os.ErrNotExist if there are none.
+func Machines(store journald.Store, namespace, cluster string) ([]journald.MachineInfo, error) {
+	infos, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	var machines []journald.MachineInfo
+	for _, info := range infos {
+		if info.Namespace != namespace || info.Cluster != cluster {
+			continue
+		}
+		if _, err := store.Status(info.Namespace, info.Name); err != nil {
+			// The journal of the Machine has not been streamed yet.
+			continue
+		}
+		machines = append(machines, info)
+	}
+	if len(machines) == 0 {
+		return nil, fmt.Errorf(
+			"no machines of cluster %s/%s found: %w",
+			namespace,
+			cluster,
+			os.ErrNotExist,
+		)
+	}
+	return machines, nil
+}
+
+// FileName returns the conventional name of the bundle of the Cluster.
+func FileName(namespace, cluster string) string {
+	return fmt.Sprintf("%s-%s.tar.gz", namespace, cluster)
+}
+
+// Write writes the bundle of the Cluster to w, as a gzipped tar archive. Every file is in a
+// directory named after the Cluster, and the files of each Machine are in its own directory:
+//
+//	<namespace>-<cluster>/machines/<machine>/journal.json
+//	<namespace>-<cluster>/machines/<machine>/status.json
+//	<namespace>-<cluster>/machines/<machine>/timeline.json
+//	<namespace>-<cluster>/machines/<machine>/<kind>.yaml
+//	<namespace>-<cluster>/manifest.json
+//
+// The journal is in journalctl JSON format, one entry per line. A Machine has no timeline file
+// if no bootstrap milestone was recorded.
+func Write(ctx context.Context, w io.Writer, options Options) error {
+	manifest := Manifest{
+		Namespace: options.Namespace,
+		Cluster:   options.Cluster,
+		Created:   time.Now().UTC(),
+		Files:     []File{},
+	}
+	if !options.Since.IsZero() {
+		manifest.Since = &options.Since
+	}
+	if !options.Until.IsZero() {
+		manifest.Until = &options.Until
+	}
+
+	gz := gzip.NewWriter(w)
+	b := &bundleWriter{
+		tar:       tar.NewWriter(gz),
+		root:      strings.TrimSuffix(FileName(options.Namespace, options.Cluster), ".tar.gz"),
+		created:   manifest.Created,
+		manifest:  &manifest,
+		directory: options.Directory,
+	}
+	for _, info := range options.Machines {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		manifest.ManagementCluster = info.ManagementCluster
+		if err := b.addMachine(ctx, info, options); err != nil {
+			return fmt.Errorf("failed to add machine %s/%s: %w", info.Namespace, info.Name, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize bundle manifest: %w", err)
+	}
+	err = b.writeFile(ManifestFileName, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := b.tar.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// bundleWriter adds files to a bundle, and lists them in its manifest.
+type bundleWriter struct {
+	tar       *tar.Writer
+	root      string
+	created   time.Time
+	manifest  *Manifest
+	directory string
+}
+
+// addMachine adds the files of the Machine.
+func (b *bundleWriter) addMachine(
+	ctx context.Context,
+	info journald.MachineInfo,
+	options Options,
+) error {
+	dir := path.Join("machines", info.Name)
+	status := Status{MachineInfo: info}
+	if options.Streaming != nil {
+		streaming := options.Streaming(info.Namespace, info.Name)
+		status.Streaming = &streaming
+	}
+
+	if journalStatus, err := options.Store.Status(info.Namespace, info.Name); err == nil {
+		status.LocalJournalFileSize = journalStatus.Size
+		status.LastWritten = &journalStatus.LastWritten
+	}
+	entries, err := b.addJournal(ctx, path.Join(dir, "journal.json"), info, options)
+	if err != nil {
+		return err
+	}
+	status.Entries = entries
+	if err := b.addJSON(path.Join(dir, "status.json"), status); err != nil {
+		return err
+	}
+
+	t, err := timeline.Load(timeline.FilePath(b.directory, info.Namespace, info.Name))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := b.addJSON(path.Join(dir, "timeline.json"), t); err != nil {
+			return err
+		}
+	}
+
+	if options.Objects == nil {
+		return nil
+	}
+	objects, err := options.Objects(ctx, info.Namespace, info.Name)
+	if err != nil {
+		b.manifest.Errors = append(b.manifest.Errors, fmt.Sprintf(
+			"failed to get Kubernetes objects of machine %s/%s: %s",
+			info.Namespace,
+			info.Name,
+			err,
+		))
+	}
+	for _, object := range objects {
+		// Managed fields only make the objects harder to read.
+		object.SetManagedFields(nil)
+		filePath := path.Join(dir, strings.ToLower(object.GetKind())+".yaml")
+		// Bundles are shared outside the organization, so secrets are never added.
+		for _, field := range redact(object) {
+			b.manifest.Redacted = append(b.manifest.Redacted, filePath+": "+field)
+		}
+		data, err := yaml.Marshal(object.Object)
+		if err != nil {
+			return fmt.Errorf("failed to serialize %s: %w", object.GetKind(), err)
+		}
+		err = b.writeFile(filePath, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addJournal adds the entries of the journal of the Machine, including its rotated entries, that
+// are in the time range, and returns how many there are.
+func (b *bundleWriter) addJournal(
+	ctx context.Context,
+	filePath string,
+	info journald.MachineInfo,
+	options Options,
+) (int, error) {
+	// The size of a file must be known before it is added, so the entries are copied to a
+	// temporary file first.
+	tmp, err := os.CreateTemp("", "machine-monitor-bundle-*.json")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	out := bufio.NewWriter(tmp)
+	entries, err := copyEntries(
+		ctx,
+		out,
+		options.Store.Reader(info.Namespace, info.Name, ""),
+		info,
+		options.Since,
+		options.Until,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if err := out.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek temporary file: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek temporary file: %w", err)
+	}
+	return entries, b.writeFile(filePath, size, tmp)
+}
+
+// copyEntries copies the entries that the reader reads that are in the time range, as journalctl
+// JSON lines, and returns how many there are. It closes the reader.
+func copyEntries(
+	ctx context.Context,
+	w io.Writer,
+	reader journald.Reader,
+	info journald.MachineInfo,
+	since, until time.Time,
+) (int, error) {
+	defer func() {
+		_ = reader.Close()
+	}()
+	entries := 0
+	for {
+		entry, err := reader.Next(ctx, false)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		t := info.CorrectTime(entry)
+		if (!since.IsZero() && t.Before(since)) || (!until.IsZero() && t.After(until)) {
+			continue
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return 0, fmt.Errorf("failed to serialize journal entry: %w", err)
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return 0, fmt.Errorf("failed to write journal entries: %w", err)
+		}
+		entries++
+	}
+}
+
+// addJSON adds the value as an indented JSON file.
+func (b *bundleWriter) addJSON(filePath string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize %s: %w", path.Base(filePath), err)
+	}
+	return b.writeFile(filePath, int64(len(data)), bytes.NewReader(data))
+}
+
+// writeFile adds the file to the bundle, and, unless it is the manifest, lists it in the
+// manifest with its checksum.
+func (b *bundleWriter) writeFile(filePath string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(b.root, filePath),
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  b.created,
+	}
+	if err := b.tar.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(b.tar, hash), r); err != nil {
+		return fmt.Errorf("failed to write %s to bundle: %w", filePath, err)
+	}
+	if filePath != ManifestFileName {
+		b.manifest.Files = append(b.manifest.Files, File{
+			Path:   filePath,
+			Size:   size,
+			SHA256: hex.EncodeToString(hash.Sum(nil)),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package bundle_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/dlipovetsky/machine-monitor/internal/bundle"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+)
+
+var base = time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+
+// writeEntries appends entries to the local journal file of the Machine, logged the given number
+// of seconds after base.
+func writeEntries(directory, name string, seconds ...int) {
+	file, err := os.OpenFile(
+		journald.LocalJournalFilePath(directory, "default", name),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY,
+		0o644,
+	)
+	Expect(err).NotTo(HaveOccurred())
+	defer func() { Expect(file.Close()).To(Succeed()) }()
+	for _, s := range seconds {
+		line, err := json.Marshal(journald.Entry{
+			journald.FieldCursor: fmt.Sprintf("s=abc;i=%x", s),
+			journald.FieldRealtimeTimestamp: strconv.FormatInt(
+				base.Add(time.Duration(s)*time.Second).UnixMicro(),
+				10,
+			),
+			journald.FieldMessage: fmt.Sprintf("%s %d", name, s),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = file.Write(append(line, '\n'))
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+// readBundle returns the contents of the files of the bundle, by path.
+func readBundle(data []byte) map[string][]byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	Expect(err).NotTo(HaveOccurred())
+	reader := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files
+		}
+		Expect(err).NotTo(HaveOccurred())
+		content, err := io.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		files[header.Name] = content
+	}
+}
+
+func messages(journal []byte) []string {
+	var m []string
+	for _, line := range strings.Split(strings.TrimSpace(string(journal)), "\n") {
+		entry, err := journald.ParseEntry([]byte(line))
+		Expect(err).NotTo(HaveOccurred())
+		m = append(m, entry.Message())
+	}
+	return m
+}
+
+var _ = Describe("Bundle", func() {
+	var (
+		directory string
+		store     *journald.FileStore
+	)
+
+	BeforeEach(func() {
+		directory = GinkgoT().TempDir()
+		store = &journald.FileStore{Directory: directory}
+		// The clock of cp-0 is 10 seconds ahead.
+		clockOffset := 10 * time.Second
+		for _, info := range []journald.MachineInfo{
+			{Namespace: "default", Name: "cp-0", Cluster: "one", ClockOffset: &clockOffset},
+			{Namespace: "default", Name: "worker-0", Cluster: "one"},
+			{Namespace: "default", Name: "other-0", Cluster: "two"},
+			{Namespace: "default", Name: "new-0", Cluster: "one"},
+		} {
+			Expect(journald.WriteMachineInfo(directory, info)).To(Succeed())
+		}
+		writeEntries(directory, "cp-0", 10, 20, 30)
+		writeEntries(directory, "worker-0", 0, 1)
+		Expect(store.Rotate("default", "worker-0")).To(Succeed())
+		writeEntries(directory, "worker-0", 2, 60)
+		writeEntries(directory, "other-0", 0)
+
+		t := &timeline.Timeline{}
+		t.Record("boot1", timeline.NetworkOnline, base)
+		Expect(t.Save(timeline.FilePath(directory, "default", "cp-0"))).To(Succeed())
+	})
+
+	It("lists the Machines of the Cluster that have a local journal file", func() {
+		machines, err := bundle.Machines(store, "default", "one")
+		Expect(err).NotTo(HaveOccurred())
+		var names []string
+		for _, machine := range machines {
+			names = append(names, machine.Name)
+		}
+		Expect(names).To(Equal([]string{"cp-0", "worker-0"}))
+
+		_, err = bundle.Machines(store, "default", "three")
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+	})
+
+	It("writes the journals in the time range, the status, timelines and objects", func() {
+		machines, err := bundle.Machines(store, "default", "one")
+		Expect(err).NotTo(HaveOccurred())
+		buf := &bytes.Buffer{}
+		Expect(bundle.Write(context.Background(), buf, bundle.Options{
+			Store:     store,
+			Directory: directory,
+			Namespace: "default",
+			Cluster:   "one",
+			Machines:  machines,
+			Since:     base.Add(time.Second),
+			Until:     base.Add(20 * time.Second),
+			Streaming: func(_, name string) bool { return name == "cp-0" },
+			Objects: func(
+				_ context.Context,
+				_, name string,
+			) ([]*unstructured.Unstructured, error) {
+				machine := &unstructured.Unstructured{}
+				machine.SetKind("Machine")
+				machine.SetName(name)
+				return []*unstructured.Unstructured{machine}, fmt.Errorf("not found")
+			},
+		})).To(Succeed())
+
+		files := readBundle(buf.Bytes())
+		Expect(files).To(HaveLen(8))
+		root := "default-one/"
+
+		// The entries of cp-0 are corrected for its clock skew, and those of worker-0 include its
+		// rotated entries.
+		Expect(messages(files[root+"machines/cp-0/journal.json"])).To(Equal(
+			[]string{"cp-0 20", "cp-0 30"},
+		))
+		Expect(messages(files[root+"machines/worker-0/journal.json"])).To(Equal(
+			[]string{"worker-0 1", "worker-0 2"},
+		))
+
+		status := bundle.Status{}
+		Expect(json.Unmarshal(files[root+"machines/cp-0/status.json"], &status)).To(Succeed())
+		Expect(status.Streaming).To(HaveValue(BeTrue()))
+		Expect(status.Entries).To(Equal(2))
+		Expect(status.LastWritten).NotTo(BeNil())
+
+		Expect(files).To(HaveKey(root + "machines/cp-0/timeline.json"))
+		Expect(files).NotTo(HaveKey(root + "machines/worker-0/timeline.json"))
+		Expect(string(files[root+"machines/worker-0/machine.yaml"])).To(
+			ContainSubstring("name: worker-0"),
+		)
+
+		manifest := bundle.Manifest{}
+		Expect(json.Unmarshal(files[root+bundle.ManifestFileName], &manifest)).To(Succeed())
+		Expect(manifest.Files).To(HaveLen(7))
+		for _, file := range manifest.Files {
+			content, ok := files[root+file.Path]
+			Expect(ok).To(BeTrue(), file.Path)
+			sum := sha256.Sum256(content)
+			Expect(file.SHA256).To(Equal(hex.EncodeToString(sum[:])), file.Path)
+			Expect(file.Size).To(BeEquivalentTo(len(content)), file.Path)
+		}
+		Expect(manifest.Errors).To(HaveLen(2))
+		Expect(manifest.Since).To(HaveValue(BeTemporally("==", base.Add(time.Second))))
+	})
+
+	It("redacts the secrets of the objects", func() {
+		machines, err := bundle.Machines(store, "default", "one")
+		Expect(err).NotTo(HaveOccurred())
+		buf := &bytes.Buffer{}
+		Expect(bundle.Write(context.Background(), buf, bundle.Options{
+			Store:     store,
+			Directory: directory,
+			Namespace: "default",
+			Cluster:   "one",
+			Machines:  machines[:1],
+			Objects: func(
+				_ context.Context,
+				_, name string,
+			) ([]*unstructured.Unstructured, error) {
+				config := &unstructured.Unstructured{Object: map[string]any{
+					"apiVersion": "bootstrap.cluster.x-k8s.io/v1beta1",
+					"kind":       "KubeadmConfig",
+					"metadata": map[string]any{
+						"name": name,
+						"annotations": map[string]any{
+							"kubectl.kubernetes.io/last-applied-configuration": "secret-applied",
+							"keep": "me",
+						},
+					},
+					"spec": map[string]any{
+						"files": []any{
+							map[string]any{"path": "/etc/key", "content": "secret-file"},
+							map[string]any{
+								"path":        "/etc/ref",
+								"contentFrom": map[string]any{"secret": map[string]any{"name": "s"}},
+							},
+						},
+						"users": []any{
+							map[string]any{"name": "admin", "passwd": "secret-password"},
+						},
+					},
+				}}
+				return []*unstructured.Unstructured{config}, nil
+			},
+		})).To(Succeed())
+
+		files := readBundle(buf.Bytes())
+		config := string(files["default-one/machines/cp-0/kubeadmconfig.yaml"])
+		Expect(config).NotTo(ContainSubstring("secret-"))
+		Expect(config).To(ContainSubstring("path: /etc/key"))
+		Expect(config).To(ContainSubstring("name: s"))
+		Expect(config).To(ContainSubstring("keep: me"))
+
+		manifest := bundle.Manifest{}
+		Expect(json.Unmarshal(files["default-one/"+bundle.ManifestFileName], &manifest)).To(Succeed())
+		Expect(manifest.Redacted).To(Equal([]string{
+			"machines/cp-0/kubeadmconfig.yaml: " +
+				"metadata.annotations[kubectl.kubernetes.io/last-applied-configuration]",
+			"machines/cp-0/kubeadmconfig.yaml: spec.files[0].content",
+			"machines/cp-0/kubeadmconfig.yaml: spec.users[0].passwd",
+		}))
+	})
+})
@@ -0,0 +1,81 @@
+package bundle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+)
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=*,verbs=get
+// +kubebuilder:rbac:groups=bootstrap.cluster.x-k8s.io,resources=*,verbs=get
+
+// KubernetesObjects returns an ObjectsFunc that reads the Machine, its infrastructure Machine, and
+// its bootstrap config with the reader. The mapper finds the version of the referenced objects,
+// because v1beta2 Machines reference only their API group.
+func KubernetesObjects(
+	reader client.Reader,
+	mapper meta.RESTMapper,
+	machineAPIVersion string,
+) ObjectsFunc {
+	return func(ctx context.Context, namespace, name string) ([]*unstructured.Unstructured, error) {
+		object := capi.NewUnstructuredMachine(machineAPIVersion)
+		key := client.ObjectKey{Namespace: namespace, Name: name}
+		if err := reader.Get(ctx, key, object); err != nil {
+			return nil, fmt.Errorf("failed to get machine: %w", err)
+		}
+		machine, err := capi.FromUnstructured(object)
+		if err != nil {
+			return nil, err
+		}
+
+		objects := []*unstructured.Unstructured{object}
+		var errs []error
+		for _, ref := range []capi.InfrastructureRef{
+			machine.InfrastructureRef,
+			machine.BootstrapConfigRef,
+		} {
+			if ref.Name == "" {
+				continue
+			}
+			referenced, err := getReferenced(ctx, reader, mapper, namespace, ref)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			objects = append(objects, referenced)
+		}
+		return objects, errors.Join(errs...)
+	}
+}
+
+// getReferenced reads an object that a Machine references.
+func getReferenced(
+	ctx context.Context,
+	reader client.Reader,
+	mapper meta.RESTMapper,
+	namespace string,
+	ref capi.InfrastructureRef,
+) (*unstructured.Unstructured, error) {
+	gvk := schema.FromAPIVersionAndKind(ref.APIVersion, ref.Kind)
+	if ref.APIVersion == "" {
+		mapping, err := mapper.RESTMapping(schema.GroupKind{Group: ref.APIGroup, Kind: ref.Kind})
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the version of %s: %w", ref.Kind, err)
+		}
+		gvk = mapping.GroupVersionKind
+	}
+	object := &unstructured.Unstructured{}
+	object.SetGroupVersionKind(gvk)
+	key := client.ObjectKey{Namespace: namespace, Name: ref.Name}
+	if err := reader.Get(ctx, key, object); err != nil {
+		return nil, fmt.Errorf("failed to get %s %s: %w", ref.Kind, ref.Name, err)
+	}
+	return object, nil
+}
@@ -0,0 +1,76 @@
+package bundle
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Redacted replaces the values of secret fields in the objects of a bundle.
+const Redacted = "REDACTED"
+
+// secretFields are the names, in lower case, of the fields whose string values are secret.
+// Bootstrap configs inline file contents, e.g. spec.files[].content of a KubeadmConfig, user
+// passwords, and bootstrap tokens. Infrastructure Machines can inline user data.
+var secretFields = []string{
+	"content",
+	"passwd",
+	"password",
+	"token",
+	"secret",
+	"userdata",
+	"customdata",
+	"privatekey",
+}
+
+// secretAnnotations are annotations that hold a copy of the object, secrets included.
+var secretAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// redact replaces the values of the secret fields of the object, and removes its secret
+// annotations. It returns the paths of the redacted fields.
+func redact(object *unstructured.Unstructured) []string {
+	var redacted []string
+	annotations := object.GetAnnotations()
+	for _, annotation := range secretAnnotations {
+		if _, ok := annotations[annotation]; ok {
+			delete(annotations, annotation)
+			redacted = append(redacted, fmt.Sprintf("metadata.annotations[%s]", annotation))
+		}
+	}
+	if annotations != nil {
+		object.SetAnnotations(annotations)
+	}
+	fields := redactValue(object.Object, "")
+	slices.Sort(fields)
+	return append(redacted, fields...)
+}
+
+// redactValue redacts the secret fields of a value of an unstructured object, at the path.
+func redactValue(value any, path string) []string {
+	var redacted []string
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			if s, ok := field.(string); ok && s != "" &&
+				slices.Contains(secretFields, strings.ToLower(key)) {
+				v[key] = Redacted
+				redacted = append(redacted, fieldPath)
+				continue
+			}
+			redacted = append(redacted, redactValue(field, fieldPath)...)
+		}
+	case []any:
+		for i, item := range v {
+			redacted = append(redacted, redactValue(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return redacted
+}
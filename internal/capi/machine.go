@@ -0,0 +1,377 @@
+package capi
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// Group is the API group of the Cluster API Machine.
+const Group = "cluster.x-k8s.io"
+
+// Supported versions of the Machine API.
+const (
+	VersionV1Beta1 = "v1beta1"
+	VersionV1Beta2 = "v1beta2"
+)
+
+// Well-known Machine labels. They are the same in every supported version.
+const (
+	ClusterNameLabel           = "cluster.x-k8s.io/cluster-name"
+	MachineDeploymentNameLabel = "cluster.x-k8s.io/deployment-name"
+)
+
+// MachineInternalIP is the type of the internal IP address of a Machine.
+const MachineInternalIP = "InternalIP"
+
+// MachinePhaseDeleting is the phase of a Machine that is being deleted.
+const MachinePhaseDeleting = "Deleting"
+
+// Conditions that report whether the Node of a Machine is Ready. NodeReadyCondition is a v1beta2
+// condition. NodeHealthyCondition is the v1beta1 condition that v1beta1 Machines report if
+// Cluster API does not add v1beta2 conditions to their status.
+const (
+	NodeReadyCondition   = "NodeReady"
+	NodeHealthyCondition = "NodeHealthy"
+)
+
+// conditionSeverityError is the severity of a v1beta1 condition that reports an error.
+const conditionSeverityError = "Error"
+
+// ServedVersion returns the version of the Machine API to use with the management cluster. It
+// returns VersionV1Beta2 if the management cluster serves it, and otherwise VersionV1Beta1.
+func ServedVersion(config *rest.Config) (string, error) {
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to create discovery client: %w", err)
+	}
+	groups, err := client.ServerGroups()
+	if err != nil {
+		return "", fmt.Errorf("failed to discover API groups: %w", err)
+	}
+	for _, group := range groups.Groups {
+		if group.Name != Group {
+			continue
+		}
+		for _, version := range []string{VersionV1Beta2, VersionV1Beta1} {
+			if slices.ContainsFunc(group.Versions, func(v metav1.GroupVersionForDiscovery) bool {
+				return v.Version == version
+			}) {
+				return version, nil
+			}
+		}
+		return "", fmt.Errorf(
+			"API group %s is served, but none of its versions is supported",
+			Group,
+		)
+	}
+	return "", fmt.Errorf("API group %s is not served, is Cluster API installed?", Group)
+}
+
+// MachineGroupVersionKind returns the GroupVersionKind of the Machine in the version.
+func MachineGroupVersionKind(version string) schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: Group, Version: version, Kind: "Machine"}
+}
+
+// NewUnstructuredMachine returns an empty Machine in the version.
+func NewUnstructuredMachine(version string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(MachineGroupVersionKind(version))
+	return u
+}
+
+// NewUnstructuredMachineList returns an empty list of Machines in the version.
+func NewUnstructuredMachineList(version string) *unstructured.UnstructuredList {
+	u := &unstructured.UnstructuredList{}
+	u.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   Group,
+		Version: version,
+		Kind:    "MachineList",
+	})
+	return u
+}
+
+// Machine is the part of a Cluster API Machine that machine-monitor uses, in the same shape for
+// every supported version.
+type Machine struct {
+	// Object is the Machine as served by the management cluster. Changes to it are not
+	// reflected in the other fields.
+	Object *unstructured.Unstructured
+
+	ClusterName       string
+	InfrastructureRef InfrastructureRef
+	// BootstrapConfigRef references the bootstrap config of the Machine. Its Name is empty if the
+	// Machine has none, e.g. because its bootstrap data Secret is created by other means.
+	BootstrapConfigRef InfrastructureRef
+	Addresses          []MachineAddress
+	// NodeName is the name of the Node of the Machine, or empty if the Machine has no Node yet.
+	NodeName string
+	Phase    string
+	// Conditions are the conditions of the Machine, in the metav1.Condition layout that is used
+	// from v1beta2 on. For v1beta1 Machines, they are the v1beta2 conditions that Cluster API
+	// adds to the status, if any, or else the v1beta1 conditions.
+	Conditions []metav1.Condition
+	// FailureReason and FailureMessage report a terminal problem with the Machine. For v1beta2
+	// Machines, they are the deprecated v1beta1 fields that Cluster API still reports.
+	FailureReason  string
+	FailureMessage string
+	// ErrorConditions are the v1beta1 conditions with severity Error that are not true. Only
+	// v1beta1 conditions have a severity.
+	ErrorConditions []metav1.Condition
+}
+
+// InfrastructureRef references the infrastructure Machine of a Machine. The bootstrap config of
+// a Machine is referenced in the same way.
+type InfrastructureRef struct {
+	APIGroup string
+	// APIVersion is only known for v1beta1 Machines.
+	APIVersion string
+	Kind       string
+	Name       string
+}
+
+// MachineAddress is an address of a Machine.
+type MachineAddress struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// machineV1Beta1 is the part of a v1beta1 Machine that machine-monitor uses.
+type machineV1Beta1 struct {
+	Spec struct {
+		ClusterName       string `json:"clusterName"`
+		InfrastructureRef struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Name       string `json:"name"`
+		} `json:"infrastructureRef"`
+		Bootstrap struct {
+			ConfigRef *struct {
+				APIVersion string `json:"apiVersion"`
+				Kind       string `json:"kind"`
+				Name       string `json:"name"`
+			} `json:"configRef"`
+		} `json:"bootstrap"`
+	} `json:"spec"`
+	Status struct {
+		NodeRef *struct {
+			Name string `json:"name"`
+		} `json:"nodeRef"`
+		Addresses      []MachineAddress `json:"addresses"`
+		Phase          string           `json:"phase"`
+		FailureReason  string           `json:"failureReason"`
+		FailureMessage string           `json:"failureMessage"`
+		Conditions     []struct {
+			Type               string                 `json:"type"`
+			Status             metav1.ConditionStatus `json:"status"`
+			Severity           string                 `json:"severity"`
+			LastTransitionTime metav1.Time            `json:"lastTransitionTime"`
+			Reason             string                 `json:"reason"`
+			Message            string                 `json:"message"`
+		} `json:"conditions"`
+		V1Beta2 *struct {
+			Conditions []metav1.Condition `json:"conditions"`
+		} `json:"v1beta2"`
+	} `json:"status"`
+}
+
+// machineV1Beta2 is the part of a v1beta2 Machine that machine-monitor uses.
+type machineV1Beta2 struct {
+	Spec struct {
+		ClusterName       string `json:"clusterName"`
+		InfrastructureRef struct {
+			APIGroup string `json:"apiGroup"`
+			Kind     string `json:"kind"`
+			Name     string `json:"name"`
+		} `json:"infrastructureRef"`
+		Bootstrap struct {
+			ConfigRef *struct {
+				APIGroup string `json:"apiGroup"`
+				Kind     string `json:"kind"`
+				Name     string `json:"name"`
+			} `json:"configRef"`
+		} `json:"bootstrap"`
+	} `json:"spec"`
+	Status struct {
+		NodeRef *struct {
+			Name string `json:"name"`
+		} `json:"nodeRef"`
+		Addresses  []MachineAddress   `json:"addresses"`
+		Phase      string             `json:"phase"`
+		Conditions []metav1.Condition `json:"conditions"`
+		Deprecated *struct {
+			V1Beta1 *struct {
+				FailureReason  string `json:"failureReason"`
+				FailureMessage string `json:"failureMessage"`
+			} `json:"v1beta1"`
+		} `json:"deprecated"`
+	} `json:"status"`
+}
+
+// FromUnstructured returns the Machine view of a Machine of any supported version.
+func FromUnstructured(u *unstructured.Unstructured) (*Machine, error) {
+	gvk := u.GroupVersionKind()
+	machine := &Machine{Object: u}
+	switch gvk.Version {
+	case VersionV1Beta1:
+		m := machineV1Beta1{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &m); err != nil {
+			return nil, fmt.Errorf("failed to convert %s Machine: %w", gvk.Version, err)
+		}
+		machine.ClusterName = m.Spec.ClusterName
+		machine.InfrastructureRef = InfrastructureRef{
+			APIVersion: m.Spec.InfrastructureRef.APIVersion,
+			Kind:       m.Spec.InfrastructureRef.Kind,
+			Name:       m.Spec.InfrastructureRef.Name,
+		}
+		machine.InfrastructureRef.APIGroup, _, _ = strings.Cut(
+			m.Spec.InfrastructureRef.APIVersion,
+			"/",
+		)
+		if ref := m.Spec.Bootstrap.ConfigRef; ref != nil {
+			machine.BootstrapConfigRef = InfrastructureRef{
+				APIVersion: ref.APIVersion,
+				Kind:       ref.Kind,
+				Name:       ref.Name,
+			}
+			machine.BootstrapConfigRef.APIGroup, _, _ = strings.Cut(ref.APIVersion, "/")
+		}
+		if m.Status.NodeRef != nil {
+			machine.NodeName = m.Status.NodeRef.Name
+		}
+		machine.Addresses = m.Status.Addresses
+		machine.Phase = m.Status.Phase
+		machine.FailureReason = m.Status.FailureReason
+		machine.FailureMessage = m.Status.FailureMessage
+		var conditions []metav1.Condition
+		for _, c := range m.Status.Conditions {
+			condition := metav1.Condition{
+				Type:               c.Type,
+				Status:             c.Status,
+				LastTransitionTime: c.LastTransitionTime,
+				Reason:             c.Reason,
+				Message:            c.Message,
+			}
+			conditions = append(conditions, condition)
+			if c.Severity == conditionSeverityError && c.Status != metav1.ConditionTrue {
+				machine.ErrorConditions = append(machine.ErrorConditions, condition)
+			}
+		}
+		if m.Status.V1Beta2 != nil {
+			machine.Conditions = m.Status.V1Beta2.Conditions
+		} else {
+			machine.Conditions = conditions
+		}
+	case VersionV1Beta2:
+		m := machineV1Beta2{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &m); err != nil {
+			return nil, fmt.Errorf("failed to convert %s Machine: %w", gvk.Version, err)
+		}
+		machine.ClusterName = m.Spec.ClusterName
+		machine.InfrastructureRef = InfrastructureRef{
+			APIGroup: m.Spec.InfrastructureRef.APIGroup,
+			Kind:     m.Spec.InfrastructureRef.Kind,
+			Name:     m.Spec.InfrastructureRef.Name,
+		}
+		if ref := m.Spec.Bootstrap.ConfigRef; ref != nil {
+			machine.BootstrapConfigRef = InfrastructureRef{
+				APIGroup: ref.APIGroup,
+				Kind:     ref.Kind,
+				Name:     ref.Name,
+			}
+		}
+		if m.Status.NodeRef != nil {
+			machine.NodeName = m.Status.NodeRef.Name
+		}
+		machine.Addresses = m.Status.Addresses
+		machine.Phase = m.Status.Phase
+		machine.Conditions = m.Status.Conditions
+		if m.Status.Deprecated != nil && m.Status.Deprecated.V1Beta1 != nil {
+			machine.FailureReason = m.Status.Deprecated.V1Beta1.FailureReason
+			machine.FailureMessage = m.Status.Deprecated.V1Beta1.FailureMessage
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Machine version %q", gvk.GroupVersion())
+	}
+	return machine, nil
+}
+
+// Namespace returns the namespace of the Machine.
+func (m *Machine) Namespace() string {
+	return m.Object.GetNamespace()
+}
+
+// Name returns the name of the Machine.
+func (m *Machine) Name() string {
+	return m.Object.GetName()
+}
+
+// Labels returns the labels of the Machine.
+func (m *Machine) Labels() map[string]string {
+	return m.Object.GetLabels()
+}
+
+// InternalIP returns the internal IP address of the Machine, or an empty string if the Machine
+// has no internal IP address yet.
+func (m *Machine) InternalIP() string {
+	for _, addr := range m.Addresses {
+		if addr.Type == MachineInternalIP {
+			return addr.Address
+		}
+	}
+	return ""
+}
+
+// Deleting returns true if the Machine is being deleted.
+func (m *Machine) Deleting() bool {
+	return m.Object.GetDeletionTimestamp() != nil || m.Phase == MachinePhaseDeleting
+}
+
+// NodeReadySince returns the time since which the Node of the Machine is Ready, and true, or false
+// if the Machine has no Node, or its Node is not Ready.
+func (m *Machine) NodeReadySince() (time.Time, bool) {
+	if m.NodeName == "" {
+		return time.Time{}, false
+	}
+	for _, conditionType := range []string{NodeReadyCondition, NodeHealthyCondition} {
+		if c := m.Condition(conditionType); c != nil {
+			return c.LastTransitionTime.Time, c.Status == metav1.ConditionTrue
+		}
+	}
+	return time.Time{}, false
+}
+
+// Condition returns the condition of the type, or nil if the Machine has no such condition.
+func (m *Machine) Condition(conditionType string) *metav1.Condition {
+	for i := range m.Conditions {
+		if m.Conditions[i].Type == conditionType {
+			return &m.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// Failures returns a description of every failure that the Machine reports, i.e. its failure
+// reason, and its conditions with severity Error. Each description identifies the failure, so
+// that the same failure has the same description every time it is reported.
+func (m *Machine) Failures() []string {
+	var failures []string
+	if m.FailureReason != "" {
+		failures = append(failures, "failure reason "+m.FailureReason)
+	}
+	for _, c := range m.ErrorConditions {
+		failures = append(
+			failures,
+			fmt.Sprintf("condition %s is %s: %s", c.Type, c.Status, c.Reason),
+		)
+	}
+	return failures
+}
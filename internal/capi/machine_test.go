@@ -0,0 +1,183 @@
+package capi
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func unstructuredFromJSON(data string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	Expect(json.Unmarshal([]byte(data), &u.Object)).To(Succeed())
+	return u
+}
+
+var _ = Describe("FromUnstructured", func() {
+	It("reads a v1beta1 Machine", func() {
+		machine, err := FromUnstructured(unstructuredFromJSON(`{
+			"apiVersion": "cluster.x-k8s.io/v1beta1",
+			"kind": "Machine",
+			"metadata": {"namespace": "ns", "name": "m", "labels": {"cluster.x-k8s.io/deployment-name": "md-0"}},
+			"spec": {
+				"clusterName": "c",
+				"infrastructureRef": {"apiVersion": "infrastructure.cluster.x-k8s.io/v1beta1", "kind": "DockerMachine", "name": "dm"},
+				"bootstrap": {"configRef": {"apiVersion": "bootstrap.cluster.x-k8s.io/v1beta1", "kind": "KubeadmConfig", "name": "kc"}}
+			},
+			"status": {
+				"nodeRef": {"kind": "Node", "name": "node-1"},
+				"addresses": [{"type": "ExternalIP", "address": "1.2.3.4"}, {"type": "InternalIP", "address": "10.0.0.1"}],
+				"phase": "Running",
+				"conditions": [{"type": "Ready", "status": "True", "lastTransitionTime": "2025-01-02T03:04:05Z"}]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machine.Namespace()).To(Equal("ns"))
+		Expect(machine.Name()).To(Equal("m"))
+		Expect(machine.Labels()).To(HaveKeyWithValue(MachineDeploymentNameLabel, "md-0"))
+		Expect(machine.ClusterName).To(Equal("c"))
+		Expect(machine.InfrastructureRef).To(Equal(InfrastructureRef{
+			APIGroup:   "infrastructure.cluster.x-k8s.io",
+			APIVersion: "infrastructure.cluster.x-k8s.io/v1beta1",
+			Kind:       "DockerMachine",
+			Name:       "dm",
+		}))
+		Expect(machine.BootstrapConfigRef).To(Equal(InfrastructureRef{
+			APIGroup:   "bootstrap.cluster.x-k8s.io",
+			APIVersion: "bootstrap.cluster.x-k8s.io/v1beta1",
+			Kind:       "KubeadmConfig",
+			Name:       "kc",
+		}))
+		Expect(machine.InternalIP()).To(Equal("10.0.0.1"))
+		Expect(machine.NodeName).To(Equal("node-1"))
+		Expect(machine.Phase).To(Equal("Running"))
+		Expect(machine.Condition("Ready")).NotTo(BeNil())
+		Expect(machine.Condition("Ready").Status).To(Equal(metav1.ConditionTrue))
+	})
+
+	It("prefers the v1beta2 conditions of a v1beta1 Machine", func() {
+		machine, err := FromUnstructured(unstructuredFromJSON(`{
+			"apiVersion": "cluster.x-k8s.io/v1beta1",
+			"kind": "Machine",
+			"status": {
+				"conditions": [{"type": "Ready", "status": "False", "lastTransitionTime": "2025-01-02T03:04:05Z"}],
+				"v1beta2": {"conditions": [{"type": "NodeReady", "status": "True", "reason": "NodeReady", "lastTransitionTime": "2025-01-02T03:04:05Z"}]}
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machine.Condition("Ready")).To(BeNil())
+		Expect(machine.Condition("NodeReady")).NotTo(BeNil())
+	})
+
+	It("reads a v1beta2 Machine", func() {
+		machine, err := FromUnstructured(unstructuredFromJSON(`{
+			"apiVersion": "cluster.x-k8s.io/v1beta2",
+			"kind": "Machine",
+			"metadata": {"namespace": "ns", "name": "m"},
+			"spec": {
+				"clusterName": "c",
+				"infrastructureRef": {"apiGroup": "infrastructure.cluster.x-k8s.io", "kind": "DockerMachine", "name": "dm"},
+				"bootstrap": {"configRef": {"apiGroup": "bootstrap.cluster.x-k8s.io", "kind": "KubeadmConfig", "name": "kc"}}
+			},
+			"status": {
+				"nodeRef": {"name": "node-1"},
+				"addresses": [{"type": "InternalIP", "address": "10.0.0.1"}],
+				"phase": "Provisioned",
+				"conditions": [{"type": "NodeReady", "status": "False", "reason": "NodeDoesNotExist", "lastTransitionTime": "2025-01-02T03:04:05Z"}]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machine.ClusterName).To(Equal("c"))
+		Expect(machine.InfrastructureRef).To(Equal(InfrastructureRef{
+			APIGroup: "infrastructure.cluster.x-k8s.io",
+			Kind:     "DockerMachine",
+			Name:     "dm",
+		}))
+		Expect(machine.BootstrapConfigRef).To(Equal(InfrastructureRef{
+			APIGroup: "bootstrap.cluster.x-k8s.io",
+			Kind:     "KubeadmConfig",
+			Name:     "kc",
+		}))
+		Expect(machine.InternalIP()).To(Equal("10.0.0.1"))
+		Expect(machine.NodeName).To(Equal("node-1"))
+		Expect(machine.Phase).To(Equal("Provisioned"))
+		Expect(machine.Condition("NodeReady").Reason).To(Equal("NodeDoesNotExist"))
+	})
+
+	It("rejects an unsupported version", func() {
+		_, err := FromUnstructured(unstructuredFromJSON(`{
+			"apiVersion": "cluster.x-k8s.io/v1alpha4",
+			"kind": "Machine"
+		}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Machine", func() {
+	It("reports when its Node became Ready", func() {
+		machine, err := FromUnstructured(unstructuredFromJSON(`{
+			"apiVersion": "cluster.x-k8s.io/v1beta2",
+			"kind": "Machine",
+			"status": {
+				"nodeRef": {"name": "node-1"},
+				"conditions": [{"type": "NodeReady", "status": "True", "reason": "NodeReady", "lastTransitionTime": "2025-01-02T03:04:05Z"}]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		since, ready := machine.NodeReadySince()
+		Expect(ready).To(BeTrue())
+		Expect(since.UTC().Format(time.RFC3339)).To(Equal("2025-01-02T03:04:05Z"))
+		Expect(machine.Deleting()).To(BeFalse())
+	})
+
+	It("reports that a Machine without a Node is not Ready", func() {
+		machine, err := FromUnstructured(unstructuredFromJSON(`{
+			"apiVersion": "cluster.x-k8s.io/v1beta1",
+			"kind": "Machine",
+			"status": {
+				"phase": "Deleting",
+				"conditions": [{"type": "NodeHealthy", "status": "True", "lastTransitionTime": "2025-01-02T03:04:05Z"}]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		_, ready := machine.NodeReadySince()
+		Expect(ready).To(BeFalse())
+		Expect(machine.Deleting()).To(BeTrue())
+	})
+
+	It("reports the failures of a v1beta1 Machine", func() {
+		machine, err := FromUnstructured(unstructuredFromJSON(`{
+			"apiVersion": "cluster.x-k8s.io/v1beta1",
+			"kind": "Machine",
+			"status": {
+				"failureReason": "CreateError",
+				"failureMessage": "instance failed to launch",
+				"conditions": [
+					{"type": "InfrastructureReady", "status": "False", "severity": "Error", "reason": "InstanceProvisionFailed", "lastTransitionTime": "2025-01-02T03:04:05Z"},
+					{"type": "BootstrapReady", "status": "False", "severity": "Info", "reason": "WaitingForDataSecret", "lastTransitionTime": "2025-01-02T03:04:05Z"}
+				]
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machine.FailureMessage).To(Equal("instance failed to launch"))
+		Expect(machine.Failures()).To(Equal([]string{
+			"failure reason CreateError",
+			"condition InfrastructureReady is False: InstanceProvisionFailed",
+		}))
+	})
+
+	It("reports the deprecated failure reason of a v1beta2 Machine", func() {
+		machine, err := FromUnstructured(unstructuredFromJSON(`{
+			"apiVersion": "cluster.x-k8s.io/v1beta2",
+			"kind": "Machine",
+			"status": {
+				"deprecated": {"v1beta1": {"failureReason": "UpdateError", "failureMessage": "m"}}
+			}
+		}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(machine.Failures()).To(Equal([]string{"failure reason UpdateError"}))
+	})
+})
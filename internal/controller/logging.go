@@ -0,0 +1,74 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/logging"
+)
+
+// machineLogger returns the logger of the Machine. The logger of the controller already carries
+// the namespace and name of the Machine, and this logger adds its cluster, and management cluster,
+// if any. If diagnostics log files are enabled, the logger also writes to the diagnostics log file
+// of the Machine. The returned function records the result of the reconcile in the file, and
+// closes it.
+func (r *MachineReconciler) machineLogger(
+	ctx context.Context,
+	machine *capi.Machine,
+) (logr.Logger, func(ctrl.Result, error)) {
+	log := logf.FromContext(ctx)
+	keysAndValues := []any{"cluster", machine.ClusterName}
+	if r.ManagementCluster != "" {
+		keysAndValues = append(keysAndValues, "managementCluster", r.ManagementCluster)
+	}
+	if !r.MachineDiagnosticsLog {
+		return log.WithValues(keysAndValues...), func(ctrl.Result, error) {}
+	}
+
+	file, err := logging.OpenDiagnosticsFile(logging.DiagnosticsFilePath(
+		r.LocalJournalDirectory,
+		machine.Namespace(),
+		machine.Name(),
+	))
+	if err != nil {
+		log.Error(err, "failed to open diagnostics log file, not writing diagnostics")
+		return log.WithValues(keysAndValues...), func(ctrl.Result, error) {}
+	}
+	// The namespace and name are added to the file only, because the logger already has them.
+	tee, fileLog := logging.Tee(log, file, "namespace", machine.Namespace(), "name", machine.Name())
+	tee = tee.WithValues(keysAndValues...)
+	fileLog = fileLog.WithValues(keysAndValues...)
+
+	return tee, func(result ctrl.Result, err error) {
+		// Errors are returned to, and logged by, the controller, so they are recorded in the file
+		// only.
+		if err != nil {
+			fileLog.Error(err, "reconcile failed")
+		} else {
+			fileLog.Info("reconcile finished", "requeueAfter", result.RequeueAfter)
+		}
+		if err := file.Close(); err != nil {
+			log.Error(err, "failed to close diagnostics log file")
+		}
+	}
+}
@@ -18,40 +18,97 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"path"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/dlipovetsky/machine-monitor/internal/archive"
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/forward"
+	"github.com/dlipovetsky/machine-monitor/internal/index"
 	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/loki"
+	"github.com/dlipovetsky/machine-monitor/internal/otlp"
 	"github.com/dlipovetsky/machine-monitor/internal/ssh"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+	"github.com/dlipovetsky/machine-monitor/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
-	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // MachineReconciler reconciles a Machine object
 type MachineReconciler struct {
 	Client client.Client
+	// APIReader reads Secrets without a cache, so that Secrets are not watched. If nil, Client is
+	// used.
+	APIReader client.Reader
 
-	SSHPort       int
-	SSHUser       string
-	SSHPrivateKey []byte
+	// ManagementCluster is the name of the management cluster that Client accesses. It is empty
+	// if machine-monitor monitors only one management cluster.
+	ManagementCluster string
+	// MachineAPIVersion is the version of the Cluster API Machine API that the management cluster
+	// serves, either capi.VersionV1Beta1 or capi.VersionV1Beta2. If empty, v1beta1 is used.
+	MachineAPIVersion string
 
-	BastionSSHHost       string
-	BastionSSHPort       int
-	BastionSSHUser       string
-	BastionSSHPrivateKey []byte
+	LocalJournalDirectory string
+	// Store stores the journals of the Machines. If nil, they are stored in local journal files
+	// in LocalJournalDirectory.
+	Store journald.Store
+	// LocalJournalSyncInterval is how often the local journal files are synced to disk. If zero,
+	// they are synced after every write.
+	LocalJournalSyncInterval time.Duration
+	// LocalJournalMaxFileSize is the size, in bytes, above which the journal of a Machine is
+	// rotated. If zero, journals are not rotated.
+	LocalJournalMaxFileSize int64
+	// DeleteJournalsOfDeletedMachines deletes the journal of a Machine, and the files derived
+	// from it, once the Machine is deleted, and, if Archiver is set, its journal is archived.
+	DeleteJournalsOfDeletedMachines bool
+	// MachineDiagnosticsLog enables a diagnostics log file for each Machine, in the local journal
+	// directory, that records the connection history of the Machine.
+	MachineDiagnosticsLog bool
 
-	LocalJournalDirectory        string
-	RemoteJournaldCursorFilePath string
+	// Loki configures forwarding of journal entries to Loki. If nil, entries are not forwarded.
+	Loki *loki.Config
+	// Archiver archives the journal of each boot to object storage once the boot is complete. If
+	// nil, journals are not archived.
+	Archiver *archive.Archiver
+	// OTLP configures export of journal entries as OpenTelemetry log records. If nil, entries are
+	// not exported.
+	OTLP *otlp.Config
+	// SearchIndex enables a full-text search index for each Machine, in the local journal
+	// directory, that is updated as entries are written to the local journal file.
+	SearchIndex bool
+
+	// Settings are the settings of the Machines that no override applies to.
+	Settings MachineSettings
+	// Overrides replace the settings of the Machines that match their selectors.
+	Overrides []SettingsOverride
+
+	// Recorder records Events on Machines whose journal cannot be collected until they, or the
+	// settings, change. If nil, no Events are recorded.
+	Recorder record.EventRecorder
+
+	// DialScheduler limits how fast Machines are dialed. It can be shared by reconcilers. If nil,
+	// Machines are dialed without limits.
+	DialScheduler *ssh.Scheduler
 
 	LabelSelector           *metav1.LabelSelector
 	MaxConcurrentReconciles int
@@ -59,15 +116,53 @@ type MachineReconciler struct {
 	RequeueMaxDelay         time.Duration
 
 	controller controller.Controller
+
+	// requeue receives the Machines that are requeued outside of the Machine events.
+	requeue chan event.GenericEvent
+
+	// settingsMu guards Settings, Overrides, streams, and failed, once the reconciler runs.
+	settingsMu sync.RWMutex
+	streams    map[types.NamespacedName]*activeStream
+	failed     map[types.NamespacedName]*failedMachine
 }
 
-// +kubebuilder:rbac:groups=machine.cluster.x-k8s.io,resources=machines,verbs=get;list;watch
-// +kubebuilder:rbac:groups=machine.cluster.x-k8s.io,resources=machines/status,verbs=get
+// forwarderDrainTimeout is how long to wait for the remaining entries of a Machine to be forwarded
+// after the stream ends. Entries that are not forwarded are forwarded after the next stream starts.
+const forwarderDrainTimeout = 30 * time.Second
+
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines/status,verbs=get
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile the Machine resource.
 // If the Machine has an IP address, it will stream its journal to a local file, making sure that
-// the entire journal is streamed, and that entries already in the local file are not streamed again
-func (r *MachineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+// the entire journal is streamed, and that entries already in the local file are not streamed again.
+// Bootstrap milestones found in the journal are recorded in a timeline file, and the timeline of
+// the latest boot is added to the Machine annotations.
+// The collection policy decides whether the journal is streamed, and stops the stream once the
+// journal should no longer be collected. While the journal is streamed, diagnostic snapshots are
+// taken when they are triggered.
+// Each reconcile is traced, with the Machine attributes, so that the time spent dialing, probing
+// and starting the stream can be seen.
+func (r *MachineReconciler) Reconcile(
+	ctx context.Context,
+	req ctrl.Request,
+) (_ ctrl.Result, err error) {
+	ctx, span := tracing.Start(ctx, "Reconcile",
+		attribute.String(otlp.AttributeNamespace, req.Namespace),
+		attribute.String(otlp.AttributeMachineName, req.Name),
+	)
+	defer func() {
+		tracing.End(span, err)
+	}()
+	return r.reconcile(ctx, req)
+}
+
+func (r *MachineReconciler) reconcile(
+	ctx context.Context,
+	req ctrl.Request,
+) (result ctrl.Result, err error) {
 	if cause := context.Cause(ctx); cause != nil {
 		// A worker may be in the queue, but not yet running, when the context is cancelled.
 		// To allow the process to exit faster, we exit early.
@@ -76,75 +171,57 @@ func (r *MachineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 	log := logf.FromContext(ctx)
 
-	machine := &clusterv1.Machine{}
-	err := r.Client.Get(ctx, req.NamespacedName, machine)
+	object := capi.NewUnstructuredMachine(r.machineAPIVersion())
+	err = r.Client.Get(ctx, req.NamespacedName, object)
+	if apierrors.IsNotFound(err) {
+		// Machine was deleted after we received the request, so its journal is complete.
+		return ctrl.Result{}, r.deleted(ctx, req.Namespace, req.Name)
+	}
 	if err != nil {
 		return ctrl.Result{}, fmt.Errorf("failed to get machine %s: %w", req.NamespacedName, err)
 	}
-	if apierrors.IsNotFound(err) {
-		// Machine was deleted after we received the request, so there is nothing to do.
-		return ctrl.Result{}, nil
+	machine, err := capi.FromUnstructured(object)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
+	// The Machine is reconciled, so it no longer waits for a change to be retried.
+	r.forgetFailed(req.NamespacedName)
 
-	// Get the machine IP from the status.
-	machineIP := ""
-	for _, addr := range machine.Status.Addresses {
-		if addr.Type == clusterv1.MachineInternalIP {
-			machineIP = addr.Address
-			break
-		}
+	span := trace.SpanFromContext(ctx)
+	for key, value := range r.otlpResourceAttributes(machine) {
+		span.SetAttributes(attribute.String(key, value))
+	}
+
+	settings := r.settingsFor(machine.Labels())
+
+	if collect, reason := settings.collectionDecision(machine, time.Now()); !collect {
+		// We expect to be requeued by the Machine update event that changes the decision.
+		log.V(1).Info("not collecting journal", "reason", reason)
+		return ctrl.Result{}, nil
 	}
+
+	machineIP := machine.InternalIP()
 	if machineIP == "" {
 		// We expect to be requeued by the Machine status update event, so we do not explicitly requeue.
 		return ctrl.Result{}, nil
 	}
 
+	log, closeLog := r.machineLogger(ctx, machine)
+	defer func() {
+		closeLog(result, err)
+	}()
+	ctx = logf.IntoContext(ctx, log)
+
 	log.V(1).Info("Machine IP found",
 		"name",
-		machine.Name,
+		machine.Name(),
 		"ip",
 		machineIP,
 	)
 
-	machineSSHConfig, err := ssh.NewSSHConfig(r.SSHUser, r.SSHPrivateKey)
+	sshClient, err := r.dial(ctx, settings, machineIP)
 	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("failed to create SSH config: %w", err)
-	}
-
-	var sshClient *ssh.Client
-	if r.BastionSSHHost != "" {
-		log.V(1).Info("creating SSH client with bastion",
-			"bastionHost", r.BastionSSHHost,
-			"bastionPort", r.BastionSSHPort,
-			"bastionUser", r.BastionSSHUser,
-			"machineHost", machineIP,
-			"machinePort", r.SSHPort,
-		)
-		bastionSSHConfig, err := ssh.NewSSHConfig(r.BastionSSHUser, r.BastionSSHPrivateKey)
-		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("failed to create SSH config: %w", err)
-		}
-		sshClient, err = ssh.NewClientWithBastion(
-			ctx,
-			bastionSSHConfig,
-			r.BastionSSHHost,
-			r.BastionSSHPort,
-			machineSSHConfig,
-			machineIP,
-			r.SSHPort,
-		)
-		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("failed to create SSH client with bastion: %w", err)
-		}
-	} else {
-		log.V(1).Info("creating SSH client without bastion",
-			"machineHost", machineIP,
-			"machinePort", r.SSHPort,
-		)
-		sshClient, err = ssh.NewClient(ctx, machineSSHConfig, machineIP, r.SSHPort)
-		if err != nil {
-			return ctrl.Result{}, fmt.Errorf("failed to create SSH client: %w", err)
-		}
+		return r.retry(ctx, object, machine, settings, 0, err)
 	}
 
 	defer func() {
@@ -156,35 +233,335 @@ func (r *MachineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		}
 	}()
 
-	localJournalFilePath := path.Join(
-		r.LocalJournalDirectory,
-		// The machine name is unique in a namespace, so we use both the namespace
-		// and the name to ensure the local journal file name is unique.
-		fmt.Sprintf(
-			"%s-%s.log",
-			machine.Namespace,
-			machine.Name,
-		),
+	privilege, err := r.privilege(ctx, settings)
+	if err != nil {
+		return r.retry(ctx, object, machine, settings, 0, err)
+	}
+	remote, err := journald.NewRemote(ctx, sshClient, privilege)
+	if err != nil {
+		return r.retry(ctx, object, machine, settings, 0, err)
+	}
+	log.Info(
+		"connected to machine",
+		"ip",
+		machineIP,
+		"systemdVersion",
+		remote.Capabilities.SystemdVersion,
+		"privilege",
+		remote.Privilege.Strategy,
+	)
+
+	// Record which Machine the journal belongs to, so that it can be read without access to the
+	// Kubernetes API, and the clock offset of its current boot. The clock offsets of earlier boots
+	// are kept, because they apply to the entries of those boots.
+	info, err := r.store().MachineInfo(machine.Namespace(), machine.Name())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error(err, "failed to read machine info, replacing it")
+	}
+	info.Namespace = machine.Namespace()
+	info.Name = machine.Name()
+	info.Cluster = machine.ClusterName
+	info.MachineDeployment = machine.Labels()[capi.MachineDeploymentNameLabel]
+	info.ManagementCluster = r.ManagementCluster
+	if remote.ClockOffset != nil {
+		info.RecordClockOffset(remote.BootID, *remote.ClockOffset)
+	}
+	if err := r.store().PutMachineInfo(info); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.rotateIfFull(ctx, machine.Namespace(), machine.Name()); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Milestones are recorded as entries are streamed, and the Machine is annotated in the
+	// background.
+	annotator, stopAnnotator := startTimelineAnnotator(ctx, r.Client, object)
+	defer stopAnnotator()
+	recorder, err := timeline.NewRecorder(
+		timeline.FilePath(r.LocalJournalDirectory, machine.Namespace(), machine.Name()),
+		annotator.HandleTimeline,
 	)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to create timeline recorder: %w", err)
+	}
+
+	handlers := []journald.EntryHandler{recorder.HandleEntry}
+
+	for _, sink := range r.sinks(machine) {
+		forwarder, err := forward.New(
+			sink.config,
+			sink.pusher,
+			r.store(),
+			machine.Namespace(),
+			machine.Name(),
+			forward.CursorFilePath(
+				r.LocalJournalDirectory,
+				machine.Namespace(),
+				machine.Name(),
+				sink.name,
+			),
+		)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to create %s forwarder: %w", sink.name, err)
+		}
+		stopForwarder := startForwarder(ctx, sink.name, forwarder)
+		defer stopForwarder()
+		handlers = append(handlers, forwarder.Notify)
+	}
+
+	if r.Archiver != nil {
+		machineArchiver := r.Archiver.ForMachine(
+			archive.KeyData{
+				ManagementCluster: r.ManagementCluster,
+				Cluster:           machine.ClusterName,
+				Namespace:         machine.Namespace(),
+				Machine:           machine.Name(),
+			},
+			r.store(),
+			archive.StateFilePath(r.LocalJournalDirectory, machine.Namespace(), machine.Name()),
+		)
+		archiverCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			machineArchiver.Run(archiverCtx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+		handlers = append(handlers, machineArchiver.HandleEntry)
+	}
 
+	// The stream is stopped once the collection policy says the journal should no longer be
+	// collected, once the settings of the Machine change, or once its journal should be rotated.
+	streamCtx, stopStream := context.WithCancelCause(ctx)
+	defer stopStream(nil)
+	defer r.registerStream(req.NamespacedName, machine.Labels(), settings, stopStream)()
+	go r.enforceCollectionPolicy(streamCtx, req.NamespacedName, settings, func() {
+		stopStream(nil)
+	})
+	go r.enforceMaxFileSize(streamCtx, req.NamespacedName, func() {
+		stopStream(errLocalJournalFull)
+	})
+
+	// Snapshots are taken while the journal is streamed, and share its SSH client.
+	snapshotsDone := make(chan struct{})
+	go func() {
+		defer close(snapshotsDone)
+		r.takeSnapshots(streamCtx, req.NamespacedName, machine, settings, remote)
+	}()
+	defer func() {
+		stopStream(nil)
+		<-snapshotsDone
+	}()
+
+	streamStarted := time.Now()
 	err = journald.StreamFromRemote(
-		ctx,
-		sshClient,
-		r.RemoteJournaldCursorFilePath,
-		localJournalFilePath,
+		streamCtx,
+		remote,
+		r.store(),
+		machine.Namespace(),
+		machine.Name(),
+		settings.Backfill,
+		r.LocalJournalSyncInterval,
+		handlers...,
 	)
 	if err != nil {
-		// If we have an unexpected error, we return an error, and the controller will requeue the machine.
-		// We rely on the retry-backoff mechanism to avoid overwhelming the remote machine.
-		return ctrl.Result{}, fmt.Errorf("failed to import journal from remote: %w", err)
+		return r.retry(
+			ctx,
+			object,
+			machine,
+			settings,
+			time.Since(streamStarted),
+			fmt.Errorf("failed to import journal from remote: %w", err),
+		)
+	}
+
+	if ctx.Err() == nil && errors.Is(context.Cause(streamCtx), errSettingsChanged) {
+		log.Info("restarting journal stream with changed settings")
+		return ctrl.Result{RequeueAfter: time.Second}, nil
+	}
+	if ctx.Err() == nil && errors.Is(context.Cause(streamCtx), errLocalJournalFull) {
+		log.Info("restarting journal stream to rotate local journal")
+		return ctrl.Result{RequeueAfter: time.Second}, nil
 	}
 
 	return ctrl.Result{}, nil
 }
 
+// machineAPIVersion returns the version of the Machine API to use.
+func (r *MachineReconciler) machineAPIVersion() string {
+	if r.MachineAPIVersion == "" {
+		return capi.VersionV1Beta1
+	}
+	return r.MachineAPIVersion
+}
+
+// store returns the Store of the journals of the Machines.
+func (r *MachineReconciler) store() journald.Store {
+	if r.Store == nil {
+		return &journald.FileStore{Directory: r.LocalJournalDirectory}
+	}
+	return r.Store
+}
+
+// deleted archives every remaining segment of a deleted Machine, if an Archiver is set, and then
+// deletes its journal, if DeleteJournalsOfDeletedMachines is set. The journal is kept if it
+// cannot be archived.
+func (r *MachineReconciler) deleted(ctx context.Context, namespace, name string) error {
+	if r.Archiver != nil {
+		if err := r.archiveDeleted(ctx, namespace, name); err != nil {
+			return err
+		}
+	}
+	if r.DeleteJournalsOfDeletedMachines {
+		return r.deleteJournal(ctx, namespace, name)
+	}
+	return nil
+}
+
+// archiveDeleted archives every remaining segment of a deleted Machine, including the segment of
+// its latest boot. Since the Machine is gone, its Cluster is read from its MachineInfo. If the
+// Cluster is unknown, the segments cannot be given their keys, and are not archived.
+func (r *MachineReconciler) archiveDeleted(ctx context.Context, namespace, name string) error {
+	info, err := r.store().MachineInfo(namespace, name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read machine info of deleted machine: %w", err)
+	}
+	err = r.Archiver.Archive(
+		ctx,
+		archive.KeyData{
+			ManagementCluster: r.ManagementCluster,
+			Cluster:           info.Cluster,
+			Namespace:         namespace,
+			Machine:           name,
+		},
+		r.store(),
+		archive.StateFilePath(r.LocalJournalDirectory, namespace, name),
+		true,
+	)
+	if errors.Is(err, archive.ErrUnknownCluster) {
+		logf.FromContext(ctx).Info("not archiving journal of deleted machine of unknown cluster")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to archive journal of deleted machine: %w", err)
+	}
+	return nil
+}
+
+// sink is a destination for journal entries, usually remote.
+type sink struct {
+	name   string
+	config forward.Config
+	pusher forward.Pusher
+}
+
+// sinks returns the configured sinks, with the labels or attributes that identify the Machine.
+func (r *MachineReconciler) sinks(machine *capi.Machine) []sink {
+	var sinks []sink
+	if r.Loki != nil {
+		sinks = append(sinks, sink{
+			name:   loki.SinkName,
+			config: r.Loki.ForwardConfig(),
+			pusher: loki.NewPusher(*r.Loki, r.lokiLabels(machine)),
+		})
+	}
+	if r.OTLP != nil {
+		sinks = append(sinks, sink{
+			name:   otlp.SinkName,
+			config: r.OTLP.ForwardConfig(),
+			pusher: otlp.NewExporter(*r.OTLP, r.otlpResourceAttributes(machine)),
+		})
+	}
+	if r.SearchIndex {
+		sinks = append(sinks, sink{
+			name:   index.SinkName,
+			config: index.ForwardConfig(),
+			pusher: index.NewWriter(
+				index.DirectoryPath(r.LocalJournalDirectory, machine.Namespace(), machine.Name()),
+			),
+		})
+	}
+	return sinks
+}
+
+// startForwarder runs the forwarder in the background. The returned function drains the
+// forwarder, waiting at most forwarderDrainTimeout, and then stops it.
+func startForwarder(ctx context.Context, sink string, forwarder *forward.Forwarder) func() {
+	log := logf.FromContext(ctx).WithValues("sink", sink)
+
+	forwarderCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := forwarder.Run(forwarderCtx); err != nil && forwarderCtx.Err() == nil {
+			log.Error(err, "failed to forward journal")
+		}
+	}()
+
+	return func() {
+		forwarder.Drain()
+		select {
+		case <-done:
+		case <-time.After(forwarderDrainTimeout):
+			log.Info("timed out forwarding remaining journal entries")
+		}
+		cancel()
+		<-done
+	}
+}
+
+// lokiLabels returns the Loki labels that identify the Machine.
+func (r *MachineReconciler) lokiLabels(machine *capi.Machine) map[string]string {
+	labels := map[string]string{
+		"namespace":          machine.Namespace(),
+		"machine":            machine.Name(),
+		"cluster":            machine.Labels()[capi.ClusterNameLabel],
+		"machine_deployment": machine.Labels()[capi.MachineDeploymentNameLabel],
+	}
+	if r.ManagementCluster != "" {
+		labels["management_cluster"] = r.ManagementCluster
+	}
+	return labels
+}
+
+// otlpResourceAttributes returns the OpenTelemetry resource attributes that identify the Machine
+// and the Cluster API resources it references.
+func (r *MachineReconciler) otlpResourceAttributes(
+	machine *capi.Machine,
+) map[string]string {
+	machineDeploymentName := machine.Labels()[capi.MachineDeploymentNameLabel]
+	infrastructureRef := machine.InfrastructureRef
+	attributes := map[string]string{
+		otlp.AttributeNamespace:                 machine.Namespace(),
+		otlp.AttributeMachineName:               machine.Name(),
+		otlp.AttributeClusterName:               machine.ClusterName,
+		otlp.AttributeMachineDeploymentName:     machineDeploymentName,
+		otlp.AttributeInfrastructureRefAPIGroup: infrastructureRef.APIGroup,
+		otlp.AttributeInfrastructureRefKind:     infrastructureRef.Kind,
+		otlp.AttributeInfrastructureRefName:     infrastructureRef.Name,
+	}
+	// From v1beta2 on, Machines reference their infrastructure Machine without a version.
+	if infrastructureRef.APIVersion != "" {
+		attributes[otlp.AttributeInfrastructureRefAPIVersion] = infrastructureRef.APIVersion
+	}
+	if r.ManagementCluster != "" {
+		attributes[otlp.AttributeManagementClusterName] = r.ManagementCluster
+	}
+	return attributes
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *MachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	b := ctrl.NewControllerManagedBy(mgr).Named("machinemonitor")
+	// Controller names must be unique, and label the controller metrics, so the controller of each
+	// management cluster is named after it.
+	name := "machinemonitor"
+	if r.ManagementCluster != "" {
+		name += "-" + r.ManagementCluster
+	}
+	b := ctrl.NewControllerManagedBy(mgr).Named(name)
 
 	var forOpts []builder.ForOption
 	if r.LabelSelector != nil {
@@ -194,7 +571,18 @@ func (r *MachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		}
 		forOpts = append(forOpts, builder.WithPredicates(labelSelectorPredicate))
 	}
-	b = b.For(&clusterv1.Machine{}, forOpts...)
+	b = b.For(capi.NewUnstructuredMachine(r.machineAPIVersion()), forOpts...)
+
+	// Machines that failed in a way that retrying does not fix are requeued when their settings
+	// change, or when the Secret of their sudo password changes. Only the metadata of Secrets is
+	// watched, so that their data is not cached.
+	r.requeue = make(chan event.GenericEvent, requeueBufferSize)
+	b = b.WatchesRawSource(source.Channel(r.requeue, &handler.EnqueueRequestForObject{}))
+	b = b.Watches(
+		&corev1.Secret{},
+		handler.EnqueueRequestsFromMapFunc(r.failedMachinesForSecret),
+		builder.OnlyMetadata,
+	)
 
 	b = b.WithOptions(controller.Options{
 		MaxConcurrentReconciles: r.MaxConcurrentReconciles,
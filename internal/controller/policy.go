@@ -0,0 +1,115 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+)
+
+// Collection policies decide when the journal of a Machine is collected.
+const (
+	// CollectionPolicyAlways collects the journal of every Machine that has an IP address.
+	CollectionPolicyAlways = "always"
+	// CollectionPolicyBootstrap collects the journal of a Machine until its Node has been Ready
+	// for a grace period, and again once the Machine is being deleted, or loses its Node.
+	CollectionPolicyBootstrap = "bootstrap"
+)
+
+// collectionPolicyCheckInterval is how often the collection policy is checked while a journal is
+// collected. The manager caches unstructured objects, so the Machine is read from the cache,
+// and checking is cheap.
+const collectionPolicyCheckInterval = 15 * time.Second
+
+// collectionDecision returns whether the journal of the Machine should be collected, and why.
+func (s MachineSettings) collectionDecision(
+	machine *capi.Machine,
+	now time.Time,
+) (bool, string) {
+	if s.CollectionPolicy != CollectionPolicyBootstrap {
+		return true, "the collection policy is " + CollectionPolicyAlways
+	}
+	if machine.Deleting() {
+		return true, "the machine is being deleted"
+	}
+	if machine.NodeName == "" {
+		return true, "the machine has no node"
+	}
+	readySince, ready := machine.NodeReadySince()
+	if !ready {
+		return true, "the node is not ready"
+	}
+	if now.Before(readySince.Add(s.NodeReadyGracePeriod)) {
+		return true, "the node became ready less than the grace period ago"
+	}
+	return false, "the node has been ready for longer than the grace period"
+}
+
+// enforceCollectionPolicy checks the collection policy of the Machine until the context is
+// cancelled, and calls stop once the journal of the Machine should no longer be collected.
+func (r *MachineReconciler) enforceCollectionPolicy(
+	ctx context.Context,
+	key types.NamespacedName,
+	settings MachineSettings,
+	stop func(),
+) {
+	if settings.CollectionPolicy != CollectionPolicyBootstrap {
+		return
+	}
+	log := logf.FromContext(ctx)
+
+	ticker := time.NewTicker(collectionPolicyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if collect, reason := r.stillCollecting(ctx, key, settings, time.Now()); !collect {
+			log.Info("stopping journal collection", "reason", reason)
+			stop()
+			return
+		}
+	}
+}
+
+// stillCollecting reads the Machine, and returns whether its journal should still be collected,
+// and why.
+func (r *MachineReconciler) stillCollecting(
+	ctx context.Context,
+	key types.NamespacedName,
+	settings MachineSettings,
+	now time.Time,
+) (bool, string) {
+	object := capi.NewUnstructuredMachine(r.machineAPIVersion())
+	if err := r.Client.Get(ctx, key, object); err != nil {
+		// If the Machine is gone, its journal is complete once the stream ends.
+		return true, "the machine cannot be read"
+	}
+	machine, err := capi.FromUnstructured(object)
+	if err != nil {
+		logf.FromContext(ctx).Error(err, "failed to check collection policy")
+		return true, "the machine cannot be parsed"
+	}
+	return settings.collectionDecision(machine, now)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+)
+
+// machineGetter is a client.Client that gets one Machine, or fails with err.
+type machineGetter struct {
+	client.Client
+	machine *capi.Machine
+	err     error
+}
+
+func (g *machineGetter) Get(
+	_ context.Context,
+	_ client.ObjectKey,
+	obj client.Object,
+	_ ...client.GetOption,
+) error {
+	if g.err != nil {
+		return g.err
+	}
+	g.machine.Object.DeepCopyInto(obj.(*unstructured.Unstructured))
+	return nil
+}
+
+var _ = Describe("collection policy", func() {
+	var (
+		now      time.Time
+		settings MachineSettings
+	)
+
+	BeforeEach(func() {
+		now = time.Now()
+		settings = MachineSettings{
+			CollectionPolicy:     CollectionPolicyBootstrap,
+			NodeReadyGracePeriod: 30 * time.Minute,
+		}
+	})
+
+	// The Node of the test Machine has been Ready for an hour.
+	DescribeTable("collectionDecision",
+		func(change func(m *capi.Machine, s *MachineSettings), collect bool, reason string) {
+			machine := newTestMachine("m", nil, true)
+			change(machine, &settings)
+			collecting, why := settings.collectionDecision(machine, now)
+			Expect(collecting).To(Equal(collect))
+			Expect(why).To(Equal(reason))
+		},
+		Entry("with the always policy",
+			func(_ *capi.Machine, s *MachineSettings) {
+				s.CollectionPolicy = CollectionPolicyAlways
+			},
+			true,
+			"the collection policy is always",
+		),
+		Entry("with an empty policy",
+			func(_ *capi.Machine, s *MachineSettings) {
+				s.CollectionPolicy = ""
+			},
+			true,
+			"the collection policy is always",
+		),
+		Entry("a Machine that is being deleted",
+			func(m *capi.Machine, _ *MachineSettings) {
+				m.Object.SetDeletionTimestamp(&metav1.Time{Time: now})
+			},
+			true,
+			"the machine is being deleted",
+		),
+		Entry("a Machine in the Deleting phase",
+			func(m *capi.Machine, _ *MachineSettings) {
+				m.Phase = capi.MachinePhaseDeleting
+			},
+			true,
+			"the machine is being deleted",
+		),
+		Entry("a Machine without a Node",
+			func(m *capi.Machine, _ *MachineSettings) {
+				m.NodeName = ""
+			},
+			true,
+			"the machine has no node",
+		),
+		Entry("a Node that is not Ready",
+			func(m *capi.Machine, _ *MachineSettings) {
+				m.Conditions[0].Status = metav1.ConditionFalse
+			},
+			true,
+			"the node is not ready",
+		),
+		Entry("a Node without a Ready condition",
+			func(m *capi.Machine, _ *MachineSettings) {
+				m.Conditions = nil
+			},
+			true,
+			"the node is not ready",
+		),
+		Entry("a Node that is Ready, inside the grace period",
+			func(_ *capi.Machine, s *MachineSettings) {
+				s.NodeReadyGracePeriod = 2 * time.Hour
+			},
+			true,
+			"the node became ready less than the grace period ago",
+		),
+		Entry("a Node that is Ready, past the grace period",
+			func(*capi.Machine, *MachineSettings) {},
+			false,
+			"the node has been ready for longer than the grace period",
+		),
+	)
+
+	DescribeTable("stillCollecting",
+		func(getter *machineGetter, collect bool, reason string) {
+			r := &MachineReconciler{Client: getter}
+			collecting, why := r.stillCollecting(
+				context.Background(),
+				types.NamespacedName{Namespace: "ns", Name: "m"},
+				settings,
+				now,
+			)
+			Expect(collecting).To(Equal(collect))
+			Expect(why).To(Equal(reason))
+		},
+		Entry("a Machine whose Node is Ready past the grace period",
+			&machineGetter{machine: newTestMachine("m", nil, true)},
+			false,
+			"the node has been ready for longer than the grace period",
+		),
+		Entry("a Machine whose Node is not Ready",
+			&machineGetter{machine: newTestMachine("m", nil, false)},
+			true,
+			"the machine has no node",
+		),
+		Entry("a Machine that cannot be read",
+			&machineGetter{err: errors.New("not found")},
+			true,
+			"the machine cannot be read",
+		),
+	)
+
+	Describe("enforceCollectionPolicy", func() {
+		It("returns right away with the always policy", func() {
+			settings.CollectionPolicy = CollectionPolicyAlways
+			r := &MachineReconciler{}
+			stopped := false
+			r.enforceCollectionPolicy(
+				context.Background(),
+				types.NamespacedName{Namespace: "ns", Name: "m"},
+				settings,
+				func() { stopped = true },
+			)
+			Expect(stopped).To(BeFalse())
+		})
+
+		It("returns without stopping once the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			r := &MachineReconciler{
+				Client: &machineGetter{machine: newTestMachine("m", nil, true)},
+			}
+			stopped := false
+			r.enforceCollectionPolicy(
+				ctx,
+				types.NamespacedName{Namespace: "ns", Name: "m"},
+				settings,
+				func() { stopped = true },
+			)
+			Expect(stopped).To(BeFalse())
+		})
+	})
+})
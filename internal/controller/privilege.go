@@ -0,0 +1,66 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// SudoPasswordSecretKey is the key of the password in the Secret of
+// MachineSettings.SudoPasswordSecret.
+const SudoPasswordSecretKey = "password"
+
+// privilege returns the privilege strategy of the settings, with the password read from its
+// Secret, if the strategy needs one.
+func (r *MachineReconciler) privilege(
+	ctx context.Context,
+	settings MachineSettings,
+) (journald.Privilege, error) {
+	privilege := journald.Privilege{Strategy: settings.PrivilegeStrategy}
+	if settings.PrivilegeStrategy != journald.PrivilegeSudoPassword {
+		return privilege, nil
+	}
+	var reader client.Reader = r.Client
+	if r.APIReader != nil {
+		reader = r.APIReader
+	}
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, settings.SudoPasswordSecret, secret); err != nil {
+		return privilege, fmt.Errorf(
+			"failed to get sudo password Secret %s: %w",
+			settings.SudoPasswordSecret,
+			err,
+		)
+	}
+	password, ok := secret.Data[SudoPasswordSecretKey]
+	if !ok {
+		return privilege, reconcile.TerminalError(fmt.Errorf(
+			"sudo password Secret %s has no %q key",
+			settings.SudoPasswordSecret,
+			SudoPasswordSecretKey,
+		))
+	}
+	privilege.Password = password
+	return privilege, nil
+}
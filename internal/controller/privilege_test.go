@@ -0,0 +1,87 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+var _ = Describe("privilege", func() {
+	secretKey := types.NamespacedName{Namespace: "ns", Name: "sudo"}
+	newReconciler := func(data map[string][]byte) *MachineReconciler {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: secretKey.Namespace, Name: secretKey.Name},
+			Data:       data,
+		}
+		return &MachineReconciler{APIReader: fake.NewClientBuilder().WithObjects(secret).Build()}
+	}
+
+	It("reads the password of sudo-password from the Secret", func() {
+		r := newReconciler(map[string][]byte{SudoPasswordSecretKey: []byte("secret")})
+		privilege, err := r.privilege(context.Background(), MachineSettings{
+			PrivilegeStrategy:  journald.PrivilegeSudoPassword,
+			SudoPasswordSecret: secretKey,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(privilege).To(Equal(journald.Privilege{
+			Strategy: journald.PrivilegeSudoPassword,
+			Password: []byte("secret"),
+		}))
+	})
+
+	It("does not read the Secret for other strategies", func() {
+		r := &MachineReconciler{}
+		privilege, err := r.privilege(context.Background(), MachineSettings{
+			PrivilegeStrategy:  journald.PrivilegeSudo,
+			SudoPasswordSecret: secretKey,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(privilege).To(Equal(journald.Privilege{Strategy: journald.PrivilegeSudo}))
+	})
+
+	It("returns a terminal error if the Secret has no password", func() {
+		r := newReconciler(map[string][]byte{"pass": []byte("secret")})
+		_, err := r.privilege(context.Background(), MachineSettings{
+			PrivilegeStrategy:  journald.PrivilegeSudoPassword,
+			SudoPasswordSecret: secretKey,
+		})
+		Expect(errors.Is(err, reconcile.TerminalError(nil))).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring(`has no "password" key`)))
+	})
+
+	It("returns an error if the Secret cannot be read", func() {
+		r := newReconciler(nil)
+		_, err := r.privilege(context.Background(), MachineSettings{
+			PrivilegeStrategy:  journald.PrivilegeSudoPassword,
+			SudoPasswordSecret: types.NamespacedName{Namespace: "ns", Name: "missing"},
+		})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(errors.Is(err, reconcile.TerminalError(nil))).To(BeFalse())
+	})
+})
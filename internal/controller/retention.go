@@ -0,0 +1,149 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/dlipovetsky/machine-monitor/internal/archive"
+	"github.com/dlipovetsky/machine-monitor/internal/forward"
+	"github.com/dlipovetsky/machine-monitor/internal/index"
+	"github.com/dlipovetsky/machine-monitor/internal/logging"
+	"github.com/dlipovetsky/machine-monitor/internal/loki"
+	"github.com/dlipovetsky/machine-monitor/internal/otlp"
+	"github.com/dlipovetsky/machine-monitor/internal/snapshot"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+)
+
+// localJournalSizeCheckInterval is how often the size of the journal of a Machine is checked
+// while it is collected.
+const localJournalSizeCheckInterval = time.Minute
+
+// errLocalJournalFull stops the stream of a Machine whose journal is larger than the maximum
+// size, so that it is rotated before the stream is restarted.
+var errLocalJournalFull = errors.New("the local journal of the machine is full")
+
+// localJournalFull returns whether the journal of the Machine is larger than
+// LocalJournalMaxFileSize.
+func (r *MachineReconciler) localJournalFull(namespace, name string) (bool, error) {
+	if r.LocalJournalMaxFileSize == 0 {
+		return false, nil
+	}
+	status, err := r.store().Status(namespace, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status.Size > r.LocalJournalMaxFileSize, nil
+}
+
+// rotateIfFull rotates the journal of the Machine if it is full. The journal must not be open for
+// appending.
+func (r *MachineReconciler) rotateIfFull(ctx context.Context, namespace, name string) error {
+	full, err := r.localJournalFull(namespace, name)
+	if err != nil || !full {
+		return err
+	}
+	logf.FromContext(ctx).Info("rotating local journal", "maxFileSize", r.LocalJournalMaxFileSize)
+	if err := r.store().Rotate(namespace, name); err != nil {
+		return fmt.Errorf("failed to rotate local journal: %w", err)
+	}
+	return nil
+}
+
+// enforceMaxFileSize checks the size of the journal of the Machine until the context is
+// cancelled, and calls stop once the journal is full. The journal is rotated when the stream is
+// restarted.
+func (r *MachineReconciler) enforceMaxFileSize(
+	ctx context.Context,
+	key types.NamespacedName,
+	stop func(),
+) {
+	if r.LocalJournalMaxFileSize == 0 {
+		return
+	}
+	log := logf.FromContext(ctx)
+
+	ticker := time.NewTicker(localJournalSizeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		full, err := r.localJournalFull(key.Namespace, key.Name)
+		if err != nil {
+			log.Error(err, "failed to check local journal size")
+			continue
+		}
+		if full {
+			log.Info("stopping journal stream to rotate local journal")
+			stop()
+			return
+		}
+	}
+}
+
+// deleteJournal deletes the journal of the Machine, and the files derived from it: its timeline,
+// its search index, the cursors of its forwarders, its archive state, its diagnostics log files,
+// and its snapshots and their state.
+func (r *MachineReconciler) deleteJournal(ctx context.Context, namespace, name string) error {
+	if err := r.store().Delete(namespace, name); err != nil {
+		return err
+	}
+	diagnosticsFilePath := logging.DiagnosticsFilePath(r.LocalJournalDirectory, namespace, name)
+	filePaths := []string{
+		timeline.FilePath(r.LocalJournalDirectory, namespace, name),
+		archive.StateFilePath(r.LocalJournalDirectory, namespace, name),
+		diagnosticsFilePath,
+		logging.RotatedDiagnosticsFilePath(diagnosticsFilePath),
+		snapshot.StateFilePath(r.LocalJournalDirectory, namespace, name),
+	}
+	for _, sinkName := range []string{loki.SinkName, otlp.SinkName, index.SinkName} {
+		filePaths = append(
+			filePaths,
+			forward.CursorFilePath(r.LocalJournalDirectory, namespace, name, sinkName),
+		)
+	}
+	for _, filePath := range filePaths {
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete journal of deleted machine: %w", err)
+		}
+	}
+	if err := os.RemoveAll(
+		index.DirectoryPath(r.LocalJournalDirectory, namespace, name),
+	); err != nil {
+		return fmt.Errorf("failed to delete search index of deleted machine: %w", err)
+	}
+	if err := os.RemoveAll(
+		snapshot.Directory(r.LocalJournalDirectory, namespace, name),
+	); err != nil {
+		return fmt.Errorf("failed to delete snapshots of deleted machine: %w", err)
+	}
+	logf.FromContext(ctx).Info("deleted journal of deleted machine")
+	return nil
+}
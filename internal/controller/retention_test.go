@@ -0,0 +1,118 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/dlipovetsky/machine-monitor/internal/archive"
+	"github.com/dlipovetsky/machine-monitor/internal/forward"
+	"github.com/dlipovetsky/machine-monitor/internal/index"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/logging"
+	"github.com/dlipovetsky/machine-monitor/internal/loki"
+	"github.com/dlipovetsky/machine-monitor/internal/snapshot"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+)
+
+var _ = Describe("deleteJournal", func() {
+	var (
+		directory string
+		store     *journald.FileStore
+	)
+
+	// writeJournal writes a rotated journal of the Machine, and every file derived from it, and
+	// returns their paths.
+	writeJournal := func(namespace, name string) []string {
+		appender, err := store.Open(namespace, name)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = appender.Write([]byte(`{"__CURSOR":"c1","_BOOT_ID":"b1","MESSAGE":"m"}` + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(appender.Close()).To(Succeed())
+		Expect(store.Rotate(namespace, name)).To(Succeed())
+		Expect(store.PutMachineInfo(journald.MachineInfo{Namespace: namespace, Name: name})).
+			To(Succeed())
+		rotated, err := store.RotatedLocalJournalFilePaths(namespace, name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rotated).To(HaveLen(1))
+
+		diagnosticsFilePath := logging.DiagnosticsFilePath(directory, namespace, name)
+		filePaths := []string{
+			timeline.FilePath(directory, namespace, name),
+			archive.StateFilePath(directory, namespace, name),
+			diagnosticsFilePath,
+			logging.RotatedDiagnosticsFilePath(diagnosticsFilePath),
+			snapshot.StateFilePath(directory, namespace, name),
+		}
+		for _, sinkName := range []string{loki.SinkName, index.SinkName} {
+			filePaths = append(
+				filePaths,
+				forward.CursorFilePath(directory, namespace, name, sinkName),
+			)
+		}
+		snapshotDirectory := path.Join(
+			snapshot.Directory(directory, namespace, name),
+			time.Now().UTC().Format("20060102T150405Z"),
+		)
+		indexDirectory := index.DirectoryPath(directory, namespace, name)
+		for _, d := range []string{snapshotDirectory, indexDirectory} {
+			Expect(os.MkdirAll(d, 0o755)).To(Succeed())
+			filePaths = append(filePaths, path.Join(d, "file"))
+		}
+		for _, filePath := range filePaths {
+			Expect(os.WriteFile(filePath, []byte("{}"), 0o644)).To(Succeed())
+		}
+		return append(
+			filePaths,
+			rotated[0],
+			store.LocalJournalFilePath(namespace, name),
+			journald.MachineInfoFilePath(directory, namespace, name),
+			snapshot.Directory(directory, namespace, name),
+			indexDirectory,
+		)
+	}
+
+	BeforeEach(func() {
+		directory = GinkgoT().TempDir()
+		store = &journald.FileStore{Directory: directory}
+	})
+
+	It("deletes the journal of the Machine, and every file derived from it", func() {
+		deleted := writeJournal("ns", "m")
+		kept := writeJournal("ns", "m-2")
+
+		r := &MachineReconciler{LocalJournalDirectory: directory, Store: store}
+		Expect(r.deleteJournal(context.Background(), "ns", "m")).To(Succeed())
+		for _, filePath := range deleted {
+			Expect(filePath).NotTo(BeAnExistingFile())
+		}
+		for _, filePath := range kept {
+			Expect(filePath).To(BeAnExistingFile())
+		}
+	})
+
+	It("deletes a Machine that has no journal", func() {
+		r := &MachineReconciler{LocalJournalDirectory: directory, Store: store}
+		Expect(r.deleteJournal(context.Background(), "ns", "m")).To(Succeed())
+	})
+})
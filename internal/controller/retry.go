@@ -0,0 +1,116 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/ssh"
+)
+
+// sshPollInterval is how often a Machine whose Node is not Ready is dialed, while its sshd is not
+// up yet.
+const sshPollInterval = 5 * time.Second
+
+// reconnectDelay is how long to wait before a stream that ended is started again.
+const reconnectDelay = 100 * time.Millisecond
+
+// minStreamDuration is how long a stream must run for it to be started again after reconnectDelay.
+// A stream that ends sooner, e.g. because journalctl exits right away, is retried with the
+// exponential backoff of the controller, rather than in a tight loop.
+const minStreamDuration = 10 * time.Second
+
+// Reasons of the Events recorded when the journal of a Machine cannot be collected.
+const (
+	reasonSSHAuthenticationFailed = "SSHAuthenticationFailed"
+	reasonSSHHostKeyRejected      = "SSHHostKeyRejected"
+	reasonPrivilegeFailed         = "JournalPrivilegeFailed"
+	reasonRemoteUnsupported       = "JournalUnsupported"
+)
+
+// retry returns the result of a reconcile that failed with the error. How the Machine is retried
+// depends on the class of the failure:
+//   - a Machine that refuses connections, or times out, while its Node is not Ready, is booting,
+//     and is dialed again after sshPollInterval;
+//   - a stream that ended, e.g. because the Machine rebooted, is started again right away, unless
+//     it ended within minStreamDuration;
+//   - a failure that retrying does not fix, e.g. a rejected private key, is recorded as an Event,
+//     and the Machine is not retried until it, its settings, or the Secret of its sudo password
+//     change;
+//   - any other failure is retried with the exponential backoff of the controller.
+//
+// The settings are the settings of the Machine that failed, and streamed is how long its journal
+// was streamed before it failed.
+func (r *MachineReconciler) retry(
+	ctx context.Context,
+	object runtime.Object,
+	machine *capi.Machine,
+	settings MachineSettings,
+	streamed time.Duration,
+	err error,
+) (ctrl.Result, error) {
+	log := logf.FromContext(ctx)
+
+	if ctx.Err() != nil {
+		return ctrl.Result{}, err
+	}
+
+	reason := ""
+	switch kind := ssh.DialErrorKindOf(err); {
+	case kind == ssh.DialErrorRefused || kind == ssh.DialErrorTimeout:
+		if _, ready := machine.NodeReadySince(); !ready {
+			log.V(1).Info("machine is not reachable yet, polling", "reason", kind)
+			return ctrl.Result{RequeueAfter: sshPollInterval}, nil
+		}
+		return ctrl.Result{}, err
+	case errors.Is(err, journald.ErrStreamEnded):
+		if streamed < minStreamDuration {
+			return ctrl.Result{}, err
+		}
+		log.Info("journal stream ended, reconnecting", "cause", err.Error())
+		return ctrl.Result{RequeueAfter: reconnectDelay}, nil
+	case kind == ssh.DialErrorAuth:
+		reason = reasonSSHAuthenticationFailed
+	case kind == ssh.DialErrorHostKey:
+		reason = reasonSSHHostKeyRejected
+	case journald.IsPrivilegeError(err):
+		reason = reasonPrivilegeFailed
+	case journald.IsUnsupportedError(err):
+		reason = reasonRemoteUnsupported
+	default:
+		if errors.Is(err, reconcile.TerminalError(nil)) {
+			r.recordFailed(machine, settings)
+		}
+		return ctrl.Result{}, err
+	}
+
+	if r.Recorder != nil {
+		r.Recorder.Event(object, corev1.EventTypeWarning, reason, err.Error())
+	}
+	r.recordFailed(machine, settings)
+	return ctrl.Result{}, reconcile.TerminalError(err)
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/ssh"
+)
+
+// newTestMachine returns a Machine in namespace ns with the name and labels. If nodeReady is
+// true, its Node has been Ready since an hour ago.
+func newTestMachine(name string, labels map[string]string, nodeReady bool) *capi.Machine {
+	object := capi.NewUnstructuredMachine(capi.VersionV1Beta1)
+	object.SetNamespace("ns")
+	object.SetName(name)
+	object.SetLabels(labels)
+	if nodeReady {
+		Expect(unstructured.SetNestedField(object.Object, "node", "status", "nodeRef", "name")).
+			To(Succeed())
+		Expect(unstructured.SetNestedSlice(object.Object, []any{map[string]any{
+			"type":               capi.NodeReadyCondition,
+			"status":             string(metav1.ConditionTrue),
+			"lastTransitionTime": time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+		}}, "status", "conditions")).To(Succeed())
+	}
+	machine, err := capi.FromUnstructured(object)
+	Expect(err).NotTo(HaveOccurred())
+	return machine
+}
+
+func testDialError(kind ssh.DialErrorKind) error {
+	return fmt.Errorf("failed to create SSH client: %w", &ssh.DialError{
+		Kind:    kind,
+		Address: "10.0.0.1:22",
+		Err:     errors.New(string(kind)),
+	})
+}
+
+var _ = Describe("retry", func() {
+	var (
+		r        *MachineReconciler
+		recorder *record.FakeRecorder
+		settings MachineSettings
+	)
+
+	BeforeEach(func() {
+		recorder = record.NewFakeRecorder(10)
+		settings = MachineSettings{SSHUser: "user"}
+		r = &MachineReconciler{Recorder: recorder, Settings: settings}
+	})
+
+	retry := func(machine *capi.Machine, streamed time.Duration, err error) (ctrl.Result, error) {
+		return r.retry(context.Background(), machine.Object, machine, settings, streamed, err)
+	}
+
+	DescribeTable("polls a Machine that is booting",
+		func(kind ssh.DialErrorKind) {
+			result, err := retry(newTestMachine("m", nil, false), 0, testDialError(kind))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(sshPollInterval))
+		},
+		Entry("connection refused", ssh.DialErrorRefused),
+		Entry("timeout", ssh.DialErrorTimeout),
+	)
+
+	It("backs off from a Machine whose Node is Ready, but is not reachable", func() {
+		dialErr := testDialError(ssh.DialErrorRefused)
+		result, err := retry(newTestMachine("m", nil, true), 0, dialErr)
+		Expect(err).To(MatchError(dialErr))
+		Expect(errors.Is(err, reconcile.TerminalError(nil))).To(BeFalse())
+		Expect(result).To(Equal(ctrl.Result{}))
+	})
+
+	It("reconnects right away to a stream that ended", func() {
+		streamErr := fmt.Errorf("%w: connection lost", journald.ErrStreamEnded)
+		result, err := retry(newTestMachine("m", nil, true), time.Hour, streamErr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(reconnectDelay))
+	})
+
+	It("backs off from a stream that ended right after it started", func() {
+		streamErr := fmt.Errorf("%w: journalctl exited", journald.ErrStreamEnded)
+		result, err := retry(newTestMachine("m", nil, true), time.Second, streamErr)
+		Expect(err).To(MatchError(streamErr))
+		Expect(result).To(Equal(ctrl.Result{}))
+	})
+
+	DescribeTable("records a failure that retrying does not fix",
+		func(failure error, reason string) {
+			machine := newTestMachine("m", nil, true)
+			_, err := retry(machine, 0, failure)
+			Expect(errors.Is(err, reconcile.TerminalError(nil))).To(BeTrue())
+			Expect(err).To(MatchError(failure))
+			Expect(recorder.Events).To(Receive(HavePrefix("Warning " + reason)))
+			Expect(r.failed).To(HaveKey(types.NamespacedName{Namespace: "ns", Name: "m"}))
+		},
+		Entry("authentication failed",
+			testDialError(ssh.DialErrorAuth), reasonSSHAuthenticationFailed),
+		Entry("host key rejected",
+			testDialError(ssh.DialErrorHostKey), reasonSSHHostKeyRejected),
+		Entry("privilege",
+			&journald.PrivilegeError{Strategy: journald.PrivilegeSudo, Stderr: "no password"},
+			reasonPrivilegeFailed),
+		Entry("unsupported",
+			&journald.UnsupportedError{Reason: "journalctl not found"},
+			reasonRemoteUnsupported),
+	)
+
+	It("records a terminal error without an Event", func() {
+		failure := reconcile.TerminalError(errors.New("sudo password Secret has no key"))
+		_, err := retry(newTestMachine("m", nil, true), 0, failure)
+		Expect(err).To(MatchError(failure))
+		Expect(recorder.Events).NotTo(Receive())
+		Expect(r.failed).To(HaveKey(types.NamespacedName{Namespace: "ns", Name: "m"}))
+	})
+
+	It("backs off from other failures", func() {
+		failure := testDialError(ssh.DialErrorHandshake)
+		result, err := retry(newTestMachine("m", nil, true), 0, failure)
+		Expect(err).To(MatchError(failure))
+		Expect(errors.Is(err, reconcile.TerminalError(nil))).To(BeFalse())
+		Expect(result).To(Equal(ctrl.Result{}))
+		Expect(r.failed).To(BeEmpty())
+	})
+
+	Describe("failed Machines", func() {
+		var secret types.NamespacedName
+
+		BeforeEach(func() {
+			secret = types.NamespacedName{Namespace: "ns", Name: "sudo"}
+			r.requeue = make(chan event.GenericEvent, 10)
+		})
+
+		It("are requeued when their settings change", func() {
+			settings.SSHUser = "old"
+			r.recordFailed(newTestMachine("m", map[string]string{"pool": "a"}, true), settings)
+			r.recordFailed(newTestMachine("other", map[string]string{"pool": "b"}, true), settings)
+
+			changed := settings
+			changed.SSHUser = "new"
+			selector, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+				MatchLabels: map[string]string{"pool": "a"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			restarted, requeued := r.UpdateSettings(settings, []SettingsOverride{
+				{Selector: selector, Settings: changed},
+			})
+			Expect(restarted).To(BeZero())
+			Expect(requeued).To(Equal(1))
+
+			var requeuedEvent event.GenericEvent
+			Eventually(r.requeue).Should(Receive(&requeuedEvent))
+			Expect(requeuedEvent.Object.GetNamespace()).To(Equal("ns"))
+			Expect(requeuedEvent.Object.GetName()).To(Equal("m"))
+			Expect(r.failed).To(HaveLen(1))
+		})
+
+		It("are requeued when the Secret of their sudo password changes", func() {
+			settings.PrivilegeStrategy = journald.PrivilegeSudoPassword
+			settings.SudoPasswordSecret = secret
+			r.recordFailed(newTestMachine("m", nil, true), settings)
+			r.recordFailed(newTestMachine("other", nil, true), MachineSettings{})
+
+			object := &metav1.PartialObjectMetadata{}
+			object.SetNamespace(secret.Namespace)
+			object.SetName(secret.Name)
+			Expect(r.failedMachinesForSecret(context.Background(), object)).To(ConsistOf(
+				reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns", Name: "m"}},
+			))
+
+			object.SetName("unrelated")
+			Expect(r.failedMachinesForSecret(context.Background(), object)).To(BeEmpty())
+		})
+
+		It("are forgotten once they are reconciled", func() {
+			r.recordFailed(newTestMachine("m", nil, true), settings)
+			r.forgetFailed(types.NamespacedName{Namespace: "ns", Name: "m"})
+			Expect(r.failed).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,271 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/snapshot"
+	"github.com/dlipovetsky/machine-monitor/internal/ssh"
+)
+
+// MachineSettings are the settings that the journal of a Machine is collected with. Unlike the
+// other fields of the reconciler, they can be changed while the reconciler runs, with
+// UpdateSettings.
+type MachineSettings struct {
+	SSHPort       int
+	SSHUser       string
+	SSHPrivateKey []byte
+
+	BastionSSHHost       string
+	BastionSSHPort       int
+	BastionSSHUser       string
+	BastionSSHPrivateKey []byte
+
+	// PrivilegeStrategy is one of journald.PrivilegeStrategies. If empty, journald.PrivilegeSudo
+	// is used.
+	PrivilegeStrategy string
+	// SudoPasswordSecret is the Secret with the password of the SSH user, in its "password" key,
+	// for journald.PrivilegeSudoPassword.
+	SudoPasswordSecret types.NamespacedName
+
+	// Backfill limits the entries that are streamed when the journal of a Machine is streamed for
+	// the first time. If zero, the entire journal is streamed.
+	Backfill journald.Backfill
+
+	// CollectionPolicy is either CollectionPolicyAlways or CollectionPolicyBootstrap. If empty,
+	// CollectionPolicyAlways is used.
+	CollectionPolicy string
+	// NodeReadyGracePeriod is how long the journal of a Machine is collected after its Node
+	// becomes Ready, with CollectionPolicyBootstrap.
+	NodeReadyGracePeriod time.Duration
+
+	// SnapshotCommands are run on a Machine to take a diagnostic snapshot when the Machine
+	// reports a failure, when its Node is not Ready SnapshotBootstrapTimeout after it was
+	// created, or when a snapshot is requested. If empty, no snapshots are taken.
+	SnapshotCommands []snapshot.Command
+	// SnapshotBootstrapTimeout, if not zero, is how long after a Machine is created its Node
+	// must be Ready. If it is not, a snapshot is taken.
+	SnapshotBootstrapTimeout time.Duration
+}
+
+// SettingsOverride replaces the settings of the Machines that match its selector.
+type SettingsOverride struct {
+	Selector labels.Selector
+	Settings MachineSettings
+}
+
+// errSettingsChanged stops the stream of a Machine whose settings changed, so that it is
+// restarted with the new settings.
+var errSettingsChanged = errors.New("the settings of the machine changed")
+
+// activeStream is the stream of the journal of a Machine.
+type activeStream struct {
+	labels   labels.Set
+	settings MachineSettings
+	stop     context.CancelCauseFunc
+}
+
+// dialer returns a Dialer that creates SSH clients for Machines.
+func (s MachineSettings) dialer() *ssh.Dialer {
+	return &ssh.Dialer{
+		Port:              s.SSHPort,
+		User:              s.SSHUser,
+		PrivateKey:        s.SSHPrivateKey,
+		BastionHost:       s.BastionSSHHost,
+		BastionPort:       s.BastionSSHPort,
+		BastionUser:       s.BastionSSHUser,
+		BastionPrivateKey: s.BastionSSHPrivateKey,
+	}
+}
+
+// dial returns an SSH client for the Machine, dialed with the settings.
+func (r *MachineReconciler) dial(
+	ctx context.Context,
+	settings MachineSettings,
+	machineHost string,
+) (*ssh.Client, error) {
+	if r.DialScheduler == nil {
+		return settings.dialer().Dial(ctx, machineHost)
+	}
+	return r.DialScheduler.Dial(ctx, settings.dialer(), machineHost)
+}
+
+// settingsFor returns the settings of the Machine with the labels. The first override whose
+// selector matches the labels applies.
+func (r *MachineReconciler) settingsFor(machineLabels map[string]string) MachineSettings {
+	r.settingsMu.RLock()
+	defer r.settingsMu.RUnlock()
+	return r.settingsForLocked(labels.Set(machineLabels))
+}
+
+func (r *MachineReconciler) settingsForLocked(machineLabels labels.Set) MachineSettings {
+	for _, override := range r.Overrides {
+		if override.Selector.Matches(machineLabels) {
+			return override.Settings
+		}
+	}
+	return r.Settings
+}
+
+// UpdateSettings replaces the settings and overrides, restarts the streams of the Machines whose
+// settings changed, and requeues the Machines that failed in a way that retrying does not fix, if
+// their settings changed. It returns the number of restarted streams, and of requeued Machines.
+func (r *MachineReconciler) UpdateSettings(
+	settings MachineSettings,
+	overrides []SettingsOverride,
+) (restarted, requeued int) {
+	r.settingsMu.Lock()
+	r.Settings = settings
+	r.Overrides = overrides
+
+	for _, stream := range r.streams {
+		if reflect.DeepEqual(stream.settings, r.settingsForLocked(stream.labels)) {
+			continue
+		}
+		stream.stop(errSettingsChanged)
+		restarted++
+	}
+
+	var keys []types.NamespacedName
+	for key, failed := range r.failed {
+		if reflect.DeepEqual(failed.settings, r.settingsForLocked(failed.labels)) {
+			continue
+		}
+		delete(r.failed, key)
+		keys = append(keys, key)
+	}
+	r.settingsMu.Unlock()
+
+	r.enqueue(keys)
+	return restarted, len(keys)
+}
+
+// requeueBufferSize is the number of Machines that can wait to be requeued before enqueue blocks.
+const requeueBufferSize = 1024
+
+// failedMachine is a Machine that failed in a way that retrying does not fix, e.g. because its
+// private key was rejected. It is retried once it, its settings, or the Secret of its sudo
+// password change.
+type failedMachine struct {
+	labels   labels.Set
+	settings MachineSettings
+}
+
+// recordFailed records that the Machine failed with the settings in a way that retrying does not
+// fix.
+func (r *MachineReconciler) recordFailed(machine *capi.Machine, settings MachineSettings) {
+	r.settingsMu.Lock()
+	defer r.settingsMu.Unlock()
+	if r.failed == nil {
+		r.failed = map[types.NamespacedName]*failedMachine{}
+	}
+	key := types.NamespacedName{Namespace: machine.Namespace(), Name: machine.Name()}
+	r.failed[key] = &failedMachine{labels: labels.Set(machine.Labels()), settings: settings}
+}
+
+// forgetFailed removes the record of a Machine that failed, once it is reconciled again.
+func (r *MachineReconciler) forgetFailed(key types.NamespacedName) {
+	r.settingsMu.Lock()
+	defer r.settingsMu.Unlock()
+	delete(r.failed, key)
+}
+
+// failedMachinesForSecret returns the requests of the failed Machines whose sudo password is in
+// the Secret.
+func (r *MachineReconciler) failedMachinesForSecret(
+	_ context.Context,
+	secret client.Object,
+) []reconcile.Request {
+	secretKey := types.NamespacedName{Namespace: secret.GetNamespace(), Name: secret.GetName()}
+	r.settingsMu.Lock()
+	defer r.settingsMu.Unlock()
+	var requests []reconcile.Request
+	for key, failed := range r.failed {
+		if failed.settings.PrivilegeStrategy != journald.PrivilegeSudoPassword ||
+			failed.settings.SudoPasswordSecret != secretKey {
+			continue
+		}
+		delete(r.failed, key)
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+	return requests
+}
+
+// enqueue requeues the Machines. It does not wait for them to be queued, because the controller
+// may not run yet.
+func (r *MachineReconciler) enqueue(keys []types.NamespacedName) {
+	if r.requeue == nil || len(keys) == 0 {
+		return
+	}
+	go func() {
+		for _, key := range keys {
+			object := &metav1.PartialObjectMetadata{}
+			object.SetNamespace(key.Namespace)
+			object.SetName(key.Name)
+			r.requeue <- event.GenericEvent{Object: object}
+		}
+	}()
+}
+
+// registerStream records the stream of a Machine, so that it can be restarted if the settings of
+// the Machine change. If they already changed, the stream is stopped right away. The returned
+// function removes the record.
+func (r *MachineReconciler) registerStream(
+	key types.NamespacedName,
+	machineLabels map[string]string,
+	settings MachineSettings,
+	stop context.CancelCauseFunc,
+) func() {
+	r.settingsMu.Lock()
+	defer r.settingsMu.Unlock()
+	if r.streams == nil {
+		r.streams = map[types.NamespacedName]*activeStream{}
+	}
+	stream := &activeStream{labels: labels.Set(machineLabels), settings: settings, stop: stop}
+	r.streams[key] = stream
+	if !reflect.DeepEqual(settings, r.settingsForLocked(stream.labels)) {
+		stop(errSettingsChanged)
+	}
+	return func() {
+		r.settingsMu.Lock()
+		defer r.settingsMu.Unlock()
+		if r.streams[key] == stream {
+			delete(r.streams, key)
+		}
+	}
+}
+
+// Streaming returns true if the journal of the Machine is being streamed.
+func (r *MachineReconciler) Streaming(namespace, name string) bool {
+	r.settingsMu.RLock()
+	defer r.settingsMu.RUnlock()
+	_, ok := r.streams[types.NamespacedName{Namespace: namespace, Name: name}]
+	return ok
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("UpdateSettings", func() {
+	var (
+		r        *MachineReconciler
+		settings MachineSettings
+		changed  MachineSettings
+		poolA    labels.Selector
+	)
+
+	BeforeEach(func() {
+		settings = MachineSettings{SSHUser: "user"}
+		changed = MachineSettings{SSHUser: "admin"}
+		r = &MachineReconciler{Settings: settings}
+		var err error
+		poolA, err = metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+			MatchLabels: map[string]string{"pool": "a"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	// register registers the stream of the Machine with the settings, and returns its context.
+	register := func(name string, machineLabels map[string]string) context.Context {
+		ctx, stop := context.WithCancelCause(context.Background())
+		DeferCleanup(func() {
+			stop(nil)
+		})
+		unregister := r.registerStream(
+			types.NamespacedName{Namespace: "ns", Name: name},
+			machineLabels,
+			r.settingsFor(machineLabels),
+			stop,
+		)
+		DeferCleanup(unregister)
+		return ctx
+	}
+
+	It("restarts only the streams whose settings changed", func() {
+		a := register("a", map[string]string{"pool": "a"})
+		b := register("b", map[string]string{"pool": "b"})
+
+		restarted, requeued := r.UpdateSettings(settings, []SettingsOverride{
+			{Selector: poolA, Settings: changed},
+		})
+		Expect(restarted).To(Equal(1))
+		Expect(requeued).To(BeZero())
+		Expect(context.Cause(a)).To(MatchError(errSettingsChanged))
+		Expect(b.Err()).NotTo(HaveOccurred())
+		Expect(r.settingsFor(map[string]string{"pool": "a"})).To(Equal(changed))
+		Expect(r.settingsFor(map[string]string{"pool": "b"})).To(Equal(settings))
+	})
+
+	It("does not restart streams if the settings did not change", func() {
+		a := register("a", map[string]string{"pool": "a"})
+		restarted, _ := r.UpdateSettings(settings, nil)
+		Expect(restarted).To(BeZero())
+		Expect(a.Err()).NotTo(HaveOccurred())
+	})
+
+	It("applies the first override that matches a Machine", func() {
+		other := MachineSettings{SSHUser: "other"}
+		r.UpdateSettings(settings, []SettingsOverride{
+			{Selector: poolA, Settings: changed},
+			{Selector: labels.Everything(), Settings: other},
+		})
+		Expect(r.settingsFor(map[string]string{"pool": "a"})).To(Equal(changed))
+		Expect(r.settingsFor(map[string]string{"pool": "b"})).To(Equal(other))
+	})
+
+	It("stops a stream that registers with settings that changed since it started", func() {
+		ctx, stop := context.WithCancelCause(context.Background())
+		defer stop(nil)
+		r.UpdateSettings(changed, nil)
+		defer r.registerStream(
+			types.NamespacedName{Namespace: "ns", Name: "a"},
+			nil,
+			settings,
+			stop,
+		)()
+		Expect(context.Cause(ctx)).To(MatchError(errSettingsChanged))
+	})
+
+	It("no longer restarts a stream once it is unregistered", func() {
+		ctx, stop := context.WithCancelCause(context.Background())
+		defer stop(nil)
+		unregister := r.registerStream(
+			types.NamespacedName{Namespace: "ns", Name: "a"},
+			nil,
+			settings,
+			stop,
+		)
+		unregister()
+		restarted, _ := r.UpdateSettings(changed, nil)
+		Expect(restarted).To(BeZero())
+		Expect(ctx.Err()).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,143 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/snapshot"
+)
+
+// snapshotCheckInterval is how often the snapshot triggers are checked while a journal is
+// collected.
+const snapshotCheckInterval = 15 * time.Second
+
+// snapshotTrigger is a reason to take a snapshot. Key identifies the trigger, so that a snapshot
+// is taken only once for each trigger.
+type snapshotTrigger struct {
+	key    string
+	reason string
+}
+
+// snapshotTriggers returns the reasons to take a snapshot of the Machine.
+func (s MachineSettings) snapshotTriggers(
+	machine *capi.Machine,
+	now time.Time,
+) []snapshotTrigger {
+	var triggers []snapshotTrigger
+	for _, failure := range machine.Failures() {
+		triggers = append(triggers, snapshotTrigger{
+			key:    "failure: " + failure,
+			reason: "the machine reports " + failure,
+		})
+	}
+	if s.SnapshotBootstrapTimeout > 0 && !machine.Deleting() {
+		_, ready := machine.NodeReadySince()
+		created := machine.Object.GetCreationTimestamp().Time
+		if !ready && now.After(created.Add(s.SnapshotBootstrapTimeout)) {
+			triggers = append(triggers, snapshotTrigger{
+				key: "bootstrap-timeout",
+				reason: fmt.Sprintf(
+					"the node is not ready %s after the machine was created",
+					s.SnapshotBootstrapTimeout,
+				),
+			})
+		}
+	}
+	if request := machine.Object.GetAnnotations()[snapshot.AnnotationRequest]; request != "" {
+		triggers = append(triggers, snapshotTrigger{
+			key: "request: " + request,
+			reason: "a snapshot was requested with the " + snapshot.AnnotationRequest +
+				" annotation",
+		})
+	}
+	return triggers
+}
+
+// takeSnapshots takes a snapshot of the Machine for every trigger that no snapshot was taken for,
+// and checks the triggers again until the context is cancelled.
+func (r *MachineReconciler) takeSnapshots(
+	ctx context.Context,
+	key types.NamespacedName,
+	machine *capi.Machine,
+	settings MachineSettings,
+	remote *journald.Remote,
+) {
+	if len(settings.SnapshotCommands) == 0 {
+		return
+	}
+	log := logf.FromContext(ctx)
+
+	stateFilePath := snapshot.StateFilePath(r.LocalJournalDirectory, key.Namespace, key.Name)
+	state, err := snapshot.LoadState(stateFilePath)
+	if err != nil {
+		log.Error(err, "failed to load snapshot state, not taking snapshots")
+		return
+	}
+
+	ticker := time.NewTicker(snapshotCheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, trigger := range settings.snapshotTriggers(machine, time.Now()) {
+			if state.Taken(trigger.key) {
+				continue
+			}
+			log.Info("taking snapshot", "reason", trigger.reason)
+			taken, err := snapshot.Take(
+				ctx,
+				remote,
+				snapshot.Directory(r.LocalJournalDirectory, key.Namespace, key.Name),
+				trigger.reason,
+				settings.SnapshotCommands,
+			)
+			if ctx.Err() != nil {
+				// The commands were interrupted, so the snapshot is taken again next time.
+				return
+			}
+			if err != nil {
+				log.Error(err, "failed to take snapshot")
+				continue
+			}
+			state.Record(trigger.key, taken.Time)
+			if err := state.Save(stateFilePath); err != nil {
+				log.Error(err, "failed to save snapshot state")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		object := capi.NewUnstructuredMachine(r.machineAPIVersion())
+		if err := r.Client.Get(ctx, key, object); err != nil {
+			continue
+		}
+		machine, err = capi.FromUnstructured(object)
+		if err != nil {
+			log.Error(err, "failed to check snapshot triggers")
+			return
+		}
+	}
+}
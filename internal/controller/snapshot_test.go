@@ -0,0 +1,124 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/dlipovetsky/machine-monitor/internal/capi"
+	"github.com/dlipovetsky/machine-monitor/internal/snapshot"
+)
+
+// triggerKeys returns the keys of the triggers.
+func triggerKeys(triggers []snapshotTrigger) []string {
+	keys := []string{}
+	for _, trigger := range triggers {
+		keys = append(keys, trigger.key)
+	}
+	return keys
+}
+
+var _ = Describe("snapshotTriggers", func() {
+	var (
+		now      time.Time
+		settings MachineSettings
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+		settings = MachineSettings{SnapshotBootstrapTimeout: 30 * time.Minute}
+	})
+
+	// createdAgo returns a Machine whose Node is not Ready, created the duration before now.
+	createdAgo := func(d time.Duration) *capi.Machine {
+		machine := newTestMachine("m", nil, false)
+		machine.Object.SetCreationTimestamp(metav1.NewTime(now.Add(-d)))
+		return machine
+	}
+
+	It("does not trigger for a healthy Machine", func() {
+		machine := newTestMachine("m", nil, true)
+		machine.Object.SetCreationTimestamp(metav1.NewTime(now.Add(-time.Hour)))
+		Expect(settings.snapshotTriggers(machine, now)).To(BeEmpty())
+	})
+
+	It("triggers once for each failure", func() {
+		machine := createdAgo(time.Minute)
+		machine.FailureReason = "CreateError"
+		machine.ErrorConditions = []metav1.Condition{{
+			Type:   "InfrastructureReady",
+			Status: metav1.ConditionFalse,
+			Reason: "ProvisioningFailed",
+		}}
+		triggers := settings.snapshotTriggers(machine, now)
+		Expect(triggerKeys(triggers)).To(Equal([]string{
+			"failure: failure reason CreateError",
+			"failure: condition InfrastructureReady is False: ProvisioningFailed",
+		}))
+		Expect(triggers[0].reason).To(Equal("the machine reports failure reason CreateError"))
+	})
+
+	DescribeTable("triggers if the Node is not Ready after the bootstrap timeout",
+		func(age time.Duration, triggered bool) {
+			keys := triggerKeys(settings.snapshotTriggers(createdAgo(age), now))
+			if triggered {
+				Expect(keys).To(Equal([]string{"bootstrap-timeout"}))
+			} else {
+				Expect(keys).To(BeEmpty())
+			}
+		},
+		Entry("within the timeout", 29*time.Minute, false),
+		Entry("at the timeout", 30*time.Minute, false),
+		Entry("past the timeout", 31*time.Minute, true),
+	)
+
+	It("does not trigger the bootstrap timeout for a Machine whose Node is Ready", func() {
+		machine := newTestMachine("m", nil, true)
+		machine.Object.SetCreationTimestamp(metav1.NewTime(now.Add(-time.Hour)))
+		Expect(settings.snapshotTriggers(machine, now)).To(BeEmpty())
+	})
+
+	It("does not trigger the bootstrap timeout for a Machine that is deleted", func() {
+		machine := createdAgo(time.Hour)
+		deleted := metav1.NewTime(now)
+		machine.Object.SetDeletionTimestamp(&deleted)
+		Expect(settings.snapshotTriggers(machine, now)).To(BeEmpty())
+	})
+
+	It("does not trigger the bootstrap timeout if it is disabled", func() {
+		settings.SnapshotBootstrapTimeout = 0
+		Expect(settings.snapshotTriggers(createdAgo(time.Hour), now)).To(BeEmpty())
+	})
+
+	It("triggers once for each value of the request annotation", func() {
+		machine := createdAgo(time.Minute)
+		machine.Object.SetAnnotations(map[string]string{snapshot.AnnotationRequest: "1"})
+		Expect(triggerKeys(settings.snapshotTriggers(machine, now))).To(Equal(
+			[]string{"request: 1"}))
+
+		machine.Object.SetAnnotations(map[string]string{snapshot.AnnotationRequest: "2"})
+		Expect(triggerKeys(settings.snapshotTriggers(machine, now))).To(Equal(
+			[]string{"request: 2"}))
+
+		machine.Object.SetAnnotations(map[string]string{snapshot.AnnotationRequest: ""})
+		Expect(settings.snapshotTriggers(machine, now)).To(BeEmpty())
+	})
+})
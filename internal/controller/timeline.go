@@ -0,0 +1,134 @@
+/*
+Copyright 2025 Daniel Lipovetsky.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+)
+
+// timelineAnnotator adds the timeline annotations to a Machine in the background, so that the
+// stream does not wait for the API server. If milestones are recorded faster than the Machine is
+// patched, only the annotations of the latest timeline are added.
+type timelineAnnotator struct {
+	client client.Client
+	// object is a copy of the Machine, so that patching it does not change the Machine that the
+	// reconciler uses.
+	object *unstructured.Unstructured
+
+	mu sync.Mutex
+	// annotations are the timeline annotations that are not yet added, or nil if there are none.
+	annotations map[string]string
+	notify      chan struct{}
+}
+
+// startTimelineAnnotator runs a timelineAnnotator for the Machine in the background. The returned
+// function adds the remaining annotations, and then stops the timelineAnnotator.
+func startTimelineAnnotator(
+	ctx context.Context,
+	c client.Client,
+	object *unstructured.Unstructured,
+) (*timelineAnnotator, func()) {
+	a := &timelineAnnotator{
+		client: c,
+		object: object.DeepCopy(),
+		notify: make(chan struct{}, 1),
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.run(ctx, stop)
+	}()
+	return a, func() {
+		close(stop)
+		<-done
+	}
+}
+
+// HandleTimeline is called by the timeline.Recorder after it records a milestone.
+func (a *timelineAnnotator) HandleTimeline(_ context.Context, t *timeline.Timeline) {
+	a.mu.Lock()
+	a.annotations = t.Annotations()
+	a.mu.Unlock()
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run adds the annotations whenever the timeline changes, until the context is done, or stop is
+// closed.
+func (a *timelineAnnotator) run(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.notify:
+			a.annotate(ctx)
+		case <-stop:
+			a.annotate(ctx)
+			return
+		}
+	}
+}
+
+// annotate replaces the timeline annotations of the Machine with the annotations that are not yet
+// added, if any.
+func (a *timelineAnnotator) annotate(ctx context.Context) {
+	a.mu.Lock()
+	timelineAnnotations := a.annotations
+	a.annotations = nil
+	a.mu.Unlock()
+	if timelineAnnotations == nil {
+		return
+	}
+
+	base := a.object.DeepCopy()
+	patch := client.MergeFrom(base)
+	annotations := a.object.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for key := range annotations {
+		if strings.HasPrefix(key, timeline.AnnotationPrefix) {
+			delete(annotations, key)
+		}
+	}
+	for key, value := range timelineAnnotations {
+		annotations[key] = value
+	}
+	a.object.SetAnnotations(annotations)
+	if err := a.client.Patch(ctx, a.object, patch); err != nil {
+		err = fmt.Errorf(
+			"failed to patch machine %s: %w",
+			client.ObjectKeyFromObject(a.object),
+			err,
+		)
+		logf.FromContext(ctx).Error(err, "failed to add timeline annotations to machine")
+		// The next patch is computed from the annotations that the Machine has.
+		a.object = base
+	}
+}
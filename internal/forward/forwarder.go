@@ -0,0 +1,215 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	minRetryDelay = 500 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+// Pusher pushes a batch of entries to a remote sink.
+type Pusher interface {
+	// Push pushes the batch. If the sink rejects the batch, and retrying will not help, Push
+	// returns an error that wraps a NonRetryableError.
+	Push(ctx context.Context, batch []journald.Entry) error
+}
+
+// NonRetryableError is returned by a Pusher when the sink rejects a batch as invalid.
+type NonRetryableError struct {
+	Err error
+}
+
+func (e *NonRetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NonRetryableError) Unwrap() error {
+	return e.Err
+}
+
+// Config configures how entries are batched.
+type Config struct {
+	// BatchSize is the maximum number of entries pushed in one batch.
+	BatchSize int
+	// BatchWait is the maximum time to wait for a batch to fill up before it is pushed.
+	BatchWait time.Duration
+}
+
+// CursorFilePath returns the path of the file that holds the cursor of the last entry of a
+// Machine that was pushed to the named sink.
+func CursorFilePath(directory, namespace, name, sink string) string {
+	return path.Join(directory, fmt.Sprintf("%s-%s.%s.cursor", namespace, name, sink))
+}
+
+// Forwarder pushes the entries of the journal of one Machine to a sink.
+//
+// The Forwarder reads entries from the journal in the store, rather than receiving them from the
+// stream, so that a slow or unavailable sink does not delay the stream. Entries are read only as
+// fast as they are pushed. After each batch is pushed, the cursor of its last entry is saved, and
+// the Forwarder resumes after this cursor when it is restarted. Entries are therefore delivered
+// at least once.
+type Forwarder struct {
+	config         Config
+	pusher         Pusher
+	cursorFilePath string
+	reader         journald.Reader
+
+	// drainCtx is cancelled when the Forwarder should stop after pushing every entry.
+	drainCtx context.Context
+	drain    context.CancelFunc
+}
+
+// New returns a Forwarder that pushes the entries of the journal of the Machine with the pusher.
+func New(
+	config Config,
+	pusher Pusher,
+	store journald.Store,
+	namespace, name, cursorFilePath string,
+) (*Forwarder, error) {
+	cursor, err := os.ReadFile(cursorFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read cursor file: %w", err)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+	drainCtx, drain := context.WithCancel(context.Background())
+	return &Forwarder{
+		drainCtx:       drainCtx,
+		drain:          drain,
+		config:         config,
+		pusher:         pusher,
+		cursorFilePath: cursorFilePath,
+		reader:         store.Reader(namespace, name, strings.TrimSpace(string(cursor))),
+	}, nil
+}
+
+// Notify is a journald.EntryHandler that wakes up the Forwarder when new entries are written.
+func (f *Forwarder) Notify(ctx context.Context, entry journald.Entry) {
+	f.reader.Notify(ctx, entry)
+}
+
+// Drain makes Run return once it has pushed every entry in the local journal file.
+func (f *Forwarder) Drain() {
+	f.drain()
+}
+
+// Run pushes entries until the context is done, or, after Drain is called, until every entry
+// is pushed.
+func (f *Forwarder) Run(ctx context.Context) error {
+	defer func() {
+		_ = f.reader.Close()
+	}()
+	for {
+		batch, err := f.nextBatch(ctx)
+		if len(batch) > 0 {
+			if pushErr := f.pushWithRetry(ctx, batch); pushErr != nil {
+				return pushErr
+			}
+			if saveErr := f.saveCursor(batch[len(batch)-1].Cursor()); saveErr != nil {
+				return saveErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nextBatch waits for the first entry, and then collects entries until the batch is full, or
+// BatchWait has elapsed. It returns io.EOF if the Forwarder is draining and no entries are left.
+func (f *Forwarder) nextBatch(ctx context.Context) ([]journald.Entry, error) {
+	entry, err := f.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch := []journald.Entry{entry}
+
+	batchCtx, cancel := context.WithTimeout(ctx, f.config.BatchWait)
+	defer cancel()
+	for len(batch) < f.config.BatchSize {
+		entry, err := f.next(batchCtx)
+		if err == io.EOF {
+			return batch, io.EOF
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return batch, err
+			}
+			// The batch wait elapsed.
+			break
+		}
+		batch = append(batch, entry)
+	}
+	return batch, nil
+}
+
+// next returns the next entry, waiting for it until the context is done, or the Forwarder is
+// draining. It returns io.EOF if the Forwarder is draining and no entries are left.
+func (f *Forwarder) next(ctx context.Context) (journald.Entry, error) {
+	if f.drainCtx.Err() == nil {
+		waitCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stop := context.AfterFunc(f.drainCtx, cancel)
+		defer stop()
+
+		entry, err := f.reader.Next(waitCtx, true)
+		if err == nil || ctx.Err() != nil || f.drainCtx.Err() == nil {
+			return entry, err
+		}
+	}
+	return f.reader.Next(ctx, false)
+}
+
+// pushWithRetry pushes the batch, and retries with exponential backoff until the push succeeds,
+// the push fails with an error that is not retryable, or the context is done.
+func (f *Forwarder) pushWithRetry(ctx context.Context, batch []journald.Entry) error {
+	log := logf.FromContext(ctx)
+
+	delay := minRetryDelay
+	for {
+		err := f.pusher.Push(ctx, batch)
+		if err == nil {
+			return nil
+		}
+		var nonRetryable *NonRetryableError
+		if errors.As(err, &nonRetryable) {
+			// Retrying will not help, so we drop the batch rather than stop forwarding.
+			log.Error(err, "dropping batch rejected by sink", "entries", len(batch))
+			return nil
+		}
+		log.Error(err, "failed to push batch, retrying", "delay", delay)
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+func (f *Forwarder) saveCursor(cursor string) error {
+	tmpFilePath := f.cursorFilePath + ".tmp"
+	if err := os.WriteFile(tmpFilePath, []byte(cursor), 0o644); err != nil {
+		return fmt.Errorf("failed to write cursor file: %w", err)
+	}
+	if err := os.Rename(tmpFilePath, f.cursorFilePath); err != nil {
+		return fmt.Errorf("failed to replace cursor file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dlipovetsky/machine-monitor/internal/forward"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// SinkName identifies the index in the names of cursor files.
+const SinkName = "index"
+
+// mergeFactor is the number of segments of the same level that are merged into one segment of
+// the next level. The number of segments grows with the logarithm of the number of entries.
+const mergeFactor = 8
+
+// maxTermLength is the length above which terms are not indexed, e.g. base64 data.
+const maxTermLength = 64
+
+// storedFields are the fields of an entry that are stored in the index, so that results can be
+// filtered and shown without reading the local journal file, which may have been rotated.
+var storedFields = []string{
+	journald.FieldCursor,
+	journald.FieldRealtimeTimestamp,
+	journald.FieldBootID,
+	journald.FieldMessage,
+	journald.FieldPriority,
+	journald.FieldSystemdUnit,
+	journald.FieldUnit,
+	journald.FieldSyslogIdentifier,
+	"_HOSTNAME",
+	"_PID",
+	"_COMM",
+}
+
+// ForwardConfig returns the batching of the entries that are indexed. Large batches make fewer,
+// larger segments, and an entry can be found about a second after it is written.
+func ForwardConfig() forward.Config {
+	return forward.Config{BatchSize: 1000, BatchWait: time.Second}
+}
+
+// DirectoryPath returns the path of the index directory of a Machine.
+func DirectoryPath(directory, namespace, name string) string {
+	return path.Join(directory, fmt.Sprintf("%s-%s.index", namespace, name))
+}
+
+// state lists the segments of an index. It is replaced atomically after segments are written,
+// so that segments that it does not list, e.g. after a crash, are ignored, and removed.
+type state struct {
+	NextSegment int           `json:"nextSegment"`
+	Segments    []segmentInfo `json:"segments"`
+	// Seqnums are the highest sequence numbers of the indexed entries, by the sequence number ID
+	// of the remote journal, so that an entry that is pushed again, e.g. after a crash, or after
+	// the local journal file is replaced, is not indexed twice.
+	Seqnums map[string]uint64 `json:"seqnums"`
+}
+
+// segmentInfo describes a segment, so that a search can skip it without reading it.
+type segmentInfo struct {
+	Name  string `json:"name"`
+	Level int    `json:"level"`
+	// MinTime and MaxTime are the realtime timestamps of the entries, in microseconds.
+	MinTime int64 `json:"minTime"`
+	MaxTime int64 `json:"maxTime"`
+}
+
+// segment holds entries, in the order they were indexed, and the postings of every term of their
+// messages. A segment is never changed after it is written.
+type segment struct {
+	Entries []journald.Entry `json:"entries"`
+	// Postings are the indexes of the entries whose message has the term, in increasing order.
+	Postings map[string][]int `json:"postings"`
+}
+
+func (s *segment) add(entry journald.Entry) {
+	stored := make(journald.Entry, len(storedFields))
+	for _, field := range storedFields {
+		if value, ok := entry[field]; ok {
+			stored[field] = value
+		}
+	}
+	i := len(s.Entries)
+	s.Entries = append(s.Entries, stored)
+	for _, term := range tokenize(entry.Message()) {
+		if len(term) > maxTermLength {
+			continue
+		}
+		postings := s.Postings[term]
+		// A term that repeats in the message is posted once.
+		if len(postings) == 0 || postings[len(postings)-1] != i {
+			s.Postings[term] = append(postings, i)
+		}
+	}
+}
+
+// info returns the description of the segment.
+func (s *segment) info(name string, level int) segmentInfo {
+	info := segmentInfo{Name: name, Level: level}
+	for i, entry := range s.Entries {
+		t := entry.RealtimeTimestamp().UnixMicro()
+		if i == 0 || t < info.MinTime {
+			info.MinTime = t
+		}
+		if i == 0 || t > info.MaxTime {
+			info.MaxTime = t
+		}
+	}
+	return info
+}
+
+// tokenize returns the terms of the text: its runs of letters and digits, in lower case.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// parseSeqnum returns the sequence number ID and sequence number of the cursor. It returns false
+// if the cursor has none, e.g. because it is the cursor of an entry written by machine-monitor.
+func parseSeqnum(cursor string) (string, uint64, bool) {
+	seqnumID, seqnum := "", ""
+	for _, part := range strings.Split(cursor, ";") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "s":
+			seqnumID = value
+		case "i":
+			seqnum = value
+		}
+	}
+	if seqnumID == "" || seqnum == "" {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(seqnum, 16, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return seqnumID, n, true
+}
+
+// Writer adds the entries of a Machine to its index. It implements forward.Pusher, so that the
+// entries are indexed as they are written to the local journal file, and indexing resumes after
+// a restart. A Writer is not safe for concurrent use, but searches may run while it writes.
+type Writer struct {
+	directory string
+	state     *state
+}
+
+// NewWriter returns a Writer for the index directory. The directory is created, and the index
+// loaded, on the first push.
+func NewWriter(directory string) *Writer {
+	return &Writer{directory: directory}
+}
+
+// Push implements forward.Pusher.
+func (w *Writer) Push(_ context.Context, batch []journald.Entry) error {
+	if w.state == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	s := &segment{Postings: map[string][]int{}}
+	seqnums := maps.Clone(w.state.Seqnums)
+	for _, entry := range batch {
+		if seqnumID, seqnum, ok := parseSeqnum(entry.Cursor()); ok {
+			if indexed, ok := seqnums[seqnumID]; ok && seqnum <= indexed {
+				continue
+			}
+			seqnums[seqnumID] = seqnum
+		}
+		s.add(entry)
+	}
+	if len(s.Entries) == 0 {
+		return nil
+	}
+
+	next := *w.state
+	next.Segments = slices.Clone(w.state.Segments)
+	next.Seqnums = seqnums
+	info, err := w.writeSegment(&next, s, 0)
+	if err != nil {
+		return err
+	}
+	next.Segments = append(next.Segments, info)
+
+	merged, err := w.merge(&next)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(w.directory, "state.json"), next); err != nil {
+		return err
+	}
+	w.state = &next
+	for _, info := range merged {
+		_ = os.Remove(filepath.Join(w.directory, info.Name))
+	}
+	return nil
+}
+
+// open creates the index directory, loads the state, and removes the segments that the state
+// does not list.
+func (w *Writer) open() error {
+	if err := os.MkdirAll(w.directory, 0o755); err != nil {
+		return fmt.Errorf("failed to create index directory: %w", err)
+	}
+	s, err := loadState(w.directory)
+	if err != nil {
+		return err
+	}
+	filePaths, err := filepath.Glob(filepath.Join(w.directory, "segment-*"))
+	if err != nil {
+		return fmt.Errorf("failed to list index segments: %w", err)
+	}
+	for _, filePath := range filePaths {
+		name := filepath.Base(filePath)
+		if !slices.ContainsFunc(s.Segments, func(info segmentInfo) bool {
+			return info.Name == name
+		}) {
+			_ = os.Remove(filePath)
+		}
+	}
+	w.state = s
+	return nil
+}
+
+// writeSegment writes the segment as the next segment of the state.
+func (w *Writer) writeSegment(s *state, seg *segment, level int) (segmentInfo, error) {
+	name := fmt.Sprintf("segment-%08d.json", s.NextSegment)
+	s.NextSegment++
+	if err := writeJSONFile(filepath.Join(w.directory, name), seg); err != nil {
+		return segmentInfo{}, err
+	}
+	return seg.info(name, level), nil
+}
+
+// merge merges the newest segments into one, while mergeFactor of them have the same level. It
+// returns the segments that were merged, which can be removed once the state is written.
+func (w *Writer) merge(s *state) ([]segmentInfo, error) {
+	var merged []segmentInfo
+	for len(s.Segments) >= mergeFactor {
+		newest := s.Segments[len(s.Segments)-mergeFactor:]
+		level := newest[0].Level
+		if slices.ContainsFunc(newest, func(info segmentInfo) bool {
+			return info.Level != level
+		}) {
+			break
+		}
+		combined := &segment{Postings: map[string][]int{}}
+		for _, info := range newest {
+			seg, err := readSegment(w.directory, info.Name)
+			if err != nil {
+				return nil, err
+			}
+			offset := len(combined.Entries)
+			combined.Entries = append(combined.Entries, seg.Entries...)
+			for term, postings := range seg.Postings {
+				for _, i := range postings {
+					combined.Postings[term] = append(combined.Postings[term], offset+i)
+				}
+			}
+		}
+		info, err := w.writeSegment(s, combined, level+1)
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, newest...)
+		s.Segments = append(s.Segments[:len(s.Segments)-mergeFactor], info)
+	}
+	return merged, nil
+}
+
+// loadState reads the state of the index. It returns an empty state if the index has none.
+func loadState(directory string) (*state, error) {
+	s := &state{Seqnums: map[string]uint64{}}
+	data, err := os.ReadFile(filepath.Join(directory, "state.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index state: %w", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse index state: %w", err)
+	}
+	if s.Seqnums == nil {
+		s.Seqnums = map[string]uint64{}
+	}
+	return s, nil
+}
+
+func readSegment(directory, name string) (*segment, error) {
+	data, err := os.ReadFile(filepath.Join(directory, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index segment: %w", err)
+	}
+	s := &segment{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse index segment %s: %w", name, err)
+	}
+	return s, nil
+}
+
+// writeJSONFile writes the value to the file. The file is replaced atomically.
+func writeJSONFile(filePath string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to serialize %s: %w", filepath.Base(filePath), err)
+	}
+	if err := os.WriteFile(filePath+".tmp", data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(filePath), err)
+	}
+	if err := os.Rename(filePath+".tmp", filePath); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", filepath.Base(filePath), err)
+	}
+	return nil
+}
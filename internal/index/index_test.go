@@ -0,0 +1,211 @@
+package index_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/dlipovetsky/machine-monitor/internal/index"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+var base = time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+
+// newEntry returns an entry of the journal with the sequence number, logged seqnum seconds after
+// base.
+func newEntry(seqnum int, unit, priority, message string) journald.Entry {
+	return journald.Entry{
+		journald.FieldCursor: fmt.Sprintf("s=abc;i=%x;b=boot1", seqnum),
+		journald.FieldRealtimeTimestamp: strconv.FormatInt(
+			base.Add(time.Duration(seqnum)*time.Second).UnixMicro(),
+			10,
+		),
+		journald.FieldBootID:      "boot1",
+		journald.FieldSystemdUnit: unit,
+		journald.FieldPriority:    priority,
+		journald.FieldMessage:     message,
+		"UNINDEXED":               "value",
+	}
+}
+
+func messages(results []index.Result) []string {
+	var m []string
+	for _, result := range results {
+		m = append(m, result.Entry.Message())
+	}
+	return m
+}
+
+var _ = Describe("Index", func() {
+	var directory string
+
+	BeforeEach(func() {
+		directory = GinkgoT().TempDir()
+		for _, info := range []journald.MachineInfo{
+			{Namespace: "default", Name: "cp-0", Cluster: "one"},
+			{Namespace: "default", Name: "worker-0", Cluster: "two"},
+		} {
+			Expect(journald.WriteMachineInfo(directory, info)).To(Succeed())
+		}
+	})
+
+	push := func(name string, entries ...journald.Entry) {
+		w := index.NewWriter(index.DirectoryPath(directory, "default", name))
+		Expect(w.Push(context.Background(), entries)).To(Succeed())
+	}
+
+	search := func(s string) []string {
+		query, err := index.ParseQuery(s)
+		Expect(err).NotTo(HaveOccurred())
+		results, err := index.Search(&journald.FileStore{Directory: directory}, directory, query)
+		Expect(err).NotTo(HaveOccurred())
+		return messages(results)
+	}
+
+	It("finds entries by terms, latest first, ignoring case", func() {
+		push("cp-0",
+			newEntry(1, "kubelet.service", "6", "Started kubelet"),
+			newEntry(2, "containerd.service", "6", "containerd started"),
+			newEntry(3, "kubelet.service", "3", "kubelet failed to start"),
+		)
+		Expect(search("STARTED")).To(Equal([]string{"containerd started", "Started kubelet"}))
+		Expect(search("kubelet started")).To(Equal([]string{"Started kubelet"}))
+		Expect(search("missing")).To(BeEmpty())
+	})
+
+	It("matches phrases in order", func() {
+		push("cp-0",
+			newEntry(1, "a.service", "6", "failed to pull image"),
+			newEntry(2, "a.service", "6", "image failed to pull"),
+		)
+		Expect(search(`"failed to pull"`)).To(Equal([]string{
+			"image failed to pull",
+			"failed to pull image",
+		}))
+		Expect(search(`"pull image"`)).To(Equal([]string{"failed to pull image"}))
+	})
+
+	It("filters by machine, cluster, unit, priority, boot, and time", func() {
+		push("cp-0",
+			newEntry(1, "kubelet.service", "6", "error one"),
+			newEntry(2, "containerd.service", "3", "error two"),
+		)
+		push("worker-0", newEntry(3, "kubelet.service", "3", "error three"))
+
+		Expect(search("error machine:default/cp-0")).To(Equal([]string{"error two", "error one"}))
+		Expect(search("error cluster:default/two")).To(Equal([]string{"error three"}))
+		Expect(search("error unit:kubelet")).To(Equal([]string{"error three", "error one"}))
+		Expect(search("error priority:err")).To(Equal([]string{"error three", "error two"}))
+		Expect(search("error boot:other")).To(BeEmpty())
+
+		query, err := index.ParseQuery("error")
+		Expect(err).NotTo(HaveOccurred())
+		query.Filter.Since = base.Add(2 * time.Second)
+		query.Filter.Until = base.Add(2 * time.Second)
+		results, err := index.Search(&journald.FileStore{Directory: directory}, directory, query)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(messages(results)).To(Equal([]string{"error two"}))
+	})
+
+	It("stores the fields needed to filter and show entries", func() {
+		push("cp-0", newEntry(1, "kubelet.service", "6", "hello"))
+		query, err := index.ParseQuery("hello")
+		Expect(err).NotTo(HaveOccurred())
+		results, err := index.Search(&journald.FileStore{Directory: directory}, directory, query)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Machine.Cluster).To(Equal("one"))
+		Expect(results[0].Entry).To(HaveKeyWithValue(journald.FieldSystemdUnit, "kubelet.service"))
+		Expect(results[0].Entry).NotTo(HaveKey("UNINDEXED"))
+	})
+
+	It("limits the results to the latest entries", func() {
+		var entries []journald.Entry
+		for i := 1; i <= 5; i++ {
+			entries = append(entries, newEntry(i, "a.service", "6", fmt.Sprintf("entry %d", i)))
+		}
+		push("cp-0", entries...)
+		query, err := index.ParseQuery("entry")
+		Expect(err).NotTo(HaveOccurred())
+		query.Limit = 2
+		results, err := index.Search(&journald.FileStore{Directory: directory}, directory, query)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(messages(results)).To(Equal([]string{"entry 5", "entry 4"}))
+	})
+
+	It("does not index an entry twice, across restarts", func() {
+		push("cp-0", newEntry(1, "a.service", "6", "once"), newEntry(2, "a.service", "6", "twice"))
+		push("cp-0", newEntry(2, "a.service", "6", "twice"), newEntry(3, "a.service", "6", "more"))
+		Expect(search("once")).To(HaveLen(1))
+		Expect(search("twice")).To(HaveLen(1))
+		Expect(search("more")).To(HaveLen(1))
+	})
+
+	It("merges segments, and finds every entry after the merges", func() {
+		w := index.NewWriter(index.DirectoryPath(directory, "default", "cp-0"))
+		for i := 1; i <= 100; i++ {
+			Expect(w.Push(
+				context.Background(),
+				[]journald.Entry{newEntry(i, "a.service", "6", fmt.Sprintf("message %d", i))},
+			)).To(Succeed())
+		}
+		segments, err := filepath.Glob(
+			filepath.Join(index.DirectoryPath(directory, "default", "cp-0"), "segment-*"),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		// 100 segments are merged into one of level 2, four of level 1, and four of level 0.
+		Expect(segments).To(HaveLen(9))
+
+		query, err := index.ParseQuery("message")
+		Expect(err).NotTo(HaveOccurred())
+		query.Limit = 1000
+		results, err := index.Search(&journald.FileStore{Directory: directory}, directory, query)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(100))
+		Expect(results[0].Entry.Message()).To(Equal("message 100"))
+		Expect(results[99].Entry.Message()).To(Equal("message 1"))
+		Expect(search(`"message 42"`)).To(Equal([]string{"message 42"}))
+	})
+
+	It("ignores segments that were written but not recorded in the state", func() {
+		push("cp-0", newEntry(1, "a.service", "6", "recorded"))
+		indexDirectory := index.DirectoryPath(directory, "default", "cp-0")
+		Expect(os.WriteFile(
+			filepath.Join(indexDirectory, "segment-99999999.json"),
+			[]byte("{}"),
+			0o644,
+		)).To(Succeed())
+		push("cp-0", newEntry(2, "a.service", "6", "recorded again"))
+		Expect(search("recorded")).To(Equal([]string{"recorded again", "recorded"}))
+		Expect(filepath.Join(indexDirectory, "segment-99999999.json")).NotTo(BeAnExistingFile())
+	})
+
+	It("skips Machines without an index", func() {
+		push("cp-0", newEntry(1, "a.service", "6", "indexed"))
+		Expect(search("indexed")).To(HaveLen(1))
+	})
+
+	It("parses queries", func() {
+		query, err := index.ParseQuery(
+			`Failed "Pull  Image" machine:ns/m cluster:ns/c unit:kubelet priority:err boot:ab-cd x:y`,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(query.Terms).To(Equal([]string{"failed", "x", "y"}))
+		Expect(query.Phrases).To(Equal([][]string{{"pull", "image"}}))
+		Expect(query.Machines).To(Equal([]string{"ns/m"}))
+		Expect(query.Clusters).To(Equal([]string{"ns/c"}))
+		Expect(query.Filter.Units).To(Equal([]string{"kubelet.service"}))
+		Expect(query.Filter.BootIDs).To(Equal([]string{"abcd"}))
+
+		_, err = index.ParseQuery(`"unterminated`)
+		Expect(err).To(HaveOccurred())
+		_, err = index.ParseQuery(`machine:nonamespace`)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,290 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// DefaultLimit is the number of results of a search, if the query has no limit.
+const DefaultLimit = 100
+
+// Query fields, written as field:value.
+const (
+	FieldMachine  = "machine"
+	FieldCluster  = "cluster"
+	FieldUnit     = "unit"
+	FieldPriority = "priority"
+	FieldBoot     = "boot"
+)
+
+// Query selects entries. Every term and phrase must be in the message of an entry, and every
+// field filter must match it.
+type Query struct {
+	// Terms are matched against the terms of the message, ignoring case.
+	Terms []string
+	// Phrases are sequences of terms that must appear together, in order.
+	Phrases [][]string
+	// Machines and Clusters, if not empty, select the entries of any of the Machines, or of the
+	// Machines of any of the Clusters, given as <namespace>/<name>.
+	Machines []string
+	Clusters []string
+	// Filter selects entries by unit, priority, boot and time. Its Grep is ignored.
+	Filter journald.Filter
+	// Limit is the maximum number of results. If zero, DefaultLimit is used.
+	Limit int
+}
+
+// ParseQuery parses a query: words, phrases in double quotes, and the field filters
+// machine:<namespace>/<name>, cluster:<namespace>/<name>, unit:<unit>, priority:<priority> and
+// boot:<boot ID>. A field filter that is repeated matches any of its values, except for the
+// priority, of which the last one applies. The time range is not part of the query string.
+func ParseQuery(s string) (Query, error) {
+	q := Query{Filter: journald.NewFilter()}
+	words, err := splitQuery(s)
+	if err != nil {
+		return q, err
+	}
+	for _, word := range words {
+		if word.quoted {
+			if terms := tokenize(word.text); len(terms) > 0 {
+				q.Phrases = append(q.Phrases, terms)
+			}
+			continue
+		}
+		field, value, ok := strings.Cut(word.text, ":")
+		if !ok || value == "" || !slices.Contains(
+			[]string{FieldMachine, FieldCluster, FieldUnit, FieldPriority, FieldBoot},
+			field,
+		) {
+			q.Terms = append(q.Terms, tokenize(word.text)...)
+			continue
+		}
+		switch field {
+		case FieldMachine, FieldCluster:
+			namespace, name, ok := strings.Cut(value, "/")
+			if !ok || namespace == "" || name == "" {
+				return q, fmt.Errorf("invalid %s %q, expected <namespace>/<name>", field, value)
+			}
+			if field == FieldMachine {
+				q.Machines = append(q.Machines, value)
+			} else {
+				q.Clusters = append(q.Clusters, value)
+			}
+		case FieldUnit:
+			q.Filter.Units = append(q.Filter.Units, journald.ParseUnit(value))
+		case FieldPriority:
+			q.Filter.MinPriority, q.Filter.MaxPriority, err = journald.ParsePriority(value)
+			if err != nil {
+				return q, err
+			}
+		case FieldBoot:
+			// A boot ID is printed with or without dashes.
+			q.Filter.BootIDs = append(q.Filter.BootIDs, strings.ReplaceAll(value, "-", ""))
+		}
+	}
+	return q, nil
+}
+
+type queryWord struct {
+	text   string
+	quoted bool
+}
+
+// splitQuery splits the query into words, and phrases in double quotes.
+func splitQuery(s string) ([]queryWord, error) {
+	var words []queryWord
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return words, nil
+		}
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated phrase in query")
+			}
+			words = append(words, queryWord{text: s[1 : end+1], quoted: true})
+			s = s[end+2:]
+			continue
+		}
+		end := strings.IndexAny(s, " \t\n")
+		if end < 0 {
+			end = len(s)
+		}
+		words = append(words, queryWord{text: s[:end]})
+		s = s[end:]
+	}
+}
+
+// Result is an entry that matches a query.
+type Result struct {
+	Machine journald.MachineInfo `json:"machine"`
+	// Entry holds the stored fields of the entry.
+	Entry journald.Entry `json:"entry"`
+}
+
+// Search returns the entries of the Machines in the store that match the query, latest first.
+// The indexes of the Machines are in the local journal directory. Machines without an index are
+// skipped.
+func Search(store journald.Store, directory string, q Query) ([]Result, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	infos, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	var results []Result
+	for _, info := range infos {
+		key := info.Namespace + "/" + info.Name
+		if len(q.Machines) > 0 && !slices.Contains(q.Machines, key) {
+			continue
+		}
+		if len(q.Clusters) > 0 &&
+			!slices.Contains(q.Clusters, info.Namespace+"/"+info.Cluster) {
+			continue
+		}
+		entries, err := searchMachine(DirectoryPath(directory, info.Namespace, info.Name), q, limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search machine %s: %w", key, err)
+		}
+		for _, entry := range entries {
+			results = append(results, Result{Machine: info, Entry: entry})
+		}
+	}
+	sortLatestFirst(results, func(r Result) time.Time { return r.Entry.RealtimeTimestamp() })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// searchMachine returns up to limit of the latest matching entries in the index directory. A
+// segment may be merged, and removed, while it is searched, so the search is retried with the
+// new state.
+func searchMachine(directory string, q Query, limit int) ([]journald.Entry, error) {
+	const attempts = 3
+	for attempt := 1; ; attempt++ {
+		entries, err := searchState(directory, q, limit)
+		if errors.Is(err, os.ErrNotExist) && attempt < attempts {
+			continue
+		}
+		return entries, err
+	}
+}
+
+func searchState(directory string, q Query, limit int) ([]journald.Entry, error) {
+	s, err := loadState(directory)
+	if err != nil {
+		return nil, err
+	}
+	var since, until int64
+	if !q.Filter.Since.IsZero() {
+		since = q.Filter.Since.UnixMicro()
+	}
+	if !q.Filter.Until.IsZero() {
+		until = q.Filter.Until.UnixMicro()
+	}
+
+	var matches []journald.Entry
+	for _, info := range s.Segments {
+		if (since != 0 && info.MaxTime < since) || (until != 0 && info.MinTime > until) {
+			continue
+		}
+		seg, err := readSegment(directory, info.Name)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, seg.search(q)...)
+	}
+	sortLatestFirst(matches, journald.Entry.RealtimeTimestamp)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// search returns the entries of the segment that match the query.
+func (s *segment) search(q Query) []journald.Entry {
+	filter := q.Filter
+	filter.Grep = nil
+
+	terms := slices.Clone(q.Terms)
+	for _, phrase := range q.Phrases {
+		terms = append(terms, phrase...)
+	}
+	var candidates []int
+	if len(terms) == 0 {
+		candidates = make([]int, len(s.Entries))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	} else {
+		candidates = s.Postings[terms[0]]
+		for _, term := range terms[1:] {
+			candidates = intersect(candidates, s.Postings[term])
+		}
+	}
+
+	var matches []journald.Entry
+	for _, i := range candidates {
+		entry := s.Entries[i]
+		if !filter.Match(entry) {
+			continue
+		}
+		if len(q.Phrases) > 0 {
+			messageTerms := tokenize(entry.Message())
+			if slices.ContainsFunc(q.Phrases, func(phrase []string) bool {
+				return !containsPhrase(messageTerms, phrase)
+			}) {
+				continue
+			}
+		}
+		matches = append(matches, entry)
+	}
+	return matches
+}
+
+// intersect returns the postings that are in both lists.
+func intersect(a, b []int) []int {
+	var both []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
+
+// containsPhrase returns true if the terms of the phrase appear in the terms, together and in
+// order.
+func containsPhrase(terms, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(terms); i++ {
+		if slices.Equal(terms[i:i+len(phrase)], phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortLatestFirst sorts the values by their time, latest first. Values with the same time keep
+// their order.
+func sortLatestFirst[T any](values []T, timeOf func(T) time.Time) {
+	slices.SortStableFunc(values, func(a, b T) int {
+		return timeOf(b).Compare(timeOf(a))
+	})
+}
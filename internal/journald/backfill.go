@@ -0,0 +1,189 @@
+package journald
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/tracing"
+)
+
+// Fields of the entry that records a truncated backfill in the local journal file.
+const (
+	// FieldBackfillTruncated is set to "1" in the entry that records a truncated backfill.
+	FieldBackfillTruncated = "MM_BACKFILL_TRUNCATED"
+	// FieldBackfillLimits describes the limits that truncated the backfill.
+	FieldBackfillLimits = "MM_BACKFILL_LIMITS"
+)
+
+// backfillTruncatedCursor is the cursor of the entry that records a truncated backfill. It is
+// followed by backfillStartPrefix and the cursor of the first entry within the limits, if any, so
+// that the stream can resume at that entry.
+const (
+	backfillTruncatedCursor = "machine-monitor;backfill-truncated"
+	backfillStartPrefix     = ";start="
+)
+
+// Backfill limits the entries that are streamed when the journal of a machine is streamed for the
+// first time. If more than one limit is set, the most restrictive one applies. Entries that are
+// logged after the stream starts are never limited.
+type Backfill struct {
+	// Boots, if not zero, limits the backfill to the latest boots, e.g. 1 for the current boot.
+	Boots int
+	// Since, if not zero, limits the backfill to the entries logged in this duration before the
+	// stream starts, measured by the clock of the machine.
+	Since time.Duration
+	// MaxEntries, if not zero, limits the backfill to the latest entries.
+	MaxEntries int
+	// MaxBytes, if not zero, limits the backfill to the latest entries that fit in this many
+	// bytes of journalctl JSON output.
+	MaxBytes int64
+}
+
+// IsZero returns true if the backfill is not limited.
+func (b Backfill) IsZero() bool {
+	return b == Backfill{}
+}
+
+// String describes the limits, e.g. "boots=1, since=24h0m0s".
+func (b Backfill) String() string {
+	var limits []string
+	if b.Boots > 0 {
+		limits = append(limits, fmt.Sprintf("boots=%d", b.Boots))
+	}
+	if b.Since > 0 {
+		limits = append(limits, fmt.Sprintf("since=%s", b.Since))
+	}
+	if b.MaxEntries > 0 {
+		limits = append(limits, fmt.Sprintf("max-entries=%d", b.MaxEntries))
+	}
+	if b.MaxBytes > 0 {
+		limits = append(limits, fmt.Sprintf("max-bytes=%d", b.MaxBytes))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// backfillStart returns the arguments that make journalctl start streaming at the first entry
+// within the limits, and, if the limits skip earlier entries, the entry that records this.
+func (r *Remote) backfillStart(
+	ctx context.Context,
+	backfill Backfill,
+) (_ []string, _ Entry, err error) {
+	ctx, span := tracing.Start(ctx, "journald.backfillStart")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	first, err := r.firstEntry(ctx, nil, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if first == nil {
+		// The journal is empty, so there is nothing to skip.
+		return nil, nil, nil
+	}
+
+	// Every limit is resolved to the first entry within the limit. The latest of these entries
+	// is the first entry within every limit.
+	type query struct {
+		args     []string
+		pipeline string
+		// unlimitedIfEmpty is true if empty output means that the limit does not apply.
+		unlimitedIfEmpty bool
+	}
+	var queries []query
+	if backfill.Boots > 0 {
+		// If the machine has fewer boots than the limit, journalctl fails, because the boot is
+		// not available, and the output is empty. Every boot is then within the limit.
+		queries = append(queries, query{
+			args:             []string{fmt.Sprintf("--boot=%d", 1-backfill.Boots)},
+			unlimitedIfEmpty: true,
+		})
+	}
+	if backfill.Since > 0 {
+		queries = append(queries, query{
+			args: []string{fmt.Sprintf("--since=-%ds", int64(backfill.Since.Seconds()))},
+		})
+	}
+	if backfill.MaxEntries > 0 {
+		queries = append(queries, query{
+			args: []string{fmt.Sprintf("--lines=%d", backfill.MaxEntries)},
+		})
+	}
+	if backfill.MaxBytes > 0 {
+		// The first line of the tail is usually incomplete, so it is skipped. Only POSIX options
+		// are used, since head and tail on the Machine may not be the GNU ones.
+		queries = append(queries, query{
+			pipeline: fmt.Sprintf("tail -c %d | tail -n +2", backfill.MaxBytes),
+		})
+	}
+
+	start := first
+	for _, q := range queries {
+		entry, err := r.firstEntry(ctx, q.args, q.pipeline)
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry == nil && q.unlimitedIfEmpty {
+			continue
+		}
+		if entry == nil {
+			// No entry is within the limit, so only entries logged from now on are streamed.
+			start = nil
+			break
+		}
+		if entry.RealtimeTimestamp().After(start.RealtimeTimestamp()) {
+			start = entry
+		}
+	}
+
+	if start != nil && start.Cursor() == first.Cursor() {
+		return nil, nil, nil
+	}
+
+	truncated := Entry{
+		FieldCursor: backfillTruncatedCursor,
+		FieldMessage: "machine-monitor: the initial backfill was limited to " +
+			backfill.String() + ", earlier journal entries were skipped",
+		FieldPriority:          "4",
+		FieldSyslogIdentifier:  "machine-monitor",
+		FieldBackfillTruncated: "1",
+		FieldBackfillLimits:    backfill.String(),
+	}
+	if start == nil {
+		truncated[FieldRealtimeTimestamp] = strconv.FormatInt(time.Now().UnixMicro(), 10)
+		return []string{"--lines=0"}, truncated, nil
+	}
+	truncated[FieldRealtimeTimestamp] = start[FieldRealtimeTimestamp]
+	truncated[FieldCursor] = backfillTruncatedCursor + backfillStartPrefix + start.Cursor()
+	return []string{"--cursor=" + start.Cursor()}, truncated, nil
+}
+
+// firstEntry runs journalctl with the arguments, and the pipeline, if any, on its output, and
+// returns the entry in the first line of the output, or nil if the output is empty.
+func (r *Remote) firstEntry(ctx context.Context, args []string, pipeline string) (Entry, error) {
+	command := r.Privilege.Wrap(
+		commandLine("journalctl", append(args, "--output=json", "--no-pager")...),
+	)
+	if pipeline != "" {
+		command += " | " + pipeline
+	}
+	command += " | head -n 1"
+	stdout, stderr, err := r.run(ctx, command, r.Privilege.Stdin())
+	if err != nil {
+		return nil, r.Privilege.checkPrivilegeError(err, stderr)
+	}
+	line := bytes.TrimSpace(stdout)
+	if len(line) == 0 {
+		// With a pipeline, the exit status is the exit status of head, so a journalctl that
+		// could not run is only noticed by its error message.
+		if privilegeErr := r.Privilege.checkPrivilegeError(nil, stderr); privilegeErr != nil {
+			return nil, privilegeErr
+		}
+		return nil, nil
+	}
+	return ParseEntry(line)
+}
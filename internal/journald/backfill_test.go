@@ -0,0 +1,145 @@
+package journald
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// entryLine returns a line of journalctl JSON output, logged seconds after an arbitrary time.
+func entryLine(cursor, bootID string, seconds int) string {
+	t := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC).Add(time.Duration(seconds) * time.Second)
+	line, err := json.Marshal(Entry{
+		FieldCursor:            cursor,
+		FieldBootID:            bootID,
+		FieldRealtimeTimestamp: strconv.FormatInt(t.UnixMicro(), 10),
+		FieldMessage:           cursor,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return string(line) + "\n"
+}
+
+// journalHandler answers each journalctl query with the result whose arguments the query
+// contains, and a query without arguments with the first entry. Queries that match nothing have
+// empty output, as journalctl piped to head has when the journal has no matching entry.
+func journalHandler(first string, results map[string]commandResult) commandHandler {
+	return func(command string, _ []byte) commandResult {
+		for args, result := range results {
+			if strings.Contains(command, args) {
+				return result
+			}
+		}
+		if command == "journalctl --output=json --no-pager | head -n 1" {
+			return commandResult{stdout: first}
+		}
+		return commandResult{}
+	}
+}
+
+var _ = ginkgo.Describe("backfillStart", func() {
+	ginkgo.It("does not limit an empty journal", func() {
+		remote, _ := newStandInRemote(journalHandler("", nil))
+		args, truncated, err := remote.backfillStart(context.Background(), Backfill{Boots: 1})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(args).To(BeEmpty())
+		Expect(truncated).To(BeNil())
+	})
+
+	ginkgo.It("does not limit a journal with fewer boots than the limit", func() {
+		remote, _ := newStandInRemote(journalHandler(
+			entryLine("c1", "b1", 0),
+			map[string]commandResult{
+				"--boot=-1": {stderr: "Data from the specified boot (-1) is not available\n"},
+			},
+		))
+		args, truncated, err := remote.backfillStart(context.Background(), Backfill{Boots: 2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(args).To(BeEmpty())
+		Expect(truncated).To(BeNil())
+	})
+
+	ginkgo.It("starts at the first entry of the latest boots", func() {
+		remote, server := newStandInRemote(journalHandler(
+			entryLine("c1", "b1", 0),
+			map[string]commandResult{"--boot=0": {stdout: entryLine("c5", "b2", 50)}},
+		))
+		args, truncated, err := remote.backfillStart(context.Background(), Backfill{Boots: 1})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(args).To(Equal([]string{"--cursor=c5"}))
+		Expect(truncated[FieldBackfillTruncated]).To(Equal("1"))
+		Expect(truncated[FieldBackfillLimits]).To(Equal("boots=1"))
+		Expect(truncated.Cursor()).To(Equal(backfillTruncatedCursor + backfillStartPrefix + "c5"))
+		Expect(truncated[FieldRealtimeTimestamp]).To(Equal(
+			parseEntryOrFail(entryLine("c5", "b2", 50))[FieldRealtimeTimestamp],
+		))
+		Expect(server.Commands()).To(ContainElement(
+			"journalctl --boot=0 --output=json --no-pager | head -n 1",
+		))
+	})
+
+	ginkgo.It("starts at the first entry within every limit", func() {
+		remote, _ := newStandInRemote(journalHandler(
+			entryLine("c1", "b1", 0),
+			map[string]commandResult{
+				"--boot=0":     {stdout: entryLine("c2", "b2", 20)},
+				"--since=-60s": {stdout: entryLine("c3", "b2", 30)},
+				"--lines=100":  {stdout: entryLine("c1", "b1", 0)},
+			},
+		))
+		args, _, err := remote.backfillStart(context.Background(), Backfill{
+			Boots:      1,
+			Since:      time.Minute,
+			MaxEntries: 100,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(args).To(Equal([]string{"--cursor=c3"}))
+	})
+
+	ginkgo.It("starts at the first complete entry within the byte limit", func() {
+		remote, server := newStandInRemote(journalHandler(
+			entryLine("c1", "b1", 0),
+			map[string]commandResult{"tail -c 4096": {stdout: entryLine("c4", "b1", 40)}},
+		))
+		args, truncated, err := remote.backfillStart(context.Background(), Backfill{
+			MaxBytes: 4096,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(args).To(Equal([]string{"--cursor=c4"}))
+		Expect(truncated[FieldBackfillLimits]).To(Equal(Backfill{MaxBytes: 4096}.String()))
+		// Only POSIX options of head and tail are used.
+		Expect(server.Commands()).To(ContainElement(
+			"journalctl --output=json --no-pager | tail -c 4096 | tail -n +2 | head -n 1",
+		))
+	})
+
+	ginkgo.It("streams only new entries if no entry is within a limit", func() {
+		remote, _ := newStandInRemote(journalHandler(entryLine("c1", "b1", 0), nil))
+		args, truncated, err := remote.backfillStart(context.Background(), Backfill{
+			Since: time.Minute,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(args).To(Equal([]string{"--lines=0"}))
+		Expect(truncated.Cursor()).To(Equal(backfillTruncatedCursor))
+	})
+
+	ginkgo.It("reports a privilege strategy that does not work", func() {
+		remote, _ := newStandInRemote(func(string, []byte) commandResult {
+			return commandResult{stderr: "sudo: a password is required\n"}
+		})
+		remote.Privilege = Privilege{Strategy: PrivilegeSudo}
+		_, _, err := remote.backfillStart(context.Background(), Backfill{Boots: 1})
+		Expect(IsPrivilegeError(err)).To(BeTrue())
+	})
+})
+
+// parseEntryOrFail parses a line of journalctl JSON output, and fails the spec if it is invalid.
+func parseEntryOrFail(line string) Entry {
+	entry, err := ParseEntry([]byte(line))
+	Expect(err).NotTo(HaveOccurred())
+	return entry
+}
@@ -0,0 +1,133 @@
+package journald
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockSamples is the number of times the clock of the remote machine is read. The sample with
+// the shortest round trip is the most accurate.
+const clockSamples = 3
+
+// probeClockOffset returns how far the clock of the remote machine is ahead of the local clock.
+// The remote clock is assumed to be read halfway through the round trip, so the offset is accurate
+// to within half the round trip.
+func (r *Remote) probeClockOffset(ctx context.Context) (time.Duration, error) {
+	var offset, shortest time.Duration
+	for i := 0; i < clockSamples; i++ {
+		before := time.Now()
+		// Without %N support, e.g. in some busybox builds, the fraction is not a number, and the
+		// clock is read to the second.
+		stdout, _, err := r.run(ctx, "date -u +%s.%N", nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the clock: %w", err)
+		}
+		roundTrip := time.Since(before)
+		remote, err := parseClock(strings.TrimSpace(string(stdout)))
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || roundTrip < shortest {
+			shortest = roundTrip
+			offset = remote.Sub(before.Add(roundTrip / 2))
+		}
+	}
+	return offset, nil
+}
+
+// parseClock parses the output of date +%s.%N.
+func parseClock(s string) (time.Time, error) {
+	seconds, fraction, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse the clock %q: %w", s, err)
+	}
+	var nsec int64
+	if len(fraction) == 9 {
+		// A fraction that is not a number is ignored.
+		nsec, _ = strconv.ParseInt(fraction, 10, 64)
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// bootIDFilePath is the file that holds the ID of the current boot on Linux.
+const bootIDFilePath = "/proc/sys/kernel/random/boot_id"
+
+// probeBootID returns the ID of the current boot of the remote machine, in the format of the
+// _BOOT_ID field.
+func (r *Remote) probeBootID(ctx context.Context) (string, error) {
+	stdout, _, err := r.run(ctx, "cat "+bootIDFilePath, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the boot ID: %w", err)
+	}
+	return parseBootID(string(stdout))
+}
+
+// parseBootID parses the content of the boot_id file, a UUID, into the format of the _BOOT_ID
+// field, which has no dashes.
+func parseBootID(s string) (string, error) {
+	bootID := strings.ReplaceAll(strings.TrimSpace(s), "-", "")
+	if _, err := hex.DecodeString(bootID); err != nil || len(bootID) != 32 {
+		return "", fmt.Errorf("failed to parse the boot ID %q", strings.TrimSpace(s))
+	}
+	return bootID, nil
+}
+
+// maxBootClockOffsets is the number of boots whose clock offsets are recorded. The offsets of
+// older boots are dropped.
+const maxBootClockOffsets = 100
+
+// BootClockOffset is how far the clock of a Machine was ahead of the clock of machine-monitor
+// during a boot.
+type BootClockOffset struct {
+	BootID      string        `json:"bootID"`
+	ClockOffset time.Duration `json:"clockOffset"`
+}
+
+// RecordClockOffset records the clock offset probed during the boot. If the boot ID is empty, only
+// the latest clock offset is recorded.
+func (info *MachineInfo) RecordClockOffset(bootID string, offset time.Duration) {
+	info.ClockOffset = &offset
+	if bootID == "" {
+		return
+	}
+	info.BootClockOffsets = slices.DeleteFunc(info.BootClockOffsets, func(b BootClockOffset) bool {
+		return b.BootID == bootID
+	})
+	info.BootClockOffsets = append(info.BootClockOffsets, BootClockOffset{
+		BootID:      bootID,
+		ClockOffset: offset,
+	})
+	if excess := len(info.BootClockOffsets) - maxBootClockOffsets; excess > 0 {
+		info.BootClockOffsets = slices.Delete(info.BootClockOffsets, 0, excess)
+	}
+}
+
+// ClockOffsetOf returns how far the clock of the Machine was ahead during the boot. The clock is
+// set, e.g. by NTP, at every boot, so the offset of one boot does not apply to another. The offset
+// of a boot that was never connected to is unknown, and is zero. If the MachineInfo records no
+// boots, e.g. because the boot ID could not be read, the latest clock offset applies to every
+// boot.
+func (info MachineInfo) ClockOffsetOf(bootID string) time.Duration {
+	for _, b := range info.BootClockOffsets {
+		if b.BootID == bootID {
+			return b.ClockOffset
+		}
+	}
+	if len(info.BootClockOffsets) == 0 && info.ClockOffset != nil {
+		return *info.ClockOffset
+	}
+	return 0
+}
+
+// CorrectTime returns the time that the clock of machine-monitor read when the clock of the
+// Machine logged the entry. If the clock offset of the boot of the entry is unknown, the
+// timestamp of the entry is returned unchanged.
+func (info MachineInfo) CorrectTime(entry Entry) time.Time {
+	return entry.RealtimeTimestamp().Add(-info.ClockOffsetOf(entry.BootID()))
+}
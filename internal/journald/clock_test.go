@@ -0,0 +1,123 @@
+package journald
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("parseClock", func() {
+	ginkgo.DescribeTable("parses the output of date",
+		func(s string, expected time.Time) {
+			t, err := parseClock(s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(t).To(BeTemporally("==", expected))
+		},
+		ginkgo.Entry("with nanoseconds", "1700000000.123456789", time.Unix(1700000000, 123456789)),
+		ginkgo.Entry("with leading zeros", "1700000000.000000001", time.Unix(1700000000, 1)),
+		ginkgo.Entry("without %N support", "1700000000.N", time.Unix(1700000000, 0)),
+		ginkgo.Entry("without %N expanded", "1700000000.%N", time.Unix(1700000000, 0)),
+		ginkgo.Entry("without a fraction", "1700000000", time.Unix(1700000000, 0)),
+		ginkgo.Entry("with a short fraction", "1700000000.5", time.Unix(1700000000, 0)),
+	)
+
+	ginkgo.DescribeTable("rejects output that is not a time",
+		func(s string) {
+			_, err := parseClock(s)
+			Expect(err).To(HaveOccurred())
+		},
+		ginkgo.Entry("empty", ""),
+		ginkgo.Entry("a date", "Thu Jan  2 15:04:05 UTC 2025"),
+		ginkgo.Entry("no seconds", ".123456789"),
+	)
+})
+
+var _ = ginkgo.Describe("parseBootID", func() {
+	ginkgo.It("removes the dashes of the UUID", func() {
+		Expect(parseBootID("0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0\n")).To(
+			Equal("0f1e2d3c4b5a69788796a5b4c3d2e1f0"))
+	})
+
+	ginkgo.DescribeTable("rejects content that is not a boot ID",
+		func(s string) {
+			_, err := parseBootID(s)
+			Expect(err).To(HaveOccurred())
+		},
+		ginkgo.Entry("empty", ""),
+		ginkgo.Entry("too short", "0f1e2d3c-4b5a"),
+		ginkgo.Entry("not hexadecimal", "zf1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"),
+		ginkgo.Entry("an error", "cat: /proc/sys/kernel/random/boot_id: No such file"),
+	)
+})
+
+var _ = ginkgo.Describe("Remote", func() {
+	ginkgo.It("probes how far the clock is ahead", func() {
+		remote, server := newStandInRemote(func(command string, _ []byte) commandResult {
+			now := time.Now().Add(time.Hour)
+			return commandResult{stdout: fmt.Sprintf("%d.%09d\n", now.Unix(), now.Nanosecond())}
+		})
+		offset, err := remote.probeClockOffset(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(offset).To(BeNumerically("~", time.Hour, time.Second))
+		Expect(server.Commands()).To(HaveLen(clockSamples))
+		Expect(server.Commands()[0]).To(Equal("date -u +%s.%N"))
+	})
+
+	ginkgo.It("probes the boot ID", func() {
+		remote, server := newStandInRemote(func(string, []byte) commandResult {
+			return commandResult{stdout: "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0\n"}
+		})
+		Expect(remote.probeBootID(context.Background())).To(
+			Equal("0f1e2d3c4b5a69788796a5b4c3d2e1f0"))
+		Expect(server.Commands()).To(Equal([]string{"cat " + bootIDFilePath}))
+	})
+})
+
+var _ = ginkgo.Describe("MachineInfo", func() {
+	ginkgo.It("applies the clock offset of each boot to its entries", func() {
+		info := MachineInfo{}
+		info.RecordClockOffset("b1", time.Hour)
+		info.RecordClockOffset("b2", time.Second)
+
+		Expect(info.ClockOffsetOf("b1")).To(Equal(time.Hour))
+		Expect(info.ClockOffsetOf("b2")).To(Equal(time.Second))
+		Expect(info.ClockOffsetOf("b0")).To(BeZero())
+		Expect(*info.ClockOffset).To(Equal(time.Second))
+
+		entry := parseEntryOrFail(entryLine("c1", "b1", 0))
+		Expect(info.CorrectTime(entry)).To(Equal(entry.RealtimeTimestamp().Add(-time.Hour)))
+	})
+
+	ginkgo.It("replaces the clock offset of a boot that is connected to again", func() {
+		info := MachineInfo{}
+		info.RecordClockOffset("b1", time.Hour)
+		info.RecordClockOffset("b2", time.Minute)
+		info.RecordClockOffset("b1", 2*time.Hour)
+
+		Expect(info.BootClockOffsets).To(Equal([]BootClockOffset{
+			{BootID: "b2", ClockOffset: time.Minute},
+			{BootID: "b1", ClockOffset: 2 * time.Hour},
+		}))
+	})
+
+	ginkgo.It("keeps the clock offsets of the latest boots", func() {
+		info := MachineInfo{}
+		for i := range maxBootClockOffsets + 2 {
+			info.RecordClockOffset(fmt.Sprintf("b%d", i), time.Duration(i))
+		}
+		Expect(info.BootClockOffsets).To(HaveLen(maxBootClockOffsets))
+		Expect(info.BootClockOffsets[0].BootID).To(Equal("b2"))
+	})
+
+	ginkgo.It("applies the latest clock offset to every boot if no boot is recorded", func() {
+		info := MachineInfo{}
+		info.RecordClockOffset("", time.Hour)
+		Expect(info.ClockOffsetOf("b1")).To(Equal(time.Hour))
+
+		// A MachineInfo file written before boots were recorded.
+		Expect(MachineInfo{}.ClockOffsetOf("b1")).To(BeZero())
+	})
+})
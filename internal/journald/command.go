@@ -0,0 +1,143 @@
+package journald
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// minSystemdVersion is the oldest journalctl that is supported. It is the version of RHEL 7.
+const minSystemdVersion = 219
+
+// posixShells are the login shells that commands are built for. Other shells, e.g. csh and fish,
+// quote and redirect differently.
+var posixShells = []string{"sh", "bash", "dash", "ash", "ksh", "mksh", "zsh", "busybox"}
+
+var (
+	safeArgRegexp        = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+	systemdVersionRegexp = regexp.MustCompile(`^systemd (\d+)`)
+)
+
+// quote returns the argument quoted for a POSIX shell, so that the shell passes it to the command
+// unchanged.
+func quote(arg string) string {
+	if safeArgRegexp.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// commandLine returns the command line that runs the command with the arguments. Each argument
+// is quoted.
+func commandLine(name string, args ...string) string {
+	quoted := make([]string, 0, len(args)+1)
+	quoted = append(quoted, quote(name))
+	for _, arg := range args {
+		quoted = append(quoted, quote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Capabilities are what the remote machine supports. They are probed once per connection.
+type Capabilities struct {
+	// SystemdVersion is the version of journalctl.
+	SystemdVersion int
+	// OutputModes are the output modes of journalctl, or nil, if journalctl cannot list them.
+	OutputModes []string
+	// Shell is the login shell of the SSH user.
+	Shell string
+}
+
+// UnsupportedError reports that the remote machine lacks something that streaming its journal
+// needs. Retrying does not fix it.
+type UnsupportedError struct {
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("the remote machine is not supported: %s", e.Reason)
+}
+
+// IsUnsupportedError returns true if the error is, or wraps, an UnsupportedError.
+func IsUnsupportedError(err error) bool {
+	unsupportedErr := &UnsupportedError{}
+	return errors.As(err, &unsupportedErr)
+}
+
+// probeCapabilities returns the capabilities of the remote machine. The shell is probed first,
+// with a command that every shell runs, because the other probes need a POSIX shell.
+func (r *Remote) probeCapabilities(ctx context.Context) (Capabilities, error) {
+	capabilities := Capabilities{}
+
+	stdout, _, err := r.run(ctx, `echo "$SHELL"`, nil)
+	if err != nil {
+		return capabilities, fmt.Errorf("failed to probe the login shell: %w", err)
+	}
+	capabilities.Shell = strings.TrimSpace(string(stdout))
+	// The shell may be unknown, e.g. if the SSH server does not set SHELL. Then it is assumed to
+	// be POSIX.
+	if capabilities.Shell != "" && !slices.Contains(posixShells, path.Base(capabilities.Shell)) {
+		return capabilities, &UnsupportedError{
+			Reason: fmt.Sprintf("the login shell %q is not a POSIX shell", capabilities.Shell),
+		}
+	}
+
+	stdout, _, err = r.run(ctx, "journalctl --version 2>&1 | head -n 1", nil)
+	if err != nil {
+		return capabilities, fmt.Errorf("failed to probe journalctl: %w", err)
+	}
+	version := string(stdout)
+	match := systemdVersionRegexp.FindStringSubmatch(strings.TrimSpace(version))
+	if match == nil {
+		return capabilities, &UnsupportedError{
+			Reason: fmt.Sprintf(
+				"journalctl is missing, or its version is unknown: %q",
+				strings.TrimSpace(version),
+			),
+		}
+	}
+	// The regular expression only matches digits.
+	capabilities.SystemdVersion, _ = strconv.Atoi(match[1])
+	if capabilities.SystemdVersion < minSystemdVersion {
+		return capabilities, &UnsupportedError{
+			Reason: fmt.Sprintf(
+				"journalctl is from systemd %d, but systemd %d or later is required",
+				capabilities.SystemdVersion,
+				minSystemdVersion,
+			),
+		}
+	}
+
+	// Older versions of journalctl cannot list their output modes, so a failure is ignored.
+	stdout, _, err = r.run(ctx, "journalctl --output=help", nil)
+	if err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(stdout))
+		capabilities.OutputModes = []string{}
+		for scanner.Scan() {
+			if mode := strings.TrimSpace(scanner.Text()); mode != "" {
+				capabilities.OutputModes = append(capabilities.OutputModes, mode)
+			}
+		}
+		if !slices.Contains(capabilities.OutputModes, "json") {
+			return capabilities, &UnsupportedError{
+				Reason: "journalctl does not support the json output mode",
+			}
+		}
+	}
+
+	logf.FromContext(ctx).V(1).Info(
+		"probed remote capabilities",
+		"systemdVersion", capabilities.SystemdVersion,
+		"shell", capabilities.Shell,
+	)
+	return capabilities, nil
+}
@@ -0,0 +1,180 @@
+package journald
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// journaldCursor is a cursor in the format of journald. Its semicolons separate commands in a
+// shell.
+const journaldCursor = "s=6a1b;i=2f;b=9c0d;m=1e;t=5f;x=7a"
+
+var _ = ginkgo.DescribeTable("quote",
+	func(arg, quoted string) {
+		Expect(quote(arg)).To(Equal(quoted))
+
+		// A POSIX shell passes the quoted argument to the command unchanged.
+		out, err := exec.Command("sh", "-c", "printf '%s' "+quoted).Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal(arg))
+	},
+	ginkgo.Entry("a safe argument", "--output=json", "--output=json"),
+	ginkgo.Entry("an empty argument", "", "''"),
+	ginkgo.Entry("a space", "a b", "'a b'"),
+	ginkgo.Entry("a semicolon", "a;reboot", "'a;reboot'"),
+	ginkgo.Entry("a dollar sign", "$HOME", "'$HOME'"),
+	ginkgo.Entry("a command substitution", "$(reboot)", "'$(reboot)'"),
+	ginkgo.Entry("a single quote", "it's", `'it'\''s'`),
+	ginkgo.Entry("only single quotes", "''", `''\'''\'''`),
+	ginkgo.Entry("a newline", "a\nb", "'a\nb'"),
+)
+
+var _ = ginkgo.DescribeTable("commandLine",
+	func(args []string, line string) {
+		Expect(commandLine("journalctl", args...)).To(Equal(line))
+	},
+	ginkgo.Entry("no arguments", nil, "journalctl"),
+	ginkgo.Entry("safe arguments",
+		[]string{"--follow", "--output=json"},
+		"journalctl --follow --output=json",
+	),
+	ginkgo.Entry("an empty argument",
+		[]string{"--follow", ""},
+		"journalctl --follow ''",
+	),
+	ginkgo.Entry("arguments with special characters",
+		[]string{"--after-cursor=a b", "--cursor=$x", "--grep=it's"},
+		`journalctl '--after-cursor=a b' '--cursor=$x' '--grep=it'\''s'`,
+	),
+)
+
+var _ = ginkgo.Describe("resuming after a cursor", func() {
+	ginkgo.It("quotes the cursor of the last entry", func() {
+		Expect(streamJournalCommand(resumeArgs(journaldCursor))).To(Equal(
+			"journalctl --follow '--after-cursor=" + journaldCursor + "' --output=json",
+		))
+	})
+
+	ginkgo.It("quotes the cursor of the first entry within the backfill limits", func() {
+		truncated := backfillTruncatedCursor + backfillStartPrefix + journaldCursor
+		Expect(streamJournalCommand(resumeArgs(truncated))).To(Equal(
+			"journalctl --follow '--cursor=" + journaldCursor + "' --output=json",
+		))
+	})
+
+	ginkgo.It("streams only new entries if no entry was within the backfill limits", func() {
+		Expect(streamJournalCommand(resumeArgs(backfillTruncatedCursor))).To(Equal(
+			"journalctl --follow --lines=0 --output=json",
+		))
+	})
+
+	ginkgo.It("quotes the cursor of a live stream", func() {
+		Expect(streamLiveJournalCommand(10, journaldCursor)).To(Equal(
+			"journalctl --follow '--after-cursor=" + journaldCursor + "' --output=json",
+		))
+		Expect(streamLiveJournalCommand(10, "")).To(Equal(
+			"journalctl --follow --lines=10 --output=json",
+		))
+	})
+
+	ginkgo.It("passes the cursor to journalctl unchanged", func() {
+		for _, args := range [][]string{
+			resumeArgs(journaldCursor),
+			resumeArgs(backfillTruncatedCursor + backfillStartPrefix + journaldCursor),
+		} {
+			line := commandLine("printf", append([]string{"%s"}, args...)...)
+			out, err := exec.Command("sh", "-c", line).Output()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(out)).To(Equal(args[0]))
+		}
+	})
+})
+
+// capabilitiesHandler answers the capability probes with the results.
+func capabilitiesHandler(shell, version, outputModes commandResult) commandHandler {
+	return func(command string, _ []byte) commandResult {
+		switch command {
+		case `echo "$SHELL"`:
+			return shell
+		case "journalctl --version 2>&1 | head -n 1":
+			return version
+		case "journalctl --output=help":
+			return outputModes
+		}
+		return commandResult{exitStatus: 127}
+	}
+}
+
+var _ = ginkgo.Describe("probeCapabilities", func() {
+	var (
+		shell       commandResult
+		version     commandResult
+		outputModes commandResult
+	)
+
+	ginkgo.BeforeEach(func() {
+		shell = commandResult{stdout: "/bin/bash\n"}
+		version = commandResult{stdout: "systemd 252 (252.22-1~deb12u1)\n"}
+		outputModes = commandResult{stdout: "short\nshort-iso\njson\njson-pretty\ncat\n"}
+	})
+
+	probe := func() (Capabilities, error) {
+		remote, _ := newStandInRemote(capabilitiesHandler(shell, version, outputModes))
+		return remote.probeCapabilities(context.Background())
+	}
+
+	ginkgo.It("parses the probes", func() {
+		capabilities, err := probe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(capabilities).To(Equal(Capabilities{
+			SystemdVersion: 252,
+			OutputModes:    []string{"short", "short-iso", "json", "json-pretty", "cat"},
+			Shell:          "/bin/bash",
+		}))
+	})
+
+	ginkgo.It("accepts the oldest supported version", func() {
+		version = commandResult{stdout: "systemd 219\n+PAM +AUDIT +SELINUX\n"}
+		capabilities, err := probe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(capabilities.SystemdVersion).To(Equal(219))
+	})
+
+	ginkgo.It("ignores a journalctl that cannot list its output modes", func() {
+		outputModes = commandResult{stderr: "Unknown output 'help'.\n", exitStatus: 1}
+		capabilities, err := probe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(capabilities.OutputModes).To(BeNil())
+	})
+
+	ginkgo.It("assumes an unknown shell is a POSIX shell", func() {
+		shell = commandResult{stdout: "\n"}
+		capabilities, err := probe()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(capabilities.Shell).To(BeEmpty())
+	})
+
+	ginkgo.DescribeTable("rejects an unsupported machine",
+		func(setup func(), reason string) {
+			setup()
+			_, err := probe()
+			Expect(IsUnsupportedError(err)).To(BeTrue())
+			Expect(err).To(MatchError(ContainSubstring(reason)))
+		},
+		ginkgo.Entry("with a shell that is not POSIX", func() {
+			shell = commandResult{stdout: "/usr/bin/fish\n"}
+		}, `the login shell "/usr/bin/fish" is not a POSIX shell`),
+		ginkgo.Entry("without journalctl", func() {
+			version = commandResult{stdout: "sh: 1: journalctl: not found\n"}
+		}, "journalctl is missing, or its version is unknown"),
+		ginkgo.Entry("with an old journalctl", func() {
+			version = commandResult{stdout: "systemd 208\n"}
+		}, "journalctl is from systemd 208, but systemd 219 or later is required"),
+		ginkgo.Entry("with a journalctl without the json output mode", func() {
+			outputModes = commandResult{stdout: "short\ncat\n"}
+		}, "journalctl does not support the json output mode"),
+	)
+})
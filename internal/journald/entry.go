@@ -0,0 +1,134 @@
+package journald
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Well-known journal field names.
+// See https://www.freedesktop.org/software/systemd/man/latest/systemd.journal-fields.html
+const (
+	FieldCursor            = "__CURSOR"
+	FieldRealtimeTimestamp = "__REALTIME_TIMESTAMP"
+	FieldBootID            = "_BOOT_ID"
+	FieldMessage           = "MESSAGE"
+	FieldMessageID         = "MESSAGE_ID"
+	FieldPriority          = "PRIORITY"
+	FieldSystemdUnit       = "_SYSTEMD_UNIT"
+	FieldSyslogIdentifier  = "SYSLOG_IDENTIFIER"
+	// FieldUnit is set by systemd (PID 1) on messages about a unit, e.g. when the unit is started.
+	FieldUnit = "UNIT"
+)
+
+// Entry is a single journal entry, as serialized by journalctl --output=json.
+// Field values that journalctl serializes as byte arrays are converted to strings. If a field
+// has multiple values, only the first one is kept.
+type Entry map[string]string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	entry := make(Entry, len(raw))
+	for field, value := range raw {
+		s, err := decodeFieldValue(value)
+		if err != nil {
+			return fmt.Errorf("failed to decode field %q: %w", field, err)
+		}
+		entry[field] = s
+	}
+	*e = entry
+	return nil
+}
+
+// decodeFieldValue decodes one field value. journalctl serializes a value as a string if it
+// is printable, as an array of numbers if it is binary, as null if it is too large, and as
+// an array of values if the field appears more than once in the entry.
+func decodeFieldValue(value json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s, nil
+	}
+	var numbers []int
+	if err := json.Unmarshal(value, &numbers); err == nil {
+		b := make([]byte, 0, len(numbers))
+		for _, n := range numbers {
+			b = append(b, byte(n))
+		}
+		return string(b), nil
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(value, &values); err == nil {
+		if len(values) == 0 {
+			return "", nil
+		}
+		return decodeFieldValue(values[0])
+	}
+	if string(value) == "null" {
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected value %s", value)
+}
+
+// ParseEntry parses one line of journalctl --output=json output.
+func ParseEntry(line []byte) (Entry, error) {
+	entry := Entry{}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse journal entry: %w", err)
+	}
+	return entry, nil
+}
+
+// Cursor returns the cursor of the entry, which can be used to resume reading the journal
+// after this entry.
+func (e Entry) Cursor() string {
+	return e[FieldCursor]
+}
+
+// BootID returns the ID of the boot that the entry was logged in.
+func (e Entry) BootID() string {
+	return e[FieldBootID]
+}
+
+// Message returns the human-readable message of the entry.
+func (e Entry) Message() string {
+	return e[FieldMessage]
+}
+
+// Unit returns the systemd unit that logged the entry. If the entry was not logged by a unit,
+// it returns the syslog identifier.
+func (e Entry) Unit() string {
+	if unit := e[FieldSystemdUnit]; unit != "" {
+		return unit
+	}
+	return e[FieldSyslogIdentifier]
+}
+
+// RealtimeTimestamp returns the wallclock time at which the entry was received by the remote
+// journal. It returns the zero time if the entry has no valid timestamp.
+func (e Entry) RealtimeTimestamp() time.Time {
+	usec, err := strconv.ParseInt(e[FieldRealtimeTimestamp], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMicro(usec)
+}
+
+// Priority returns the syslog priority of the entry, from 0 (emerg) to 7 (debug).
+// Entries without a valid priority are treated as informational (6), as journalctl does.
+func (e Entry) Priority() int {
+	priority, err := strconv.Atoi(e[FieldPriority])
+	if err != nil || priority < 0 || priority > 7 {
+		return 6
+	}
+	return priority
+}
+
+// EntryHandler is called for each entry streamed from the remote journal, after the entry has
+// been written to the local journal file.
+type EntryHandler func(ctx context.Context, entry Entry)
@@ -0,0 +1,33 @@
+package journald
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrStreamEnded reports that the stream of the journal ended, because the connection was closed,
+// or journalctl was stopped, e.g. because the remote machine rebooted. The stream can be started
+// again right away.
+var ErrStreamEnded = errors.New("the journal stream ended")
+
+// RemoteCommandError reports that a command exited with a non-zero status on the remote machine.
+type RemoteCommandError struct {
+	Command string
+	Stderr  string
+	// Err is the *ssh.ExitError of the command.
+	Err error
+}
+
+func (e *RemoteCommandError) Error() string {
+	return fmt.Sprintf(
+		"command %q failed on remote host: %s: stderr=%q",
+		e.Command,
+		e.Err,
+		strings.TrimSpace(e.Stderr),
+	)
+}
+
+func (e *RemoteCommandError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,149 @@
+package journald
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// priorityNames are the names of the syslog priorities, indexed by priority.
+var priorityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Filter selects entries, like the matching options of journalctl.
+type Filter struct {
+	// Since and Until, if not zero, select entries logged at or after, and at or before, the time.
+	Since time.Time
+	Until time.Time
+	// Units, if not empty, select entries logged by, or about, any of the units.
+	Units []string
+	// MinPriority and MaxPriority select entries with a priority in the range. Note that a
+	// lower number is a higher priority.
+	MinPriority int
+	MaxPriority int
+	// BootIDs, if not empty, select entries logged in any of the boots.
+	BootIDs []string
+	// Grep, if not nil, selects entries whose message matches.
+	Grep *regexp.Regexp
+}
+
+// NewFilter returns a Filter that selects every entry.
+func NewFilter() Filter {
+	return Filter{MinPriority: 0, MaxPriority: 7}
+}
+
+// Match returns true if the filter selects the entry.
+func (f Filter) Match(entry Entry) bool {
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		t := entry.RealtimeTimestamp()
+		if !f.Since.IsZero() && t.Before(f.Since) {
+			return false
+		}
+		if !f.Until.IsZero() && t.After(f.Until) {
+			return false
+		}
+	}
+	if len(f.Units) > 0 &&
+		!slices.Contains(f.Units, entry[FieldSystemdUnit]) &&
+		!slices.Contains(f.Units, entry[FieldUnit]) {
+		return false
+	}
+	if p := entry.Priority(); p < f.MinPriority || p > f.MaxPriority {
+		return false
+	}
+	if len(f.BootIDs) > 0 && !slices.Contains(f.BootIDs, entry.BootID()) {
+		return false
+	}
+	if f.Grep != nil && !f.Grep.MatchString(entry.Message()) {
+		return false
+	}
+	return true
+}
+
+// ParseUnit returns the unit name, with the .service suffix if the name has no suffix, as
+// journalctl --unit does.
+func ParseUnit(unit string) string {
+	if strings.Contains(unit, ".") {
+		return unit
+	}
+	return unit + ".service"
+}
+
+// ParsePriority parses a priority, or range of priorities, as journalctl --priority does. A
+// priority is a name, e.g. "err", or a number, e.g. "3". A single priority selects that priority
+// and every higher priority. A range, e.g. "err..info", selects the priorities in the range.
+func ParsePriority(s string) (minPriority, maxPriority int, err error) {
+	from, to, isRange := strings.Cut(s, "..")
+	if !isRange {
+		maxPriority, err = parseOnePriority(s)
+		return 0, maxPriority, err
+	}
+	if minPriority, err = parseOnePriority(from); err != nil {
+		return 0, 0, err
+	}
+	if maxPriority, err = parseOnePriority(to); err != nil {
+		return 0, 0, err
+	}
+	if minPriority > maxPriority {
+		minPriority, maxPriority = maxPriority, minPriority
+	}
+	return minPriority, maxPriority, nil
+}
+
+func parseOnePriority(s string) (int, error) {
+	if i := slices.Index(priorityNames, s); i >= 0 {
+		return i, nil
+	}
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 || p > 7 {
+		return 0, fmt.Errorf("invalid priority %q", s)
+	}
+	return p, nil
+}
+
+// PriorityName returns the name of the syslog priority.
+func PriorityName(priority int) string {
+	if priority < 0 || priority >= len(priorityNames) {
+		return strconv.Itoa(priority)
+	}
+	return priorityNames[priority]
+}
+
+// ParseBoot returns the IDs of the boots selected by s, as journalctl --boot does. s is a boot
+// ID, or an offset: 0 or a negative number counts back from the latest boot, and a positive
+// number counts forward from the first boot. bootIDs are the boots in the journal, in order.
+func ParseBoot(s string, bootIDs []string) ([]string, error) {
+	offset, err := strconv.Atoi(s)
+	if err != nil {
+		// A boot ID is printed with or without dashes.
+		id := strings.ReplaceAll(s, "-", "")
+		if !slices.Contains(bootIDs, id) {
+			return nil, fmt.Errorf("boot %q not found", s)
+		}
+		return []string{id}, nil
+	}
+	i := offset - 1
+	if offset <= 0 {
+		i = len(bootIDs) - 1 + offset
+	}
+	if i < 0 || i >= len(bootIDs) {
+		return nil, fmt.Errorf("boot offset %d not found", offset)
+	}
+	return []string{bootIDs[i]}, nil
+}
+
+// CompileGrep compiles the pattern. As journalctl --grep does, the pattern is case-insensitive
+// unless it contains an uppercase character.
+func CompileGrep(pattern string) (*regexp.Regexp, error) {
+	if !strings.ContainsFunc(pattern, unicode.IsUpper) {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid grep pattern: %w", err)
+	}
+	return re, nil
+}
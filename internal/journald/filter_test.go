@@ -0,0 +1,57 @@
+package journald
+
+import (
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = ginkgo.DescribeTable("ParsePriority",
+	func(s string, expectedMin, expectedMax int, expectedErr string) {
+		minPriority, maxPriority, err := ParsePriority(s)
+		if expectedErr != "" {
+			Expect(err).To(MatchError(expectedErr))
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(minPriority).To(Equal(expectedMin))
+		Expect(maxPriority).To(Equal(expectedMax))
+	},
+	ginkgo.Entry("a name selects it and every higher priority", "err", 0, 3, ""),
+	ginkgo.Entry("a number selects it and every higher priority", "6", 0, 6, ""),
+	ginkgo.Entry("the lowest priority", "debug", 0, 7, ""),
+	ginkgo.Entry("a range of names", "err..info", 3, 6, ""),
+	ginkgo.Entry("a range of numbers", "1..4", 1, 4, ""),
+	ginkgo.Entry("a range of a name and a number", "crit..5", 2, 5, ""),
+	ginkgo.Entry("a reversed range", "info..err", 3, 6, ""),
+	ginkgo.Entry("a range of one priority", "warning..warning", 4, 4, ""),
+	ginkgo.Entry("an unknown name", "error", 0, 0, `invalid priority "error"`),
+	ginkgo.Entry("a number out of range", "8", 0, 0, `invalid priority "8"`),
+	ginkgo.Entry("a negative number", "-1", 0, 0, `invalid priority "-1"`),
+	ginkgo.Entry("a range with an invalid end", "err..", 0, 0, `invalid priority ""`),
+	ginkgo.Entry("a name in uppercase", "ERR", 0, 0, `invalid priority "ERR"`),
+)
+
+var _ = ginkgo.DescribeTable("ParseBoot",
+	func(s string, bootIDs []string, expected []string, expectedErr string) {
+		selected, err := ParseBoot(s, bootIDs)
+		if expectedErr != "" {
+			Expect(err).To(MatchError(expectedErr))
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(selected).To(Equal(expected))
+	},
+	ginkgo.Entry("0 is the latest boot", "0", []string{"a", "b", "c"}, []string{"c"}, ""),
+	ginkgo.Entry("-1 is the previous boot", "-1", []string{"a", "b", "c"}, []string{"b"}, ""),
+	ginkgo.Entry("-2 is the first boot of three", "-2", []string{"a", "b", "c"}, []string{"a"}, ""),
+	ginkgo.Entry("1 is the first boot", "1", []string{"a", "b", "c"}, []string{"a"}, ""),
+	ginkgo.Entry("3 is the third boot", "3", []string{"a", "b", "c"}, []string{"c"}, ""),
+	ginkgo.Entry("a negative offset before the first boot", "-3", []string{"a", "b", "c"}, nil,
+		"boot offset -3 not found"),
+	ginkgo.Entry("a positive offset after the latest boot", "4", []string{"a", "b", "c"}, nil,
+		"boot offset 4 not found"),
+	ginkgo.Entry("0 without boots", "0", nil, nil, "boot offset 0 not found"),
+	ginkgo.Entry("a boot ID", "0a1b", []string{"0a1b", "2c3d"}, []string{"0a1b"}, ""),
+	ginkgo.Entry("a boot ID with dashes", "2c-3d", []string{"0a1b", "2c3d"}, []string{"2c3d"}, ""),
+	ginkgo.Entry("an unknown boot ID", "ffff-0", []string{"0a1b"}, nil, `boot "ffff-0" not found`),
+)
@@ -0,0 +1,186 @@
+package journald
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// followerPollInterval is how often a Follower checks the local journal file for new entries,
+// when it is not notified about them.
+const followerPollInterval = time.Second
+
+// Follower reads entries from a local journal file, including entries appended after the
+// Follower is created. If the file is rotated, the Follower reads the rest of the rotated file,
+// and then the new local journal file.
+type Follower struct {
+	localJournalFilePath string
+	afterCursor          string
+	// offset is where reading starts, if afterCursor is empty.
+	offset int64
+
+	file    *os.File
+	reader  *bufio.Reader
+	partial []byte
+	notify  chan struct{}
+}
+
+// NewFollower returns a Follower that reads the entries after the entry with the given cursor.
+// If the cursor is empty, or is not found in the local journal file, it reads all entries.
+func NewFollower(localJournalFilePath, afterCursor string) *Follower {
+	return &Follower{
+		localJournalFilePath: localJournalFilePath,
+		afterCursor:          afterCursor,
+		notify:               make(chan struct{}, 1),
+	}
+}
+
+// Notify is an EntryHandler that wakes up the Follower when an entry is written to the local
+// journal file, so that it does not have to wait for the next poll.
+func (f *Follower) Notify(_ context.Context, _ Entry) {
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Next returns the next entry. If there is no next entry, and wait is true, it waits until there
+// is one, or the context is done. If wait is false, it returns io.EOF.
+func (f *Follower) Next(ctx context.Context, wait bool) (Entry, error) {
+	for {
+		if f.file == nil {
+			err := f.open()
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			if err != nil {
+				// The local journal file has not been created yet.
+				if !wait {
+					return nil, io.EOF
+				}
+				if err := f.wait(ctx); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		line, err := f.reader.ReadBytes('\n')
+		f.partial = append(f.partial, line...)
+		if err == nil {
+			entry, parseErr := ParseEntry(f.partial)
+			f.partial = f.partial[:0]
+			if parseErr != nil {
+				// Skip lines that are not entries, rather than stopping the reader.
+				continue
+			}
+			return entry, nil
+		}
+		if err != io.EOF {
+			return nil, fmt.Errorf("failed to read local journal file: %w", err)
+		}
+		if f.rotated() {
+			// Every entry of the rotated file was read.
+			_ = f.file.Close()
+			f.file, f.reader, f.afterCursor, f.offset = nil, nil, "", 0
+			f.partial = f.partial[:0]
+			continue
+		}
+		if !wait {
+			return nil, io.EOF
+		}
+		if err := f.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait waits until the Follower is notified, the poll interval elapses, or the context is done.
+func (f *Follower) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-f.notify:
+	case <-time.After(followerPollInterval):
+	}
+	return nil
+}
+
+// Close closes the local journal file.
+func (f *Follower) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// rotated returns true if the open file is no longer the local journal file, because it was
+// rotated, and a new local journal file was created.
+func (f *Follower) rotated() bool {
+	opened, err := f.file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(f.localJournalFilePath)
+	if err != nil {
+		// The new local journal file has not been created yet.
+		return false
+	}
+	return !os.SameFile(opened, current)
+}
+
+// open opens the local journal file, and positions the reader after the entry with the cursor,
+// or at the offset.
+func (f *Follower) open() error {
+	file, err := os.Open(f.localJournalFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open local journal file: %w", err)
+	}
+
+	offset := f.offset
+	if f.afterCursor != "" {
+		offset, _, err = offsetAfterCursor(file, f.afterCursor)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to seek local journal file: %w", err)
+	}
+	f.file = file
+	f.reader = bufio.NewReader(file)
+	return nil
+}
+
+// offsetAfterCursor returns the offset of the entry after the entry with the cursor, and true.
+// It returns zero and false if the cursor is empty or not found.
+func offsetAfterCursor(file *os.File, cursor string) (int64, bool, error) {
+	if cursor == "" {
+		return 0, false, nil
+	}
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to read local journal file: %w", err)
+		}
+		offset += int64(len(line))
+		entry, err := ParseEntry(line)
+		if err != nil {
+			continue
+		}
+		if entry.Cursor() == cursor {
+			return offset, true, nil
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package journald
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// backwardReadSize is how much of a local journal file is read at a time, when it is read
+// backwards.
+const backwardReadSize = 64 * 1024
+
+// LatestEntries returns up to limit of the latest entries of the journal of the Machine in the
+// store that match the filter, oldest first, and the cursor of the latest entry of the journal,
+// whether it matches or not. The local journal files of a FileStore are read backwards from their
+// end, until limit entries match, so that the latest entries of a large journal are found without
+// reading all of it. Other Stores are read from the start.
+func LatestEntries(
+	ctx context.Context,
+	store Store,
+	namespace, name string,
+	filter Filter,
+	limit int,
+) ([]Entry, string, error) {
+	if fileStore, ok := store.(*FileStore); ok {
+		return fileStore.latestEntries(ctx, namespace, name, filter, limit)
+	}
+	return readLatestEntries(ctx, store.Reader(namespace, name, ""), filter, limit)
+}
+
+// readLatestEntries returns up to limit of the latest entries that the reader reads that match
+// the filter, oldest first, and the cursor of the last entry. It closes the reader.
+func readLatestEntries(
+	ctx context.Context,
+	reader Reader,
+	filter Filter,
+	limit int,
+) ([]Entry, string, error) {
+	defer func() {
+		_ = reader.Close()
+	}()
+	entries := []Entry{}
+	cursor := ""
+	for {
+		entry, err := reader.Next(ctx, false)
+		if errors.Is(err, io.EOF) {
+			if len(entries) > limit {
+				entries = entries[len(entries)-limit:]
+			}
+			return entries, cursor, nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		cursor = entry.Cursor()
+		if !filter.Match(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		// Earlier entries are dropped in bulk, rather than one by one.
+		if len(entries) >= 2*limit {
+			entries = append(entries[:0], entries[len(entries)-limit:]...)
+		}
+	}
+}
+
+// latestEntries reads the local journal file of the Machine, and then its rotated local journal
+// files, latest first, each from its end, until limit entries match the filter.
+func (s *FileStore) latestEntries(
+	ctx context.Context,
+	namespace, name string,
+	filter Filter,
+	limit int,
+) ([]Entry, string, error) {
+	files, err := s.openLocalJournalFiles(namespace, name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
+	entries := []Entry{}
+	cursor := ""
+	for i := len(files) - 1; i >= 0 && len(entries) < limit; i-- {
+		reader, err := newBackwardLineReader(files[i])
+		if err != nil {
+			return nil, "", err
+		}
+		for len(entries) < limit {
+			if err := ctx.Err(); err != nil {
+				return nil, "", err
+			}
+			line, err := reader.previous()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			entry, err := ParseEntry(line)
+			if err != nil {
+				// Skip lines that are not entries, as Readers do.
+				continue
+			}
+			if cursor == "" {
+				cursor = entry.Cursor()
+			}
+			if filter.Match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	slices.Reverse(entries)
+	return entries, cursor, nil
+}
+
+// openLocalJournalFiles opens the rotated local journal files of the Machine, oldest first, and
+// then its local journal file, if they exist. The local journal file is opened before the rotated
+// files are listed, so that, if it is rotated in between, it is found among the rotated files, and
+// is not read twice.
+func (s *FileStore) openLocalJournalFiles(namespace, name string) ([]*os.File, error) {
+	current, err := os.Open(s.LocalJournalFilePath(namespace, name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open local journal file: %w", err)
+	}
+	var files []*os.File
+	closeFiles := func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+		if current != nil {
+			_ = current.Close()
+		}
+	}
+	var currentInfo os.FileInfo
+	if current != nil {
+		if currentInfo, err = current.Stat(); err != nil {
+			closeFiles()
+			return nil, fmt.Errorf("failed to stat local journal file: %w", err)
+		}
+	}
+
+	rotated, err := s.RotatedLocalJournalFilePaths(namespace, name)
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
+	for _, filePath := range rotated {
+		file, err := os.Open(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			// The journal is being deleted.
+			continue
+		}
+		if err != nil {
+			closeFiles()
+			return nil, fmt.Errorf("failed to open rotated local journal file: %w", err)
+		}
+		if currentInfo != nil {
+			if info, err := file.Stat(); err == nil && os.SameFile(info, currentInfo) {
+				_ = file.Close()
+				continue
+			}
+		}
+		files = append(files, file)
+	}
+	if current != nil {
+		files = append(files, current)
+	}
+	return files, nil
+}
+
+// backwardLineReader reads the complete lines of a file, from the last to the first. An
+// incomplete last line, e.g. one that is being appended, is not read.
+type backwardLineReader struct {
+	file *os.File
+	// offset is the offset in the file of the unread bytes in buf.
+	offset int64
+	// buf holds the unread bytes before the lines that were read. Unless it is empty, it ends with
+	// a newline.
+	buf []byte
+}
+
+func newBackwardLineReader(file *os.File) (*backwardLineReader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat local journal file: %w", err)
+	}
+	r := &backwardLineReader{file: file, offset: info.Size()}
+	// The bytes after the last newline are an incomplete line.
+	for r.offset > 0 && !bytes.Contains(r.buf, []byte{'\n'}) {
+		if err := r.readChunk(); err != nil {
+			return nil, err
+		}
+	}
+	r.buf = r.buf[:bytes.LastIndexByte(r.buf, '\n')+1]
+	return r, nil
+}
+
+// previous returns the line before the lines that were read, without its newline. It returns
+// io.EOF after the first line was read.
+func (r *backwardLineReader) previous() ([]byte, error) {
+	for {
+		if len(r.buf) > 0 {
+			i := bytes.LastIndexByte(r.buf[:len(r.buf)-1], '\n')
+			if i >= 0 || r.offset == 0 {
+				line := r.buf[i+1 : len(r.buf)-1]
+				r.buf = r.buf[:i+1]
+				return line, nil
+			}
+		}
+		if r.offset == 0 {
+			return nil, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readChunk reads the bytes before the unread bytes into buf.
+func (r *backwardLineReader) readChunk() error {
+	n := min(int64(backwardReadSize), r.offset)
+	chunk := make([]byte, int(n)+len(r.buf))
+	if _, err := r.file.ReadAt(chunk[:n], r.offset-n); err != nil {
+		return fmt.Errorf("failed to read local journal file: %w", err)
+	}
+	copy(chunk[n:], r.buf)
+	r.buf = chunk
+	r.offset -= n
+	return nil
+}
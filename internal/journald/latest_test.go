@@ -0,0 +1,131 @@
+package journald
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// readerStore hides the FileStore, so that LatestEntries reads its journals from the start.
+type readerStore struct {
+	*FileStore
+}
+
+var _ = ginkgo.Describe("LatestEntries", func() {
+	var store *FileStore
+
+	ginkgo.BeforeEach(func() {
+		store = &FileStore{Directory: ginkgo.GinkgoT().TempDir()}
+	})
+
+	// latest returns the cursors of the latest entries that match the filter, and the cursor of
+	// the latest entry, read both backwards, and from the start, which must agree.
+	latest := func(filter Filter, limit int) ([]string, string) {
+		var results [][]string
+		var cursors []string
+		for _, s := range []Store{store, readerStore{store}} {
+			entries, cursor, err := LatestEntries(context.Background(), s, "ns", "a", filter, limit)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).NotTo(BeNil())
+			var entryCursors []string
+			for _, entry := range entries {
+				entryCursors = append(entryCursors, entry.Cursor())
+			}
+			results = append(results, entryCursors)
+			cursors = append(cursors, cursor)
+		}
+		Expect(results[0]).To(Equal(results[1]), "read backwards, and from the start")
+		Expect(cursors[0]).To(Equal(cursors[1]), "read backwards, and from the start")
+		return results[0], cursors[0]
+	}
+
+	ginkgo.It("returns no entries of a journal that does not exist", func() {
+		entries, cursor := latest(NewFilter(), 10)
+		Expect(entries).To(BeEmpty())
+		Expect(cursor).To(BeEmpty())
+	})
+
+	ginkgo.It("returns the latest entries, oldest first", func() {
+		Expect(appendLines(store, "a",
+			entryLine("a-1", "boot", 1),
+			entryLine("a-2", "boot", 2),
+			entryLine("a-3", "boot", 3),
+		)).To(Succeed())
+		entries, cursor := latest(NewFilter(), 2)
+		Expect(entries).To(Equal([]string{"a-2", "a-3"}))
+		Expect(cursor).To(Equal("a-3"))
+
+		entries, _ = latest(NewFilter(), 10)
+		Expect(entries).To(Equal([]string{"a-1", "a-2", "a-3"}))
+	})
+
+	ginkgo.It("returns the matching entries, and the cursor of the latest entry", func() {
+		Expect(appendLines(store, "a",
+			entryLine("a-1", "boot1", 1),
+			entryLine("a-2", "boot2", 2),
+			entryLine("a-3", "boot1", 3),
+			entryLine("a-4", "boot2", 4),
+		)).To(Succeed())
+		filter := NewFilter()
+		filter.BootIDs = []string{"boot1"}
+		entries, cursor := latest(filter, 10)
+		Expect(entries).To(Equal([]string{"a-1", "a-3"}))
+		Expect(cursor).To(Equal("a-4"))
+	})
+
+	ginkgo.It("reads the rotated files, and large files, in chunks", func() {
+		// Each entry is about 1KiB, so that each file takes several chunks.
+		padding := strings.Repeat("x", 1000)
+		seconds := 0
+		for range 3 {
+			var lines []string
+			for range 200 {
+				seconds++
+				lines = append(lines, strings.Replace(
+					entryLine(fmt.Sprintf("a-%d", seconds), "boot", seconds),
+					`"MESSAGE":"`,
+					`"MESSAGE":"`+padding,
+					1,
+				))
+			}
+			Expect(appendLines(store, "a", lines...)).To(Succeed())
+			Expect(store.Rotate("ns", "a")).To(Succeed())
+		}
+		// After the last rotation, the local journal file is empty.
+		entries, cursor := latest(NewFilter(), 450)
+		Expect(entries).To(HaveLen(450))
+		Expect(entries[0]).To(Equal("a-151"))
+		Expect(entries[449]).To(Equal("a-600"))
+		Expect(cursor).To(Equal("a-600"))
+
+		entries, _ = latest(NewFilter(), 1000)
+		Expect(entries).To(HaveLen(600))
+	})
+
+	ginkgo.It("skips an incomplete last line, and lines that are not entries", func() {
+		localJournalFilePath := store.LocalJournalFilePath("ns", "a")
+		Expect(os.WriteFile(localJournalFilePath, []byte(
+			"\n"+
+				entryLine("a-1", "boot", 1)+
+				"not an entry\n"+
+				entryLine("a-2", "boot", 2)+
+				`{"__CURSOR":"a-3"`,
+		), 0o644)).To(Succeed())
+		entries, cursor := latest(NewFilter(), 10)
+		Expect(entries).To(Equal([]string{"a-1", "a-2"}))
+		Expect(cursor).To(Equal("a-2"))
+	})
+
+	ginkgo.It("returns no entries of a file with only an incomplete line", func() {
+		localJournalFilePath := store.LocalJournalFilePath("ns", "a")
+		Expect(os.WriteFile(localJournalFilePath, []byte(`{"__CURSOR":"a-1"`), 0o644)).
+			To(Succeed())
+		entries, cursor := latest(NewFilter(), 10)
+		Expect(entries).To(BeEmpty())
+		Expect(cursor).To(BeEmpty())
+	})
+})
@@ -0,0 +1,140 @@
+package journald
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LocalJournalFilePath returns the path of the local journal file of a Machine.
+func LocalJournalFilePath(directory, namespace, name string) string {
+	return path.Join(
+		directory,
+		// The machine name is unique in a namespace, so we use both the namespace
+		// and the name to ensure the local journal file name is unique.
+		fmt.Sprintf(
+			"%s-%s.log",
+			namespace,
+			name,
+		),
+	)
+}
+
+// ReadBootIDs returns the IDs of the boots in the journal of the Machine, in the order they first
+// appear. If the Machine has no journal, it returns no IDs.
+func ReadBootIDs(ctx context.Context, store Store, namespace, name string) ([]string, error) {
+	reader := store.Reader(namespace, name, "")
+	defer func() {
+		_ = reader.Close()
+	}()
+	var boots []string
+	for {
+		entry, err := reader.Next(ctx, false)
+		if errors.Is(err, io.EOF) {
+			return boots, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.BootID() == "" || slices.Contains(boots, entry.BootID()) {
+			continue
+		}
+		boots = append(boots, entry.BootID())
+	}
+}
+
+// MachineInfo describes the Machine that a local journal file belongs to, so that the local
+// journal files can be found and grouped without access to the Kubernetes API.
+type MachineInfo struct {
+	Namespace         string `json:"namespace"`
+	Name              string `json:"name"`
+	Cluster           string `json:"cluster,omitempty"`
+	MachineDeployment string `json:"machineDeployment,omitempty"`
+	// ManagementCluster is empty if machine-monitor monitors only one management cluster.
+	ManagementCluster string `json:"managementCluster,omitempty"`
+	// ClockOffset is how far the clock of the Machine was ahead of the clock of machine-monitor,
+	// in nanoseconds, when it was last connected to, or nil if it is unknown.
+	ClockOffset *time.Duration `json:"clockOffset,omitempty"`
+	// BootClockOffsets are the clock offsets of the latest boots that were connected to, oldest
+	// first, as probed when each boot was last connected to.
+	BootClockOffsets []BootClockOffset `json:"bootClockOffsets,omitempty"`
+}
+
+// machineInfoFileSuffix is the suffix of the file names of MachineInfo files.
+const machineInfoFileSuffix = ".machine.json"
+
+// MachineInfoFilePath returns the path of the MachineInfo file of a Machine.
+func MachineInfoFilePath(directory, namespace, name string) string {
+	return path.Join(directory, fmt.Sprintf("%s-%s%s", namespace, name, machineInfoFileSuffix))
+}
+
+// WriteMachineInfo writes the MachineInfo file of a Machine. The file is replaced atomically.
+func WriteMachineInfo(directory string, info MachineInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to serialize machine info: %w", err)
+	}
+	filePath := MachineInfoFilePath(directory, info.Namespace, info.Name)
+	tmpFilePath := filePath + ".tmp"
+	if err := os.WriteFile(tmpFilePath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write machine info file: %w", err)
+	}
+	if err := os.Rename(tmpFilePath, filePath); err != nil {
+		return fmt.Errorf("failed to replace machine info file: %w", err)
+	}
+	return nil
+}
+
+// ReadMachineInfo reads the MachineInfo file of a Machine. If the Machine has none, it returns an
+// error that wraps os.ErrNotExist.
+func ReadMachineInfo(directory, namespace, name string) (MachineInfo, error) {
+	filePath := MachineInfoFilePath(directory, namespace, name)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return MachineInfo{}, fmt.Errorf("failed to read machine info file: %w", err)
+	}
+	info := MachineInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return MachineInfo{}, fmt.Errorf("failed to parse machine info file %s: %w", filePath, err)
+	}
+	return info, nil
+}
+
+// ListMachineInfos returns the MachineInfo of every Machine with a MachineInfo file in the
+// directory, sorted by namespace and name.
+func ListMachineInfos(directory string) ([]MachineInfo, error) {
+	if directory == "" {
+		directory = "."
+	}
+	filePaths, err := filepath.Glob(filepath.Join(directory, "*"+machineInfoFileSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list machine info files: %w", err)
+	}
+	infos := make([]MachineInfo, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read machine info file: %w", err)
+		}
+		info := MachineInfo{}
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("failed to parse machine info file %s: %w", filePath, err)
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b MachineInfo) int {
+		if c := strings.Compare(a.Namespace, b.Namespace); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return infos, nil
+}
@@ -0,0 +1,130 @@
+package journald
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Fields that are added to the entries of several Machines when they are merged.
+const (
+	// FieldMachine identifies the Machine of the entry, as <namespace>/<name>.
+	FieldMachine = "MM_MACHINE"
+	// FieldCorrectedRealtimeTimestamp is the realtime timestamp of the entry, corrected by the
+	// clock offset of its Machine.
+	FieldCorrectedRealtimeTimestamp = "MM_CORRECTED_REALTIME_TIMESTAMP"
+)
+
+// Merge reads the entries of several journals that match the filter, and calls fn for each entry
+// in the order of their timestamps, with the index of the Reader of the journal that holds the
+// entry. Entries with the same timestamp are ordered by Reader. If infos is not nil, the
+// timestamps of the entries of each journal are first corrected by the clock offsets of its
+// Machine, see MachineInfo.CorrectTime, so that entries of Machines with skewed clocks are ordered
+// as they happened. If fn returns an error, Merge stops and returns the error. Merge reads only
+// the entries that are stored when it reads them, and closes the Readers.
+func Merge(
+	ctx context.Context,
+	readers []Reader,
+	infos []MachineInfo,
+	filter Filter,
+	fn func(i int, entry Entry) error,
+) error {
+	defer func() {
+		for _, reader := range readers {
+			_ = reader.Close()
+		}
+	}()
+	merging := make(mergeHeap, 0, len(readers))
+	for i, reader := range readers {
+		r := &mergeReader{index: i, reader: reader, filter: filter}
+		if infos != nil {
+			r.info = &infos[i]
+		}
+		ok, err := r.advance(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			merging = append(merging, r)
+		}
+	}
+	heap.Init(&merging)
+
+	for len(merging) > 0 {
+		r := merging[0]
+		if err := fn(r.index, r.entry); err != nil {
+			return err
+		}
+		ok, err := r.advance(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&merging, 0)
+			continue
+		}
+		heap.Pop(&merging)
+	}
+	return nil
+}
+
+// mergeReader reads the matching entries of one journal.
+type mergeReader struct {
+	index  int
+	reader Reader
+	filter Filter
+	// info has the clock offsets of the Machine, or is nil if timestamps are not corrected.
+	info *MachineInfo
+
+	entry Entry
+	// timestamp is the corrected timestamp of the entry.
+	timestamp time.Time
+}
+
+// advance reads the next matching entry. It returns false at the end of the journal.
+func (r *mergeReader) advance(ctx context.Context) (bool, error) {
+	for {
+		entry, err := r.reader.Next(ctx, false)
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !r.filter.Match(entry) {
+			continue
+		}
+		r.entry = entry
+		r.timestamp = entry.RealtimeTimestamp()
+		if r.info != nil {
+			r.timestamp = r.info.CorrectTime(entry)
+		}
+		return true, nil
+	}
+}
+
+// mergeHeap orders readers by the timestamp of their current entry. It implements heap.Interface.
+type mergeHeap []*mergeReader
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	ti, tj := h[i].timestamp, h[j].timestamp
+	if ti.Equal(tj) {
+		return h[i].index < h[j].index
+	}
+	return ti.Before(tj)
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeReader)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
@@ -0,0 +1,152 @@
+package journald
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writeLocalJournal writes the lines to the local journal file of a Machine in a temporary
+// directory, and returns its path.
+func writeLocalJournal(name string, lines ...string) string {
+	filePath := LocalJournalFilePath(ginkgo.GinkgoT().TempDir(), "ns", name)
+	Expect(os.WriteFile(filePath, []byte(strings.Join(lines, "")), 0o644)).To(Succeed())
+	return filePath
+}
+
+// mergedCursors returns the cursors of the entries that Merge calls fn with, in order, when it
+// merges the journals of the Machines.
+func mergedCursors(store Store, names []string, infos []MachineInfo, filter Filter) []string {
+	var cursors []string
+	Expect(Merge(
+		context.Background(),
+		readers(store, names),
+		infos,
+		filter,
+		func(_ int, entry Entry) error {
+			cursors = append(cursors, entry.Cursor())
+			return nil
+		},
+	)).To(Succeed())
+	return cursors
+}
+
+// readers returns a Reader of the journal of each Machine.
+func readers(store Store, names []string) []Reader {
+	readers := make([]Reader, 0, len(names))
+	for _, name := range names {
+		readers = append(readers, store.Reader("ns", name, ""))
+	}
+	return readers
+}
+
+var _ = ginkgo.Describe("Merge", func() {
+	var (
+		store *FileStore
+		names []string
+	)
+
+	// writeJournal writes the lines to the local journal file of the Machine.
+	writeJournal := func(name string, lines ...string) {
+		Expect(os.WriteFile(
+			store.LocalJournalFilePath("ns", name),
+			[]byte(strings.Join(lines, "")),
+			0o644,
+		)).To(Succeed())
+	}
+
+	ginkgo.BeforeEach(func() {
+		store = &FileStore{Directory: ginkgo.GinkgoT().TempDir()}
+		// The clock of Machine a was an hour ahead during boot a1, and right during boot a2.
+		writeJournal("a",
+			entryLine("a1-10", "a1", 3600+10),
+			entryLine("a2-30", "a2", 30),
+		)
+		writeJournal("b",
+			entryLine("b-5", "b", 5),
+			entryLine("b-20", "b", 20),
+			entryLine("b-40", "b", 40),
+		)
+		names = []string{"a", "b"}
+	})
+
+	ginkgo.It("orders the entries by their timestamps", func() {
+		Expect(mergedCursors(store, names, nil, NewFilter())).To(Equal([]string{
+			"b-5", "b-20", "b-40", "a1-10", "a2-30",
+		}))
+	})
+
+	ginkgo.It("orders the entries by their timestamps, corrected for each boot", func() {
+		a := MachineInfo{Namespace: "ns", Name: "a"}
+		a.RecordClockOffset("a1", time.Hour)
+		a.RecordClockOffset("a2", 0)
+		infos := []MachineInfo{a, {Namespace: "ns", Name: "b"}}
+
+		Expect(mergedCursors(store, names, infos, NewFilter())).To(Equal([]string{
+			"b-5", "a1-10", "b-20", "a2-30", "b-40",
+		}))
+	})
+
+	ginkgo.It("orders entries with the same timestamp by reader", func() {
+		writeJournal("a", entryLine("a", "a1", 10))
+		writeJournal("b", entryLine("b", "b1", 10))
+		Expect(mergedCursors(store, names, nil, NewFilter())).To(Equal([]string{"a", "b"}))
+		Expect(mergedCursors(store, []string{"b", "a"}, nil, NewFilter())).To(
+			Equal([]string{"b", "a"}))
+	})
+
+	ginkgo.It("merges only the entries that match the filter", func() {
+		bootFilter := NewFilter()
+		bootFilter.BootIDs = []string{"a2", "b"}
+		Expect(mergedCursors(store, names, nil, bootFilter)).To(Equal(
+			[]string{"b-5", "b-20", "a2-30", "b-40"},
+		))
+	})
+
+	ginkgo.It("skips lines that are not entries", func() {
+		writeJournal("a",
+			entryLine("a1", "a", 1),
+			"not json\n",
+			entryLine("a2", "a", 2),
+			`{"__CURSOR":"incomplete"`,
+		)
+		Expect(mergedCursors(store, []string{"a"}, nil, NewFilter())).To(
+			Equal([]string{"a1", "a2"}))
+	})
+
+	ginkgo.It("merges the rotated entries of a journal", func() {
+		Expect(store.Rotate("ns", "b")).To(Succeed())
+		Expect(appendLines(store, "b", entryLine("b-50", "b", 50))).To(Succeed())
+		Expect(mergedCursors(store, names, nil, NewFilter())).To(Equal([]string{
+			"b-5", "b-20", "b-40", "b-50", "a1-10", "a2-30",
+		}))
+	})
+
+	ginkgo.It("stops at the error of fn", func() {
+		err := Merge(context.Background(), readers(store, names), nil, NewFilter(),
+			func(int, Entry) error { return os.ErrClosed })
+		Expect(err).To(MatchError(os.ErrClosed))
+	})
+
+	ginkgo.It("treats a Machine without a journal as having no entries", func() {
+		Expect(mergedCursors(store, []string{"b", "missing"}, nil, NewFilter())).To(
+			Equal([]string{"b-5", "b-20", "b-40"}))
+	})
+})
+
+// appendLines appends the lines to the journal of the Machine.
+func appendLines(store Store, name string, lines ...string) error {
+	appender, err := store.Open("ns", name)
+	if err != nil {
+		return err
+	}
+	if _, err := appender.Write([]byte(strings.Join(lines, ""))); err != nil {
+		_ = appender.Close()
+		return err
+	}
+	return appender.Close()
+}
@@ -0,0 +1,256 @@
+package journald
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/dlipovetsky/machine-monitor/internal/tracing"
+)
+
+// Privilege strategies decide how journalctl gets access to the entire journal.
+const (
+	// PrivilegeNone runs journalctl as the SSH user, which must be root, or be allowed to read
+	// the entire journal, e.g. as a member of the systemd-journal group.
+	PrivilegeNone = "none"
+	// PrivilegeSudo runs journalctl with sudo, which must not ask for a password.
+	PrivilegeSudo = "sudo"
+	// PrivilegeDoas runs journalctl with doas, which must not ask for a password.
+	PrivilegeDoas = "doas"
+	// PrivilegeSudoPassword runs journalctl with sudo, and sends the password to sudo.
+	PrivilegeSudoPassword = "sudo-password"
+	// PrivilegeAuto probes the remote machine for the first strategy that works, in the order
+	// none (for root), sudo, doas, and none (for members of the systemd-journal or adm groups).
+	PrivilegeAuto = "auto"
+)
+
+// PrivilegeStrategies are the supported privilege strategies.
+var PrivilegeStrategies = []string{
+	PrivilegeNone,
+	PrivilegeSudo,
+	PrivilegeDoas,
+	PrivilegeSudoPassword,
+	PrivilegeAuto,
+}
+
+// Privilege is how commands that need access to the entire journal are run.
+type Privilege struct {
+	// Strategy is one of PrivilegeStrategies. If empty, PrivilegeSudo is used.
+	Strategy string
+	// Password is the password of the SSH user, for PrivilegeSudoPassword.
+	Password []byte
+}
+
+// Wrap returns the command that runs the command with the privilege. The command must be a
+// single command, not a pipeline.
+func (p Privilege) Wrap(command string) string {
+	switch p.Strategy {
+	case PrivilegeNone:
+		return command
+	case PrivilegeDoas:
+		return "doas -n " + command
+	case PrivilegeSudoPassword:
+		// The password is read from standard input, without a prompt.
+		return "sudo -S -p '' " + command
+	default:
+		return "sudo -n " + command
+	}
+}
+
+// Stdin returns the standard input of a command that is run with the privilege, or nil.
+func (p Privilege) Stdin() io.Reader {
+	if p.Strategy != PrivilegeSudoPassword {
+		return nil
+	}
+	return bytes.NewReader(append(bytes.Clone(p.Password), '\n'))
+}
+
+// PrivilegeError reports that the privilege strategy does not work on the remote machine. It is
+// a misconfiguration, which retrying does not fix.
+type PrivilegeError struct {
+	Strategy string
+	Stderr   string
+}
+
+func (e *PrivilegeError) Error() string {
+	return fmt.Sprintf(
+		"privilege strategy %q does not work on the remote machine: %s",
+		e.Strategy,
+		strings.TrimSpace(e.Stderr),
+	)
+}
+
+// privilegeFailures are messages that sudo and doas print when they refuse to run a command.
+var privilegeFailures = []string{
+	"a password is required",
+	"a terminal is required",
+	"no tty present",
+	"is not in the sudoers file",
+	"is not allowed to execute",
+	"incorrect password attempt",
+	"sudo: command not found",
+	"doas: command not found",
+	"doas: Authorization required",
+	"doas: Operation not permitted",
+	"doas: not installed setuid",
+}
+
+// checkPrivilegeError returns a PrivilegeError if stderr shows that the command was not run,
+// because the privilege strategy does not work. Otherwise, it returns err.
+func (p Privilege) checkPrivilegeError(err error, stderr string) error {
+	for _, failure := range privilegeFailures {
+		if strings.Contains(stderr, failure) {
+			strategy := p.Strategy
+			if strategy == "" {
+				strategy = PrivilegeSudo
+			}
+			return &PrivilegeError{Strategy: strategy, Stderr: stderr}
+		}
+	}
+	return err
+}
+
+// IsPrivilegeError returns true if the error is, or wraps, a PrivilegeError.
+func IsPrivilegeError(err error) bool {
+	privilegeErr := &PrivilegeError{}
+	return errors.As(err, &privilegeErr)
+}
+
+// Remote is a remote machine that journal commands are run on.
+type Remote struct {
+	Client       *ssh.Client
+	Privilege    Privilege
+	Capabilities Capabilities
+	// ClockOffset is how far the clock of the remote machine is ahead of the local clock, or nil
+	// if it could not be read.
+	ClockOffset *time.Duration
+	// BootID is the ID of the current boot of the remote machine, or empty if it could not be
+	// read.
+	BootID string
+}
+
+// NewRemote returns the remote machine of the client. It probes the remote machine for its
+// capabilities, its clock, its boot ID and, if the privilege strategy is PrivilegeAuto, for the
+// strategy to use. It returns an UnsupportedError if the remote machine cannot stream its journal.
+func NewRemote(
+	ctx context.Context,
+	client *ssh.Client,
+	privilege Privilege,
+) (_ *Remote, err error) {
+	ctx, span := tracing.Start(ctx, "journald.NewRemote")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	remote := &Remote{Client: client, Privilege: privilege}
+	capabilities, err := remote.probeCapabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	remote.Capabilities = capabilities
+	span.SetAttributes(attribute.Int(AttributeSystemdVersion, capabilities.SystemdVersion))
+	// The journal can be streamed without the clock offset, so a failure is only logged.
+	if offset, err := remote.probeClockOffset(ctx); err == nil {
+		remote.ClockOffset = &offset
+		logf.FromContext(ctx).V(1).Info("probed clock offset", "clockOffset", offset)
+	} else {
+		logf.FromContext(ctx).Info("unable to probe clock offset", "reason", err.Error())
+	}
+	// The boot ID tells which boot the clock offset applies to.
+	if bootID, err := remote.probeBootID(ctx); err == nil {
+		remote.BootID = bootID
+	} else {
+		logf.FromContext(ctx).Info("unable to probe boot ID", "reason", err.Error())
+	}
+	if privilege.Strategy != PrivilegeAuto {
+		span.SetAttributes(attribute.String(AttributePrivilege, privilege.Strategy))
+		return remote, nil
+	}
+	strategy, err := remote.probePrivilege(ctx)
+	if err != nil {
+		return nil, err
+	}
+	logf.FromContext(ctx).V(1).Info("probed privilege strategy", "strategy", strategy)
+	remote.Privilege = Privilege{Strategy: strategy}
+	span.SetAttributes(attribute.String(AttributePrivilege, strategy))
+	return remote, nil
+}
+
+// probePrivilege returns the first privilege strategy that works on the remote machine.
+func (r *Remote) probePrivilege(ctx context.Context) (string, error) {
+	probes := []struct {
+		strategy string
+		command  string
+	}{
+		{PrivilegeNone, `test "$(id -u)" = 0`},
+		{PrivilegeSudo, "sudo -n true"},
+		{PrivilegeDoas, "doas -n true"},
+		{PrivilegeNone, "id -nG | grep -qwE 'systemd-journal|adm'"},
+	}
+	for _, probe := range probes {
+		if _, _, err := r.run(ctx, probe.command, nil); err == nil {
+			return probe.strategy, nil
+		} else if exitErr := (&ssh.ExitError{}); !errors.As(err, &exitErr) {
+			return "", err
+		}
+	}
+	return "", &PrivilegeError{
+		Strategy: PrivilegeAuto,
+		Stderr: "the SSH user is not root, cannot use sudo or doas without a password, and is " +
+			"not a member of the systemd-journal or adm groups",
+	}
+}
+
+// run runs the command on the remote machine, and returns its standard output and standard
+// error.
+func (r *Remote) run(
+	ctx context.Context,
+	command string,
+	stdin io.Reader,
+) ([]byte, string, error) {
+	log := logf.FromContext(ctx)
+
+	session, err := r.Client.NewSession()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create new SSH session: %w", err)
+	}
+	defer func() {
+		closeSessionErr := session.Close()
+		if closeSessionErr != nil && closeSessionErr != io.EOF {
+			log.Error(closeSessionErr, "failed to close session")
+		}
+	}()
+
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	session.Stdin = stdin
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	log.V(1).Info("running command on remote host", "command", command)
+	if err := session.Run(command); err != nil {
+		exitErr := &ssh.ExitError{}
+		if errors.As(err, &exitErr) {
+			return nil, stderr.String(), &RemoteCommandError{
+				Command: command,
+				Stderr:  stderr.String(),
+				Err:     err,
+			}
+		}
+		return nil, stderr.String(), fmt.Errorf(
+			"failed to run command %q on remote host: %w: stderr=%q",
+			command,
+			err,
+			stderr.String(),
+		)
+	}
+	return stdout.Bytes(), stderr.String(), nil
+}
@@ -0,0 +1,131 @@
+package journald
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Privilege", func() {
+	ginkgo.DescribeTable("Wrap",
+		func(strategy, expected string) {
+			Expect(Privilege{Strategy: strategy}.Wrap("journalctl --follow")).To(Equal(expected))
+		},
+		ginkgo.Entry("none", PrivilegeNone, "journalctl --follow"),
+		ginkgo.Entry("sudo", PrivilegeSudo, "sudo -n journalctl --follow"),
+		ginkgo.Entry("the default", "", "sudo -n journalctl --follow"),
+		ginkgo.Entry("doas", PrivilegeDoas, "doas -n journalctl --follow"),
+		ginkgo.Entry("sudo-password", PrivilegeSudoPassword, "sudo -S -p '' journalctl --follow"),
+	)
+
+	ginkgo.It("sends the password only to sudo-password", func() {
+		for _, strategy := range []string{PrivilegeNone, PrivilegeSudo, PrivilegeDoas, ""} {
+			Expect(Privilege{Strategy: strategy, Password: []byte("secret")}.Stdin()).To(BeNil())
+		}
+		privilege := Privilege{Strategy: PrivilegeSudoPassword, Password: []byte("secret")}
+		Expect(io.ReadAll(privilege.Stdin())).To(Equal([]byte("secret\n")))
+		// The password is not changed by reading it.
+		Expect(privilege.Password).To(Equal([]byte("secret")))
+	})
+
+	ginkgo.DescribeTable("checkPrivilegeError",
+		func(strategy, stderr string, isPrivilegeErr bool) {
+			commandErr := errors.New("exit status 1")
+			err := Privilege{Strategy: strategy}.checkPrivilegeError(commandErr, stderr)
+			if !isPrivilegeErr {
+				Expect(err).To(BeIdenticalTo(commandErr))
+				return
+			}
+			privilegeErr := &PrivilegeError{}
+			Expect(errors.As(err, &privilegeErr)).To(BeTrue())
+			Expect(privilegeErr.Stderr).To(Equal(stderr))
+			expectedStrategy := strategy
+			if expectedStrategy == "" {
+				expectedStrategy = PrivilegeSudo
+			}
+			Expect(privilegeErr.Strategy).To(Equal(expectedStrategy))
+		},
+		ginkgo.Entry("sudo without a password",
+			PrivilegeSudo, "sudo: a password is required\n", true),
+		ginkgo.Entry("sudo without a terminal",
+			PrivilegeSudo, "sudo: a terminal is required to read the password\n", true),
+		ginkgo.Entry("a user not in sudoers",
+			"", "user is not in the sudoers file.  This incident will be reported.\n", true),
+		ginkgo.Entry("a command sudo does not allow",
+			PrivilegeSudo, "Sorry, user u is not allowed to execute 'journalctl' as root\n", true),
+		ginkgo.Entry("a wrong sudo password",
+			PrivilegeSudoPassword, "sudo: 1 incorrect password attempt\n", true),
+		ginkgo.Entry("sudo that is not installed",
+			PrivilegeSudo, "bash: sudo: command not found\n", true),
+		ginkgo.Entry("doas without a password",
+			PrivilegeDoas, "doas: Authorization required\n", true),
+		ginkgo.Entry("doas that does not permit the user",
+			PrivilegeDoas, "doas: Operation not permitted\n", true),
+		ginkgo.Entry("doas that is not installed",
+			PrivilegeDoas, "sh: doas: command not found\n", true),
+		ginkgo.Entry("doas that is not setuid",
+			PrivilegeDoas, "doas: not installed setuid\n", true),
+		ginkgo.Entry("a failure of journalctl",
+			PrivilegeSudo, "Failed to open files: No such file or directory\n", false),
+		ginkgo.Entry("no error output",
+			PrivilegeSudo, "", false),
+	)
+
+	ginkgo.It("sends the password of sudo-password to sudo on standard input", func() {
+		var stdin []byte
+		remote, server := newStandInRemote(func(_ string, input []byte) commandResult {
+			stdin = input
+			return commandResult{stdout: entryLine("c1", "b1", 0)}
+		})
+		remote.Privilege = Privilege{Strategy: PrivilegeSudoPassword, Password: []byte("secret")}
+		entry, err := remote.firstEntry(context.Background(), nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.Cursor()).To(Equal("c1"))
+		Expect(server.Commands()).To(Equal([]string{
+			"sudo -S -p '' journalctl --output=json --no-pager | head -n 1",
+		}))
+		Expect(string(stdin)).To(Equal("secret\n"))
+	})
+})
+
+// probeCommands are the commands that probePrivilege runs, in order.
+var probeCommands = []string{
+	`test "$(id -u)" = 0`,
+	"sudo -n true",
+	"doas -n true",
+	"id -nG | grep -qwE 'systemd-journal|adm'",
+}
+
+var _ = ginkgo.Describe("probePrivilege", func() {
+	ginkgo.DescribeTable("returns the first strategy that works",
+		func(succeeding, expectedStrategy string) {
+			remote, server := newStandInRemote(func(command string, _ []byte) commandResult {
+				if command == succeeding {
+					return commandResult{}
+				}
+				return commandResult{exitStatus: 1}
+			})
+			strategy, err := remote.probePrivilege(context.Background())
+			if expectedStrategy == "" {
+				Expect(IsPrivilegeError(err)).To(BeTrue())
+				Expect(server.Commands()).To(Equal(probeCommands))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strategy).To(Equal(expectedStrategy))
+			// The probes after the one that works are not run.
+			Expect(server.Commands()).To(Equal(
+				probeCommands[:slices.Index(probeCommands, succeeding)+1],
+			))
+		},
+		ginkgo.Entry("root", probeCommands[0], PrivilegeNone),
+		ginkgo.Entry("sudo", probeCommands[1], PrivilegeSudo),
+		ginkgo.Entry("doas", probeCommands[2], PrivilegeDoas),
+		ginkgo.Entry("a member of the journal groups", probeCommands[3], PrivilegeNone),
+		ginkgo.Entry("nothing", "", ""),
+	)
+})
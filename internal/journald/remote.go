@@ -3,128 +3,226 @@ package journald
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/dlipovetsky/machine-monitor/internal/tracing"
+)
+
+// Span attribute keys.
+const (
+	AttributeCommand          = "journald.command"
+	AttributeLocalJournalFile = "journald.local_journal_file"
+	AttributeSystemdVersion   = "journald.systemd_version"
+	AttributePrivilege        = "journald.privilege"
 )
 
-// StreamFromRemote streams the journal from the remote machine to the local machine.
-// If the local journal file does not exist, it will remove the remote journald cursor file
-// before streaming the journal, to ensure that entire journal is streamed.
+// StreamFromRemote streams the journal from the remote machine to the journal of the Machine in
+// the store. Entries are appended in journalctl JSON format, and are passed to the handlers in
+// order. The journal is synced every syncInterval, or after every write if syncInterval is zero.
+// If the journal has no entries, the entire remote journal is streamed, unless the backfill
+// limits it. If the backfill skips entries, an entry that records this is appended first. It is
+// not passed to the handlers. Otherwise, the stream resumes after the last stored entry, so that
+// every entry is stored once, even if the process is killed while it writes.
 // The function will return if the remote command fails, if the SSH session fails,
 // or if the context is cancelled.
 func StreamFromRemote(
 	ctx context.Context,
-	client *ssh.Client,
-	cursorFilePath, localJournalFilePath string,
+	remote *Remote,
+	store Store,
+	namespace, name string,
+	backfill Backfill,
+	syncInterval time.Duration,
+	handlers ...EntryHandler,
 ) error {
 	log := logf.FromContext(ctx)
 
-	// Check if the local journal file exists. If the local journal file does not exist, we should
-	// ensure the remote journald cursor file does not exist. If the remote journald cursor file exists,
-	// then the local journal file will only receive entries from after the cursor.
-	_, err := os.Stat(localJournalFilePath)
+	_, span := tracing.Start(ctx, "journald.Store.Open")
+	if fileStore, ok := store.(*FileStore); ok {
+		span.SetAttributes(attribute.String(
+			AttributeLocalJournalFile,
+			fileStore.LocalJournalFilePath(namespace, name),
+		))
+	}
+	appender, err := store.Open(namespace, name)
+	tracing.End(span, err)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.V(1).Info(
-				"local journal file does not exist, removing remote journald cursor file",
-				"cursorFilePath",
-				cursorFilePath,
-			)
-			resetCursorErr := resetCursorFile(ctx, client, cursorFilePath)
-			if resetCursorErr != nil {
-				return fmt.Errorf("failed to reset journald cursor file: %w", resetCursorErr)
+		return err
+	}
+	defer func() {
+		if closeErr := appender.Close(); closeErr != nil {
+			log.Error(closeErr, "failed to close journal")
+		}
+	}()
+
+	startArgs := []string{"--no-tail"}
+	// A journal that was rotated has no entries, but keeps its cursor, so that the stream
+	// resumes.
+	if appender.Cursor() == "" {
+		if !backfill.IsZero() {
+			args, truncated, backfillErr := remote.backfillStart(ctx, backfill)
+			if backfillErr != nil {
+				return fmt.Errorf("failed to apply backfill limits: %w", backfillErr)
+			}
+			if truncated != nil {
+				log.Info(
+					"initial backfill is limited, skipping earlier journal entries",
+					"limits",
+					backfill.String(),
+				)
+				if writeErr := appendEntry(appender, truncated); writeErr != nil {
+					return fmt.Errorf("failed to record truncated backfill: %w", writeErr)
+				}
+				startArgs = args
 			}
-		} else {
-			return fmt.Errorf("failed to check if local journal file exists: %w", err)
 		}
+	} else {
+		startArgs = resumeArgs(appender.Cursor())
 	}
 
-	streamErr := stream(ctx, client, cursorFilePath, localJournalFilePath)
+	out := io.Writer(appender)
+	if syncInterval > 0 {
+		syncCtx, stopSync := context.WithCancel(ctx)
+		defer stopSync()
+		go syncPeriodically(syncCtx, appender, syncInterval)
+	} else {
+		out = syncingWriter{appender}
+	}
+
+	streamErr := remote.stream(
+		ctx,
+		remote.Privilege.Wrap(streamJournalCommand(startArgs)),
+		out,
+		handlers,
+	)
 	if streamErr != nil {
 		return fmt.Errorf("failed to stream journal from remote: %w", streamErr)
 	}
 	return nil
 }
 
-func streamJournalAsRootCommand(cursorFilePath string) string {
-	return fmt.Sprintf("sudo journalctl --follow --no-tail --cursor-file=%s", cursorFilePath)
+// syncPeriodically syncs the journal every interval, until the context is done.
+func syncPeriodically(ctx context.Context, appender Appender, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := appender.Sync(); err != nil {
+				logf.FromContext(ctx).Error(err, "failed to sync journal")
+			}
+		}
+	}
 }
 
-func removeCursorFileCommand(cursorFilePath string) string {
-	// We use --force so that the command succeeds even if the file does not exist.
-	return fmt.Sprintf("rm --force %s", cursorFilePath)
+// syncingWriter syncs the journal after every write.
+type syncingWriter struct {
+	Appender
 }
 
-func resetCursorFile(ctx context.Context, client *ssh.Client, cursorFilePath string) error {
-	log := logf.FromContext(ctx)
+func (w syncingWriter) Write(p []byte) (int, error) {
+	n, err := w.Appender.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Sync()
+}
 
-	session, createSessionErr := client.NewSession()
-	if createSessionErr != nil {
-		return fmt.Errorf("failed to create new SSH session: %w", createSessionErr)
+// StreamLive streams the journal from the remote machine, starting with the most recent lines,
+// or, if afterCursor is not empty, with the entry after the cursor, and passes each entry to the
+// handlers. Unlike StreamFromRemote, it does not store entries, and
+// does not use a remote journald cursor file.
+// The function will return if the remote command fails, if the SSH session fails,
+// or if the context is cancelled.
+func StreamLive(
+	ctx context.Context,
+	remote *Remote,
+	lines int,
+	afterCursor string,
+	handlers ...EntryHandler,
+) error {
+	streamErr := remote.stream(
+		ctx,
+		remote.Privilege.Wrap(streamLiveJournalCommand(lines, afterCursor)),
+		io.Discard,
+		handlers,
+	)
+	if streamErr != nil {
+		return fmt.Errorf("failed to stream journal from remote: %w", streamErr)
 	}
+	return nil
+}
 
-	sshErrWriter := bytes.Buffer{}
-	session.Stdout = io.Discard
-	session.Stderr = &sshErrWriter
+func streamJournalCommand(startArgs []string) string {
+	args := append([]string{"--follow"}, startArgs...)
+	return commandLine("journalctl", append(args, "--output=json")...)
+}
 
-	command := removeCursorFileCommand(cursorFilePath)
-	log.V(1).Info("running command on remote host", "command", command)
-	resetCursorErr := session.Run(command)
-	if resetCursorErr != nil {
-		return fmt.Errorf(
-			"failed to run command %q on remote host: %w: stderr=%q",
-			command,
-			resetCursorErr,
-			sshErrWriter.String(),
-		)
+func streamLiveJournalCommand(lines int, afterCursor string) string {
+	if afterCursor != "" {
+		return commandLine("journalctl", "--follow", "--after-cursor="+afterCursor, "--output=json")
 	}
-	closeSessionErr := session.Close()
-	if closeSessionErr != nil && closeSessionErr != io.EOF {
-		// EOF is expected when the session is closed. See https://github.com/golang/go/issues/38115 for more details.
-		log.Error(closeSessionErr, "failed to close session")
+	return commandLine("journalctl", "--follow", fmt.Sprintf("--lines=%d", lines), "--output=json")
+}
+
+// resumeArgs returns the arguments that make journalctl resume after the entry with the cursor,
+// the last entry in the local journal file.
+func resumeArgs(cursor string) []string {
+	rest, truncated := strings.CutPrefix(cursor, backfillTruncatedCursor)
+	switch {
+	case !truncated:
+		return []string{"--after-cursor=" + cursor}
+	case strings.HasPrefix(rest, backfillStartPrefix):
+		// No entry was streamed after the backfill was truncated.
+		return []string{"--cursor=" + strings.TrimPrefix(rest, backfillStartPrefix)}
+	default:
+		// No entry was within the backfill limits.
+		return []string{"--lines=0"}
 	}
-	return nil
 }
 
-func stream(
+// stream runs the journalctl command on the remote machine, and writes its output to outWriter.
+func (r *Remote) stream(
 	ctx context.Context,
-	client *ssh.Client,
-	cursorFilePath, localJournalFilePath string,
-) error {
+	command string,
+	outWriter io.Writer,
+	handlers []EntryHandler,
+) (err error) {
+	ctx, span := tracing.Start(ctx, "journald.stream", attribute.String(AttributeCommand, command))
+	defer func() {
+		tracing.End(span, err)
+	}()
 	log := logf.FromContext(ctx)
 
-	session, createSessionErr := client.NewSession()
+	session, createSessionErr := r.Client.NewSession()
 	if createSessionErr != nil {
 		return fmt.Errorf("failed to create new SSH session: %w", createSessionErr)
 	}
 
-	// We only append to the local journal file.
-	outWriter, openFileErr := os.OpenFile(
-		localJournalFilePath,
-		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
-		0o644,
-	)
-	if openFileErr != nil {
-		return fmt.Errorf("failed to open local journal file: %w", openFileErr)
-	}
-
 	sshErrWriter := bytes.Buffer{}
-	session.Stdout = outWriter
+	session.Stdin = r.Privilege.Stdin()
+	session.Stdout = &entryWriter{
+		ctx:      ctx,
+		span:     span,
+		out:      outWriter,
+		handlers: handlers,
+	}
 	session.Stderr = &sshErrWriter
 
-	command := streamJournalAsRootCommand(cursorFilePath)
 	log.V(1).Info("running command on remote host", "command", command)
 	sessionErr := session.Start(command)
 	if sessionErr != nil {
-		closeOutWriterErr := outWriter.Close()
-		if closeOutWriterErr != nil {
-			log.Error(closeOutWriterErr, "failed to close local journal file")
-		}
 		return fmt.Errorf(
 			"failed to run command %q on remote host: %w: stderr=%q",
 			command,
@@ -132,6 +230,7 @@ func stream(
 			sshErrWriter.String(),
 		)
 	}
+	span.AddEvent("started")
 
 	// Wait for the session to finish.
 	// If the context is cancelled, send a signal to the session to interrupt it.
@@ -167,14 +266,77 @@ func stream(
 		// EOF is expected when the session is closed. See https://github.com/golang/go/issues/38115 for more details.
 		log.Error(closeSessionErr, "failed to close SSH session")
 	}
-	closeOutWriterErr := outWriter.Close()
-	if closeOutWriterErr != nil {
-		log.Error(closeOutWriterErr, "failed to close local journal file")
-	}
 
-	if ctx.Err() == nil && waitErr != nil {
-		// If the context was not cancelled, then we have an unexpected error.
+	if ctx.Err() != nil {
+		return nil
+	}
+	exitErr := &ssh.ExitError{}
+	exitMissingErr := &ssh.ExitMissingError{}
+	switch {
+	case waitErr == nil,
+		errors.Is(waitErr, io.EOF),
+		errors.As(waitErr, &exitMissingErr),
+		errors.As(waitErr, &exitErr) && exitErr.Signal() != "":
+		// The connection was closed, or journalctl was stopped, e.g. because the machine
+		// rebooted.
+		return fmt.Errorf("%w: %v", ErrStreamEnded, waitErr)
+	case errors.As(waitErr, &exitErr):
+		return r.Privilege.checkPrivilegeError(
+			&RemoteCommandError{Command: command, Stderr: sshErrWriter.String(), Err: waitErr},
+			sshErrWriter.String(),
+		)
+	default:
 		return fmt.Errorf("unexpected error running journalctl on remote host: %w", waitErr)
 	}
-	return nil
+}
+
+// entryWriter writes the output of journalctl to the local journal file one complete line at a
+// time, and passes each line, parsed as an entry, to the handlers. The first line is recorded
+// as an event of the span, so that the startup time of journalctl can be seen.
+type entryWriter struct {
+	ctx      context.Context
+	span     trace.Span
+	out      io.Writer
+	handlers []EntryHandler
+
+	// received is true once the first line is written.
+	received bool
+
+	// buf holds output that does not yet end with a newline.
+	buf []byte
+}
+
+func (w *entryWriter) Write(p []byte) (int, error) {
+	log := logf.FromContext(w.ctx)
+
+	w.buf = append(w.buf, p...)
+	rest := w.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		line := rest[:i+1]
+		rest = rest[i+1:]
+		if !w.received {
+			w.received = true
+			w.span.AddEvent("first entry received")
+		}
+		if _, err := w.out.Write(line); err != nil {
+			return 0, fmt.Errorf("failed to write to local journal file: %w", err)
+		}
+		if len(w.handlers) == 0 {
+			continue
+		}
+		entry, err := ParseEntry(line)
+		if err != nil {
+			log.Error(err, "failed to parse journal entry, not passing it to handlers")
+			continue
+		}
+		for _, handler := range w.handlers {
+			handler(w.ctx, entry)
+		}
+	}
+	w.buf = append(w.buf[:0], rest...)
+	return len(p), nil
 }
@@ -0,0 +1,386 @@
+package journald
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store stores the journals of Machines. The journal of a Machine is appended to by one stream
+// at a time, and read by any number of Readers.
+type Store interface {
+	// Open opens the journal of the Machine for appending, and creates it if it does not exist.
+	// The Appender reports the state of the journal, so that the stream resumes after the last
+	// stored entry.
+	Open(namespace, name string) (Appender, error)
+	// Reader returns a Reader of the entries of the journal of the Machine after the entry with
+	// the cursor. If the cursor is empty, or is not found, it reads every entry.
+	Reader(namespace, name, afterCursor string) Reader
+	// List returns the MachineInfo of every Machine in the Store.
+	List() ([]MachineInfo, error)
+	// Status returns the status of the journal of the Machine. If the Machine has no journal, it
+	// returns an error that wraps os.ErrNotExist.
+	Status(namespace, name string) (JournalStatus, error)
+	// MachineInfo returns the MachineInfo of the Machine. If the Machine has none, it returns an
+	// error that wraps os.ErrNotExist.
+	MachineInfo(namespace, name string) (MachineInfo, error)
+	// PutMachineInfo records which Machine a journal belongs to.
+	PutMachineInfo(info MachineInfo) error
+	// Rotate moves the entries of the journal of the Machine out of the way, e.g. to limit its
+	// size, and keeps its cursor, so that the stream resumes after the last rotated entry. The
+	// journal must not be open for appending.
+	Rotate(namespace, name string) error
+	// Delete removes the journal of the Machine, its rotated entries, and its MachineInfo. The
+	// journal must not be open for appending.
+	Delete(namespace, name string) error
+}
+
+// JournalStatus is the status of the journal of a Machine.
+type JournalStatus struct {
+	// Size is the size of the journal, in bytes, not counting rotated entries.
+	Size int64
+	// LastWritten is when entries were last appended to the journal.
+	LastWritten time.Time
+}
+
+// Appender appends entries to the journal of a Machine.
+type Appender interface {
+	// Write appends p, which is one or more complete lines of journalctl JSON output.
+	io.Writer
+	// Cursor returns the cursor of the last stored entry, or an empty string if the journal has
+	// none.
+	Cursor() string
+	// Sync makes the appended entries durable, and commits the cursor of the last of them.
+	Sync() error
+	// Close syncs and closes the journal.
+	Close() error
+}
+
+// Reader reads the entries of the journal of a Machine, including entries appended after the
+// Reader is created.
+type Reader interface {
+	// Next returns the next entry. If there is no next entry, and wait is true, it waits until
+	// there is one, or the context is done. If wait is false, it returns io.EOF.
+	Next(ctx context.Context, wait bool) (Entry, error)
+	// Notify is an EntryHandler that wakes up the Reader when an entry is appended.
+	Notify(ctx context.Context, entry Entry)
+	// Close releases the resources of the Reader.
+	Close() error
+}
+
+// FileStore stores the journal of each Machine in a local journal file in a directory, in
+// journalctl JSON format, one entry per line.
+type FileStore struct {
+	Directory string
+}
+
+var _ Store = &FileStore{}
+
+// LocalJournalFilePath returns the path of the local journal file of the Machine.
+func (s *FileStore) LocalJournalFilePath(namespace, name string) string {
+	return LocalJournalFilePath(s.Directory, namespace, name)
+}
+
+// Open implements Store. A local journal file in the text format of journalctl, written before
+// machine-monitor stored entries in JSON format, is moved aside first, see
+// LegacyLocalJournalFilePath.
+func (s *FileStore) Open(namespace, name string) (Appender, error) {
+	localJournalFilePath := s.LocalJournalFilePath(namespace, name)
+	if err := moveLegacyLocalJournalFile(localJournalFilePath); err != nil {
+		return nil, err
+	}
+	return OpenWriter(localJournalFilePath)
+}
+
+// LegacyLocalJournalFilePath returns the path that a local journal file in the text format of
+// journalctl is moved to, so that entries in JSON format are not appended to it.
+func LegacyLocalJournalFilePath(localJournalFilePath string) string {
+	return localJournalFilePath + ".legacy"
+}
+
+// moveLegacyLocalJournalFile moves the local journal file to its legacy path if its first line is
+// not an entry in JSON format. Every line written in JSON format is an entry, so only a file in
+// the text format has such a first line.
+func moveLegacyLocalJournalFile(localJournalFilePath string) error {
+	file, err := os.Open(localJournalFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open local journal file: %w", err)
+	}
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	_ = file.Close()
+	if err == io.EOF {
+		// The file is empty, or its first line is incomplete, and is removed by OpenWriter.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read local journal file: %w", err)
+	}
+	if _, err := ParseEntry(line); err == nil {
+		return nil
+	}
+
+	legacyFilePath := LegacyLocalJournalFilePath(localJournalFilePath)
+	if _, err := os.Stat(legacyFilePath); err == nil {
+		return fmt.Errorf(
+			"failed to move legacy local journal file aside: %s already exists",
+			legacyFilePath,
+		)
+	}
+	if err := os.Rename(localJournalFilePath, legacyFilePath); err != nil {
+		return fmt.Errorf("failed to move legacy local journal file aside: %w", err)
+	}
+	// The checkpoint, if any, belongs to the legacy file.
+	if err := os.Remove(
+		checkpointFilePath(localJournalFilePath),
+	); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove local journal checkpoint file: %w", err)
+	}
+	return syncDirectory(filepath.Dir(localJournalFilePath))
+}
+
+// Reader implements Store. It reads the rotated local journal files of the Machine, oldest
+// first, and then follows its local journal file.
+func (s *FileStore) Reader(namespace, name, afterCursor string) Reader {
+	return &fileReader{
+		store:       s,
+		namespace:   namespace,
+		name:        name,
+		afterCursor: afterCursor,
+		current:     NewFollower(s.LocalJournalFilePath(namespace, name), ""),
+	}
+}
+
+// List implements Store.
+func (s *FileStore) List() ([]MachineInfo, error) {
+	return ListMachineInfos(s.Directory)
+}
+
+// Status implements Store.
+func (s *FileStore) Status(namespace, name string) (JournalStatus, error) {
+	fileInfo, err := os.Stat(s.LocalJournalFilePath(namespace, name))
+	if err != nil {
+		return JournalStatus{}, fmt.Errorf("failed to stat local journal file: %w", err)
+	}
+	return JournalStatus{Size: fileInfo.Size(), LastWritten: fileInfo.ModTime()}, nil
+}
+
+// MachineInfo implements Store.
+func (s *FileStore) MachineInfo(namespace, name string) (MachineInfo, error) {
+	return ReadMachineInfo(s.Directory, namespace, name)
+}
+
+// PutMachineInfo implements Store.
+func (s *FileStore) PutMachineInfo(info MachineInfo) error {
+	return WriteMachineInfo(s.Directory, info)
+}
+
+// rotatedFileTimeFormat is the format of the time in the names of rotated local journal files.
+// It sorts in time order.
+const rotatedFileTimeFormat = "20060102T150405.000000000Z"
+
+// rotatedFileTimePattern matches rotatedFileTimeFormat in a glob.
+const rotatedFileTimePattern = "[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]T" +
+	"[0-9][0-9][0-9][0-9][0-9][0-9].[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]Z"
+
+// RotatedLocalJournalFilePaths returns the paths of the rotated local journal files of the
+// Machine, oldest first.
+func (s *FileStore) RotatedLocalJournalFilePaths(namespace, name string) ([]string, error) {
+	// The pattern matches only the time, so that the files of a Machine whose name has a dot
+	// are not matched.
+	filePaths, err := filepath.Glob(
+		strings.TrimSuffix(s.LocalJournalFilePath(namespace, name), ".log") + "." +
+			rotatedFileTimePattern + ".log",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rotated local journal files: %w", err)
+	}
+	// Glob returns the paths sorted, and the time in their names sorts in time order.
+	return filePaths, nil
+}
+
+// Rotate implements Store. The local journal file is renamed after the current time, and a new,
+// empty one takes its place, with a checkpoint that holds the cursor of the last rotated entry.
+// If the current time is not after the time of the last rotated file, e.g. because the clock was
+// set back, the time of the last rotated file is advanced instead, so that the names are unique,
+// and sort in rotation order.
+func (s *FileStore) Rotate(namespace, name string) error {
+	localJournalFilePath := s.LocalJournalFilePath(namespace, name)
+	writer, err := OpenWriter(localJournalFilePath)
+	if err != nil {
+		return err
+	}
+	cursor := writer.Cursor()
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if cursor == "" {
+		// There is nothing to rotate.
+		return nil
+	}
+
+	rotated, err := s.RotatedLocalJournalFilePaths(namespace, name)
+	if err != nil {
+		return err
+	}
+	rotatedAt := time.Now().UTC()
+	if len(rotated) > 0 {
+		last := rotated[len(rotated)-1]
+		value := last[len(last)-len(rotatedFileTimeFormat)-len(".log") : len(last)-len(".log")]
+		lastRotatedAt, err := time.Parse(rotatedFileTimeFormat, value)
+		if err != nil {
+			return fmt.Errorf("failed to parse the time of rotated local journal file: %w", err)
+		}
+		if !rotatedAt.After(lastRotatedAt) {
+			rotatedAt = lastRotatedAt.Add(time.Nanosecond)
+		}
+	}
+	rotatedFilePath := strings.TrimSuffix(localJournalFilePath, ".log") + "." +
+		rotatedAt.Format(rotatedFileTimeFormat) + ".log"
+	// The checkpoint is written first. If the process is killed before the file is renamed, the
+	// cursor of the last entry of the file supersedes the cursor of the checkpoint.
+	if err := writeCheckpoint(checkpointFilePath(localJournalFilePath), checkpoint{
+		Cursor: cursor,
+	}); err != nil {
+		return err
+	}
+	if err := os.Rename(localJournalFilePath, rotatedFilePath); err != nil {
+		return fmt.Errorf("failed to rotate local journal file: %w", err)
+	}
+	// The new file is created now, rather than when the journal is next opened, so that the
+	// journal still exists, and so that Readers move on to it.
+	file, err := os.OpenFile(localJournalFilePath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create local journal file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to create local journal file: %w", err)
+	}
+	return syncDirectory(filepath.Dir(localJournalFilePath))
+}
+
+// Delete implements Store. It also removes the legacy local journal file of the Machine, if any.
+func (s *FileStore) Delete(namespace, name string) error {
+	localJournalFilePath := s.LocalJournalFilePath(namespace, name)
+	rotated, err := s.RotatedLocalJournalFilePaths(namespace, name)
+	if err != nil {
+		return err
+	}
+	filePaths := append(
+		rotated,
+		localJournalFilePath,
+		checkpointFilePath(localJournalFilePath),
+		LegacyLocalJournalFilePath(localJournalFilePath),
+		MachineInfoFilePath(s.Directory, namespace, name),
+	)
+	for _, filePath := range filePaths {
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete journal of machine: %w", err)
+		}
+	}
+	return nil
+}
+
+// fileReader reads the rotated local journal files of a Machine, oldest first, and then follows
+// its local journal file. It implements Reader.
+type fileReader struct {
+	store           *FileStore
+	namespace, name string
+	afterCursor     string
+
+	// rotated read the rotated files that are left to read, oldest first. They are listed by the
+	// first call to Next.
+	rotated []*Follower
+	started bool
+	current *Follower
+}
+
+// Next implements Reader.
+func (r *fileReader) Next(ctx context.Context, wait bool) (Entry, error) {
+	if !r.started {
+		if err := r.start(); err != nil {
+			return nil, err
+		}
+		r.started = true
+	}
+	for len(r.rotated) > 0 {
+		entry, err := r.rotated[0].Next(ctx, false)
+		if err != io.EOF {
+			return entry, err
+		}
+		_ = r.rotated[0].Close()
+		r.rotated = r.rotated[1:]
+	}
+	return r.current.Next(ctx, wait)
+}
+
+// start finds the file with the entry with the cursor, starting with the latest file, and
+// positions the reader after the entry. If no file has the entry, every file is read.
+func (r *fileReader) start() error {
+	filePaths, err := r.store.RotatedLocalJournalFilePaths(r.namespace, r.name)
+	if err != nil {
+		return err
+	}
+	filePaths = append(filePaths, r.current.localJournalFilePath)
+	first, offset := 0, int64(0)
+	for i := len(filePaths) - 1; i >= 0 && r.afterCursor != ""; i-- {
+		found := false
+		offset, found, err = fileOffsetAfterCursor(filePaths[i], r.afterCursor)
+		if err != nil {
+			return err
+		}
+		if found {
+			first = i
+			break
+		}
+	}
+	for i, filePath := range filePaths[first:] {
+		follower := r.current
+		if first+i < len(filePaths)-1 {
+			follower = NewFollower(filePath, "")
+			r.rotated = append(r.rotated, follower)
+		}
+		if i == 0 {
+			follower.offset = offset
+		}
+	}
+	return nil
+}
+
+// fileOffsetAfterCursor returns the offset of the entry after the entry with the cursor in the
+// local journal file, and true. It returns false if the file does not exist, or has no entry with
+// the cursor.
+func fileOffsetAfterCursor(filePath, cursor string) (int64, bool, error) {
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open local journal file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return offsetAfterCursor(file, cursor)
+}
+
+// Notify implements Reader.
+func (r *fileReader) Notify(ctx context.Context, entry Entry) {
+	r.current.Notify(ctx, entry)
+}
+
+// Close implements Reader.
+func (r *fileReader) Close() error {
+	for _, follower := range r.rotated {
+		_ = follower.Close()
+	}
+	return r.current.Close()
+}
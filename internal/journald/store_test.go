@@ -0,0 +1,201 @@
+package journald
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// readCursors returns the cursors of the entries that the reader reads before io.EOF.
+func readCursors(reader Reader) []string {
+	var cursors []string
+	for {
+		entry, err := reader.Next(context.Background(), false)
+		if errors.Is(err, io.EOF) {
+			return cursors
+		}
+		Expect(err).NotTo(HaveOccurred())
+		cursors = append(cursors, entry.Cursor())
+	}
+}
+
+var _ = ginkgo.Describe("FileStore", func() {
+	var store *FileStore
+
+	ginkgo.BeforeEach(func() {
+		store = &FileStore{Directory: ginkgo.GinkgoT().TempDir()}
+	})
+
+	// allCursors returns the cursors of every entry of the journal of the Machine.
+	allCursors := func(name string) []string {
+		reader := store.Reader("ns", name, "")
+		defer func() {
+			Expect(reader.Close()).To(Succeed())
+		}()
+		return readCursors(reader)
+	}
+
+	ginkgo.It("reports the status of a journal", func() {
+		_, err := store.Status("ns", "a")
+		Expect(err).To(MatchError(os.ErrNotExist))
+
+		Expect(appendLines(store, "a", entryLine("a-1", "boot", 1))).To(Succeed())
+		status, err := store.Status("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Size).To(BeEquivalentTo(len(entryLine("a-1", "boot", 1))))
+		Expect(status.LastWritten).To(BeTemporally("~", time.Now(), time.Minute))
+	})
+
+	ginkgo.It("moves a local journal file in the text format aside", func() {
+		localJournalFilePath := store.LocalJournalFilePath("ns", "a")
+		text := "Jan 02 15:04:05 m systemd[1]: Started kubelet.service.\n"
+		Expect(os.WriteFile(localJournalFilePath, []byte(text), 0o644)).To(Succeed())
+
+		Expect(appendLines(store, "a", entryLine("a-1", "boot", 1))).To(Succeed())
+		data, err := os.ReadFile(LegacyLocalJournalFilePath(localJournalFilePath))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(text))
+		Expect(allCursors("a")).To(Equal([]string{"a-1"}))
+
+		// A local journal file in JSON format stays in place.
+		Expect(appendLines(store, "a", entryLine("a-2", "boot", 2))).To(Succeed())
+		Expect(allCursors("a")).To(Equal([]string{"a-1", "a-2"}))
+	})
+
+	ginkgo.It("rotates the journal, and keeps its cursor", func() {
+		Expect(appendLines(store, "a",
+			entryLine("a-1", "boot", 1),
+			entryLine("a-2", "boot", 2),
+		)).To(Succeed())
+		Expect(store.Rotate("ns", "a")).To(Succeed())
+
+		rotated, err := store.RotatedLocalJournalFilePaths("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rotated).To(HaveLen(1))
+		status, err := store.Status("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Size).To(BeZero())
+
+		appender, err := store.Open("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(appender.Cursor()).To(Equal("a-2"))
+		Expect(appender.Close()).To(Succeed())
+
+		Expect(appendLines(store, "a", entryLine("a-3", "boot", 3))).To(Succeed())
+		Expect(allCursors("a")).To(Equal([]string{"a-1", "a-2", "a-3"}))
+	})
+
+	ginkgo.It("does not rotate an empty journal", func() {
+		Expect(store.Rotate("ns", "a")).To(Succeed())
+		rotated, err := store.RotatedLocalJournalFilePaths("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rotated).To(BeEmpty())
+	})
+
+	ginkgo.It("gives the files rotated within a second unique names, in rotation order", func() {
+		for _, cursor := range []string{"a-1", "a-2", "a-3"} {
+			Expect(appendLines(store, "a", entryLine(cursor, "boot", 1))).To(Succeed())
+			Expect(store.Rotate("ns", "a")).To(Succeed())
+		}
+		rotated, err := store.RotatedLocalJournalFilePaths("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rotated).To(HaveLen(3))
+		Expect(allCursors("a")).To(Equal([]string{"a-1", "a-2", "a-3"}))
+	})
+
+	ginkgo.It("names a rotated file after the last one, if the clock was set back", func() {
+		prefix := strings.TrimSuffix(store.LocalJournalFilePath("ns", "a"), ".log")
+		future := prefix + ".29991231T235959.999999999Z.log"
+		Expect(os.WriteFile(future, []byte(entryLine("a-1", "boot", 1)), 0o644)).To(Succeed())
+		Expect(appendLines(store, "a", entryLine("a-2", "boot", 2))).To(Succeed())
+		Expect(store.Rotate("ns", "a")).To(Succeed())
+
+		rotated, err := store.RotatedLocalJournalFilePaths("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rotated).To(Equal([]string{future, prefix + ".30000101T000000.000000000Z.log"}))
+		Expect(allCursors("a")).To(Equal([]string{"a-1", "a-2"}))
+	})
+
+	ginkgo.It("does not list the files of a Machine whose name has the same prefix", func() {
+		Expect(appendLines(store, "a", entryLine("a-1", "boot", 1))).To(Succeed())
+		Expect(store.Rotate("ns", "a")).To(Succeed())
+		Expect(appendLines(store, "a.b", entryLine("ab-1", "boot", 1))).To(Succeed())
+		Expect(store.Rotate("ns", "a.b")).To(Succeed())
+
+		rotated, err := store.RotatedLocalJournalFilePaths("ns", "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rotated).To(HaveLen(1))
+		Expect(allCursors("a")).To(Equal([]string{"a-1"}))
+	})
+
+	ginkgo.DescribeTable("reads the entries after the cursor",
+		func(afterCursor string, cursors []string) {
+			Expect(appendLines(store, "a",
+				entryLine("a-1", "boot", 1),
+				entryLine("a-2", "boot", 2),
+			)).To(Succeed())
+			Expect(store.Rotate("ns", "a")).To(Succeed())
+			Expect(appendLines(store, "a",
+				entryLine("a-3", "boot", 3),
+				entryLine("a-4", "boot", 4),
+			)).To(Succeed())
+
+			reader := store.Reader("ns", "a", afterCursor)
+			defer func() {
+				Expect(reader.Close()).To(Succeed())
+			}()
+			Expect(readCursors(reader)).To(Equal(cursors))
+		},
+		ginkgo.Entry("in a rotated file", "a-1", []string{"a-2", "a-3", "a-4"}),
+		ginkgo.Entry("at the end of a rotated file", "a-2", []string{"a-3", "a-4"}),
+		ginkgo.Entry("in the local journal file", "a-3", []string{"a-4"}),
+		ginkgo.Entry("that is not found", "missing", []string{"a-1", "a-2", "a-3", "a-4"}),
+	)
+
+	ginkgo.It("follows the journal across a rotation", func() {
+		Expect(appendLines(store, "a", entryLine("a-1", "boot", 1))).To(Succeed())
+		reader := store.Reader("ns", "a", "")
+		defer func() {
+			Expect(reader.Close()).To(Succeed())
+		}()
+		Expect(readCursors(reader)).To(Equal([]string{"a-1"}))
+
+		Expect(appendLines(store, "a", entryLine("a-2", "boot", 2))).To(Succeed())
+		Expect(store.Rotate("ns", "a")).To(Succeed())
+		Expect(appendLines(store, "a", entryLine("a-3", "boot", 3))).To(Succeed())
+		Expect(readCursors(reader)).To(Equal([]string{"a-2", "a-3"}))
+	})
+
+	ginkgo.It("deletes the journal, its rotated files, and its MachineInfo", func() {
+		Expect(os.WriteFile(
+			LegacyLocalJournalFilePath(store.LocalJournalFilePath("ns", "a")),
+			[]byte("text\n"),
+			0o644,
+		)).To(Succeed())
+		Expect(store.PutMachineInfo(MachineInfo{Namespace: "ns", Name: "a"})).To(Succeed())
+		Expect(appendLines(store, "a", entryLine("a-1", "boot", 1))).To(Succeed())
+		Expect(store.Rotate("ns", "a")).To(Succeed())
+		Expect(appendLines(store, "a", entryLine("a-2", "boot", 2))).To(Succeed())
+		Expect(store.PutMachineInfo(MachineInfo{Namespace: "ns", Name: "b"})).To(Succeed())
+		Expect(appendLines(store, "b", entryLine("b-1", "boot", 1))).To(Succeed())
+
+		Expect(store.Delete("ns", "a")).To(Succeed())
+		filePaths, err := filepath.Glob(filepath.Join(store.Directory, "ns-a.*"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filePaths).To(BeEmpty())
+		_, err = store.MachineInfo("ns", "a")
+		Expect(err).To(MatchError(os.ErrNotExist))
+		Expect(allCursors("a")).To(BeEmpty())
+		Expect(allCursors("b")).To(Equal([]string{"b-1"}))
+
+		// Deleting a Machine without a journal does nothing.
+		Expect(store.Delete("ns", "a")).To(Succeed())
+	})
+})
@@ -0,0 +1,128 @@
+package journald
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// Ginkgo is not dot-imported in this package, because its Entry would shadow journald.Entry.
+
+func TestJournald(t *testing.T) {
+	RegisterFailHandler(ginkgo.Fail)
+
+	ginkgo.RunSpecs(t, "Journald Suite")
+}
+
+// commandResult is what a command run on the stand-in SSH server outputs.
+type commandResult struct {
+	stdout     string
+	stderr     string
+	exitStatus uint32
+}
+
+// commandHandler returns the result of a command run on the stand-in SSH server.
+type commandHandler func(command string, stdin []byte) commandResult
+
+// standInServer is an SSH server that hands the commands it is asked to run to a handler, so that
+// the commands that a Remote runs can be checked, and their results faked.
+type standInServer struct {
+	listener net.Listener
+	handler  commandHandler
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// newStandInRemote starts a stand-in SSH server, and returns a Remote connected to it, with the
+// privilege strategy none. The server is stopped when the spec ends.
+func newStandInRemote(handler commandHandler) (*Remote, *standInServer) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	Expect(err).NotTo(HaveOccurred())
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	server := &standInServer{listener: listener, handler: handler}
+	ginkgo.DeferCleanup(listener.Close)
+	go server.serve(config)
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	Expect(err).NotTo(HaveOccurred())
+	ginkgo.DeferCleanup(client.Close)
+	return &Remote{Client: client, Privilege: Privilege{Strategy: PrivilegeNone}}, server
+}
+
+// Commands returns the commands that were run, in order.
+func (s *standInServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *standInServer) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ginkgo.GinkgoRecover()
+			_, channels, requests, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				if newChannel.ChannelType() != "session" {
+					_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+				go s.session(channel, requests)
+			}
+		}()
+	}
+}
+
+// session runs the command of an exec request.
+func (s *standInServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer func() { _ = channel.Close() }()
+	for request := range requests {
+		if request.Type != "exec" || len(request.Payload) < 4 {
+			_ = request.Reply(false, nil)
+			continue
+		}
+		command := string(request.Payload[4:])
+		_ = request.Reply(true, nil)
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+
+		stdin, _ := io.ReadAll(channel)
+		result := s.handler(command, stdin)
+		_, _ = io.WriteString(channel, result.stdout)
+		_, _ = io.WriteString(channel.Stderr(), result.stderr)
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, result.exitStatus)
+		_, _ = channel.SendRequest("exit-status", false, status)
+		return
+	}
+}
@@ -0,0 +1,273 @@
+package journald
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultSyncInterval is how often the local journal file is synced to disk by default.
+const DefaultSyncInterval = time.Second
+
+// checkpoint is the position in the local journal file up to which entries are synced to disk,
+// and the cursor of the last of these entries.
+type checkpoint struct {
+	Offset int64  `json:"offset"`
+	Cursor string `json:"cursor"`
+}
+
+// checkpointFilePath returns the path of the checkpoint file of the local journal file.
+func checkpointFilePath(localJournalFilePath string) string {
+	return localJournalFilePath + ".checkpoint"
+}
+
+// Writer appends entries to the local journal file. Only complete lines are written, and the
+// file is synced to disk by Sync. After each sync, the position of the last synced entry is
+// committed to a checkpoint file, so that OpenWriter does not read the entire file.
+//
+// The stream resumes after the last entry in the local journal file, so an entry that is lost
+// in a crash is streamed again, and an entry that is stored is not.
+type Writer struct {
+	mu   sync.Mutex
+	file *os.File
+	path string
+
+	// offset is the size of the file.
+	offset int64
+	// last is the last line written since cursor was updated.
+	last []byte
+	// cursor is the cursor of the last entry in the file.
+	cursor string
+	synced checkpoint
+}
+
+// OpenWriter opens the local journal file for appending, and creates it if it does not exist.
+// If the file ends with an incomplete line, e.g. because the process was killed while writing
+// it, the line is removed.
+func OpenWriter(localJournalFilePath string) (*Writer, error) {
+	file, err := os.OpenFile(localJournalFilePath, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local journal file: %w", err)
+	}
+	w := &Writer{file: file, path: localJournalFilePath}
+	if err := w.recover(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// recover finds the end of the last complete line, and the cursor of the last entry, starting
+// at the checkpoint, and removes anything after the last complete line.
+func (w *Writer) recover() error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat local journal file: %w", err)
+	}
+	size := info.Size()
+
+	start, err := readCheckpoint(checkpointFilePath(w.path))
+	if err != nil {
+		return err
+	}
+	if start.Offset > size || !w.lineEndsAt(start.Offset) {
+		// The checkpoint does not belong to this file, e.g. because the file was replaced.
+		start = checkpoint{}
+	}
+
+	if _, err := w.file.Seek(start.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek local journal file: %w", err)
+	}
+	end, cursor := start.Offset, start.Cursor
+	reader := bufio.NewReader(w.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read local journal file: %w", err)
+		}
+		end += int64(len(line))
+		if entry, err := ParseEntry(line); err == nil {
+			cursor = entry.Cursor()
+		}
+	}
+
+	if end < size {
+		if err := w.file.Truncate(end); err != nil {
+			return fmt.Errorf(
+				"failed to remove incomplete line from local journal file: %w",
+				err,
+			)
+		}
+	}
+	if _, err := w.file.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek local journal file: %w", err)
+	}
+	w.offset = end
+	w.cursor = cursor
+	w.synced = start
+	return nil
+}
+
+// lineEndsAt returns true if a line ends right before the offset, or if the offset is zero.
+func (w *Writer) lineEndsAt(offset int64) bool {
+	if offset == 0 {
+		return true
+	}
+	b := make([]byte, 1)
+	if _, err := w.file.ReadAt(b, offset-1); err != nil {
+		return false
+	}
+	return b[0] == '\n'
+}
+
+// readCheckpoint reads the checkpoint file. It returns an empty checkpoint if the file does not
+// exist.
+func readCheckpoint(filePath string) (checkpoint, error) {
+	c := checkpoint{}
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("failed to read local journal checkpoint file: %w", err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		// The file is replaced atomically, so it is not expected to be corrupt. If it is, the
+		// entire local journal file is read instead.
+		return checkpoint{}, nil
+	}
+	return c, nil
+}
+
+// writeCheckpoint writes the checkpoint file. The file is replaced atomically, and durably: the
+// new file is synced before it replaces the old one, so that a crash cannot leave an empty
+// checkpoint file behind, and the directory is synced after, so that the replacement is not lost.
+func writeCheckpoint(filePath string, c checkpoint) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to serialize local journal checkpoint: %w", err)
+	}
+	tmpFilePath := filePath + ".tmp"
+	file, err := os.OpenFile(tmpFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create local journal checkpoint file: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write local journal checkpoint file: %w", err)
+	}
+	if err := os.Rename(tmpFilePath, filePath); err != nil {
+		return fmt.Errorf("failed to replace local journal checkpoint file: %w", err)
+	}
+	if err := syncDirectory(filepath.Dir(filePath)); err != nil {
+		return fmt.Errorf("failed to sync local journal directory: %w", err)
+	}
+	return nil
+}
+
+// syncDirectory syncs the directory to disk, so that the files created, renamed or removed in it
+// are durable.
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Cursor returns the cursor of the last entry in the local journal file, or an empty string if
+// it has none. After the file is rotated, it is the cursor of the last rotated entry.
+func (w *Writer) Cursor() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cursorLocked()
+}
+
+func (w *Writer) cursorLocked() string {
+	if w.last != nil {
+		if entry, err := ParseEntry(w.last); err == nil {
+			w.cursor = entry.Cursor()
+		}
+		w.last = nil
+	}
+	return w.cursor
+}
+
+// Write appends p to the local journal file. p must be one or more complete lines of journalctl
+// JSON output.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := w.file.Write(p)
+	w.offset += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write to local journal file: %w", err)
+	}
+	// Only the last line is kept, and it is parsed when its cursor is needed.
+	lines := p[:len(p)-1]
+	if i := bytes.LastIndexByte(lines, '\n'); i >= 0 {
+		lines = lines[i+1:]
+	}
+	w.last = append(w.last[:0], lines...)
+	return n, nil
+}
+
+// appendEntry appends the entry to the journal as one line of journalctl JSON output.
+func appendEntry(appender Appender, entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize journal entry: %w", err)
+	}
+	_, err = appender.Write(append(line, '\n'))
+	return err
+}
+
+// Sync syncs the local journal file to disk, and then commits the checkpoint.
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.synced.Offset == w.offset {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync local journal file: %w", err)
+	}
+	synced := checkpoint{Offset: w.offset, Cursor: w.cursorLocked()}
+	if err := writeCheckpoint(checkpointFilePath(w.path), synced); err != nil {
+		return err
+	}
+	w.synced = synced
+	return nil
+}
+
+// Close syncs and closes the local journal file.
+func (w *Writer) Close() error {
+	syncErr := w.Sync()
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close local journal file: %w", err)
+	}
+	return syncErr
+}
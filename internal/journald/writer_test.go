@@ -0,0 +1,137 @@
+package journald
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Writer", func() {
+	var filePath string
+
+	ginkgo.BeforeEach(func() {
+		filePath = writeLocalJournal("m",
+			entryLine("c1", "b1", 1),
+			entryLine("c2", "b1", 2),
+		)
+	})
+
+	// openWriter opens the local journal file, and closes it when the spec ends.
+	openWriter := func() *Writer {
+		w, err := OpenWriter(filePath)
+		Expect(err).NotTo(HaveOccurred())
+		ginkgo.DeferCleanup(w.Close)
+		return w
+	}
+
+	writeCheckpointFile := func(c checkpoint) {
+		Expect(writeCheckpoint(checkpointFilePath(filePath), c)).To(Succeed())
+	}
+
+	fileContent := func() string {
+		data, err := os.ReadFile(filePath)
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	ginkgo.It("resumes after the last entry", func() {
+		w := openWriter()
+		Expect(w.Cursor()).To(Equal("c2"))
+
+		Expect(appendEntry(w, parseEntryOrFail(entryLine("c3", "b1", 3)))).To(Succeed())
+		Expect(w.Cursor()).To(Equal("c3"))
+		Expect(fileContent()).To(Equal(
+			entryLine("c1", "b1", 1) + entryLine("c2", "b1", 2) + entryLine("c3", "b1", 3),
+		))
+	})
+
+	ginkgo.It("removes a torn last line", func() {
+		torn := entryLine("c3", "b1", 3)
+		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0o644)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.WriteString(torn[:len(torn)/2])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		w := openWriter()
+		Expect(w.Cursor()).To(Equal("c2"))
+		Expect(fileContent()).To(Equal(entryLine("c1", "b1", 1) + entryLine("c2", "b1", 2)))
+
+		Expect(appendEntry(w, parseEntryOrFail(entryLine("c4", "b1", 4)))).To(Succeed())
+		Expect(fileContent()).To(Equal(
+			entryLine("c1", "b1", 1) + entryLine("c2", "b1", 2) + entryLine("c4", "b1", 4),
+		))
+	})
+
+	ginkgo.It("commits a checkpoint when it syncs", func() {
+		w := openWriter()
+		Expect(appendEntry(w, parseEntryOrFail(entryLine("c3", "b1", 3)))).To(Succeed())
+		Expect(w.Sync()).To(Succeed())
+
+		c, err := readCheckpoint(checkpointFilePath(filePath))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(Equal(checkpoint{Offset: int64(len(fileContent())), Cursor: "c3"}))
+		Expect(checkpointFilePath(filePath) + ".tmp").NotTo(BeAnExistingFile())
+	})
+
+	ginkgo.It("reads the entries after a stale checkpoint", func() {
+		writeCheckpointFile(checkpoint{
+			Offset: int64(len(entryLine("c1", "b1", 1))),
+			Cursor: "c1",
+		})
+
+		Expect(openWriter().Cursor()).To(Equal("c2"))
+	})
+
+	ginkgo.It("starts at the checkpoint", func() {
+		// The cursor of the checkpoint differs from the cursor of the entry at its offset, to show
+		// that the entries before the checkpoint are not read.
+		writeCheckpointFile(checkpoint{Offset: int64(len(fileContent())), Cursor: "synced"})
+
+		Expect(openWriter().Cursor()).To(Equal("synced"))
+	})
+
+	ginkgo.DescribeTable("ignores the checkpoint of a replaced file",
+		func(c func() checkpoint) {
+			writeCheckpointFile(c())
+
+			w := openWriter()
+			Expect(w.Cursor()).To(Equal("c2"))
+			Expect(fileContent()).To(Equal(entryLine("c1", "b1", 1) + entryLine("c2", "b1", 2)))
+		},
+		ginkgo.Entry("with an offset beyond the end of the file", func() checkpoint {
+			return checkpoint{Offset: int64(len(fileContent())) + 100, Cursor: "old"}
+		}),
+		ginkgo.Entry("with an offset inside a line", func() checkpoint {
+			return checkpoint{Offset: 10, Cursor: "old"}
+		}),
+	)
+
+	ginkgo.It("reads the entire file if the checkpoint is corrupt", func() {
+		Expect(os.WriteFile(checkpointFilePath(filePath), []byte(`{"offset":`), 0o644)).
+			To(Succeed())
+
+		Expect(openWriter().Cursor()).To(Equal("c2"))
+	})
+
+	ginkgo.It("creates a missing file", func() {
+		Expect(os.Remove(filePath)).To(Succeed())
+
+		w := openWriter()
+		Expect(w.Cursor()).To(BeEmpty())
+		Expect(filePath).To(BeAnExistingFile())
+	})
+
+	ginkgo.It("writes a checkpoint that can be read back", func() {
+		c := checkpoint{Offset: 42, Cursor: "c42"}
+		writeCheckpointFile(c)
+
+		data, err := os.ReadFile(checkpointFilePath(filePath))
+		Expect(err).NotTo(HaveOccurred())
+		read := checkpoint{}
+		Expect(json.Unmarshal(data, &read)).To(Succeed())
+		Expect(read).To(Equal(c))
+	})
+})
@@ -0,0 +1,250 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Supported formats.
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Formats are the supported formats.
+var Formats = []string{FormatJSON, FormatConsole}
+
+// Keys of every log entry, so that the log pipeline can rely on them in both formats.
+const (
+	TimeKey       = "ts"
+	LevelKey      = "level"
+	LoggerKey     = "logger"
+	MessageKey    = "msg"
+	CallerKey     = "caller"
+	StacktraceKey = "stacktrace"
+	ErrorKey      = "error"
+)
+
+// DiagnosticsVerbosity is the verbosity of the diagnostics log files of Machines. It is higher
+// than the default, so that every attempt to connect is recorded.
+const DiagnosticsVerbosity = 1
+
+// Options configure a logger.
+type Options struct {
+	// Format is FormatJSON or FormatConsole.
+	Format string
+	// Verbosity is the verbosity of the logger. It can be changed while the logger is used.
+	Verbosity *Verbosity
+	// SamplingInitial, if not zero, is the number of entries with the same level and message
+	// that are logged each second. After that, only every SamplingThereafter-th entry is logged,
+	// so that an error that repeats many times does not flood the log.
+	SamplingInitial    int
+	SamplingThereafter int
+}
+
+// Verbosity is the verbosity of a logger, which can be changed while the logger is used. It is
+// safe for concurrent use.
+type Verbosity struct {
+	level zap.AtomicLevel
+}
+
+// NewVerbosity returns a Verbosity. A higher verbosity logs more.
+func NewVerbosity(verbosity int) *Verbosity {
+	return &Verbosity{level: zap.NewAtomicLevelAt(toLevel(verbosity))}
+}
+
+// Set changes the verbosity.
+func (v *Verbosity) Set(verbosity int) {
+	v.level.SetLevel(toLevel(verbosity))
+}
+
+// toLevel returns the zap level of the logr verbosity.
+func toLevel(verbosity int) zapcore.Level {
+	return zapcore.Level(-verbosity)
+}
+
+func encoderConfig() zapcore.EncoderConfig {
+	return zapcore.EncoderConfig{
+		TimeKey:        TimeKey,
+		LevelKey:       LevelKey,
+		NameKey:        LoggerKey,
+		CallerKey:      CallerKey,
+		MessageKey:     MessageKey,
+		StacktraceKey:  StacktraceKey,
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.RFC3339NanoTimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+		EncodeCaller:   zapcore.ShortCallerEncoder,
+	}
+}
+
+func newEncoder(format string) zapcore.Encoder {
+	if format == FormatJSON {
+		return zapcore.NewJSONEncoder(encoderConfig())
+	}
+	return zapcore.NewConsoleEncoder(encoderConfig())
+}
+
+// New returns a logger that writes to w. An unknown format is written as FormatConsole.
+func New(w io.Writer, options Options) logr.Logger {
+	verbosity := options.Verbosity
+	if verbosity == nil {
+		verbosity = NewVerbosity(0)
+	}
+	core := zapcore.NewCore(newEncoder(options.Format), zapcore.AddSync(w), verbosity.level)
+	if options.SamplingInitial > 0 {
+		core = zapcore.NewSamplerWithOptions(
+			core,
+			time.Second,
+			options.SamplingInitial,
+			options.SamplingThereafter,
+		)
+	}
+	return zapr.NewLoggerWithOptions(
+		zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)),
+		zapr.ErrorKey(ErrorKey),
+	)
+}
+
+// DiagnosticsFilePath returns the path of the diagnostics log file of a Machine.
+func DiagnosticsFilePath(directory, namespace, name string) string {
+	return path.Join(directory, fmt.Sprintf("%s-%s.diagnostics.log", namespace, name))
+}
+
+// DiagnosticsMaxFileSize is the size above which a diagnostics log file is rotated.
+const DiagnosticsMaxFileSize = 10 * 1024 * 1024
+
+// RotatedDiagnosticsFilePath returns the path that the diagnostics log file is rotated to.
+func RotatedDiagnosticsFilePath(filePath string) string {
+	return filePath + ".1"
+}
+
+// DiagnosticsFile is a diagnostics log file that is rotated once it would grow above its maximum
+// size. It is rotated to RotatedDiagnosticsFilePath, replacing the file rotated before, so that
+// the diagnostics of a Machine take at most twice the maximum size. It is safe for concurrent use.
+type DiagnosticsFile struct {
+	filePath string
+	maxSize  int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenDiagnosticsFile opens the diagnostics log file for appending, and creates it if it does
+// not exist. The file is rotated once it would grow above DiagnosticsMaxFileSize.
+func OpenDiagnosticsFile(filePath string) (*DiagnosticsFile, error) {
+	return openDiagnosticsFile(filePath, DiagnosticsMaxFileSize)
+}
+
+func openDiagnosticsFile(filePath string, maxSize int64) (*DiagnosticsFile, error) {
+	f := &DiagnosticsFile{filePath: filePath, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *DiagnosticsFile) open() error {
+	file, err := os.OpenFile(f.filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open diagnostics log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to read status of diagnostics log file: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p to the file, after rotating the file if p would grow it above its maximum size.
+// An entry larger than the maximum size is written to an empty file.
+func (f *DiagnosticsFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *DiagnosticsFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close diagnostics log file: %w", err)
+	}
+	f.file = nil
+	renameErr := os.Rename(f.filePath, RotatedDiagnosticsFilePath(f.filePath))
+	// The file is opened again even if it was not rotated, so that later entries are written.
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("failed to rotate diagnostics log file: %w", renameErr)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (f *DiagnosticsFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Tee returns a logger that writes to the logger, and, as JSON, to w, and a logger that only
+// writes to w. The keys and values of the logger are not written to w, but keysAndValues, and
+// those added to the returned loggers, are. Entries up to DiagnosticsVerbosity are written to w,
+// whatever the verbosity of the logger. If the logger is not backed by zap, the first logger
+// returned is the logger.
+func Tee(logger logr.Logger, w io.Writer, keysAndValues ...any) (logr.Logger, logr.Logger) {
+	fields := make([]zap.Field, 0, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields = append(fields, zap.Any(fmt.Sprint(keysAndValues[i]), keysAndValues[i+1]))
+	}
+	fileCore := zapcore.NewCore(
+		zapcore.NewJSONEncoder(encoderConfig()),
+		zapcore.AddSync(w),
+		toLevel(DiagnosticsVerbosity),
+	).With(fields)
+	fileLogger := zapr.NewLoggerWithOptions(
+		zap.New(fileCore, zap.AddCaller()),
+		zapr.ErrorKey(ErrorKey),
+	)
+
+	underlier, ok := logger.GetSink().(zapr.Underlier)
+	if !ok {
+		return logger, fileLogger
+	}
+	tee := underlier.GetUnderlying().WithOptions(
+		zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewTee(core, fileCore)
+		}),
+		// zapr skips the frames of zapr and logr, and the underlying logger already skips them.
+		zap.AddCallerSkip(-2),
+	)
+	return zapr.NewLoggerWithOptions(tee, zapr.ErrorKey(ErrorKey)), fileLogger
+}
@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// decodeLines decodes the JSON log entries in the buffer.
+func decodeLines(buffer *bytes.Buffer) []map[string]any {
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		entry := map[string]any{}
+		Expect(json.Unmarshal([]byte(line), &entry)).To(Succeed())
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// caller returns the caller of the function that calls caller, as the logger records it.
+func caller() string {
+	_, file, line, ok := runtime.Caller(1)
+	Expect(ok).To(BeTrue())
+	return fmt.Sprintf("logging/%s:%d", filepath.Base(file), line+1)
+}
+
+var _ = Describe("Tee", func() {
+	var (
+		logged, written *bytes.Buffer
+		logger          logr.Logger
+	)
+
+	BeforeEach(func() {
+		logged, written = &bytes.Buffer{}, &bytes.Buffer{}
+		logger = New(logged, Options{Format: FormatJSON}).WithValues("controller", "machine")
+	})
+
+	It("records the caller of the tee, and of the file logger", func() {
+		tee, fileLogger := Tee(logger, written)
+
+		teeCaller := caller()
+		tee.Info("to both")
+		fileCaller := caller()
+		fileLogger.Info("to the file")
+
+		Expect(decodeLines(logged)).To(ConsistOf(
+			HaveKeyWithValue(CallerKey, teeCaller),
+		))
+		Expect(decodeLines(written)).To(ConsistOf(
+			HaveKeyWithValue(CallerKey, teeCaller),
+			HaveKeyWithValue(CallerKey, fileCaller),
+		))
+	})
+
+	It("writes its keys and values to the file, and those of the logger to the logger", func() {
+		tee, _ := Tee(logger, written, "namespace", "ns")
+		tee.WithValues("cluster", "c").Info("hello")
+
+		Expect(decodeLines(logged)).To(ConsistOf(SatisfyAll(
+			HaveKeyWithValue("controller", "machine"),
+			HaveKeyWithValue("cluster", "c"),
+			Not(HaveKey("namespace")),
+		)))
+		Expect(decodeLines(written)).To(ConsistOf(SatisfyAll(
+			HaveKeyWithValue("namespace", "ns"),
+			HaveKeyWithValue("cluster", "c"),
+			Not(HaveKey("controller")),
+		)))
+	})
+
+	It("writes entries up to DiagnosticsVerbosity to the file, whatever the verbosity", func() {
+		tee, _ := Tee(logger, written)
+		tee.V(DiagnosticsVerbosity).Info("verbose")
+		tee.V(DiagnosticsVerbosity + 1).Info("too verbose")
+
+		Expect(logged.String()).To(BeEmpty())
+		Expect(decodeLines(written)).To(ConsistOf(HaveKeyWithValue(MessageKey, "verbose")))
+	})
+
+	It("returns a logger that is not backed by zap", func() {
+		tee, fileLogger := Tee(logr.Discard(), written)
+		Expect(tee).To(Equal(logr.Discard()))
+		fileLogger.Info("to the file")
+		Expect(decodeLines(written)).To(ConsistOf(HaveKeyWithValue(MessageKey, "to the file")))
+	})
+})
+
+var _ = Describe("DiagnosticsFile", func() {
+	var filePath string
+
+	BeforeEach(func() {
+		filePath = DiagnosticsFilePath(GinkgoT().TempDir(), "ns", "m")
+	})
+
+	write := func(f *DiagnosticsFile, s string) {
+		n, err := f.Write([]byte(s))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(len(s)))
+	}
+
+	It("appends to the file", func() {
+		Expect(os.WriteFile(filePath, []byte("before\n"), 0o644)).To(Succeed())
+		f, err := openDiagnosticsFile(filePath, 100)
+		Expect(err).NotTo(HaveOccurred())
+		write(f, "after\n")
+		Expect(f.Close()).To(Succeed())
+		Expect(os.ReadFile(filePath)).To(BeEquivalentTo("before\nafter\n"))
+		Expect(RotatedDiagnosticsFilePath(filePath)).NotTo(BeAnExistingFile())
+	})
+
+	It("rotates the file before it grows above the maximum size", func() {
+		Expect(os.WriteFile(filePath, []byte("0123456\n"), 0o644)).To(Succeed())
+		f, err := openDiagnosticsFile(filePath, 10)
+		Expect(err).NotTo(HaveOccurred())
+		write(f, "a\n")
+		write(f, "b\n")
+		write(f, "c\n")
+		Expect(f.Close()).To(Succeed())
+		Expect(os.ReadFile(RotatedDiagnosticsFilePath(filePath))).To(BeEquivalentTo("0123456\na\n"))
+		Expect(os.ReadFile(filePath)).To(BeEquivalentTo("b\nc\n"))
+	})
+
+	It("replaces the file rotated before", func() {
+		f, err := openDiagnosticsFile(filePath, 4)
+		Expect(err).NotTo(HaveOccurred())
+		write(f, "a\n")
+		write(f, "b\n")
+		write(f, "c\n")
+		write(f, "d\n")
+		write(f, "e\n")
+		Expect(f.Close()).To(Succeed())
+		Expect(os.ReadFile(RotatedDiagnosticsFilePath(filePath))).To(BeEquivalentTo("c\nd\n"))
+		Expect(os.ReadFile(filePath)).To(BeEquivalentTo("e\n"))
+	})
+
+	It("writes an entry larger than the maximum size to an empty file", func() {
+		f, err := openDiagnosticsFile(filePath, 4)
+		Expect(err).NotTo(HaveOccurred())
+		write(f, "a\n")
+		write(f, "too large\n")
+		Expect(f.Close()).To(Succeed())
+		Expect(os.ReadFile(RotatedDiagnosticsFilePath(filePath))).To(BeEquivalentTo("a\n"))
+		Expect(os.ReadFile(filePath)).To(BeEquivalentTo("too large\n"))
+	})
+
+	It("is not written after it is closed", func() {
+		f, err := OpenDiagnosticsFile(filePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		_, err = f.Write([]byte("closed\n"))
+		Expect(err).To(MatchError(os.ErrClosed))
+	})
+})
@@ -0,0 +1,151 @@
+package loki
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/forward"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// SinkName identifies Loki in the names of cursor files.
+const SinkName = "loki"
+
+// Config configures how entries are pushed to Loki.
+type Config struct {
+	// URL is the Loki push API endpoint, e.g. http://loki:3100/loki/api/v1/push.
+	URL string
+	// TenantID is sent in the X-Scope-OrgID header, if not empty.
+	TenantID string
+	// BatchSize is the maximum number of entries pushed in one request.
+	BatchSize int
+	// BatchWait is the maximum time to wait for a batch to fill up before it is pushed.
+	BatchWait time.Duration
+	// HTTPClient is used to push entries. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// ForwardConfig returns the batching configuration for a forward.Forwarder.
+func (c Config) ForwardConfig() forward.Config {
+	return forward.Config{
+		BatchSize: c.BatchSize,
+		BatchWait: c.BatchWait,
+	}
+}
+
+// Pusher pushes entries to the Loki push API. It implements forward.Pusher.
+type Pusher struct {
+	config Config
+	labels map[string]string
+}
+
+// NewPusher returns a Pusher that pushes every entry with the given labels, and with the
+// boot_id and unit labels of the entry.
+func NewPusher(config Config, labels map[string]string) *Pusher {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &Pusher{
+		config: config,
+		labels: labels,
+	}
+}
+
+type pushRequest struct {
+	Streams []pushStream `json:"streams"`
+}
+
+type pushStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// Push implements forward.Pusher.
+func (p *Pusher) Push(ctx context.Context, batch []journald.Entry) error {
+	body, err := json.Marshal(p.pushRequest(batch))
+	if err != nil {
+		return fmt.Errorf("failed to serialize push request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		p.config.URL,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create push request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.config.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", p.config.TenantID)
+	}
+
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send push request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("push request failed with status %s: %s", resp.Status, respBody)
+	// Loki rejects an invalid batch, e.g. with entries that are too old, or labels that are not
+	// valid, with 400, and a batch that is too large with 413. Other errors, e.g. 401, 403 or 404,
+	// are errors of the configuration, or of Loki, and the batch is accepted once they are fixed.
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return &forward.NonRetryableError{Err: err}
+	}
+	return err
+}
+
+// pushRequest groups the entries of the batch into streams with the same labels.
+func (p *Pusher) pushRequest(batch []journald.Entry) pushRequest {
+	streams := map[string]*pushStream{}
+	var keys []string
+	for _, entry := range batch {
+		labels := maps.Clone(p.labels)
+		labels["boot_id"] = entry.BootID()
+		labels["unit"] = entry.Unit()
+
+		key := labelsKey(labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &pushStream{Stream: labels}
+			streams[key] = stream
+			keys = append(keys, key)
+		}
+		stream.Values = append(stream.Values, [2]string{
+			strconv.FormatInt(entry.RealtimeTimestamp().UnixNano(), 10),
+			entry.Message(),
+		})
+	}
+
+	req := pushRequest{}
+	for _, key := range keys {
+		req.Streams = append(req.Streams, *streams[key])
+	}
+	return req
+}
+
+func labelsKey(labels map[string]string) string {
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		fmt.Fprintf(&b, "%s=%q,", name, labels[name])
+	}
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package loki
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/dlipovetsky/machine-monitor/internal/forward"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// lokiStandIn is a local HTTP stand-in for the Loki push API.
+type lokiStandIn struct {
+	mu       sync.Mutex
+	requests []pushRequest
+	// failures is the number of requests to fail before accepting requests.
+	failures int
+	// failureStatus is the status of the failed requests. If zero, it is 503.
+	failureStatus int
+}
+
+func (l *lokiStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures > 0 {
+		l.failures--
+		w.WriteHeader(cmp.Or(l.failureStatus, http.StatusServiceUnavailable))
+		return
+	}
+	req := pushRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	l.requests = append(l.requests, req)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (l *lokiStandIn) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var messages []string
+	for _, req := range l.requests {
+		for _, stream := range req.Streams {
+			for _, value := range stream.Values {
+				messages = append(messages, value[1])
+			}
+		}
+	}
+	return messages
+}
+
+func writeJournal(filePath string, count int) {
+	var b strings.Builder
+	for i := range count {
+		fmt.Fprintf(&b,
+			`{"__CURSOR":"c%d","__REALTIME_TIMESTAMP":"%d","_BOOT_ID":"b1",`+
+				`"_SYSTEMD_UNIT":"kubelet.service","MESSAGE":"m%d"}`+"\n",
+			i, 1700000000000000+i, i)
+	}
+	Expect(os.WriteFile(filePath, []byte(b.String()), 0o644)).To(Succeed())
+}
+
+var _ = Describe("Pusher", func() {
+	var (
+		standIn              *lokiStandIn
+		server               *httptest.Server
+		config               Config
+		store                *journald.FileStore
+		localJournalFilePath string
+		cursorFilePath       string
+		labels               map[string]string
+	)
+
+	BeforeEach(func() {
+		standIn = &lokiStandIn{}
+		server = httptest.NewServer(standIn)
+		DeferCleanup(server.Close)
+
+		config = Config{
+			URL:       server.URL,
+			BatchSize: 2,
+			BatchWait: 100 * time.Millisecond,
+		}
+		dir := GinkgoT().TempDir()
+		store = &journald.FileStore{Directory: dir}
+		localJournalFilePath = store.LocalJournalFilePath("ns", "m")
+		cursorFilePath = forward.CursorFilePath(dir, "ns", "m", SinkName)
+		labels = map[string]string{"namespace": "ns", "machine": "m"}
+	})
+
+	run := func() {
+		forwarder, err := forward.New(
+			config.ForwardConfig(),
+			NewPusher(config, labels),
+			store,
+			"ns",
+			"m",
+			cursorFilePath,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		forwarder.Drain()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		Expect(forwarder.Run(ctx)).To(Succeed())
+	}
+
+	It("should push every entry in batches, with labels", func() {
+		writeJournal(localJournalFilePath, 3)
+		run()
+
+		Expect(standIn.messages()).To(Equal([]string{"m0", "m1", "m2"}))
+		Expect(standIn.requests).To(HaveLen(2))
+		Expect(standIn.requests[0].Streams[0].Stream).To(Equal(map[string]string{
+			"namespace": "ns",
+			"machine":   "m",
+			"boot_id":   "b1",
+			"unit":      "kubelet.service",
+		}))
+		Expect(os.ReadFile(cursorFilePath)).To(BeEquivalentTo("c2"))
+	})
+
+	It("should resume after the saved cursor", func() {
+		writeJournal(localJournalFilePath, 3)
+		Expect(os.WriteFile(cursorFilePath, []byte("c1"), 0o644)).To(Succeed())
+		run()
+
+		Expect(standIn.messages()).To(Equal([]string{"m2"}))
+	})
+
+	It("should retry when Loki is unavailable", func() {
+		writeJournal(localJournalFilePath, 1)
+		standIn.failures = 1
+		run()
+
+		Expect(standIn.messages()).To(Equal([]string{"m0"}))
+	})
+
+	DescribeTable("should retry when Loki rejects the configuration",
+		func(status int) {
+			writeJournal(localJournalFilePath, 1)
+			standIn.failures = 1
+			standIn.failureStatus = status
+			run()
+
+			Expect(standIn.messages()).To(Equal([]string{"m0"}))
+		},
+		Entry("unauthorized", http.StatusUnauthorized),
+		Entry("forbidden", http.StatusForbidden),
+		Entry("not found", http.StatusNotFound),
+	)
+
+	DescribeTable("should drop a batch that Loki rejects",
+		func(status int) {
+			writeJournal(localJournalFilePath, 3)
+			standIn.failures = 1
+			standIn.failureStatus = status
+			run()
+
+			Expect(standIn.messages()).To(Equal([]string{"m2"}))
+			Expect(os.ReadFile(cursorFilePath)).To(BeEquivalentTo("c2"))
+		},
+		Entry("bad request", http.StatusBadRequest),
+		Entry("request entity too large", http.StatusRequestEntityTooLarge),
+	)
+})
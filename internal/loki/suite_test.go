@@ -0,0 +1,14 @@
+package loki
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestLoki(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Loki Suite")
+}
@@ -0,0 +1,133 @@
+package otlp
+
+import (
+	"maps"
+	"slices"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// The messages below are encoded by hand, following the OTLP protobuf definitions in
+// https://github.com/open-telemetry/opentelemetry-proto/tree/main/opentelemetry/proto, so that
+// we do not depend on generated code and a gRPC implementation.
+
+// scopeName is the name of the instrumentation scope of every log record.
+const scopeName = "github.com/dlipovetsky/machine-monitor"
+
+// Log record attribute keys.
+const (
+	AttributeSystemdUnit     = "systemd.unit"
+	AttributeJournaldBootID  = "journald.boot_id"
+	AttributeJournaldCursor  = "journald.cursor"
+	AttributeJournaldPID     = "journald.pid"
+	AttributeJournaldCommand = "journald.comm"
+)
+
+// severity maps a syslog priority to an OTel severity number and text.
+// See https://opentelemetry.io/docs/specs/otel/logs/data-model-appendix/#appendix-b-severitynumber-example-mappings
+var severity = [8]struct {
+	number uint64
+	text   string
+}{
+	{21, "emerg"},
+	{19, "alert"},
+	{18, "crit"},
+	{17, "err"},
+	{13, "warning"},
+	{10, "notice"},
+	{9, "info"},
+	{5, "debug"},
+}
+
+// encodeExportLogsServiceRequest encodes an ExportLogsServiceRequest with one ResourceLogs that
+// holds every entry in the batch.
+func encodeExportLogsServiceRequest(
+	resourceAttributes map[string]string,
+	batch []journald.Entry,
+	observed time.Time,
+) []byte {
+	// ExportLogsServiceRequest.resource_logs = 1
+	return appendMessage(nil, 1, encodeResourceLogs(resourceAttributes, batch, observed))
+}
+
+func encodeResourceLogs(
+	resourceAttributes map[string]string,
+	batch []journald.Entry,
+	observed time.Time,
+) []byte {
+	// Resource.attributes = 1
+	var resource []byte
+	for _, key := range slices.Sorted(maps.Keys(resourceAttributes)) {
+		resource = appendMessage(resource, 1, encodeKeyValue(key, resourceAttributes[key]))
+	}
+
+	// InstrumentationScope.name = 1
+	scope := protowire.AppendTag(nil, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, scopeName)
+
+	// ScopeLogs.scope = 1, ScopeLogs.log_records = 2
+	scopeLogs := appendMessage(nil, 1, scope)
+	for _, entry := range batch {
+		scopeLogs = appendMessage(scopeLogs, 2, encodeLogRecord(entry, observed))
+	}
+
+	// ResourceLogs.resource = 1, ResourceLogs.scope_logs = 2
+	resourceLogs := appendMessage(nil, 1, resource)
+	return appendMessage(resourceLogs, 2, scopeLogs)
+}
+
+func encodeLogRecord(entry journald.Entry, observed time.Time) []byte {
+	var b []byte
+	// LogRecord.time_unix_nano = 1
+	if t := entry.RealtimeTimestamp(); !t.IsZero() {
+		b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, uint64(t.UnixNano()))
+	}
+	// LogRecord.severity_number = 2, LogRecord.severity_text = 3
+	s := severity[entry.Priority()]
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, s.number)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, s.text)
+	// LogRecord.body = 5
+	b = appendMessage(b, 5, encodeStringValue(entry.Message()))
+	// LogRecord.attributes = 6
+	attributes := map[string]string{
+		AttributeSystemdUnit:     entry.Unit(),
+		AttributeJournaldBootID:  entry.BootID(),
+		AttributeJournaldCursor:  entry.Cursor(),
+		AttributeJournaldPID:     entry["_PID"],
+		AttributeJournaldCommand: entry["_COMM"],
+	}
+	for _, key := range slices.Sorted(maps.Keys(attributes)) {
+		if attributes[key] == "" {
+			continue
+		}
+		b = appendMessage(b, 6, encodeKeyValue(key, attributes[key]))
+	}
+	// LogRecord.observed_time_unix_nano = 11
+	b = protowire.AppendTag(b, 11, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(observed.UnixNano()))
+	return b
+}
+
+func encodeKeyValue(key, value string) []byte {
+	// KeyValue.key = 1, KeyValue.value = 2
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+	return appendMessage(b, 2, encodeStringValue(value))
+}
+
+func encodeStringValue(value string) []byte {
+	// AnyValue.string_value = 1
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
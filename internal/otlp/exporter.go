@@ -0,0 +1,260 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/forward"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// SinkName identifies the OTLP exporter in the names of cursor files.
+const SinkName = "otlp"
+
+// Supported protocols, named as in the OTEL_EXPORTER_OTLP_PROTOCOL environment variable.
+const (
+	ProtocolGRPC         = "grpc"
+	ProtocolHTTPProtobuf = "http/protobuf"
+)
+
+// Paths of the gRPC Export methods.
+const (
+	grpcLogsExportPath   = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+	grpcTracesExportPath = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+)
+
+// Resource attribute keys that identify the Cluster API resources of a Machine.
+const (
+	AttributeNamespace                   = "k8s.namespace.name"
+	AttributeMachineName                 = "capi.machine.name"
+	AttributeClusterName                 = "capi.cluster.name"
+	AttributeMachineDeploymentName       = "capi.machine_deployment.name"
+	AttributeInfrastructureRefAPIGroup   = "capi.infrastructure_ref.api_group"
+	AttributeInfrastructureRefAPIVersion = "capi.infrastructure_ref.api_version"
+	AttributeInfrastructureRefKind       = "capi.infrastructure_ref.kind"
+	AttributeInfrastructureRefName       = "capi.infrastructure_ref.name"
+	AttributeManagementClusterName       = "capi.management_cluster.name"
+)
+
+// Config configures how entries are exported.
+type Config struct {
+	// Protocol is either ProtocolGRPC or ProtocolHTTPProtobuf.
+	Protocol string
+	// Endpoint is the URL of the collector. For gRPC, it is the base URL, e.g.
+	// http://collector:4317. For HTTP, it is the full URL, e.g. http://collector:4318/v1/logs.
+	// For gRPC, the http scheme means the connection is not encrypted.
+	Endpoint string
+	// Headers are sent with every request, e.g. for authentication.
+	Headers map[string]string
+	// BatchSize is the maximum number of entries exported in one request.
+	BatchSize int
+	// BatchWait is the maximum time to wait for a batch to fill up before it is exported.
+	BatchWait time.Duration
+	// HTTPClient is used to export entries. If nil, a client that supports the protocol is used.
+	HTTPClient *http.Client
+}
+
+// Validate checks that the configuration is complete.
+func (c Config) Validate() error {
+	if c.Protocol != ProtocolGRPC && c.Protocol != ProtocolHTTPProtobuf {
+		return fmt.Errorf(
+			"unsupported protocol %q, must be %q or %q",
+			c.Protocol,
+			ProtocolGRPC,
+			ProtocolHTTPProtobuf,
+		)
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid endpoint %q: scheme must be http or https", c.Endpoint)
+	}
+	return nil
+}
+
+// ForwardConfig returns the batching configuration for a forward.Forwarder.
+func (c Config) ForwardConfig() forward.Config {
+	return forward.Config{
+		BatchSize: c.BatchSize,
+		BatchWait: c.BatchWait,
+	}
+}
+
+// NewHTTPClient returns an HTTP client for the protocol. gRPC requires HTTP/2, which, for
+// unencrypted connections, has to be enabled explicitly.
+func NewHTTPClient(protocol string) *http.Client {
+	if protocol != ProtocolGRPC {
+		return &http.Client{}
+	}
+	protocols := &http.Protocols{}
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{
+		Transport: &http.Transport{
+			Protocols: protocols,
+		},
+	}
+}
+
+// Exporter exports entries as OTLP log records. It implements forward.Pusher.
+type Exporter struct {
+	config             Config
+	resourceAttributes map[string]string
+}
+
+// NewExporter returns an Exporter that exports every entry with the given resource attributes.
+func NewExporter(config Config, resourceAttributes map[string]string) *Exporter {
+	if config.HTTPClient == nil {
+		config.HTTPClient = NewHTTPClient(config.Protocol)
+	}
+	return &Exporter{
+		config:             config,
+		resourceAttributes: resourceAttributes,
+	}
+}
+
+// Push implements forward.Pusher.
+func (e *Exporter) Push(ctx context.Context, batch []journald.Entry) error {
+	message := encodeExportLogsServiceRequest(e.resourceAttributes, batch, time.Now())
+	return send(ctx, e.config, grpcLogsExportPath, message)
+}
+
+// send sends the encoded export request with the protocol of the configuration. For gRPC, the
+// request is sent to the method at grpcPath.
+func send(ctx context.Context, config Config, grpcPath string, message []byte) error {
+	if config.Protocol == ProtocolGRPC {
+		return sendGRPC(ctx, config, grpcPath, message)
+	}
+	return sendHTTP(ctx, config, message)
+}
+
+func sendHTTP(ctx context.Context, config Config, message []byte) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		config.Endpoint,
+		bytes.NewReader(message),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	setHeaders(req, config.Headers)
+
+	resp, err := config.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send export request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("export request failed with status %s: %s", resp.Status, respBody)
+	// See https://opentelemetry.io/docs/specs/otlp/#retryable-response-codes. As with Loki, 401,
+	// 403 and 404 are errors of the configuration, or of the collector, and the batch is accepted
+	// once they are fixed, so they are retried too.
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusNotFound:
+		return err
+	}
+	return &forward.NonRetryableError{Err: err}
+}
+
+func sendGRPC(ctx context.Context, config Config, grpcPath string, message []byte) error {
+	// A gRPC message is prefixed with a compression flag, and its length.
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		strings.TrimSuffix(config.Endpoint, "/")+grpcPath,
+		bytes.NewReader(frame),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	setHeaders(req, config.Headers)
+
+	resp, err := config.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send export request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	// The status is sent in the trailers, which are only available after the body is read.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("export request failed with HTTP status %s", resp.Status)
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	statusMessage := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// A response without a body may send the status in the headers.
+		status = resp.Header.Get("Grpc-Status")
+		statusMessage = resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("export response has invalid gRPC status %q", status)
+	}
+	if code == grpcCodeOK {
+		return nil
+	}
+
+	statusMessage, _ = url.PathUnescape(statusMessage)
+	err = fmt.Errorf("export request failed with gRPC status %d: %s", code, statusMessage)
+	if retryableGRPCCodes[code] {
+		return err
+	}
+	return &forward.NonRetryableError{Err: err}
+}
+
+func setHeaders(req *http.Request, headers map[string]string) {
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+}
+
+const grpcCodeOK = 0
+
+// retryableGRPCCodes are the gRPC status codes after which an export is retried.
+// See https://opentelemetry.io/docs/specs/otlp/#failures. PERMISSION_DENIED, UNIMPLEMENTED and
+// UNAUTHENTICATED are errors of the configuration, or of the collector, and are retried too.
+var retryableGRPCCodes = map[int]bool{
+	1:  true, // CANCELLED
+	4:  true, // DEADLINE_EXCEEDED
+	7:  true, // PERMISSION_DENIED
+	8:  true, // RESOURCE_EXHAUSTED
+	10: true, // ABORTED
+	11: true, // OUT_OF_RANGE
+	12: true, // UNIMPLEMENTED
+	14: true, // UNAVAILABLE
+	15: true, // DATA_LOSS
+	16: true, // UNAUTHENTICATED
+}
@@ -0,0 +1,367 @@
+package otlp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dlipovetsky/machine-monitor/internal/forward"
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// field is a field of an encoded protobuf message.
+type field struct {
+	number protowire.Number
+	// bytes is the value of a field of the bytes wire type, e.g. a string, or a message.
+	bytes []byte
+	// value is the value of a field of the varint or fixed64 wire type.
+	value uint64
+}
+
+// decodeFields decodes the fields of an encoded protobuf message, in order.
+func decodeFields(b []byte) []field {
+	var fields []field
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		Expect(n).To(BeNumerically(">", 0), "invalid tag")
+		b = b[n:]
+		f := field{number: number}
+		switch wireType {
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		default:
+			Fail(fmt.Sprintf("unexpected wire type %d of field %d", wireType, number))
+		}
+		Expect(n).To(BeNumerically(">", 0), "invalid value of field %d", number)
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// repeated returns the fields with the number.
+func repeated(fields []field, number protowire.Number) []field {
+	var matching []field
+	for _, f := range fields {
+		if f.number == number {
+			matching = append(matching, f)
+		}
+	}
+	return matching
+}
+
+// single returns the only field with the number.
+func single(fields []field, number protowire.Number) field {
+	matching := repeated(fields, number)
+	Expect(matching).To(HaveLen(1), "expected one field %d", number)
+	return matching[0]
+}
+
+// decodeKeyValues decodes KeyValues whose values are strings.
+func decodeKeyValues(keyValues []field) map[string]string {
+	m := map[string]string{}
+	for _, kv := range keyValues {
+		fields := decodeFields(kv.bytes)
+		// KeyValue.key = 1, KeyValue.value = 2, AnyValue.string_value = 1
+		value := decodeFields(single(fields, 2).bytes)
+		m[string(single(fields, 1).bytes)] = string(single(value, 1).bytes)
+	}
+	return m
+}
+
+// logRecord is a decoded LogRecord.
+type logRecord struct {
+	time           time.Time
+	severityNumber uint64
+	severityText   string
+	body           string
+	attributes     map[string]string
+	observed       time.Time
+}
+
+// exportLogsRequest is a decoded ExportLogsServiceRequest with one ResourceLogs, and one
+// ScopeLogs.
+type exportLogsRequest struct {
+	resource map[string]string
+	scope    string
+	records  []logRecord
+}
+
+func decodeExportLogsServiceRequest(b []byte) exportLogsRequest {
+	// ExportLogsServiceRequest.resource_logs = 1
+	resourceLogs := decodeFields(single(decodeFields(b), 1).bytes)
+	// ResourceLogs.resource = 1, Resource.attributes = 1
+	request := exportLogsRequest{
+		resource: decodeKeyValues(repeated(decodeFields(single(resourceLogs, 1).bytes), 1)),
+	}
+	// ResourceLogs.scope_logs = 2
+	scopeLogs := decodeFields(single(resourceLogs, 2).bytes)
+	// ScopeLogs.scope = 1, InstrumentationScope.name = 1
+	request.scope = string(single(decodeFields(single(scopeLogs, 1).bytes), 1).bytes)
+	// ScopeLogs.log_records = 2
+	for _, f := range repeated(scopeLogs, 2) {
+		fields := decodeFields(f.bytes)
+		record := logRecord{
+			severityNumber: single(fields, 2).value,
+			severityText:   string(single(fields, 3).bytes),
+			body:           string(single(decodeFields(single(fields, 5).bytes), 1).bytes),
+			attributes:     decodeKeyValues(repeated(fields, 6)),
+			observed:       time.Unix(0, int64(single(fields, 11).value)).UTC(),
+		}
+		if times := repeated(fields, 1); len(times) > 0 {
+			record.time = time.Unix(0, int64(times[0].value)).UTC()
+		}
+		request.records = append(request.records, record)
+	}
+	return request
+}
+
+// collectorStandIn is a local stand-in for the export methods of an OTLP collector. It serves
+// OTLP/HTTP, and, with unencrypted HTTP/2, OTLP/gRPC.
+type collectorStandIn struct {
+	mu       sync.Mutex
+	paths    []string
+	headers  []http.Header
+	messages [][]byte
+
+	// httpStatus is the status of OTLP/HTTP responses. If zero, it is 200.
+	httpStatus int
+	// grpcStatus and grpcMessage are the status of OTLP/gRPC responses.
+	grpcStatus  int
+	grpcMessage string
+}
+
+func (c *collectorStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	Expect(err).NotTo(HaveOccurred())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, r.URL.Path)
+	c.headers = append(c.headers, r.Header.Clone())
+
+	if r.Header.Get("Content-Type") != "application/grpc" {
+		c.messages = append(c.messages, body)
+		if c.httpStatus != 0 {
+			w.WriteHeader(c.httpStatus)
+			_, _ = w.Write([]byte("rejected"))
+		}
+		return
+	}
+
+	// A gRPC message is prefixed with a compression flag, and its length.
+	Expect(len(body)).To(BeNumerically(">=", 5))
+	Expect(body[0]).To(BeZero())
+	Expect(binary.BigEndian.Uint32(body[1:5])).To(BeEquivalentTo(len(body) - 5))
+	c.messages = append(c.messages, body[5:])
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	// The response is an empty message.
+	_, _ = w.Write([]byte{0, 0, 0, 0, 0})
+	w.Header().Set("Grpc-Status", strconv.Itoa(c.grpcStatus))
+	w.Header().Set("Grpc-Message", c.grpcMessage)
+}
+
+// lastMessage returns the last message that the stand-in received.
+func (c *collectorStandIn) lastMessage() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	Expect(c.messages).NotTo(BeEmpty())
+	return c.messages[len(c.messages)-1]
+}
+
+// startCollectorStandIn starts a collectorStandIn that serves HTTP/1.1, and unencrypted HTTP/2.
+func startCollectorStandIn() (*collectorStandIn, *httptest.Server) {
+	standIn := &collectorStandIn{}
+	server := httptest.NewUnstartedServer(standIn)
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	DeferCleanup(server.Close)
+	return standIn, server
+}
+
+// testEntry returns an entry with the priority and message, logged seconds after 2025-01-02
+// 15:04:05 UTC.
+func testEntry(seconds int, priority, message string) journald.Entry {
+	t := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC).Add(time.Duration(seconds) * time.Second)
+	return journald.Entry{
+		journald.FieldCursor:            "c" + strconv.Itoa(seconds),
+		journald.FieldBootID:            "boot",
+		journald.FieldRealtimeTimestamp: strconv.FormatInt(t.UnixMicro(), 10),
+		journald.FieldPriority:          priority,
+		journald.FieldMessage:           message,
+		journald.FieldSystemdUnit:       "kubelet.service",
+		"_PID":                          "42",
+		"_COMM":                         "kubelet",
+	}
+}
+
+var _ = Describe("encodeExportLogsServiceRequest", func() {
+	It("encodes the entries as log records of one resource", func() {
+		observed := time.Date(2025, 1, 2, 16, 0, 0, 0, time.UTC)
+		message := encodeExportLogsServiceRequest(
+			map[string]string{AttributeMachineName: "m", AttributeNamespace: "ns"},
+			[]journald.Entry{testEntry(0, "3", "failed"), testEntry(1, "", "no priority")},
+			observed,
+		)
+		request := decodeExportLogsServiceRequest(message)
+		Expect(request.resource).To(Equal(map[string]string{
+			AttributeMachineName: "m",
+			AttributeNamespace:   "ns",
+		}))
+		Expect(request.scope).To(Equal(scopeName))
+		Expect(request.records).To(Equal([]logRecord{
+			{
+				time:           time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC),
+				severityNumber: 17,
+				severityText:   "err",
+				body:           "failed",
+				attributes: map[string]string{
+					AttributeSystemdUnit:     "kubelet.service",
+					AttributeJournaldBootID:  "boot",
+					AttributeJournaldCursor:  "c0",
+					AttributeJournaldPID:     "42",
+					AttributeJournaldCommand: "kubelet",
+				},
+				observed: observed,
+			},
+			{
+				time: time.Date(2025, 1, 2, 15, 4, 6, 0, time.UTC),
+				// An entry without a priority has the info priority.
+				severityNumber: 9,
+				severityText:   "info",
+				body:           "no priority",
+				attributes: map[string]string{
+					AttributeSystemdUnit:     "kubelet.service",
+					AttributeJournaldBootID:  "boot",
+					AttributeJournaldCursor:  "c1",
+					AttributeJournaldPID:     "42",
+					AttributeJournaldCommand: "kubelet",
+				},
+				observed: observed,
+			},
+		}))
+	})
+
+	It("leaves out the time and the attributes that the entry does not have", func() {
+		message := encodeExportLogsServiceRequest(
+			nil,
+			[]journald.Entry{{journald.FieldMessage: "bare"}},
+			time.Now(),
+		)
+		request := decodeExportLogsServiceRequest(message)
+		Expect(request.resource).To(BeEmpty())
+		Expect(request.records).To(HaveLen(1))
+		Expect(request.records[0].time).To(BeZero())
+		Expect(request.records[0].body).To(Equal("bare"))
+		Expect(request.records[0].attributes).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Exporter", func() {
+	var (
+		standIn *collectorStandIn
+		server  *httptest.Server
+	)
+
+	BeforeEach(func() {
+		standIn, server = startCollectorStandIn()
+	})
+
+	push := func(protocol, endpoint string) error {
+		exporter := NewExporter(Config{
+			Protocol: protocol,
+			Endpoint: endpoint,
+			Headers:  map[string]string{"Authorization": "secret"},
+		}, map[string]string{AttributeMachineName: "m"})
+		return exporter.Push(context.Background(), []journald.Entry{testEntry(0, "6", "hello")})
+	}
+
+	// expectRetryable expects the error of a push that the forwarder retries, or, if retryable
+	// is false, drops.
+	expectRetryable := func(err error, retryable bool) {
+		Expect(err).To(HaveOccurred())
+		var nonRetryable *forward.NonRetryableError
+		Expect(errors.As(err, &nonRetryable)).To(Equal(!retryable))
+	}
+
+	Context("with OTLP/HTTP", func() {
+		It("exports the entries", func() {
+			Expect(push(ProtocolHTTPProtobuf, server.URL+"/v1/logs")).To(Succeed())
+			Expect(standIn.paths).To(Equal([]string{"/v1/logs"}))
+			Expect(standIn.headers[0].Get("Content-Type")).To(Equal("application/x-protobuf"))
+			Expect(standIn.headers[0].Get("Authorization")).To(Equal("secret"))
+			request := decodeExportLogsServiceRequest(standIn.lastMessage())
+			Expect(request.resource).To(Equal(map[string]string{AttributeMachineName: "m"}))
+			Expect(request.records).To(HaveLen(1))
+			Expect(request.records[0].body).To(Equal("hello"))
+		})
+
+		DescribeTable("retries, or drops, a rejected export",
+			func(status int, retryable bool) {
+				standIn.httpStatus = status
+				err := push(ProtocolHTTPProtobuf, server.URL+"/v1/logs")
+				expectRetryable(err, retryable)
+				Expect(err).To(MatchError(ContainSubstring("rejected")))
+			},
+			Entry("too many requests", http.StatusTooManyRequests, true),
+			Entry("service unavailable", http.StatusServiceUnavailable, true),
+			Entry("unauthorized", http.StatusUnauthorized, true),
+			Entry("forbidden", http.StatusForbidden, true),
+			Entry("not found", http.StatusNotFound, true),
+			Entry("bad request", http.StatusBadRequest, false),
+			Entry("request entity too large", http.StatusRequestEntityTooLarge, false),
+		)
+	})
+
+	Context("with OTLP/gRPC", func() {
+		It("exports the entries", func() {
+			Expect(push(ProtocolGRPC, server.URL+"/")).To(Succeed())
+			Expect(standIn.paths).To(Equal([]string{grpcLogsExportPath}))
+			Expect(standIn.headers[0].Get("Authorization")).To(Equal("secret"))
+			Expect(standIn.headers[0].Get("TE")).To(Equal("trailers"))
+			request := decodeExportLogsServiceRequest(standIn.lastMessage())
+			Expect(request.resource).To(Equal(map[string]string{AttributeMachineName: "m"}))
+			Expect(request.records).To(HaveLen(1))
+			Expect(request.records[0].body).To(Equal("hello"))
+		})
+
+		DescribeTable("retries, or drops, a rejected export",
+			func(code int, retryable bool) {
+				standIn.grpcStatus = code
+				standIn.grpcMessage = "export%20rejected"
+				err := push(ProtocolGRPC, server.URL)
+				expectRetryable(err, retryable)
+				Expect(err).To(MatchError(fmt.Sprintf(
+					"export request failed with gRPC status %d: export rejected",
+					code,
+				)))
+			},
+			Entry("unavailable", 14, true),
+			Entry("resource exhausted", 8, true),
+			Entry("unauthenticated", 16, true),
+			Entry("permission denied", 7, true),
+			Entry("unimplemented", 12, true),
+			Entry("invalid argument", 3, false),
+		)
+	})
+})
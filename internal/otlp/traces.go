@@ -0,0 +1,185 @@
+package otlp
+
+import (
+	"context"
+	"math"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SpanExporter exports spans as OTLP traces. It implements sdktrace.SpanExporter, and is meant
+// to be used with a batching span processor.
+type SpanExporter struct {
+	config Config
+}
+
+// NewSpanExporter returns a SpanExporter. The batch size and wait of the configuration are
+// ignored; the span processor batches spans.
+func NewSpanExporter(config Config) *SpanExporter {
+	if config.HTTPClient == nil {
+		config.HTTPClient = NewHTTPClient(config.Protocol)
+	}
+	return &SpanExporter{config: config}
+}
+
+// ExportSpans implements sdktrace.SpanExporter.
+func (e *SpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	return send(ctx, e.config, grpcTracesExportPath, encodeExportTraceServiceRequest(spans))
+}
+
+// Shutdown implements sdktrace.SpanExporter. The exporter holds no resources.
+func (e *SpanExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// encodeExportTraceServiceRequest encodes an ExportTraceServiceRequest with one ResourceSpans
+// for every resource, and one ScopeSpans for every instrumentation scope of the spans.
+func encodeExportTraceServiceRequest(spans []sdktrace.ReadOnlySpan) []byte {
+	type group struct {
+		resource []attribute.KeyValue
+		scopes   map[string][]sdktrace.ReadOnlySpan
+		order    []string
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, span := range spans {
+		key := ""
+		var resource []attribute.KeyValue
+		if span.Resource() != nil {
+			key = span.Resource().Encoded(attribute.DefaultEncoder())
+			resource = span.Resource().Attributes()
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &group{resource: resource, scopes: map[string][]sdktrace.ReadOnlySpan{}}
+			groups[key] = g
+			order = append(order, key)
+		}
+		scope := span.InstrumentationScope().Name
+		if _, ok := g.scopes[scope]; !ok {
+			g.order = append(g.order, scope)
+		}
+		g.scopes[scope] = append(g.scopes[scope], span)
+	}
+
+	var b []byte
+	for _, key := range order {
+		g := groups[key]
+		// Resource.attributes = 1
+		var resource []byte
+		for _, kv := range g.resource {
+			resource = appendMessage(resource, 1, encodeAttribute(kv))
+		}
+		// ResourceSpans.resource = 1
+		resourceSpans := appendMessage(nil, 1, resource)
+		for _, name := range g.order {
+			// InstrumentationScope.name = 1
+			scope := protowire.AppendTag(nil, 1, protowire.BytesType)
+			scope = protowire.AppendString(scope, name)
+			// ScopeSpans.scope = 1, ScopeSpans.spans = 2
+			scopeSpans := appendMessage(nil, 1, scope)
+			for _, span := range g.scopes[name] {
+				scopeSpans = appendMessage(scopeSpans, 2, encodeSpan(span))
+			}
+			// ResourceSpans.scope_spans = 2
+			resourceSpans = appendMessage(resourceSpans, 2, scopeSpans)
+		}
+		// ExportTraceServiceRequest.resource_spans = 1
+		b = appendMessage(b, 1, resourceSpans)
+	}
+	return b
+}
+
+func encodeSpan(span sdktrace.ReadOnlySpan) []byte {
+	var b []byte
+	// Span.trace_id = 1, Span.span_id = 2
+	traceID := span.SpanContext().TraceID()
+	spanID := span.SpanContext().SpanID()
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, traceID[:])
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, spanID[:])
+	// Span.parent_span_id = 4
+	if parent := span.Parent(); parent.HasSpanID() {
+		parentID := parent.SpanID()
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, parentID[:])
+	}
+	// Span.name = 5
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendString(b, span.Name())
+	// Span.kind = 6. The values of trace.SpanKind match the protobuf enum.
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(span.SpanKind()))
+	// Span.start_time_unix_nano = 7, Span.end_time_unix_nano = 8
+	b = protowire.AppendTag(b, 7, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(span.StartTime().UnixNano()))
+	b = protowire.AppendTag(b, 8, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(span.EndTime().UnixNano()))
+	// Span.attributes = 9
+	for _, kv := range span.Attributes() {
+		b = appendMessage(b, 9, encodeAttribute(kv))
+	}
+	// Span.events = 11
+	for _, event := range span.Events() {
+		// Event.time_unix_nano = 1, Event.name = 2, Event.attributes = 3
+		e := protowire.AppendTag(nil, 1, protowire.Fixed64Type)
+		e = protowire.AppendFixed64(e, uint64(event.Time.UnixNano()))
+		e = protowire.AppendTag(e, 2, protowire.BytesType)
+		e = protowire.AppendString(e, event.Name)
+		for _, kv := range event.Attributes {
+			e = appendMessage(e, 3, encodeAttribute(kv))
+		}
+		b = appendMessage(b, 11, e)
+	}
+	// Span.status = 15
+	if status := span.Status(); status.Code != codes.Unset {
+		// Status.message = 2, Status.code = 3. The values of codes.Code do not match the
+		// protobuf enum, in which OK is 1, and ERROR is 2.
+		var s []byte
+		if status.Description != "" {
+			s = protowire.AppendTag(s, 2, protowire.BytesType)
+			s = protowire.AppendString(s, status.Description)
+		}
+		code := uint64(1)
+		if status.Code == codes.Error {
+			code = 2
+		}
+		s = protowire.AppendTag(s, 3, protowire.VarintType)
+		s = protowire.AppendVarint(s, code)
+		b = appendMessage(b, 15, s)
+	}
+	return b
+}
+
+// encodeAttribute encodes a KeyValue. Slices are encoded as their string representation.
+func encodeAttribute(kv attribute.KeyValue) []byte {
+	// KeyValue.key = 1, KeyValue.value = 2
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, string(kv.Key))
+
+	var value []byte
+	switch kv.Value.Type() {
+	case attribute.BOOL:
+		// AnyValue.bool_value = 2
+		value = protowire.AppendTag(nil, 2, protowire.VarintType)
+		value = protowire.AppendVarint(value, protowire.EncodeBool(kv.Value.AsBool()))
+	case attribute.INT64:
+		// AnyValue.int_value = 3
+		value = protowire.AppendTag(nil, 3, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(kv.Value.AsInt64()))
+	case attribute.FLOAT64:
+		// AnyValue.double_value = 4
+		value = protowire.AppendTag(nil, 4, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(kv.Value.AsFloat64()))
+	default:
+		value = encodeStringValue(kv.Value.Emit())
+	}
+	return appendMessage(b, 2, value)
+}
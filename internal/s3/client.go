@@ -0,0 +1,294 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config configures access to a bucket in an S3-compatible object storage.
+type Config struct {
+	// Endpoint is the URL of the object storage, e.g. https://s3.us-east-1.amazonaws.com, or
+	// http://minio:9000. Buckets are addressed by path, e.g. https://endpoint/bucket/key.
+	Endpoint string
+	// Region is used to sign requests. Most S3-compatible object storages accept us-east-1.
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// HTTPClient is used to send requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// Client is a minimal client for the S3 API, supporting only the operations needed to upload
+// objects. Requests are signed with AWS Signature Version 4.
+type Client struct {
+	config Config
+}
+
+// NewClient returns a Client for the bucket.
+func NewClient(config Config) *Client {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &Client{config: config}
+}
+
+// Part identifies an uploaded part of a multipart upload.
+type Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// PutObject uploads an object in a single request, and returns its ETag. The object storage
+// verifies the content against its MD5 checksum.
+func (c *Client) PutObject(ctx context.Context, key string, body []byte) (string, error) {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, body, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to put object %q: %w", key, err)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// CreateMultipartUpload starts a multipart upload, and returns its ID.
+func (c *Client) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload for object %q: %w", key, err)
+	}
+	result := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err := xml.Unmarshal(resp.body, &result); err != nil {
+		return "", fmt.Errorf("failed to parse create multipart upload response: %w", err)
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart uploads one part of a multipart upload. The object storage verifies the content
+// against its MD5 checksum.
+func (c *Client) UploadPart(
+	ctx context.Context,
+	key, uploadID string,
+	partNumber int,
+	body []byte,
+) (Part, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	resp, err := c.do(ctx, http.MethodPut, key, query, body, true)
+	if err != nil {
+		return Part{}, fmt.Errorf("failed to upload part %d of object %q: %w", partNumber, key, err)
+	}
+	return Part{PartNumber: partNumber, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// CompleteMultipartUpload completes a multipart upload, and returns the ETag of the object.
+func (c *Client) CompleteMultipartUpload(
+	ctx context.Context,
+	key, uploadID string,
+	parts []Part,
+) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []Part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize complete multipart upload request: %w", err)
+	}
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload of object %q: %w", key, err)
+	}
+	// The object storage can report an error after it has responded with status 200.
+	if err := parseError(resp.body); err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload of object %q: %w", key, err)
+	}
+	result := struct {
+		ETag string `xml:"ETag"`
+	}{}
+	if err := xml.Unmarshal(resp.body, &result); err != nil {
+		return "", fmt.Errorf("failed to parse complete multipart upload response: %w", err)
+	}
+	return result.ETag, nil
+}
+
+// AbortMultipartUpload aborts a multipart upload, and removes its uploaded parts.
+func (c *Client) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, false)
+	if err != nil {
+		return fmt.Errorf("failed to abort multipart upload of object %q: %w", key, err)
+	}
+	return nil
+}
+
+// Error is an error response from the object storage.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func parseError(body []byte) error {
+	if !bytes.Contains(body, []byte("<Error>")) {
+		return nil
+	}
+	e := &Error{StatusCode: http.StatusOK}
+	if err := xml.Unmarshal(body, e); err != nil {
+		return fmt.Errorf("failed to parse error response: %w", err)
+	}
+	return e
+}
+
+type response struct {
+	*http.Response
+	body []byte
+}
+
+func (c *Client) do(
+	ctx context.Context,
+	method, key string,
+	query url.Values,
+	body []byte,
+	withMD5 bool,
+) (*response, error) {
+	rawURL := strings.TrimSuffix(c.config.Endpoint, "/") +
+		"/" + escapePath(c.config.Bucket) +
+		"/" + escapePath(key)
+	if len(query) > 0 {
+		rawURL += "?" + canonicalQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if withMD5 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	c.sign(req, body, time.Now())
+
+	httpResp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = httpResp.Body.Close()
+	}()
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if httpResp.StatusCode/100 != 2 {
+		e := &Error{StatusCode: httpResp.StatusCode}
+		_ = xml.Unmarshal(respBody, e)
+		return nil, e
+	}
+	return &response{Response: httpResp, body: respBody}, nil
+}
+
+// sign adds the AWS Signature Version 4 authorization header to the request.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (c *Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, c.config.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.config.SecretAccessKey), date)
+	key = hmacSHA256(key, c.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.config.AccessKeyID,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// canonicalQuery encodes the query as required by Signature Version 4: sorted by key, with
+// spaces encoded as %20.
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// escapePath encodes every byte of the path, except unreserved characters and slashes, as
+// required by Signature Version 4.
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
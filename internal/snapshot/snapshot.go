@@ -0,0 +1,311 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// AnnotationRequest requests a snapshot of a Machine. A snapshot is taken every time the value of
+// the annotation changes, e.g. with
+// kubectl annotate machine m machine-monitor.dlipovetsky.github.io/snapshot-request=$(date +%s).
+const AnnotationRequest = "machine-monitor.dlipovetsky.github.io/snapshot-request"
+
+// DefaultTimeout is the timeout of a command that does not set one.
+const DefaultTimeout = 30 * time.Second
+
+// timeFormat is the format of the snapshot directory names. They sort in the order the snapshots
+// were taken. The fraction has a fixed width, so that it sorts too.
+const timeFormat = "20060102T150405.000000000Z"
+
+// tmpDirectoryPattern is the pattern of the names of the directories that snapshots are written
+// to before they are complete. They are hidden, so that they are not taken for snapshots.
+const tmpDirectoryPattern = ".snapshot-*.tmp"
+
+// Command is a command that is run on a Machine to take a snapshot.
+type Command struct {
+	// Name identifies the command in the snapshot, and names the file with its output.
+	Name string `json:"name"`
+	// Command is run by the shell of the SSH user.
+	Command string `json:"command"`
+	// Privileged commands are run with the privilege strategy that journalctl is run with. The
+	// command must be a single command, not a pipeline.
+	Privileged bool `json:"privileged,omitempty"`
+	// Timeout is how long the command may run. If zero, DefaultTimeout is used.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+// DefaultCommands are the commands that are run if no commands are configured.
+var DefaultCommands = []Command{
+	{Name: "systemctl-failed", Command: "systemctl --failed --no-pager"},
+	{Name: "ip-addr", Command: "ip addr"},
+	{Name: "df", Command: "df -h"},
+	{Name: "crictl-ps", Command: "crictl ps -a", Privileged: true},
+	{Name: "cloud-init-status", Command: "cloud-init status --long", Privileged: true},
+}
+
+var commandNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+// LoadCommands reads a list of commands from a YAML or JSON file, e.g.
+//
+//   - name: df
+//     command: df -h
+//     timeout: 10s
+func LoadCommands(filePath string) ([]Command, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot commands file: %w", err)
+	}
+	commands := []Command{}
+	if err := yaml.UnmarshalStrict(data, &commands); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot commands file: %w", err)
+	}
+	if err := ValidateCommands(commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// ValidateCommands returns an error if a command has no command, or if its name is not unique, or
+// cannot be used as a file name.
+func ValidateCommands(commands []Command) error {
+	names := map[string]bool{}
+	for _, command := range commands {
+		if !commandNameRegexp.MatchString(command.Name) {
+			return fmt.Errorf(
+				"invalid snapshot command name %q: must consist of lower case alphanumeric "+
+					"characters, '-' or '.'",
+				command.Name,
+			)
+		}
+		if names[command.Name] {
+			return fmt.Errorf("duplicate snapshot command name %q", command.Name)
+		}
+		names[command.Name] = true
+		if command.Command == "" {
+			return fmt.Errorf("snapshot command %q has no command", command.Name)
+		}
+	}
+	return nil
+}
+
+// Directory returns the path of the directory with the snapshots of a Machine. Each snapshot is
+// a subdirectory, named after the time it was taken, with a file with the output of each command,
+// and a snapshot.json file that describes the snapshot.
+func Directory(directory, namespace, name string) string {
+	return path.Join(directory, fmt.Sprintf("%s-%s.snapshots", namespace, name))
+}
+
+// Snapshot describes a snapshot.
+type Snapshot struct {
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+	Results []Result  `json:"results"`
+}
+
+// Result describes how a command of a snapshot ran.
+type Result struct {
+	Name    string `json:"name"`
+	Command string `json:"command"`
+	// OutputFile is the name of the file with the output of the command, relative to the
+	// snapshot directory.
+	OutputFile string        `json:"outputFile"`
+	ExitStatus int           `json:"exitStatus"`
+	Duration   time.Duration `json:"duration"`
+	TimedOut   bool          `json:"timedOut,omitempty"`
+	// Error is set if the command could not be run, or did not exit normally.
+	Error string `json:"error,omitempty"`
+}
+
+// Take runs the commands on the remote machine one after another, and stores their combined
+// standard output and standard error in a new snapshot in the directory returned by Directory.
+// A command that fails, or times out, is recorded in the snapshot, and does not stop the
+// remaining commands. The snapshot is written to a temporary directory, and renamed once it is
+// complete, so that a snapshot that is not stored, e.g. because the context is cancelled, leaves
+// nothing behind. Take returns an error if the snapshot is not stored.
+func Take(
+	ctx context.Context,
+	remote *journald.Remote,
+	snapshotsDirectory string,
+	reason string,
+	commands []Command,
+) (_ *Snapshot, err error) {
+	if err := os.MkdirAll(snapshotsDirectory, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshots directory: %w", err)
+	}
+	removeTmpDirectories(ctx, snapshotsDirectory)
+	tmpDirectory, err := os.MkdirTemp(snapshotsDirectory, tmpDirectoryPattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(tmpDirectory)
+		}
+	}()
+
+	snapshot := &Snapshot{Time: time.Now().UTC(), Reason: reason}
+	for _, command := range commands {
+		output, result := run(ctx, remote, command)
+		if ctx.Err() != nil {
+			// The command was interrupted, so its result says nothing about the machine.
+			return nil, fmt.Errorf("snapshot interrupted: %w", context.Cause(ctx))
+		}
+		result.OutputFile = command.Name + ".txt"
+		if err := os.WriteFile(
+			path.Join(tmpDirectory, result.OutputFile),
+			output,
+			0o644,
+		); err != nil {
+			return nil, fmt.Errorf("failed to write output of snapshot command: %w", err)
+		}
+		snapshot.Results = append(snapshot.Results, result)
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize snapshot: %w", err)
+	}
+	if err := os.WriteFile(path.Join(tmpDirectory, "snapshot.json"), data, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+	snapshotDirectory := path.Join(snapshotsDirectory, snapshot.Time.Format(timeFormat))
+	if err := rename(tmpDirectory, snapshotDirectory); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// rename renames the temporary directory of a complete snapshot to the snapshot directory. If a
+// snapshot was taken at the same time, a suffix makes the name unique.
+func rename(tmpDirectory, snapshotDirectory string) error {
+	for i := 0; ; i++ {
+		name := snapshotDirectory
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", snapshotDirectory, i)
+		}
+		// A directory is not renamed over a directory that is not empty, and snapshot
+		// directories are never empty.
+		err := os.Rename(tmpDirectory, name)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to rename snapshot directory: %w", err)
+		}
+	}
+}
+
+// removeTmpDirectories removes the temporary directories of snapshots that were not complete when
+// machine-monitor stopped.
+func removeTmpDirectories(ctx context.Context, snapshotsDirectory string) {
+	tmpDirectories, _ := filepath.Glob(path.Join(snapshotsDirectory, tmpDirectoryPattern))
+	for _, tmpDirectory := range tmpDirectories {
+		if err := os.RemoveAll(tmpDirectory); err != nil {
+			logf.FromContext(ctx).Error(err, "failed to remove incomplete snapshot")
+		}
+	}
+}
+
+// run runs the command on the remote machine, and returns its combined output.
+func run(ctx context.Context, remote *journald.Remote, command Command) ([]byte, Result) {
+	log := logf.FromContext(ctx)
+
+	result := Result{Name: command.Name, Command: command.Command}
+	timeout := command.Timeout.Duration
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	session, err := remote.Client.NewSession()
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create new SSH session: %s", err)
+		return nil, result
+	}
+	defer func() {
+		closeSessionErr := session.Close()
+		if closeSessionErr != nil && closeSessionErr != io.EOF {
+			log.Error(closeSessionErr, "failed to close session")
+		}
+	}()
+
+	commandLine := command.Command
+	if command.Privileged {
+		commandLine = remote.Privilege.Wrap(commandLine)
+		session.Stdin = remote.Privilege.Stdin()
+	}
+	output := &lockedBuffer{}
+	session.Stdout = output
+	session.Stderr = output
+
+	start := time.Now()
+	log.V(1).Info("running command on remote host", "command", commandLine)
+	if err := session.Start(commandLine); err != nil {
+		result.Error = fmt.Sprintf("failed to start command: %s", err)
+		return nil, result
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- session.Wait()
+	}()
+
+	var waitErr error
+	select {
+	case waitErr = <-errCh:
+	case <-ctx.Done():
+		result.TimedOut = ctx.Err() == context.DeadlineExceeded
+		// Not every SSH server delivers signals, so the session is closed as well.
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+		waitErr = <-errCh
+	}
+	result.Duration = time.Since(start)
+
+	exitErr := &ssh.ExitError{}
+	switch {
+	case result.TimedOut:
+		result.Error = fmt.Sprintf("command timed out after %s", timeout)
+	case errors.As(waitErr, &exitErr):
+		result.ExitStatus = exitErr.ExitStatus()
+	case waitErr != nil:
+		result.Error = waitErr.Error()
+	}
+	return output.Bytes(), result
+}
+
+// lockedBuffer is a buffer that is safe for concurrent writes, so that standard output and
+// standard error can be written to it at the same time.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
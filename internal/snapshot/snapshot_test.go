@@ -0,0 +1,213 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeMachine is a commandHandler that outputs the command, and exits with status 3 if the
+// command is "false". The command "sleep" outputs a line, and then runs until it is stopped.
+func fakeMachine(command string, output io.Writer, stopped <-chan struct{}) uint32 {
+	switch command {
+	case "false":
+		return 3
+	case "sleep":
+		_, _ = io.WriteString(output, "sleeping\n")
+		<-stopped
+		return 0
+	default:
+		_, _ = io.WriteString(output, command+"\n")
+		return 0
+	}
+}
+
+// writeSnapshot creates a snapshot directory with a file, as a complete snapshot has.
+func writeSnapshot(directory string) {
+	Expect(os.MkdirAll(directory, 0o755)).To(Succeed())
+	Expect(os.WriteFile(path.Join(directory, "snapshot.json"), []byte("{}"), 0o644)).To(Succeed())
+}
+
+var _ = Describe("Take", func() {
+	var snapshotsDirectory string
+
+	BeforeEach(func() {
+		snapshotsDirectory = path.Join(GinkgoT().TempDir(), "ns-m.snapshots")
+	})
+
+	It("stores the output and the result of every command", func() {
+		remote := newStandInRemote(fakeMachine)
+		commands := []Command{
+			{Name: "uptime", Command: "uptime"},
+			{Name: "fail", Command: "false"},
+		}
+		ctx := context.Background()
+		snapshot, err := Take(ctx, remote, snapshotsDirectory, "requested", commands)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snapshot.Reason).To(Equal("requested"))
+		Expect(snapshot.Results).To(HaveLen(2))
+		Expect(snapshot.Results[0]).To(And(
+			HaveField("Name", "uptime"),
+			HaveField("OutputFile", "uptime.txt"),
+			HaveField("ExitStatus", 0),
+			HaveField("Error", ""),
+		))
+		Expect(snapshot.Results[1]).To(And(
+			HaveField("Name", "fail"),
+			HaveField("ExitStatus", 3),
+			HaveField("Error", ""),
+		))
+
+		snapshotDirectory := path.Join(snapshotsDirectory, snapshot.Time.Format(timeFormat))
+		Expect(os.ReadFile(path.Join(snapshotDirectory, "uptime.txt"))).
+			To(Equal([]byte("uptime\n")))
+		data, err := os.ReadFile(path.Join(snapshotDirectory, "snapshot.json"))
+		Expect(err).NotTo(HaveOccurred())
+		stored := &Snapshot{}
+		Expect(json.Unmarshal(data, stored)).To(Succeed())
+		Expect(stored.Results).To(Equal(snapshot.Results))
+
+		entries, err := os.ReadDir(snapshotsDirectory)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("records the output of a command that timed out, and runs the next command", func() {
+		remote := newStandInRemote(fakeMachine)
+		commands := []Command{
+			{Name: "sleep", Command: "sleep", Timeout: metav1.Duration{Duration: time.Second / 5}},
+			{Name: "uptime", Command: "uptime"},
+		}
+		ctx := context.Background()
+		snapshot, err := Take(ctx, remote, snapshotsDirectory, "requested", commands)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snapshot.Results).To(HaveLen(2))
+		Expect(snapshot.Results[0]).To(And(
+			HaveField("TimedOut", true),
+			HaveField("Error", "command timed out after 200ms"),
+		))
+		Expect(snapshot.Results[1]).To(HaveField("TimedOut", false))
+
+		snapshotDirectory := path.Join(snapshotsDirectory, snapshot.Time.Format(timeFormat))
+		Expect(os.ReadFile(path.Join(snapshotDirectory, "sleep.txt"))).
+			To(Equal([]byte("sleeping\n")))
+	})
+
+	It("leaves nothing behind if it is interrupted", func() {
+		remote := newStandInRemote(fakeMachine)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second/5)
+		defer cancel()
+		_, err := Take(ctx, remote, snapshotsDirectory, "requested", []Command{
+			{Name: "sleep", Command: "sleep"},
+		})
+		Expect(err).To(MatchError(ContainSubstring("snapshot interrupted")))
+		Expect(os.ReadDir(snapshotsDirectory)).To(BeEmpty())
+	})
+
+	It("removes the snapshots that were not complete", func() {
+		Expect(os.MkdirAll(snapshotsDirectory, 0o755)).To(Succeed())
+		tmpDirectory, err := os.MkdirTemp(snapshotsDirectory, tmpDirectoryPattern)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(path.Join(tmpDirectory, "df.txt"), nil, 0o644)).To(Succeed())
+		complete := path.Join(snapshotsDirectory, "20250102T150405.000000000Z")
+		writeSnapshot(complete)
+
+		removeTmpDirectories(context.Background(), snapshotsDirectory)
+		Expect(tmpDirectory).NotTo(BeADirectory())
+		Expect(complete).To(BeADirectory())
+	})
+})
+
+var _ = Describe("rename", func() {
+	It("adds a suffix if a snapshot was taken at the same time", func() {
+		snapshotsDirectory := GinkgoT().TempDir()
+		snapshotDirectory := path.Join(snapshotsDirectory, "20250102T150405.000000000Z")
+		writeSnapshot(snapshotDirectory)
+		writeSnapshot(snapshotDirectory + "-1")
+		tmpDirectory := path.Join(snapshotsDirectory, ".snapshot-1.tmp")
+		writeSnapshot(tmpDirectory)
+
+		Expect(rename(tmpDirectory, snapshotDirectory)).To(Succeed())
+		Expect(snapshotDirectory + "-2").To(BeADirectory())
+		Expect(tmpDirectory).NotTo(BeADirectory())
+		snapshots, err := filepath.Glob(snapshotDirectory + "*")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snapshots).To(HaveLen(3))
+	})
+})
+
+var _ = Describe("LoadCommands", func() {
+	writeCommandsFile := func(content string) string {
+		filePath := path.Join(GinkgoT().TempDir(), "commands.yaml")
+		Expect(os.WriteFile(filePath, []byte(content), 0o644)).To(Succeed())
+		return filePath
+	}
+
+	It("loads commands", func() {
+		commands, err := LoadCommands(writeCommandsFile(
+			"- name: df\n  command: df -h\n  timeout: 10s\n" +
+				"- name: crictl-ps\n  command: crictl ps -a\n  privileged: true\n",
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(commands).To(Equal([]Command{
+			{Name: "df", Command: "df -h", Timeout: metav1.Duration{Duration: 10 * time.Second}},
+			{Name: "crictl-ps", Command: "crictl ps -a", Privileged: true},
+		}))
+	})
+
+	DescribeTable("rejects invalid commands files",
+		func(content, expectedErr string) {
+			_, err := LoadCommands(writeCommandsFile(content))
+			Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+		},
+		Entry("with an unknown field",
+			"- name: df\n  command: df -h\n  sudo: true\n",
+			"failed to parse snapshot commands file"),
+		Entry("that is not a list",
+			"name: df\n",
+			"failed to parse snapshot commands file"),
+		Entry("with an invalid command",
+			"- name: df\n",
+			`snapshot command "df" has no command`),
+	)
+
+	It("returns an error if the file cannot be read", func() {
+		_, err := LoadCommands(path.Join(GinkgoT().TempDir(), "missing.yaml"))
+		Expect(err).To(MatchError(ContainSubstring("failed to read snapshot commands file")))
+	})
+})
+
+var _ = Describe("ValidateCommands", func() {
+	It("accepts the default commands", func() {
+		Expect(ValidateCommands(DefaultCommands)).To(Succeed())
+	})
+
+	DescribeTable("rejects invalid commands",
+		func(commands []Command, expectedErr string) {
+			Expect(ValidateCommands(commands)).To(MatchError(ContainSubstring(expectedErr)))
+		},
+		Entry("without a name",
+			[]Command{{Command: "df"}},
+			`invalid snapshot command name ""`),
+		Entry("with an upper case name",
+			[]Command{{Name: "DF", Command: "df"}},
+			`invalid snapshot command name "DF"`),
+		Entry("with a name that is a path",
+			[]Command{{Name: "../df", Command: "df"}},
+			`invalid snapshot command name "../df"`),
+		Entry("with a duplicate name",
+			[]Command{{Name: "df", Command: "df"}, {Name: "df", Command: "df -h"}},
+			`duplicate snapshot command name "df"`),
+		Entry("without a command",
+			[]Command{{Name: "df"}},
+			`snapshot command "df" has no command`),
+	)
+})
@@ -0,0 +1,71 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// StateFilePath returns the path of the file that records the triggers of the snapshots of a
+// Machine.
+func StateFilePath(directory, namespace, name string) string {
+	return path.Join(directory, fmt.Sprintf("%s-%s.snapshot.json", namespace, name))
+}
+
+// State records the triggers that snapshots were taken for, so that a trigger that is still
+// active, e.g. a failure that the Machine still reports, does not take a snapshot again, not even
+// after a restart.
+type State struct {
+	// Triggers maps each trigger to the time its snapshot was taken.
+	Triggers map[string]time.Time `json:"triggers,omitempty"`
+}
+
+// LoadState reads the snapshot state from a file. If the file does not exist, it returns an
+// empty state.
+func LoadState(filePath string) (*State, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &State{}, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot state file: %w", err)
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot state file: %w", err)
+	}
+	return state, nil
+}
+
+// Taken returns true if a snapshot was taken for the trigger.
+func (s *State) Taken(trigger string) bool {
+	_, ok := s.Triggers[trigger]
+	return ok
+}
+
+// Record records that a snapshot was taken for the trigger.
+func (s *State) Record(trigger string, at time.Time) {
+	if s.Triggers == nil {
+		s.Triggers = map[string]time.Time{}
+	}
+	s.Triggers[trigger] = at
+}
+
+// Save writes the state to a file. The file is replaced atomically.
+func (s *State) Save(filePath string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to serialize snapshot state: %w", err)
+	}
+	tmpFilePath := filePath + ".tmp"
+	if err := os.WriteFile(tmpFilePath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write snapshot state file: %w", err)
+	}
+	if err := os.Rename(tmpFilePath, filePath); err != nil {
+		return fmt.Errorf("failed to replace snapshot state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package snapshot
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+func TestSnapshot(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Snapshot Suite")
+}
+
+// commandHandler runs a command on the stand-in SSH server, writes its output, and returns its
+// exit status. The stopped channel is closed once the command is signalled, or its session is
+// closed.
+type commandHandler func(command string, output io.Writer, stopped <-chan struct{}) uint32
+
+// newStandInRemote starts an SSH server that hands the commands it is asked to run to the
+// handler, and returns a Remote connected to it, with the privilege strategy none. The server is
+// stopped when the spec ends.
+func newStandInRemote(handler commandHandler) *journald.Remote {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	Expect(err).NotTo(HaveOccurred())
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(listener.Close)
+	go serve(listener, config, handler)
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(client.Close)
+	return &journald.Remote{
+		Client:    client,
+		Privilege: journald.Privilege{Strategy: journald.PrivilegeNone},
+	}
+}
+
+func serve(listener net.Listener, config *ssh.ServerConfig, handler commandHandler) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer GinkgoRecover()
+			_, channels, requests, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+				go session(channel, requests, handler)
+			}
+		}()
+	}
+}
+
+// session runs the command of an exec request, until it exits, or is stopped.
+func session(channel ssh.Channel, requests <-chan *ssh.Request, handler commandHandler) {
+	stopped := make(chan struct{})
+	stop := sync.OnceFunc(func() { close(stopped) })
+	defer stop()
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			command := string(request.Payload[4:])
+			_ = request.Reply(true, nil)
+			go func() {
+				defer func() { _ = channel.Close() }()
+				exitStatus := handler(command, channel, stopped)
+				status := make([]byte, 4)
+				binary.BigEndian.PutUint32(status, exitStatus)
+				_, _ = channel.SendRequest("exit-status", false, status)
+			}()
+		case "signal":
+			stop()
+		default:
+			_ = request.Reply(false, nil)
+		}
+	}
+}
@@ -3,8 +3,24 @@ package ssh
 import (
 	"context"
 	"fmt"
+	"net"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/dlipovetsky/machine-monitor/internal/tracing"
+)
+
+// dialTimeout is how long to wait for the TCP connection to a machine, or its bastion server.
+const dialTimeout = 30 * time.Second
+
+// Span attribute keys.
+const (
+	// AttributeAddress is the address that is dialed.
+	AttributeAddress = "ssh.address"
+	// AttributeBastionAddress is the address of the bastion server.
+	AttributeBastionAddress = "ssh.bastion.address"
 )
 
 // Client is an alias for the ssh.Client type, so that users can import only this package.
@@ -18,14 +34,10 @@ func NewClient(ctx context.Context,
 	*ssh.Client,
 	error,
 ) {
-	client, err := DialContext(
-		ctx,
-		"tcp",
-		fmt.Sprintf("%s:%d", machineHost, machinePort),
-		machineConfig,
-	)
+	machineAddress := fmt.Sprintf("%s:%d", machineHost, machinePort)
+	client, err := DialContext(ctx, "tcp", machineAddress, machineConfig)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing machine: %w", err)
+		return nil, fmt.Errorf("error dialing machine: %w", classifyDialError(machineAddress, err))
 	}
 	return client, nil
 }
@@ -39,40 +51,64 @@ func NewClientWithBastion(
 	machineHost string,
 	machinePort int,
 ) (
-	*ssh.Client,
-	error,
+	_ *ssh.Client,
+	err error,
 ) {
-	bastionClient, err := DialContext(
-		ctx,
-		"tcp",
-		fmt.Sprintf("%s:%d", bastionHost, bastionPort),
-		bastionConfig,
+	bastionAddress := fmt.Sprintf("%s:%d", bastionHost, bastionPort)
+	machineAddress := fmt.Sprintf("%s:%d", machineHost, machinePort)
+	ctx, span := tracing.Start(ctx, "ssh.NewClientWithBastion",
+		attribute.String(AttributeAddress, machineAddress),
+		attribute.String(AttributeBastionAddress, bastionAddress),
 	)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	bastionClient, err := DialContext(ctx, "tcp", bastionAddress, bastionConfig)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing bastion: %w", err)
+		return nil, fmt.Errorf("error dialing bastion: %w", classifyDialError(bastionAddress, err))
 	}
 
-	bastionConn, err := bastionClient.DialContext(
-		ctx,
-		"tcp",
-		fmt.Sprintf("%s:%d", machineHost, machinePort),
-	)
+	bastionConn, err := bastionClient.DialContext(ctx, "tcp", machineAddress)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing machine via bastion: %w", err)
+		_ = bastionClient.Close()
+		return nil, fmt.Errorf(
+			"error dialing machine via bastion: %w",
+			classifyDialError(machineAddress, err),
+		)
 	}
 
-	machineConn, chans, reqs, err := ssh.NewClientConn(
-		bastionConn,
-		fmt.Sprintf("%s:%d", machineHost, machinePort),
-		machineConfig,
-	)
+	span.AddEvent("connected to machine via bastion")
+
+	machineConn, chans, reqs, err := handshake(ctx, bastionConn, machineAddress, machineConfig)
 	if err != nil {
-		return nil, fmt.Errorf("error creating new client connection: %w", err)
+		_ = bastionClient.Close()
+		return nil, fmt.Errorf(
+			"error creating new client connection: %w",
+			classifyDialError(machineAddress, err),
+		)
 	}
 
 	return ssh.NewClient(machineConn, chans, reqs), nil
 }
 
+// handshake creates a client connection to the machine over the connection, in a span of its
+// own, so that the machine handshake can be told apart from the bastion dial.
+func handshake(
+	ctx context.Context,
+	conn net.Conn,
+	machineAddress string,
+	machineConfig *ssh.ClientConfig,
+) (_ ssh.Conn, _ <-chan ssh.NewChannel, _ <-chan *ssh.Request, err error) {
+	_, span := tracing.Start(ctx, "ssh.Handshake",
+		attribute.String(AttributeAddress, machineAddress),
+	)
+	defer func() {
+		tracing.End(span, err)
+	}()
+	return ssh.NewClientConn(conn, machineAddress, machineConfig)
+}
+
 func NewSSHConfig(
 	user string,
 	privateKey []byte,
@@ -86,6 +122,7 @@ func NewSSHConfig(
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: checkHostKey(ssh.InsecureIgnoreHostKey()),
+		Timeout:         dialTimeout,
 	}, nil
 }
@@ -8,7 +8,10 @@ import (
 	"context"
 	"net"
 
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/dlipovetsky/machine-monitor/internal/tracing"
 )
 
 // NOTE This code is from https://github.com/golang/crypto/commit/29643602415fafeae2dbf472db6a3956732571bd,
@@ -27,7 +30,13 @@ func DialContext(
 	ctx context.Context,
 	network, addr string,
 	config *ssh.ClientConfig,
-) (*Client, error) {
+) (_ *Client, err error) {
+	// The span is not part of the upstream code.
+	ctx, span := tracing.Start(ctx, "ssh.DialContext", attribute.String(AttributeAddress, addr))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
 	d := net.Dialer{
 		Timeout: config.Timeout,
 	}
@@ -35,6 +44,7 @@ func DialContext(
 	if err != nil {
 		return nil, err
 	}
+	span.AddEvent("connected")
 	type result struct {
 		client *Client
 		err    error
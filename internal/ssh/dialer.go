@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Dialer creates SSH clients for machines, through a bastion server if one is configured.
+type Dialer struct {
+	Port       int
+	User       string
+	PrivateKey []byte
+
+	// BastionHost is the host of the bastion server. If empty, machines are dialed directly.
+	BastionHost       string
+	BastionPort       int
+	BastionUser       string
+	BastionPrivateKey []byte
+}
+
+// Dial returns a client for the machine.
+func (d *Dialer) Dial(ctx context.Context, machineHost string) (*Client, error) {
+	log := logf.FromContext(ctx)
+
+	machineSSHConfig, err := NewSSHConfig(d.User, d.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH config: %w", err)
+	}
+
+	if d.BastionHost == "" {
+		log.V(1).Info("creating SSH client without bastion",
+			"machineHost", machineHost,
+			"machinePort", d.Port,
+		)
+		client, err := NewClient(ctx, machineSSHConfig, machineHost, d.Port)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SSH client: %w", err)
+		}
+		return client, nil
+	}
+
+	log.V(1).Info("creating SSH client with bastion",
+		"bastionHost", d.BastionHost,
+		"bastionPort", d.BastionPort,
+		"bastionUser", d.BastionUser,
+		"machineHost", machineHost,
+		"machinePort", d.Port,
+	)
+	bastionSSHConfig, err := NewSSHConfig(d.BastionUser, d.BastionPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH config: %w", err)
+	}
+	client, err := NewClientWithBastion(
+		ctx,
+		bastionSSHConfig,
+		d.BastionHost,
+		d.BastionPort,
+		machineSSHConfig,
+		machineHost,
+		d.Port,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH client with bastion: %w", err)
+	}
+	return client, nil
+}
@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DialErrorKind is the class of a failure to dial a machine, or its bastion server.
+type DialErrorKind string
+
+const (
+	// DialErrorRefused means that nothing accepts connections at the address, e.g. because the
+	// machine is booting, and sshd is not up yet.
+	DialErrorRefused DialErrorKind = "ConnectionRefused"
+	// DialErrorTimeout means that the connection, or the handshake, timed out.
+	DialErrorTimeout DialErrorKind = "Timeout"
+	// DialErrorHandshake means that the SSH handshake failed before authentication, e.g. because
+	// sshd dropped the connection, having too many unauthenticated connections.
+	DialErrorHandshake DialErrorKind = "Handshake"
+	// DialErrorAuth means that sshd rejected the user, or the private key.
+	DialErrorAuth DialErrorKind = "AuthenticationFailed"
+	// DialErrorHostKey means that the host key of the server was rejected.
+	DialErrorHostKey DialErrorKind = "HostKeyRejected"
+)
+
+// DialError reports a failure to dial a machine, or its bastion server.
+type DialError struct {
+	Kind DialErrorKind
+	// Address is the address that failed, either of the machine, or of the bastion server.
+	Address string
+	Err     error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("failed to dial %s (%s): %s", e.Address, e.Kind, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Transient returns true if retrying the dial soon may succeed.
+func (e *DialError) Transient() bool {
+	return e.Kind == DialErrorTimeout || e.Kind == DialErrorHandshake
+}
+
+// DialErrorKindOf returns the kind of the DialError that err is, or wraps, or an empty string.
+func DialErrorKindOf(err error) DialErrorKind {
+	dialErr := &DialError{}
+	if !errors.As(err, &dialErr) {
+		return ""
+	}
+	return dialErr.Kind
+}
+
+// hostKeyError marks an error returned by the host key callback.
+type hostKeyError struct {
+	err error
+}
+
+func (e *hostKeyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *hostKeyError) Unwrap() error {
+	return e.err
+}
+
+// checkHostKey returns a host key callback that marks the errors of the callback, so that they
+// can be told apart from other handshake failures.
+func checkHostKey(callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := callback(hostname, remote, key); err != nil {
+			return &hostKeyError{err: err}
+		}
+		return nil
+	}
+}
+
+// classifyDialError returns a DialError with the kind of the error. Errors of the context are
+// returned unchanged.
+func classifyDialError(address string, err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	dialErr := &DialError{Address: address, Err: err}
+	var netErr net.Error
+	var openChannelErr *ssh.OpenChannelError
+	var hostKeyErr *hostKeyError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		dialErr.Kind = DialErrorRefused
+	case errors.As(err, &openChannelErr) && openChannelErr.Reason == ssh.ConnectionFailed:
+		// The bastion server could not connect to the machine.
+		dialErr.Kind = DialErrorRefused
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		dialErr.Kind = DialErrorTimeout
+	case errors.As(err, &hostKeyErr):
+		dialErr.Kind = DialErrorHostKey
+	case strings.Contains(err.Error(), "ssh: unable to authenticate"):
+		// The ssh package does not export an error for this.
+		dialErr.Kind = DialErrorAuth
+	default:
+		dialErr.Kind = DialErrorHandshake
+	}
+	return dialErr
+}
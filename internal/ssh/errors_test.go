@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+// dialOpError returns the error of a failed connect, as net.Dial returns it.
+func dialOpError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+var _ = Describe("classifyDialError", func() {
+	DescribeTable("classifies the error",
+		func(err error, kind DialErrorKind, transient bool) {
+			classified := classifyDialError("machine:22", fmt.Errorf("failed: %w", err))
+			dialErr := &DialError{}
+			Expect(errors.As(classified, &dialErr)).To(BeTrue())
+			Expect(dialErr.Kind).To(Equal(kind))
+			Expect(dialErr.Address).To(Equal("machine:22"))
+			Expect(dialErr.Transient()).To(Equal(transient))
+			Expect(classified).To(MatchError(err))
+		},
+		Entry("connection refused", dialOpError(syscall.ECONNREFUSED), DialErrorRefused, false),
+		Entry("host unreachable", dialOpError(syscall.EHOSTUNREACH), DialErrorRefused, false),
+		Entry("network unreachable", dialOpError(syscall.ENETUNREACH), DialErrorRefused, false),
+		Entry("bastion could not connect",
+			&ssh.OpenChannelError{Reason: ssh.ConnectionFailed, Message: "connect failed"},
+			DialErrorRefused, false),
+		Entry("deadline exceeded", context.DeadlineExceeded, DialErrorTimeout, true),
+		Entry("network timeout",
+			&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}},
+			DialErrorTimeout, true),
+		Entry("host key rejected",
+			&hostKeyError{err: errors.New("knownhosts: key mismatch")},
+			DialErrorHostKey, false),
+		Entry("authentication failed",
+			errors.New("ssh: handshake failed: ssh: unable to authenticate, "+
+				"attempted methods [none publickey], no supported methods remain"),
+			DialErrorAuth, false),
+		Entry("connection dropped during handshake",
+			errors.New("ssh: handshake failed: EOF"),
+			DialErrorHandshake, true),
+		Entry("bastion channel rejected for another reason",
+			&ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "prohibited"},
+			DialErrorHandshake, true),
+	)
+
+	It("returns a cancelled context unchanged", func() {
+		err := fmt.Errorf("failed: %w", context.Canceled)
+		Expect(classifyDialError("machine:22", err)).To(BeIdenticalTo(err))
+		Expect(DialErrorKindOf(err)).To(BeEmpty())
+	})
+})
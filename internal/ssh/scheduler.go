@@ -0,0 +1,199 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Defaults of the Scheduler. sshd drops new connections once 10 are unauthenticated, by default,
+// so the bastion concurrency stays below that.
+const (
+	DefaultDialRate           = 10
+	DefaultDialBurst          = 10
+	DefaultBastionConcurrency = 8
+	DefaultDialRetries        = 3
+	DefaultRetryBaseDelay     = time.Second
+	DefaultRetryMaxDelay      = 30 * time.Second
+)
+
+// MaxDialRetries is the most times that a Scheduler retries a dial. Beyond it, the Machine is
+// better requeued, so that its reconcile does not hold a worker.
+const MaxDialRetries = 10
+
+var dialQueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "machine_monitor_ssh_dial_queue_depth",
+		Help: "The number of SSH dials waiting for the dial rate limit or a bastion dial slot, " +
+			"by bastion. The bastion is empty for Machines that are dialed directly.",
+	},
+	[]string{"bastion"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(dialQueueDepth)
+}
+
+// Scheduler limits how fast SSH clients are dialed, so that many Machines that are dialed at
+// once, e.g. when machine-monitor starts, do not overwhelm the SSH servers. Dials are limited by
+// a rate that applies to every dial, and by the number of dials through the same bastion at a
+// time. A dial that fails with a transient error is retried with a jittered delay. A Scheduler is
+// safe for concurrent use.
+type Scheduler struct {
+	limiter            *rate.Limiter
+	bastionConcurrency int
+	retries            int
+	retryBaseDelay     time.Duration
+	retryMaxDelay      time.Duration
+	// dial creates the client. It is the dial of the Dialer, except in tests.
+	dial func(dialer *Dialer, ctx context.Context, machineHost string) (*Client, error)
+
+	mu sync.Mutex
+	// bastions limit the number of dials through each bastion at a time.
+	bastions map[string]chan struct{}
+	// queued is the number of dials waiting, by bastion.
+	queued map[string]int
+}
+
+// NewScheduler returns a Scheduler that starts at most dialRate dials per second, with bursts of
+// up to dialBurst dials, and at most bastionConcurrency dials through the same bastion at a
+// time, or any number if bastionConcurrency is zero. A dial that fails with a transient error is
+// retried up to retries times, but at most MaxDialRetries times.
+func NewScheduler(
+	dialRate float64,
+	dialBurst int,
+	bastionConcurrency int,
+	retries int,
+) *Scheduler {
+	return &Scheduler{
+		limiter:            rate.NewLimiter(rate.Limit(dialRate), dialBurst),
+		bastionConcurrency: bastionConcurrency,
+		retries:            min(retries, MaxDialRetries),
+		retryBaseDelay:     DefaultRetryBaseDelay,
+		retryMaxDelay:      DefaultRetryMaxDelay,
+		dial:               (*Dialer).Dial,
+		bastions:           map[string]chan struct{}{},
+		queued:             map[string]int{},
+	}
+}
+
+// QueueDepth returns the number of dials waiting for the dial rate limit or a bastion dial slot.
+func (s *Scheduler) QueueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	depth := 0
+	for _, queued := range s.queued {
+		depth += queued
+	}
+	return depth
+}
+
+// Dial returns a client for the machine, created by the dialer once the limits allow it.
+func (s *Scheduler) Dial(ctx context.Context, dialer *Dialer, machineHost string) (*Client, error) {
+	log := logf.FromContext(ctx)
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var client *Client
+		client, err = s.dialOnce(ctx, dialer, machineHost)
+		if err == nil {
+			return client, nil
+		}
+		dialErr := &DialError{}
+		if ctx.Err() != nil || attempt >= s.retries ||
+			!errors.As(err, &dialErr) || !dialErr.Transient() {
+			break
+		}
+		delay := s.retryDelay(attempt)
+		log.V(1).Info("retrying SSH dial", "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case <-time.After(delay):
+		}
+	}
+	return nil, err
+}
+
+// retryDelay returns the delay before the retry that follows the attempt. The delay doubles with
+// each attempt, up to the max delay. Full jitter spreads the retries of dials that failed
+// together.
+func (s *Scheduler) retryDelay(attempt int) time.Duration {
+	delay := s.retryMaxDelay
+	// Shifting the max delay right, instead of the base delay left, cannot overflow.
+	if attempt < 63 && s.retryBaseDelay <= s.retryMaxDelay>>attempt {
+		delay = s.retryBaseDelay << attempt
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return rand.N(delay)
+}
+
+func (s *Scheduler) dialOnce(
+	ctx context.Context,
+	dialer *Dialer,
+	machineHost string,
+) (*Client, error) {
+	bastion := ""
+	if dialer.BastionHost != "" {
+		bastion = net.JoinHostPort(dialer.BastionHost, strconv.Itoa(dialer.BastionPort))
+	}
+
+	s.enqueue(bastion, 1)
+	queued := true
+	defer func() {
+		if queued {
+			s.enqueue(bastion, -1)
+		}
+	}()
+
+	if bastion != "" && s.bastionConcurrency > 0 {
+		slots := s.bastionSlots(bastion)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+		defer func() {
+			<-slots
+		}()
+	}
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("failed to wait for the SSH dial rate limit: %w", err)
+	}
+	s.enqueue(bastion, -1)
+	queued = false
+
+	return s.dial(dialer, ctx, machineHost)
+}
+
+// bastionSlots returns the semaphore of the bastion.
+func (s *Scheduler) bastionSlots(bastion string) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slots, ok := s.bastions[bastion]
+	if !ok {
+		slots = make(chan struct{}, s.bastionConcurrency)
+		s.bastions[bastion] = slots
+	}
+	return slots
+}
+
+// enqueue adds delta to the number of dials waiting for the bastion.
+func (s *Scheduler) enqueue(bastion string, delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued[bastion] += delta
+	dialQueueDepth.WithLabelValues(bastion).Set(float64(s.queued[bastion]))
+}
@@ -0,0 +1,203 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// failingDial returns a dial that fails with the errors, in order, and then succeeds. It counts
+// the dials.
+func failingDial(
+	dials *atomic.Int32,
+	errs ...error,
+) func(*Dialer, context.Context, string) (*Client, error) {
+	return func(*Dialer, context.Context, string) (*Client, error) {
+		n := int(dials.Add(1))
+		if n <= len(errs) {
+			return nil, errs[n-1]
+		}
+		return &Client{}, nil
+	}
+}
+
+// blockingDial returns a dial that blocks until release is closed, and reports each dial that
+// started on started.
+func blockingDial(
+	started chan<- string,
+	release <-chan struct{},
+) func(*Dialer, context.Context, string) (*Client, error) {
+	return func(_ *Dialer, ctx context.Context, machineHost string) (*Client, error) {
+		started <- machineHost
+		select {
+		case <-release:
+			return &Client{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func dialError(kind DialErrorKind) error {
+	return &DialError{Kind: kind, Address: "machine:22", Err: errors.New(string(kind))}
+}
+
+var _ = Describe("Scheduler", func() {
+	var scheduler *Scheduler
+
+	BeforeEach(func() {
+		scheduler = NewScheduler(1000, 1000, 1, 3)
+		scheduler.retryBaseDelay = time.Millisecond
+		scheduler.retryMaxDelay = 4 * time.Millisecond
+	})
+
+	Describe("retries", func() {
+		It("retries transient errors", func() {
+			dials := &atomic.Int32{}
+			scheduler.dial = failingDial(dials,
+				dialError(DialErrorTimeout),
+				dialError(DialErrorHandshake),
+			)
+			client, err := scheduler.Dial(context.Background(), &Dialer{}, "machine")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client).NotTo(BeNil())
+			Expect(dials.Load()).To(BeEquivalentTo(3))
+		})
+
+		DescribeTable("does not retry other errors",
+			func(err error) {
+				dials := &atomic.Int32{}
+				scheduler.dial = failingDial(dials, err)
+				_, dialErr := scheduler.Dial(context.Background(), &Dialer{}, "machine")
+				Expect(dialErr).To(MatchError(err))
+				Expect(dials.Load()).To(BeEquivalentTo(1))
+			},
+			Entry("connection refused", dialError(DialErrorRefused)),
+			Entry("authentication failed", dialError(DialErrorAuth)),
+			Entry("host key rejected", dialError(DialErrorHostKey)),
+			Entry("not a dial error", errors.New("failed to create SSH config")),
+		)
+
+		It("gives up after the retries", func() {
+			dials := &atomic.Int32{}
+			errs := make([]error, 10)
+			for i := range errs {
+				errs[i] = dialError(DialErrorTimeout)
+			}
+			scheduler.dial = failingDial(dials, errs...)
+			_, err := scheduler.Dial(context.Background(), &Dialer{}, "machine")
+			Expect(DialErrorKindOf(err)).To(Equal(DialErrorTimeout))
+			Expect(dials.Load()).To(BeEquivalentTo(4))
+		})
+
+		It("stops retrying when the context is done", func() {
+			scheduler.retryBaseDelay = time.Hour
+			scheduler.retryMaxDelay = time.Hour
+			dials := &atomic.Int32{}
+			scheduler.dial = failingDial(dials, dialError(DialErrorTimeout))
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := scheduler.Dial(ctx, &Dialer{}, "machine")
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(dials.Load()).To(BeEquivalentTo(1))
+		})
+
+		It("retries at most MaxDialRetries times", func() {
+			Expect(NewScheduler(1, 1, 1, 1000).retries).To(Equal(MaxDialRetries))
+		})
+	})
+
+	Describe("retryDelay", func() {
+		It("doubles the delay up to the max delay", func() {
+			scheduler.retryBaseDelay = time.Second
+			scheduler.retryMaxDelay = 30 * time.Second
+			for attempt := range 5 {
+				Expect(scheduler.retryDelay(attempt)).To(
+					BeNumerically("<", time.Second<<attempt))
+			}
+			for _, attempt := range []int{5, 32, 33, 62, 63, 64, 1000} {
+				Expect(scheduler.retryDelay(attempt)).To(
+					BeNumerically("<", 30*time.Second), "attempt %d", attempt)
+			}
+		})
+
+		It("does not delay if the delay is zero", func() {
+			scheduler.retryBaseDelay = 0
+			scheduler.retryMaxDelay = 0
+			Expect(scheduler.retryDelay(0)).To(BeZero())
+			Expect(scheduler.retryDelay(100)).To(BeZero())
+		})
+	})
+
+	Describe("limits", func() {
+		It("dials through the same bastion one at a time", func() {
+			started := make(chan string, 2)
+			release := make(chan struct{})
+			scheduler.dial = blockingDial(started, release)
+			dialer := &Dialer{BastionHost: "bastion", BastionPort: 22}
+
+			done := make(chan error, 2)
+			for _, host := range []string{"machine-1", "machine-2"} {
+				go func() {
+					_, err := scheduler.Dial(context.Background(), dialer, host)
+					done <- err
+				}()
+			}
+			Eventually(started).Should(Receive())
+			Eventually(scheduler.QueueDepth).Should(Equal(1))
+			Consistently(started, 50*time.Millisecond).ShouldNot(Receive())
+
+			close(release)
+			Eventually(started).Should(Receive())
+			Eventually(done).Should(Receive(BeNil()))
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(scheduler.QueueDepth()).To(BeZero())
+		})
+
+		It("does not limit dials through different bastions, or without a bastion", func() {
+			started := make(chan string, 3)
+			release := make(chan struct{})
+			defer close(release)
+			scheduler.dial = blockingDial(started, release)
+
+			for _, dialer := range []*Dialer{
+				{BastionHost: "bastion-1", BastionPort: 22},
+				{BastionHost: "bastion-2", BastionPort: 22},
+				{},
+			} {
+				go func() {
+					_, _ = scheduler.Dial(context.Background(), dialer, "machine")
+				}()
+			}
+			for range 3 {
+				Eventually(started).Should(Receive())
+			}
+			Expect(scheduler.QueueDepth()).To(BeZero())
+		})
+
+		It("waits for the dial rate limit", func() {
+			scheduler = NewScheduler(0.001, 1, 0, 0)
+			dials := &atomic.Int32{}
+			scheduler.dial = failingDial(dials)
+			_, err := scheduler.Dial(context.Background(), &Dialer{}, "machine-1")
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				_, err := scheduler.Dial(ctx, &Dialer{}, "machine-2")
+				done <- err
+			}()
+			Consistently(done, 50*time.Millisecond).ShouldNot(Receive())
+			Expect(scheduler.QueueDepth()).To(Equal(1))
+			cancel()
+			Eventually(done).Should(Receive(HaveOccurred()))
+			Expect(dials.Load()).To(BeEquivalentTo(1))
+			Expect(scheduler.QueueDepth()).To(BeZero())
+		})
+	})
+})
@@ -0,0 +1,14 @@
+package ssh
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSSH(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "SSH Suite")
+}
@@ -0,0 +1,84 @@
+package timeline
+
+import (
+	"strings"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+)
+
+// Milestone is a well-known step in the bootstrap of a Machine.
+type Milestone string
+
+const (
+	NetworkOnline    Milestone = "network-online"
+	SSHDStarted      Milestone = "sshd-started"
+	CloudInitLocal   Milestone = "cloud-init-local"
+	CloudInitNetwork Milestone = "cloud-init-network"
+	CloudInitConfig  Milestone = "cloud-init-config"
+	CloudInitFinal   Milestone = "cloud-init-final"
+	ContainerdReady  Milestone = "containerd-ready"
+	KubeletStarted   Milestone = "kubelet-started"
+	KubeadmPreflight Milestone = "kubeadm-preflight"
+	KubeadmComplete  Milestone = "kubeadm-complete"
+	NodeRegistered   Milestone = "node-registered"
+)
+
+// Milestones lists all milestones, in the order they are expected to be reached during bootstrap.
+var Milestones = []Milestone{
+	NetworkOnline,
+	SSHDStarted,
+	CloudInitLocal,
+	CloudInitNetwork,
+	CloudInitConfig,
+	CloudInitFinal,
+	ContainerdReady,
+	KubeletStarted,
+	KubeadmPreflight,
+	KubeadmComplete,
+	NodeRegistered,
+}
+
+// unitStartedMessageID is the MESSAGE_ID that systemd logs when a unit has started, or, for
+// a oneshot service, when it has finished.
+const unitStartedMessageID = "39f53479d3a045ac8e11786248231fbf"
+
+// unitMilestones maps systemd units to the milestone reached when the unit has started.
+var unitMilestones = map[string]Milestone{
+	"network-online.target":      NetworkOnline,
+	"ssh.service":                SSHDStarted,
+	"sshd.service":               SSHDStarted,
+	"cloud-init-local.service":   CloudInitLocal,
+	"cloud-init.service":         CloudInitNetwork,
+	"cloud-init-network.service": CloudInitNetwork,
+	"cloud-config.service":       CloudInitConfig,
+	"cloud-final.service":        CloudInitFinal,
+	"containerd.service":         ContainerdReady,
+	"kubelet.service":            KubeletStarted,
+}
+
+// messageMilestones maps substrings of messages logged by kubeadm and the kubelet to the
+// milestone they indicate.
+var messageMilestones = []struct {
+	substring string
+	milestone Milestone
+}{
+	{"[preflight] Running pre-flight checks", KubeadmPreflight},
+	{"This node has joined the cluster", KubeadmComplete},
+	{"Your Kubernetes control-plane has initialized successfully", KubeadmComplete},
+	{"Successfully registered node", NodeRegistered},
+}
+
+// Match returns the milestone indicated by the journal entry, if any.
+func Match(entry journald.Entry) (Milestone, bool) {
+	if entry[journald.FieldMessageID] == unitStartedMessageID {
+		milestone, ok := unitMilestones[entry[journald.FieldUnit]]
+		return milestone, ok
+	}
+	message := entry.Message()
+	for _, m := range messageMilestones {
+		if strings.Contains(message, m.substring) {
+			return m.milestone, true
+		}
+	}
+	return "", false
+}
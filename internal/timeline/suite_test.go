@@ -0,0 +1,14 @@
+package timeline_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTimeline(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Timeline Suite")
+}
@@ -0,0 +1,180 @@
+package timeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Event records when a milestone was reached.
+type Event struct {
+	Milestone Milestone `json:"milestone"`
+	Time      time.Time `json:"time"`
+}
+
+// Boot is the list of milestones reached during one boot, in the order they were reached.
+type Boot struct {
+	ID     string  `json:"id"`
+	Events []Event `json:"events"`
+}
+
+// Timeline is the list of boots of a Machine, in the order they were observed.
+type Timeline struct {
+	Boots []Boot `json:"boots"`
+}
+
+// Record adds the milestone to the given boot. It returns false if the milestone was already
+// recorded for the boot, in which case the timeline is not changed.
+func (t *Timeline) Record(bootID string, milestone Milestone, at time.Time) bool {
+	var boot *Boot
+	for i := range t.Boots {
+		if t.Boots[i].ID == bootID {
+			boot = &t.Boots[i]
+			break
+		}
+	}
+	if boot == nil {
+		t.Boots = append(t.Boots, Boot{ID: bootID})
+		boot = &t.Boots[len(t.Boots)-1]
+	}
+	for _, event := range boot.Events {
+		if event.Milestone == milestone {
+			return false
+		}
+	}
+	boot.Events = append(boot.Events, Event{Milestone: milestone, Time: at})
+	return true
+}
+
+// LatestBoot returns the most recently observed boot, or nil if no boot was observed.
+func (t *Timeline) LatestBoot() *Boot {
+	if len(t.Boots) == 0 {
+		return nil
+	}
+	return &t.Boots[len(t.Boots)-1]
+}
+
+// FilePath returns the path of the timeline file of a Machine.
+func FilePath(directory, namespace, name string) string {
+	return path.Join(directory, fmt.Sprintf("%s-%s.timeline.json", namespace, name))
+}
+
+// Load reads a timeline from a file. If the file does not exist, the returned error
+// wraps os.ErrNotExist.
+func Load(filePath string) (*Timeline, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timeline file: %w", err)
+	}
+	t := &Timeline{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("failed to parse timeline file: %w", err)
+	}
+	return t, nil
+}
+
+// Save writes the timeline to a file. The file is replaced atomically, so readers never see a
+// partially written timeline.
+func (t *Timeline) Save(filePath string) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to serialize timeline: %w", err)
+	}
+	tmpFilePath := filePath + ".tmp"
+	if err := os.WriteFile(tmpFilePath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write timeline file: %w", err)
+	}
+	if err := os.Rename(tmpFilePath, filePath); err != nil {
+		return fmt.Errorf("failed to replace timeline file: %w", err)
+	}
+	return nil
+}
+
+// Recorder records the milestones found in a stream of journal entries to a timeline file.
+type Recorder struct {
+	filePath string
+	onRecord func(ctx context.Context, t *Timeline)
+
+	mu       sync.Mutex
+	timeline *Timeline
+}
+
+// NewRecorder returns a Recorder that continues the timeline in the file, if the file exists.
+// After a milestone is recorded and the file is updated, onRecord is called, if it is not nil.
+func NewRecorder(
+	filePath string,
+	onRecord func(ctx context.Context, t *Timeline),
+) (*Recorder, error) {
+	t, err := Load(filePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		t = &Timeline{}
+	}
+	return &Recorder{
+		filePath: filePath,
+		onRecord: onRecord,
+		timeline: t,
+	}, nil
+}
+
+// HandleEntry is a journald.EntryHandler.
+func (r *Recorder) HandleEntry(ctx context.Context, entry journald.Entry) {
+	log := logf.FromContext(ctx)
+
+	milestone, ok := Match(entry)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.timeline.Record(entry.BootID(), milestone, entry.RealtimeTimestamp()) {
+		return
+	}
+	log.V(1).Info("milestone reached", "milestone", milestone, "bootID", entry.BootID())
+	if err := r.timeline.Save(r.filePath); err != nil {
+		log.Error(err, "failed to save timeline")
+	}
+	if r.onRecord != nil {
+		r.onRecord(ctx, r.timeline)
+	}
+}
+
+// AnnotationPrefix is the prefix of the Machine annotations that hold the timeline of the latest
+// boot.
+const AnnotationPrefix = "machine-monitor.dlipovetsky.github.io/"
+
+// BootIDAnnotation is the Machine annotation that holds the ID of the latest boot.
+const BootIDAnnotation = AnnotationPrefix + "boot-id"
+
+// MilestoneAnnotation returns the Machine annotation that holds the time the milestone was
+// reached during the latest boot.
+func MilestoneAnnotation(milestone Milestone) string {
+	return AnnotationPrefix + "milestone." + string(milestone)
+}
+
+// Annotations returns the Machine annotations for the latest boot of the timeline. Milestones
+// not reached during the latest boot have no annotation.
+func (t *Timeline) Annotations() map[string]string {
+	annotations := map[string]string{}
+	boot := t.LatestBoot()
+	if boot == nil {
+		return annotations
+	}
+	annotations[BootIDAnnotation] = boot.ID
+	for _, event := range boot.Events {
+		annotations[MilestoneAnnotation(event.Milestone)] = event.Time.UTC().Format(time.RFC3339)
+	}
+	return annotations
+}
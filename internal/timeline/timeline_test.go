@@ -0,0 +1,147 @@
+package timeline_test
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/dlipovetsky/machine-monitor/internal/journald"
+	"github.com/dlipovetsky/machine-monitor/internal/timeline"
+)
+
+var base = time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+
+// unitStarted returns the entry that systemd logs when the unit has started.
+func unitStarted(unit string) journald.Entry {
+	return journald.Entry{
+		journald.FieldMessageID: "39f53479d3a045ac8e11786248231fbf",
+		journald.FieldUnit:      unit,
+		journald.FieldMessage:   "Started " + unit + ".",
+	}
+}
+
+// logged returns the entry of the boot with the message, logged seconds after base.
+func logged(bootID string, seconds int, message string) journald.Entry {
+	return journald.Entry{
+		journald.FieldBootID: bootID,
+		journald.FieldRealtimeTimestamp: strconv.FormatInt(
+			base.Add(time.Duration(seconds)*time.Second).UnixMicro(),
+			10,
+		),
+		journald.FieldMessage: message,
+	}
+}
+
+var _ = DescribeTable("Match",
+	func(entry journald.Entry, milestone timeline.Milestone, ok bool) {
+		m, matched := timeline.Match(entry)
+		Expect(matched).To(Equal(ok))
+		Expect(m).To(Equal(milestone))
+	},
+	Entry("network-online.target",
+		unitStarted("network-online.target"),
+		timeline.NetworkOnline,
+		true,
+	),
+	Entry("ssh.service", unitStarted("ssh.service"), timeline.SSHDStarted, true),
+	Entry("sshd.service", unitStarted("sshd.service"), timeline.SSHDStarted, true),
+	Entry("cloud-init.service", unitStarted("cloud-init.service"), timeline.CloudInitNetwork, true),
+	Entry("cloud-final.service", unitStarted("cloud-final.service"), timeline.CloudInitFinal, true),
+	Entry("kubelet.service", unitStarted("kubelet.service"), timeline.KubeletStarted, true),
+	Entry("an unknown unit", unitStarted("chronyd.service"), timeline.Milestone(""), false),
+	Entry("a known unit without the started message ID",
+		journald.Entry{journald.FieldUnit: "kubelet.service", journald.FieldMessage: "Stopping"},
+		timeline.Milestone(""),
+		false,
+	),
+	Entry("kubeadm preflight",
+		logged("b", 0, "[preflight] Running pre-flight checks"),
+		timeline.KubeadmPreflight,
+		true,
+	),
+	Entry("a worker that joined",
+		logged("b", 0, "This node has joined the cluster:"),
+		timeline.KubeadmComplete,
+		true,
+	),
+	Entry("a control plane that initialized",
+		logged("b", 0, "Your Kubernetes control-plane has initialized successfully!"),
+		timeline.KubeadmComplete,
+		true,
+	),
+	Entry("a registered node",
+		logged("b", 0, `"Successfully registered node" node="cp-0"`),
+		timeline.NodeRegistered,
+		true,
+	),
+	Entry("an unrelated message", logged("b", 0, "hello"), timeline.Milestone(""), false),
+)
+
+var _ = Describe("Timeline", func() {
+	It("records each milestone once per boot, in the order reached", func() {
+		t := &timeline.Timeline{}
+		Expect(t.Record("one", timeline.NetworkOnline, base)).To(BeTrue())
+		Expect(t.Record("one", timeline.KubeletStarted, base.Add(time.Second))).To(BeTrue())
+		Expect(t.Record("one", timeline.NetworkOnline, base.Add(2*time.Second))).To(BeFalse())
+		Expect(t.Record("two", timeline.NetworkOnline, base.Add(time.Hour))).To(BeTrue())
+
+		Expect(t.Boots).To(Equal([]timeline.Boot{
+			{ID: "one", Events: []timeline.Event{
+				{Milestone: timeline.NetworkOnline, Time: base},
+				{Milestone: timeline.KubeletStarted, Time: base.Add(time.Second)},
+			}},
+			{ID: "two", Events: []timeline.Event{
+				{Milestone: timeline.NetworkOnline, Time: base.Add(time.Hour)},
+			}},
+		}))
+		Expect(t.LatestBoot().ID).To(Equal("two"))
+	})
+
+	It("annotates the milestones of the latest boot", func() {
+		t := &timeline.Timeline{}
+		Expect(t.Annotations()).To(BeEmpty())
+		t.Record("one", timeline.NetworkOnline, base)
+		t.Record("two", timeline.KubeletStarted, base.Add(time.Hour))
+		Expect(t.Annotations()).To(Equal(map[string]string{
+			timeline.BootIDAnnotation:                             "two",
+			timeline.MilestoneAnnotation(timeline.KubeletStarted): "2025-01-02T16:04:05Z",
+		}))
+	})
+
+	It("records the milestones of the entries, and continues the saved timeline", func() {
+		filePath := filepath.Join(GinkgoT().TempDir(), "ns-m.timeline.json")
+		var recorded []*timeline.Timeline
+		recorder, err := timeline.NewRecorder(
+			filePath,
+			func(_ context.Context, t *timeline.Timeline) {
+				recorded = append(recorded, t)
+			},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		for _, entry := range []journald.Entry{
+			logged("one", 1, "hello"),
+			logged("one", 2, "[preflight] Running pre-flight checks"),
+			logged("one", 3, "[preflight] Running pre-flight checks"),
+		} {
+			recorder.HandleEntry(context.Background(), entry)
+		}
+		Expect(recorded).To(HaveLen(1))
+
+		recorder, err = timeline.NewRecorder(filePath, nil)
+		Expect(err).NotTo(HaveOccurred())
+		recorder.HandleEntry(
+			context.Background(),
+			logged("one", 4, "This node has joined the cluster:"),
+		)
+		t, err := timeline.Load(filePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t.Boots).To(Equal([]timeline.Boot{{ID: "one", Events: []timeline.Event{
+			{Milestone: timeline.KubeadmPreflight, Time: base.Add(2 * time.Second)},
+			{Milestone: timeline.KubeadmComplete, Time: base.Add(4 * time.Second)},
+		}}}))
+	})
+})
@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is the name of the instrumentation scope of every span.
+const ScopeName = "github.com/dlipovetsky/machine-monitor"
+
+// ServiceName is the service.name resource attribute of every span.
+const ServiceName = "machine-monitor"
+
+// Start starts a span with the tracer of the global tracer provider. Until a tracer provider is
+// set with otel.SetTracerProvider, spans are not recorded.
+func Start(
+	ctx context.Context,
+	name string,
+	attributes ...attribute.KeyValue,
+) (context.Context, trace.Span) {
+	return otel.Tracer(ScopeName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End records the error, if any, as the status of the span, and ends the span. The cancellation
+// of the context is not an error, because it is how streams stop.
+func End(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// NewTracerProvider returns a tracer provider that exports spans in batches with the exporter.
+// In tests, the exporter can be a tracetest.InMemoryExporter.
+func NewTracerProvider(
+	exporter sdktrace.SpanExporter,
+	options ...sdktrace.BatchSpanProcessorOption,
+) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, options...),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", ServiceName),
+		)),
+	)
+}
@@ -0,0 +1,121 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	cryptossh "golang.org/x/crypto/ssh"
+
+	"github.com/dlipovetsky/machine-monitor/internal/ssh"
+	"github.com/dlipovetsky/machine-monitor/internal/tracing"
+)
+
+// refusedAddress returns a local address where nothing accepts connections.
+func refusedAddress() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	address := listener.Addr().String()
+	Expect(listener.Close()).To(Succeed())
+	return address
+}
+
+var _ = Describe("Tracing", func() {
+	var (
+		exporter *tracetest.InMemoryExporter
+		provider *sdktrace.TracerProvider
+	)
+
+	BeforeEach(func() {
+		exporter = tracetest.NewInMemoryExporter()
+		provider = tracing.NewTracerProvider(exporter)
+		previous := otel.GetTracerProvider()
+		otel.SetTracerProvider(provider)
+		DeferCleanup(func() {
+			otel.SetTracerProvider(previous)
+			Expect(provider.Shutdown(context.Background())).To(Succeed())
+		})
+	})
+
+	spans := func() tracetest.SpanStubs {
+		Expect(provider.ForceFlush(context.Background())).To(Succeed())
+		return exporter.GetSpans()
+	}
+
+	It("records the error as the status of the span", func() {
+		_, span := tracing.Start(context.Background(), "failing", attribute.String("key", "value"))
+		tracing.End(span, errors.New("failed"))
+
+		recorded := spans()
+		Expect(recorded).To(HaveLen(1))
+		Expect(recorded[0].Name).To(Equal("failing"))
+		Expect(recorded[0].Attributes).To(ContainElement(attribute.String("key", "value")))
+		Expect(recorded[0].Status.Code).To(Equal(codes.Error))
+		Expect(recorded[0].Status.Description).To(Equal("failed"))
+		Expect(recorded[0].Resource.Attributes()).To(
+			ContainElement(attribute.String("service.name", tracing.ServiceName)),
+		)
+	})
+
+	It("does not record the cancellation of the context as an error", func() {
+		_, span := tracing.Start(context.Background(), "cancelled")
+		tracing.End(span, context.Canceled)
+
+		recorded := spans()
+		Expect(recorded).To(HaveLen(1))
+		Expect(recorded[0].Status.Code).To(Equal(codes.Unset))
+	})
+
+	It("traces a failed SSH dial", func() {
+		address := refusedAddress()
+		_, err := ssh.DialContext(context.Background(), "tcp", address, &cryptossh.ClientConfig{})
+		Expect(err).To(HaveOccurred())
+
+		recorded := spans()
+		Expect(recorded).To(HaveLen(1))
+		Expect(recorded[0].Name).To(Equal("ssh.DialContext"))
+		Expect(recorded[0].Attributes).To(
+			ContainElement(attribute.String(ssh.AttributeAddress, address)),
+		)
+		Expect(recorded[0].Status.Code).To(Equal(codes.Error))
+	})
+
+	It("traces the bastion dial as a child of the dial through the bastion", func() {
+		bastionAddress := refusedAddress()
+		host, port, err := net.SplitHostPort(bastionAddress)
+		Expect(err).NotTo(HaveOccurred())
+		portNumber, err := strconv.Atoi(port)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = ssh.NewClientWithBastion(
+			context.Background(),
+			&cryptossh.ClientConfig{},
+			host,
+			portNumber,
+			&cryptossh.ClientConfig{},
+			"machine",
+			22,
+		)
+		Expect(ssh.DialErrorKindOf(err)).To(Equal(ssh.DialErrorRefused))
+
+		recorded := spans()
+		Expect(recorded).To(HaveLen(2))
+		// Spans are exported when they end, so the child comes first.
+		dial, withBastion := recorded[0], recorded[1]
+		Expect(dial.Name).To(Equal("ssh.DialContext"))
+		Expect(withBastion.Name).To(Equal("ssh.NewClientWithBastion"))
+		Expect(dial.Parent.SpanID()).To(Equal(withBastion.SpanContext.SpanID()))
+		Expect(withBastion.Attributes).To(
+			ContainElement(attribute.String(ssh.AttributeBastionAddress, bastionAddress)),
+		)
+		Expect(withBastion.Status.Code).To(Equal(codes.Error))
+	})
+})